@@ -0,0 +1,249 @@
+// Package audit keeps an append-only, hash-chained log of every change made to
+// messages.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/shawn1912/messages-service/database"
+)
+
+// Actions recorded in the log.
+const (
+	ActionCreate = "message.create"
+	ActionUpdate = "message.update"
+	ActionDelete = "message.delete"
+	// ActionApprove and ActionReject record moderators' decisions.
+	ActionApprove = "message.approve"
+	ActionReject  = "message.reject"
+	// ActionMerge records a duplicate counted into the message it repeats.
+	ActionMerge = "message.merge"
+)
+
+// genesisHash is the previous hash of the first entry.
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Entry is one record in the audit log.
+type Entry struct {
+	ID         int64     `json:"id"`
+	TenantID   string    `json:"tenantId"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	MessageID  int64     `json:"messageId"`
+	BeforeHash string    `json:"beforeHash,omitempty"` // content hash before the change
+	AfterHash  string    `json:"afterHash,omitempty"`  // content hash after the change
+	RequestID  string    `json:"requestId"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"createdAt"`
+	PrevHash   string    `json:"prevHash"`
+	Hash       string    `json:"hash"`
+}
+
+// ContentHash returns the hash recorded for a message's content.
+func ContentHash(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// Record appends entry to the log within tx, which should be the transaction
+// making the change so the entry is committed or rolled back with it. ID,
+// CreatedAt, PrevHash and Hash are filled in. Each tenant has a chain of its
+// own, and appends to it are serialized so that it has a single head, without
+// holding up other tenants.
+func Record(tx *sql.Tx, entry *Entry) error {
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('audit_log:' || $1))", entry.TenantID); err != nil {
+		return err
+	}
+
+	err := tx.QueryRow("SELECT hash FROM audit_log WHERE tenant_id = $1 ORDER BY id DESC LIMIT 1",
+		entry.TenantID).Scan(&entry.PrevHash)
+	if err == sql.ErrNoRows {
+		entry.PrevHash = genesisHash
+	} else if err != nil {
+		return err
+	}
+
+	// Postgres keeps microseconds, so truncate before hashing
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	entry.Hash = entry.computeHash()
+
+	query := `
+        INSERT INTO audit_log (tenant_id, actor, action, message_id, before_hash, after_hash,
+                               request_id, ip, created_at, prev_hash, hash)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+        RETURNING id
+    `
+	return tx.QueryRow(query, entry.TenantID, entry.Actor, entry.Action, entry.MessageID,
+		nullIfEmpty(entry.BeforeHash), nullIfEmpty(entry.AfterHash), entry.RequestID, entry.IP,
+		entry.CreatedAt, entry.PrevHash, entry.Hash).Scan(&entry.ID)
+}
+
+// computeHash returns the hash of the entry's contents chained to PrevHash.
+func (e *Entry) computeHash() string {
+	// A fixed struct gives a canonical encoding; ID and Hash are not covered
+	canonical, _ := json.Marshal(struct {
+		PrevHash   string `json:"prevHash"`
+		TenantID   string `json:"tenantId"`
+		Actor      string `json:"actor"`
+		Action     string `json:"action"`
+		MessageID  int64  `json:"messageId"`
+		BeforeHash string `json:"beforeHash"`
+		AfterHash  string `json:"afterHash"`
+		RequestID  string `json:"requestId"`
+		IP         string `json:"ip"`
+		CreatedAt  string `json:"createdAt"`
+	}{e.PrevHash, e.TenantID, e.Actor, e.Action, e.MessageID, e.BeforeHash, e.AfterHash,
+		e.RequestID, e.IP, e.CreatedAt.UTC().Format(time.RFC3339Nano)})
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// Filter selects audit entries. Zero fields match everything.
+type Filter struct {
+	Actor     string
+	Action    string
+	MessageID int64
+	From, To  *time.Time // created at or after From and before To
+}
+
+// List returns one page of the tenant's entries matching filter, newest
+// first, along with the total number of matching entries.
+func List(tx *sql.Tx, tenant string, filter Filter, limit, offset int) ([]Entry, int, error) {
+	where := `
+        WHERE tenant_id = $1
+          AND ($2 = '' OR actor = $2)
+          AND ($3 = '' OR action = $3)
+          AND ($4 = 0 OR message_id = $4)
+          AND ($5::timestamptz IS NULL OR created_at >= $5)
+          AND ($6::timestamptz IS NULL OR created_at < $6)
+    `
+	args := []any{tenant, filter.Actor, filter.Action, filter.MessageID, filter.From, filter.To}
+
+	var total int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM audit_log"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := tx.Query(`SELECT `+entryColumns+` FROM audit_log`+where+` ORDER BY id DESC LIMIT $7 OFFSET $8`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var entry Entry
+		if err := scanEntry(rows, &entry); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
+}
+
+// VerifyError reports the first entry at which the chain is broken.
+type VerifyError struct {
+	EntryID int64
+	Reason  string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("audit log entry %d: %s", e.EntryID, e.Reason)
+}
+
+// Verify walks the whole log in order, recomputing every hash and checking
+// that each entry links to the one before it in its tenant's chain. It returns
+// the number of entries checked, the hash at the head of each tenant's chain,
+// and a *VerifyError at the first broken link. Removing entries from the end
+// of a chain cannot be detected from the log alone, so the head hashes should
+// be kept elsewhere and checked with VerifyContains on the next run.
+func Verify(ctx context.Context, batchSize int) (checked int64, heads map[string]string, err error) {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	var lastID int64
+	heads = map[string]string{}
+	// Entries recorded before chains were kept per tenant link to the entry
+	// before them in the whole log instead
+	prevHash := genesisHash
+
+	for {
+		rows, err := database.DB.QueryContext(ctx,
+			`SELECT `+entryColumns+` FROM audit_log WHERE id > $1 ORDER BY id ASC LIMIT $2`, lastID, batchSize)
+		if err != nil {
+			return checked, heads, err
+		}
+
+		n := 0
+		for rows.Next() {
+			var entry Entry
+			if err := scanEntry(rows, &entry); err != nil {
+				rows.Close()
+				return checked, heads, err
+			}
+			n++
+
+			tenantHash, ok := heads[entry.TenantID]
+			if !ok {
+				tenantHash = genesisHash
+			}
+			if entry.PrevHash != tenantHash && entry.PrevHash != prevHash {
+				rows.Close()
+				return checked, heads, &VerifyError{EntryID: entry.ID, Reason: "does not link to the previous entry"}
+			}
+			if entry.computeHash() != entry.Hash {
+				rows.Close()
+				return checked, heads, &VerifyError{EntryID: entry.ID, Reason: "contents do not match its hash"}
+			}
+			heads[entry.TenantID] = entry.Hash
+			prevHash = entry.Hash
+			lastID = entry.ID
+			checked++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return checked, heads, err
+		}
+		if n < batchSize {
+			return checked, heads, nil
+		}
+	}
+}
+
+// VerifyContains checks that an entry with the given hash, typically a head
+// reported by an earlier Verify, is still in the log.
+func VerifyContains(ctx context.Context, hash string) error {
+	var exists bool
+	err := database.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM audit_log WHERE hash = $1)", hash).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("audit log no longer contains the entry with hash %s", hash)
+	}
+	return nil
+}
+
+const entryColumns = `id, tenant_id, actor, action, message_id, COALESCE(before_hash, ''), COALESCE(after_hash, ''),
+    request_id, ip, created_at, prev_hash, hash`
+
+func scanEntry(rows *sql.Rows, e *Entry) error {
+	return rows.Scan(&e.ID, &e.TenantID, &e.Actor, &e.Action, &e.MessageID, &e.BeforeHash, &e.AfterHash,
+		&e.RequestID, &e.IP, &e.CreatedAt, &e.PrevHash, &e.Hash)
+}
+
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,132 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestMain(m *testing.M) {
+	// Initialize the test database
+	database.InitDB("user=postgres password=postgres dbname=messages_test sslmode=disable")
+	defer database.DB.Close()
+
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run tests
+	code := m.Run()
+
+	// Clean up the test database
+	truncateAuditLog()
+
+	os.Exit(code)
+}
+
+// truncateAuditLog empties the log, which only the table's owner can do by
+// disabling the trigger that forbids it.
+func truncateAuditLog() {
+	database.DB.Exec("ALTER TABLE audit_log DISABLE TRIGGER audit_log_no_truncate")
+	database.DB.Exec("TRUNCATE TABLE audit_log RESTART IDENTITY;")
+	database.DB.Exec("ALTER TABLE audit_log ENABLE TRIGGER audit_log_no_truncate")
+}
+
+// recordTestEntries appends n entries for message 1 of tenant.
+func recordTestEntries(t *testing.T, tenant string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		tx, err := database.BeginAllTenants(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := &Entry{TenantID: tenant, Actor: "alice", Action: ActionUpdate, MessageID: 1,
+			BeforeHash: ContentHash("a"), AfterHash: ContentHash("b"), RequestID: "req", IP: "203.0.113.7"}
+		if err := Record(tx, entry); err != nil {
+			tx.Rollback()
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecordAndVerify(t *testing.T) {
+	truncateAuditLog()
+	recordTestEntries(t, "acme", 3)
+	recordTestEntries(t, "globex", 2)
+	recordTestEntries(t, "acme", 2)
+
+	// A small batch size exercises the paging
+	checked, heads, err := Verify(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 7 || len(heads) != 2 {
+		t.Errorf("Expected 7 entries checked in 2 chains, got %d in %d", checked, len(heads))
+	}
+	for _, head := range heads {
+		if err := VerifyContains(context.Background(), head); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Each tenant's chain starts from scratch
+	var prevHash string
+	database.DB.QueryRow("SELECT prev_hash FROM audit_log WHERE tenant_id = 'globex' ORDER BY id LIMIT 1").Scan(&prevHash)
+	if prevHash != genesisHash {
+		t.Errorf("Expected the first globex entry to start a chain, got previous hash %s", prevHash)
+	}
+
+	// Entries cannot be changed through normal statements
+	if _, err := database.DB.Exec("UPDATE audit_log SET actor = 'mallory' WHERE id = 3"); err == nil {
+		t.Error("Expected update of an audit entry to fail")
+	}
+	if _, err := database.DB.Exec("DELETE FROM audit_log WHERE id = 3"); err == nil {
+		t.Error("Expected delete of an audit entry to fail")
+	}
+	if _, err := database.DB.Exec("TRUNCATE TABLE audit_log"); err == nil {
+		t.Error("Expected truncation of the audit log to fail")
+	}
+}
+
+func TestVerify_DetectsTampering(t *testing.T) {
+	truncateAuditLog()
+	recordTestEntries(t, "acme", 3)
+
+	// Simulate someone with enough privileges to bypass the trigger
+	if _, err := database.DB.Exec("ALTER TABLE audit_log DISABLE TRIGGER audit_log_append_only"); err != nil {
+		t.Fatal(err)
+	}
+	defer database.DB.Exec("ALTER TABLE audit_log ENABLE TRIGGER audit_log_append_only")
+
+	if _, err := database.DB.Exec("UPDATE audit_log SET actor = 'mallory' WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+
+	checked, _, err := Verify(context.Background(), 0)
+	var verifyErr *VerifyError
+	if !errors.As(err, &verifyErr) {
+		t.Fatalf("Expected a VerifyError, got %v", err)
+	}
+	if verifyErr.EntryID != 2 || checked != 1 {
+		t.Errorf("Expected the chain to break at entry 2 after 1 entry, got entry %d after %d", verifyErr.EntryID, checked)
+	}
+
+	// Removing an entry breaks the link of the one after it
+	if _, err := database.DB.Exec("UPDATE audit_log SET actor = 'alice' WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.DB.Exec("DELETE FROM audit_log WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Verify(context.Background(), 0); !errors.As(err, &verifyErr) || verifyErr.EntryID != 3 {
+		t.Errorf("Expected the chain to break at entry 3, got %v", err)
+	}
+}
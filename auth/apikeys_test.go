@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestMain(m *testing.M) {
+	// Initialize the test database
+	database.InitDB("user=postgres password=postgres dbname=messages_test sslmode=disable")
+	defer database.DB.Close()
+
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run tests
+	code := m.Run()
+
+	// Clean up the test database
+	database.DB.Exec("TRUNCATE TABLE api_keys RESTART IDENTITY CASCADE;")
+
+	os.Exit(code)
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	id, key, err := CreateAPIKey("lifecycle", "acme", []string{ScopeRead, ScopeWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		t.Errorf("Expected key to start with %q, got %q", apiKeyPrefix, key)
+	}
+
+	// The plaintext key is never stored
+	var stored string
+	err = database.DB.QueryRow("SELECT key_hash FROM api_keys WHERE id = $1", id).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored == key || stored != hashAPIKey(key) {
+		t.Errorf("Expected the key's hash to be stored, got %q", stored)
+	}
+
+	principal, err := authenticateAPIKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Subject != APIKeySubject(id) {
+		t.Errorf("Expected subject %q, got %q", APIKeySubject(id), principal.Subject)
+	}
+	if !slices.Equal(principal.Scopes, []string{ScopeRead, ScopeWrite}) {
+		t.Errorf("Unexpected scopes %v", principal.Scopes)
+	}
+	if principal.Tenant != "acme" {
+		t.Errorf("Expected tenant 'acme', got %q", principal.Tenant)
+	}
+
+	if err := RevokeAPIKey(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := authenticateAPIKey(key); err != ErrInvalidAPIKey {
+		t.Errorf("Expected revoked key to be rejected, got %v", err)
+	}
+	if err := RevokeAPIKey(id); err == nil {
+		t.Error("Expected revoking a revoked key to fail")
+	}
+}
+
+func TestCreateAPIKey_UnknownScope(t *testing.T) {
+	if _, _, err := CreateAPIKey("bad scope", "", []string{"messages:everything"}); err == nil {
+		t.Error("Expected an unknown scope to be rejected")
+	}
+}
+
+func TestCreateAPIKey_InvalidTenant(t *testing.T) {
+	if _, _, err := CreateAPIKey("bad tenant", "not a tenant!", []string{ScopeRead}); err == nil {
+		t.Error("Expected an invalid tenant ID to be rejected")
+	}
+}
@@ -0,0 +1,198 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// key is a verification key loaded from a JWK.
+type key struct {
+	id   string
+	alg  string // the only algorithm the key may be used with
+	hmac []byte
+	rsa  *rsa.PublicKey
+	ec   *ecdsa.PublicKey
+}
+
+// jwk is the JSON form of a key in a JWKS document (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// KeySet holds the verification keys read from a local JWKS file. It is safe
+// for concurrent use and can be reloaded while in use.
+type KeySet struct {
+	path string
+
+	mu      sync.RWMutex
+	keys    []key
+	modTime time.Time
+}
+
+// LoadKeySet reads the JWKS file at path.
+func LoadKeySet(path string) (*KeySet, error) {
+	ks := &KeySet{path: path}
+	if err := ks.Reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Reload reads the JWKS file again, replacing the current keys. If the file
+// cannot be read or parsed the current keys are kept.
+func (ks *KeySet) Reload() error {
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(ks.path)
+	if err != nil {
+		return err
+	}
+
+	var doc struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parse %s: %w", ks.path, err)
+	}
+
+	keys := make([]key, 0, len(doc.Keys))
+	for i, raw := range doc.Keys {
+		if raw.Use != "" && raw.Use != "sig" {
+			continue
+		}
+		k, err := parseJWK(raw)
+		if err != nil {
+			return fmt.Errorf("parse %s: key %d: %w", ks.path, i, err)
+		}
+		keys = append(keys, k)
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.modTime = info.ModTime()
+	ks.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the key set every interval when the file has changed, until
+// ctx is done. Failed reloads are logged and the previous keys stay in use.
+func (ks *KeySet) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(ks.path)
+			if err != nil {
+				log.Printf("JWKS reload failed: %v", err)
+				continue
+			}
+			ks.mu.RLock()
+			changed := !info.ModTime().Equal(ks.modTime)
+			ks.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := ks.Reload(); err != nil {
+				log.Printf("JWKS reload failed: %v", err)
+			}
+		}
+	}
+}
+
+// lookup returns the keys that may verify a token signed with alg. A token
+// naming a key ID only matches that key.
+func (ks *KeySet) lookup(kid, alg string) []key {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	var matches []key
+	for _, k := range ks.keys {
+		if k.alg != alg {
+			continue
+		}
+		if kid != "" && k.id != kid {
+			continue
+		}
+		matches = append(matches, k)
+	}
+	return matches
+}
+
+// parseJWK converts a JWK into a key, pinning the algorithm it may be used
+// with so that, for example, an RSA public key can never be used as an HMAC
+// secret.
+func parseJWK(raw jwk) (key, error) {
+	k := key{id: raw.Kid}
+
+	switch raw.Kty {
+	case "oct":
+		secret, err := decodeSegment(raw.K)
+		if err != nil || len(secret) == 0 {
+			return key{}, errors.New("invalid symmetric key")
+		}
+		k.alg, k.hmac = AlgHS256, secret
+
+	case "RSA":
+		n, errN := decodeSegment(raw.N)
+		e, errE := decodeSegment(raw.E)
+		if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return key{}, errors.New("invalid RSA key")
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		k.alg, k.rsa = AlgRS256, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}
+
+	case "EC":
+		if raw.Crv != "P-256" {
+			return key{}, fmt.Errorf("unsupported curve %q", raw.Crv)
+		}
+		x, errX := decodeSegment(raw.X)
+		y, errY := decodeSegment(raw.Y)
+		if errX != nil || errY != nil {
+			return key{}, errors.New("invalid EC key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return key{}, errors.New("EC point is not on curve P-256")
+		}
+		k.alg, k.ec = AlgES256, pub
+
+	default:
+		return key{}, fmt.Errorf("unsupported key type %q", raw.Kty)
+	}
+
+	if raw.Alg != "" && raw.Alg != k.alg {
+		return key{}, fmt.Errorf("algorithm %q does not match key type %q", raw.Alg, raw.Kty)
+	}
+	return k, nil
+}
+
+// decodeSegment decodes unpadded base64url, as used throughout JOSE.
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,215 @@
+// Package jwt verifies JSON Web Tokens signed with HS256, RS256 or ES256
+// against keys loaded from a local JWKS file.
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Supported signing algorithms.
+const (
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+// ErrInvalidToken is wrapped by every error returned for a token that must be
+// rejected.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Claims are the verified contents of a token.
+type Claims struct {
+	Subject string
+	Scopes  []string
+	Raw     map[string]any
+}
+
+// Verifier validates tokens against a key set and the expected claims.
+type Verifier struct {
+	Keys      *KeySet
+	Issuer    string        // required "iss", if not empty
+	Audience  string        // required "aud" entry, if not empty
+	ClockSkew time.Duration // leeway applied to "exp" and "nbf"
+
+	now func() time.Time // replaced in tests
+}
+
+// Verify checks the token's signature and registered claims and returns its
+// subject and scopes. Scopes are read from a space-separated "scope" claim or
+// a "scp" claim holding a string or an array.
+func (v *Verifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Claims{}, invalid("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJSONSegment(parts[0], &header); err != nil {
+		return Claims{}, invalid("malformed header")
+	}
+	if header.Alg != AlgHS256 && header.Alg != AlgRS256 && header.Alg != AlgES256 {
+		return Claims{}, invalid(fmt.Sprintf("unsupported algorithm %q", header.Alg))
+	}
+
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		return Claims{}, invalid("malformed signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, k := range v.Keys.lookup(header.Kid, header.Alg) {
+		if verifySignature(k, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Claims{}, invalid("signature verification failed")
+	}
+
+	var raw map[string]any
+	if err := decodeJSONSegment(parts[1], &raw); err != nil {
+		return Claims{}, invalid("malformed claims")
+	}
+	if err := v.checkClaims(raw); err != nil {
+		return Claims{}, err
+	}
+
+	claims := Claims{Raw: raw}
+	claims.Subject, _ = raw["sub"].(string)
+	if claims.Subject == "" {
+		return Claims{}, invalid("missing subject")
+	}
+	claims.Scopes = scopes(raw)
+	return claims, nil
+}
+
+// checkClaims validates exp, nbf, iss and aud.
+func (v *Verifier) checkClaims(raw map[string]any) error {
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+
+	exp, ok := numericDate(raw["exp"])
+	if !ok {
+		return invalid("missing or invalid exp")
+	}
+	if !now.Before(exp.Add(v.ClockSkew)) {
+		return invalid("token has expired")
+	}
+
+	if value, present := raw["nbf"]; present {
+		nbf, ok := numericDate(value)
+		if !ok {
+			return invalid("invalid nbf")
+		}
+		if now.Add(v.ClockSkew).Before(nbf) {
+			return invalid("token is not valid yet")
+		}
+	}
+
+	if v.Issuer != "" {
+		if iss, _ := raw["iss"].(string); iss != v.Issuer {
+			return invalid("unexpected issuer")
+		}
+	}
+
+	if v.Audience != "" {
+		var audiences []string
+		switch aud := raw["aud"].(type) {
+		case string:
+			audiences = []string{aud}
+		case []any:
+			for _, a := range aud {
+				if s, ok := a.(string); ok {
+					audiences = append(audiences, s)
+				}
+			}
+		}
+		if !slices.Contains(audiences, v.Audience) {
+			return invalid("unexpected audience")
+		}
+	}
+	return nil
+}
+
+// verifySignature checks signature over signed with k.
+func verifySignature(k key, signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+
+	switch k.alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.hmac)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case AlgRS256:
+		return rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, digest[:], signature) == nil
+	case AlgES256:
+		// JWS encodes ECDSA signatures as the fixed-width concatenation R || S
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k.ec, digest[:], r, s)
+	}
+	return false
+}
+
+// scopes reads the scopes granted by a token.
+func scopes(raw map[string]any) []string {
+	if scope, ok := raw["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	switch scp := raw["scp"].(type) {
+	case string:
+		return strings.Fields(scp)
+	case []any:
+		var result []string
+		for _, s := range scp {
+			if str, ok := s.(string); ok {
+				result = append(result, str)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// numericDate converts a JSON NumericDate (seconds since the epoch) to a time.
+func numericDate(value any) (time.Time, bool) {
+	seconds, ok := value.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, 0).Add(time.Duration(seconds * float64(time.Second))), true
+}
+
+// decodeJSONSegment decodes a base64url-encoded JSON token segment into v.
+func decodeJSONSegment(segment string, v any) error {
+	data, err := decodeSegment(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func invalid(reason string) error {
+	return fmt.Errorf("%w: %s", ErrInvalidToken, reason)
+}
@@ -0,0 +1,229 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+var enc = base64.RawURLEncoding
+
+// testKeys holds one key of every supported type along with the JWKS
+// document describing them.
+type testKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	path   string
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &testKeys{secret: []byte("0123456789abcdef0123456789abcdef"), rsa: rsaKey, ec: ecKey}
+
+	doc := map[string]any{"keys": []map[string]string{
+		{"kty": "oct", "kid": "hs", "alg": AlgHS256, "k": enc.EncodeToString(keys.secret)},
+		{"kty": "RSA", "kid": "rs", "n": enc.EncodeToString(rsaKey.N.Bytes()),
+			"e": enc.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "es", "crv": "P-256",
+			"x": enc.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			"y": enc.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32)))},
+	}}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.path = filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(keys.path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// sign returns a token with the given header and claims signed by the key
+// matching alg.
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case AlgRS256:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case AlgES256:
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + enc.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	keySet, err := LoadKeySet(keys.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1_700_000_000, 0)
+	verifier := &Verifier{
+		Keys:      keySet,
+		Issuer:    "https://issuer.example",
+		Audience:  "messages-service",
+		ClockSkew: 30 * time.Second,
+		now:       func() time.Time { return now },
+	}
+
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"sub":   "user-1",
+			"iss":   "https://issuer.example",
+			"aud":   []string{"other", "messages-service"},
+			"exp":   now.Add(time.Minute).Unix(),
+			"scope": "messages:read messages:write",
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	testCases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"HS256", keys.sign(t, AlgHS256, "hs", claims(nil)), true},
+		{"RS256", keys.sign(t, AlgRS256, "rs", claims(nil)), true},
+		{"ES256", keys.sign(t, AlgES256, "es", claims(nil)), true},
+		{"no key ID", keys.sign(t, AlgES256, "", claims(nil)), true},
+		{"string audience", keys.sign(t, AlgRS256, "rs", claims(map[string]any{"aud": "messages-service"})), true},
+		{"expired within skew", keys.sign(t, AlgHS256, "hs", claims(map[string]any{"exp": now.Add(-10 * time.Second).Unix()})), true},
+		{"expired", keys.sign(t, AlgHS256, "hs", claims(map[string]any{"exp": now.Add(-time.Minute).Unix()})), false},
+		{"missing exp", keys.sign(t, AlgHS256, "hs", claims(map[string]any{"exp": nil})), false},
+		{"not yet valid within skew", keys.sign(t, AlgHS256, "hs", claims(map[string]any{"nbf": now.Add(10 * time.Second).Unix()})), true},
+		{"not yet valid", keys.sign(t, AlgHS256, "hs", claims(map[string]any{"nbf": now.Add(time.Minute).Unix()})), false},
+		{"wrong issuer", keys.sign(t, AlgHS256, "hs", claims(map[string]any{"iss": "https://evil.example"})), false},
+		{"wrong audience", keys.sign(t, AlgHS256, "hs", claims(map[string]any{"aud": "other"})), false},
+		{"missing subject", keys.sign(t, AlgHS256, "hs", claims(map[string]any{"sub": nil})), false},
+		{"wrong key ID", keys.sign(t, AlgRS256, "es", claims(nil)), false},
+		{"unsupported algorithm", keys.sign(t, "none", "", claims(nil)), false},
+		{"tampered", keys.sign(t, AlgHS256, "hs", claims(nil)) + "x", false},
+		{"malformed", "not-a-token", false},
+	}
+
+	for _, tc := range testCases {
+		result, err := verifier.Verify(tc.token)
+		if tc.valid {
+			if err != nil {
+				t.Errorf("%s: expected token to be valid, got %v", tc.name, err)
+				continue
+			}
+			if result.Subject != "user-1" {
+				t.Errorf("%s: expected subject 'user-1', got %q", tc.name, result.Subject)
+			}
+			if !slices.Equal(result.Scopes, []string{"messages:read", "messages:write"}) {
+				t.Errorf("%s: unexpected scopes %v", tc.name, result.Scopes)
+			}
+		} else if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestVerify_AlgorithmConfusion(t *testing.T) {
+	keys := newTestKeys(t)
+	keySet, err := LoadKeySet(keys.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := &Verifier{Keys: keySet}
+
+	// An HS256 token keyed with the RSA public key's bytes must not verify
+	header, _ := json.Marshal(map[string]string{"alg": AlgHS256, "kid": "rs"})
+	payload, _ := json.Marshal(map[string]any{"sub": "attacker", "exp": time.Now().Add(time.Hour).Unix()})
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	mac := hmac.New(sha256.New, keys.rsa.N.Bytes())
+	mac.Write([]byte(signed))
+	token := signed + "." + enc.EncodeToString(mac.Sum(nil))
+
+	if _, err := verifier.Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestKeySetReload(t *testing.T) {
+	keys := newTestKeys(t)
+	keySet, err := LoadKeySet(keys.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := &Verifier{Keys: keySet}
+	token := keys.sign(t, AlgHS256, "hs", map[string]any{"sub": "user-1", "exp": time.Now().Add(time.Hour).Unix()})
+
+	if _, err := verifier.Verify(token); err != nil {
+		t.Fatalf("Expected token to be valid, got %v", err)
+	}
+
+	// A broken file keeps the previous keys
+	if err := os.WriteFile(keys.path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := keySet.Reload(); err == nil {
+		t.Error("Expected reload of a malformed file to fail")
+	}
+	if _, err := verifier.Verify(token); err != nil {
+		t.Errorf("Expected previous keys to remain in use, got %v", err)
+	}
+
+	// Removing the key revokes its tokens
+	if err := os.WriteFile(keys.path, []byte(`{"keys": []}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := keySet.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected ErrInvalidToken after key removal, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/shawn1912/messages-service/auth/jwt"
+	"github.com/shawn1912/messages-service/database"
+)
+
+// APIKeyHeader is the request header carrying an API key.
+const APIKeyHeader = "X-API-Key"
+
+// JWT verifies bearer tokens. Bearer tokens are rejected while it is nil.
+var JWT *jwt.Verifier
+
+// errNoCredentials is returned when a request carries neither a bearer token
+// nor an API key.
+var errNoCredentials = errors.New("authentication required")
+
+// Authenticate is middleware that identifies the caller of every request that
+// carries credentials and makes the principal available to later handlers
+// through PrincipalFromContext. Requests with invalid credentials get a 401;
+// requests without any pass through unauthenticated, for Require to reject on
+// routes that need a scope.
+func Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !HasCredentials(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		principal, ok := identify(w, r)
+		if !ok {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// HasCredentials reports whether r carries a bearer token or an API key.
+func HasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get(APIKeyHeader) != ""
+}
+
+// Require returns a handler that only calls next if the caller was granted
+// scope, authenticating the request first unless Authenticate already has.
+// Callers authenticate with either an "Authorization: Bearer" JWT or an API key
+// in the X-API-Key header. Unauthenticated requests get a 401, and requests
+// lacking the scope or naming a tenant their credentials are not bound to a
+// 403. The principal, including the tenant the request acts on, is available
+// to next through PrincipalFromContext.
+func Require(scope string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := PrincipalFromContext(r.Context())
+		if !ok {
+			if principal, ok = identify(w, r); !ok {
+				return
+			}
+		}
+
+		if !principal.HasScope(scope) {
+			http.Error(w, "Missing required scope "+scope, http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// identify authenticates the request and resolves the tenant it acts on. On
+// failure it writes the error response and returns false.
+func identify(w http.ResponseWriter, r *http.Request) (Principal, bool) {
+	principal, err := authenticate(r)
+	if err != nil {
+		switch {
+		case err == errNoCredentials:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="messages-service"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+		case err == ErrInvalidAPIKey:
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		case errors.Is(err, jwt.ErrInvalidToken):
+			w.Header().Set("WWW-Authenticate", `Bearer realm="messages-service", error="invalid_token"`)
+			http.Error(w, "Invalid bearer token", http.StatusUnauthorized)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return Principal{}, false
+		}
+		// Requests without credentials have not failed to authenticate
+		if hook, ok := r.Context().Value(failureHookKey{}).(func()); ok && HasCredentials(r) {
+			hook()
+		}
+		return Principal{}, false
+	}
+
+	principal.Tenant, err = resolveTenant(principal.Tenant, r.Header.Get(TenantHeader))
+	if err != nil {
+		if err == errInvalidTenant {
+			http.Error(w, "Invalid "+TenantHeader+" header", http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		}
+		return Principal{}, false
+	}
+	return principal, true
+}
+
+// tokenPrincipal returns the principal for the verified claims of a bearer
+// token. Subjects in the namespace of API keys are refused, so that a token
+// cannot pass for a key and own what the key created. Tokens without a tenant
+// claim are bound to the default tenant, unless they are admin tokens, which
+// may name any tenant.
+func tokenPrincipal(claims jwt.Claims) (Principal, error) {
+	if strings.HasPrefix(claims.Subject, apiKeySubjectPrefix) {
+		return Principal{}, fmt.Errorf("%w: subject %q is reserved for API keys", jwt.ErrInvalidToken, claims.Subject)
+	}
+	principal := Principal{Subject: claims.Subject, Scopes: claims.Scopes}
+	principal.Tenant, _ = claims.Raw[TenantClaim].(string)
+	if principal.Tenant == "" && !principal.IsAdmin() {
+		principal.Tenant = database.DefaultTenant
+	}
+	return principal, nil
+}
+
+// authenticate identifies the caller from a bearer token or an API key.
+func authenticate(r *http.Request) (Principal, error) {
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, token, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return Principal{}, errNoCredentials
+		}
+		if JWT == nil {
+			return Principal{}, jwt.ErrInvalidToken
+		}
+		claims, err := JWT.Verify(strings.TrimSpace(token))
+		if err != nil {
+			return Principal{}, err
+		}
+		return tokenPrincipal(claims)
+	}
+
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return authenticateAPIKey(key)
+	}
+	return Principal{}, errNoCredentials
+}
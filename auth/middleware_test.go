@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/shawn1912/messages-service/auth/jwt"
+)
+
+func TestTokenPrincipal(t *testing.T) {
+	claims := jwt.Claims{Subject: "alice", Scopes: []string{ScopeRead}, Raw: map[string]any{TenantClaim: "acme"}}
+	principal, err := tokenPrincipal(claims)
+	if err != nil || principal.Subject != "alice" || principal.Tenant != "acme" || !principal.HasScope(ScopeRead) {
+		t.Errorf("Unexpected principal %+v, %v", principal, err)
+	}
+
+	// Only admin tokens may act on any tenant without a tenant claim
+	for scope, tenant := range map[string]string{ScopeWrite: "default", ScopeAdmin: ""} {
+		principal, err := tokenPrincipal(jwt.Claims{Subject: "bob", Scopes: []string{scope}, Raw: map[string]any{}})
+		if err != nil || principal.Tenant != tenant {
+			t.Errorf("Expected a %s token without a tenant claim to be bound to %q, got %q, %v", scope, tenant, principal.Tenant, err)
+		}
+		if _, err := resolveTenant(principal.Tenant, "acme"); (err == nil) != (scope == ScopeAdmin) {
+			t.Errorf("Unexpected result naming another tenant with a %s token: %v", scope, err)
+		}
+	}
+
+	// Tokens cannot pass for API keys
+	claims.Subject = APIKeySubject(5)
+	if _, err := tokenPrincipal(claims); !errors.Is(err, jwt.ErrInvalidToken) {
+		t.Errorf("Expected a token with subject %q to be invalid, got %v", claims.Subject, err)
+	}
+}
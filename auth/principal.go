@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"context"
+	"slices"
+)
+
+// Scopes granted to API clients.
+const (
+	ScopeRead     = "messages:read"
+	ScopeWrite    = "messages:write"
+	ScopeDelete   = "messages:delete"
+	ScopeModerate = "messages:moderate"
+	ScopeAdmin    = "admin"
+)
+
+// KnownScopes lists every scope that can be granted.
+var KnownScopes = []string{ScopeRead, ScopeWrite, ScopeDelete, ScopeModerate, ScopeAdmin}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string
+	Scopes  []string
+	// Tenant is the tenant the request acts on. Credentials bound to a tenant
+	// always act on it; unbound ones (API keys created for any tenant and
+	// admin tokens without a tenant claim) act on the tenant named in the
+	// X-Tenant-ID header, or the default tenant.
+	Tenant string
+}
+
+// HasScope reports whether the principal was granted scope. The admin scope
+// implies every other scope.
+func (p Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || p.IsAdmin()
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p.
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// IsAdmin reports whether the principal was granted the admin scope.
+func (p Principal) IsAdmin() bool {
+	return slices.Contains(p.Scopes, ScopeAdmin)
+}
+
+type failureHookKey struct{}
+
+// WithFailureHook returns a copy of ctx in which every failure to
+// authenticate the request with the credentials it carries calls hook.
+func WithFailureHook(ctx context.Context, hook func()) context.Context {
+	return context.WithValue(ctx, failureHookKey{}, hook)
+}
+
+// PrincipalFromContext returns the principal stored in ctx by the
+// authentication middleware, if any.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/shawn1912/messages-service/database"
+)
+
+// TenantHeader is the request header naming the tenant a request acts on.
+const TenantHeader = "X-Tenant-ID"
+
+// TenantClaim is the JWT claim binding a token to a tenant.
+const TenantClaim = "tenant"
+
+// errTenantMismatch is returned when a request names a tenant other than the
+// one its credentials are bound to.
+var errTenantMismatch = errors.New("credentials are not valid for this tenant")
+
+// errInvalidTenant is returned when a request names a malformed tenant ID.
+var errInvalidTenant = errors.New("invalid tenant ID")
+
+var tenantIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidTenantID reports whether id is a well-formed tenant ID.
+func ValidTenantID(id string) bool {
+	return tenantIDPattern.MatchString(id)
+}
+
+// resolveTenant returns the tenant a request acts on, given the tenant its
+// credentials are bound to (if any) and the tenant named in its header (if any).
+// Only API keys created for any tenant and admin tokens are unbound.
+func resolveTenant(bound, requested string) (string, error) {
+	if requested != "" && !ValidTenantID(requested) {
+		return "", errInvalidTenant
+	}
+	switch {
+	case bound != "":
+		if requested != "" && requested != bound {
+			return "", errTenantMismatch
+		}
+		return bound, nil
+	case requested != "":
+		return requested, nil
+	default:
+		return database.DefaultTenant, nil
+	}
+}
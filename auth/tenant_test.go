@@ -0,0 +1,26 @@
+package auth
+
+import "testing"
+
+func TestResolveTenant(t *testing.T) {
+	testCases := []struct {
+		bound, requested string
+		expected         string
+		err              error
+	}{
+		{"", "", "default", nil},
+		{"", "acme", "acme", nil},
+		{"acme", "", "acme", nil},
+		{"acme", "acme", "acme", nil},
+		{"acme", "globex", "", errTenantMismatch},
+		{"", "../etc", "", errInvalidTenant},
+	}
+
+	for _, tc := range testCases {
+		tenant, err := resolveTenant(tc.bound, tc.requested)
+		if tenant != tc.expected || err != tc.err {
+			t.Errorf("resolveTenant(%q, %q) = %q, %v; expected %q, %v",
+				tc.bound, tc.requested, tenant, err, tc.expected, tc.err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Package blobs stores the content of attachments. Blobs are immutable and
+// addressed by the hex SHA-256 of their content, so identical uploads are
+// stored once.
+package blobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// ErrNotFound is returned when a blob does not exist.
+var ErrNotFound = errors.New("blob not found")
+
+// BlobStore stores blobs by the SHA-256 of their content.
+type BlobStore interface {
+	// Put stores the content read from r, returning its key and size. If
+	// reading fails nothing is stored.
+	Put(ctx context.Context, r io.Reader) (key string, size int64, err error)
+	// Open returns the content of the blob with key, which must be closed.
+	Open(ctx context.Context, key string) (Blob, error)
+	// Delete removes the blob with key. Deleting a missing blob is not an
+	// error.
+	Delete(ctx context.Context, key string) error
+}
+
+// Blob is the content of a stored blob. It can seek, so that it can serve
+// range requests.
+type Blob interface {
+	io.ReadSeekCloser
+}
+
+var validKey = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// LocalStore is a BlobStore keeping blobs as files under Dir, in
+// subdirectories named after the first bytes of their key. Blobs are written
+// to a temporary file and renamed into place, so readers never see partial
+// content.
+type LocalStore struct {
+	Dir string
+}
+
+// NewLocalStore returns a LocalStore keeping blobs under dir, which is
+// created if needed.
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0o750); err != nil {
+		return nil, err
+	}
+	return &LocalStore{Dir: dir}, nil
+}
+
+// Put stores the content read from r.
+func (s *LocalStore) Put(ctx context.Context, r io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.Dir, "tmp"), "upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	// Removing the temporary file fails harmlessly once it has been renamed
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), contextReader{ctx, r})
+	if err != nil {
+		return "", 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	key := hex.EncodeToString(hash.Sum(nil))
+	path := s.path(key)
+	if _, err := os.Stat(path); err == nil {
+		return key, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+	return key, size, syncDir(filepath.Dir(path))
+}
+
+// Open returns the content of the blob with key.
+func (s *LocalStore) Open(ctx context.Context, key string) (Blob, error) {
+	if !validKey.MatchString(key) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Delete removes the blob with key.
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	if !validKey.MatchString(key) {
+		return nil
+	}
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// path returns the path of the file holding the blob with key.
+func (s *LocalStore) path(key string) string {
+	return filepath.Join(s.Dir, key[:2], key[2:4], key)
+}
+
+// syncDir flushes the directory entries of dir to disk, so that a rename in
+// it survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// contextReader stops reading once its context is done, so that abandoned
+// uploads are not stored.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,90 @@
+package blobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := "Hello, blob"
+	sum := sha256.Sum256([]byte(content))
+	key, size, err := store.Put(ctx, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != hex.EncodeToString(sum[:]) || size != int64(len(content)) {
+		t.Errorf("Expected key %x and size %d, got %s and %d", sum, len(content), key, size)
+	}
+	if _, err := os.Stat(filepath.Join(store.Dir, key[:2], key[2:4], key)); err != nil {
+		t.Errorf("Expected the blob to be stored by its key: %v", err)
+	}
+
+	// Storing the same content again gives the same blob
+	if again, _, err := store.Put(ctx, strings.NewReader(content)); err != nil || again != key {
+		t.Errorf("Expected key %s, got %s (err %v)", key, again, err)
+	}
+
+	blob, err := store.Open(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob.Seek(7, io.SeekStart)
+	got, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(got) != "blob" {
+		t.Errorf("Expected %q after seeking, got %q", "blob", got)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound after deleting, got %v", err)
+	}
+	if err := store.Delete(ctx, key); err != nil {
+		t.Errorf("Expected deleting a missing blob to succeed, got %v", err)
+	}
+	if _, err := store.Open(ctx, "../../etc/passwd"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for an invalid key, got %v", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestLocalStore_FailedPut(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := io.MultiReader(strings.NewReader("partial"), failingReader{})
+	if _, _, err := store.Put(context.Background(), r); err == nil {
+		t.Fatal("Expected an error from a failing reader")
+	}
+
+	// Nothing is left behind, not even the temporary file
+	var files []string
+	filepath.Walk(store.Dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if len(files) != 0 {
+		t.Errorf("Expected no files, got %v", files)
+	}
+}
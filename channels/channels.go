@@ -0,0 +1,199 @@
+// Package channels stores the named channels that group a tenant's messages,
+// along with the members of private channels.
+package channels
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrNameTaken is returned when a tenant already has a channel with the name.
+var ErrNameTaken = errors.New("a channel with this name already exists")
+
+// validName matches channel names: lowercase letters, digits, '-' and '_'.
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Channel is a named group of messages.
+type Channel struct {
+	ID               int64     `json:"id"`
+	Name             string    `json:"name"`
+	IsPrivate        bool      `json:"isPrivate"`        // only members can see it
+	MaxContentLength int       `json:"maxContentLength"` // in characters; 0 for no limit beyond the tenant's
+	PalindromesOnly  bool      `json:"palindromesOnly"`
+	CreatedBy        string    `json:"createdBy,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+// Validate checks the channel's name and settings.
+func (c *Channel) Validate() error {
+	if !validName.MatchString(c.Name) {
+		return fmt.Errorf("invalid channel name %q: use up to 64 lowercase letters, digits, '-' and '_'", c.Name)
+	}
+	if c.MaxContentLength < 0 {
+		return fmt.Errorf("invalid maxContentLength %d: must not be negative", c.MaxContentLength)
+	}
+	return nil
+}
+
+const channelColumns = `id, name, is_private, max_content_length, palindromes_only, COALESCE(created_by, ''),
+    created_at, updated_at`
+
+func scanChannel(row interface{ Scan(...any) error }, c *Channel) error {
+	return row.Scan(&c.ID, &c.Name, &c.IsPrivate, &c.MaxContentLength, &c.PalindromesOnly, &c.CreatedBy,
+		&c.CreatedAt, &c.UpdatedAt)
+}
+
+// Create stores a new channel for tenant and makes its creator a member.
+func Create(tx *sql.Tx, tenant string, c *Channel) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	err := tx.QueryRow(`
+        INSERT INTO channels (tenant_id, name, is_private, max_content_length, palindromes_only, created_by)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at, updated_at
+    `, tenant, c.Name, c.IsPrivate, c.MaxContentLength, c.PalindromesOnly,
+		sql.NullString{String: c.CreatedBy, Valid: c.CreatedBy != ""}).
+		Scan(&c.ID, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return nameError(err)
+	}
+	if c.CreatedBy == "" {
+		return nil
+	}
+	return AddMember(tx, tenant, c.ID, c.CreatedBy)
+}
+
+// Get returns the tenant's channel with the given ID, or sql.ErrNoRows.
+func Get(tx *sql.Tx, tenant string, id int64) (Channel, error) {
+	var c Channel
+	err := scanChannel(tx.QueryRow(`SELECT `+channelColumns+` FROM channels WHERE id = $1 AND tenant_id = $2`, id, tenant), &c)
+	return c, err
+}
+
+// List returns the tenant's channels member can see: the public ones and the
+// private ones they belong to. If all is true it returns every channel.
+func List(tx *sql.Tx, tenant, member string, all bool) ([]Channel, error) {
+	rows, err := tx.Query(`
+        SELECT `+channelColumns+`
+        FROM channels
+        WHERE tenant_id = $1
+          AND ($3 OR NOT is_private
+               OR id IN (SELECT channel_id FROM channel_members WHERE tenant_id = $1 AND member = $2))
+        ORDER BY name ASC
+    `, tenant, member, all)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []Channel{}
+	for rows.Next() {
+		var c Channel
+		if err := scanChannel(rows, &c); err != nil {
+			return nil, err
+		}
+		channels = append(channels, c)
+	}
+	return channels, rows.Err()
+}
+
+// Update saves the name and settings of an existing channel.
+func Update(tx *sql.Tx, tenant string, c *Channel) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	err := tx.QueryRow(`
+        UPDATE channels
+        SET name = $1, is_private = $2, max_content_length = $3, palindromes_only = $4, updated_at = NOW()
+        WHERE id = $5 AND tenant_id = $6
+        RETURNING updated_at
+    `, c.Name, c.IsPrivate, c.MaxContentLength, c.PalindromesOnly, c.ID, tenant).Scan(&c.UpdatedAt)
+	return nameError(err)
+}
+
+// Delete removes the tenant's channel with the given ID along with its
+// members, reporting whether it existed. It fails if the channel still has
+// messages.
+func Delete(tx *sql.Tx, tenant string, id int64) (bool, error) {
+	result, err := tx.Exec("DELETE FROM channels WHERE id = $1 AND tenant_id = $2", id, tenant)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// HasMessages reports whether any message was posted to the channel.
+func HasMessages(tx *sql.Tx, tenant string, id int64) (bool, error) {
+	var exists bool
+	err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM messages WHERE channel_id = $1 AND tenant_id = $2)", id, tenant).
+		Scan(&exists)
+	return exists, err
+}
+
+// AddMember adds member to the channel. Adding an existing member does nothing.
+func AddMember(tx *sql.Tx, tenant string, id int64, member string) error {
+	_, err := tx.Exec(`
+        INSERT INTO channel_members (channel_id, tenant_id, member) VALUES ($1, $2, $3)
+        ON CONFLICT DO NOTHING
+    `, id, tenant, member)
+	return err
+}
+
+// RemoveMember removes member from the channel, reporting whether they were one.
+func RemoveMember(tx *sql.Tx, tenant string, id int64, member string) (bool, error) {
+	result, err := tx.Exec("DELETE FROM channel_members WHERE channel_id = $1 AND tenant_id = $2 AND member = $3",
+		id, tenant, member)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// IsMember reports whether member belongs to the channel.
+func IsMember(tx *sql.Tx, tenant string, id int64, member string) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(`
+        SELECT EXISTS (SELECT 1 FROM channel_members WHERE channel_id = $1 AND tenant_id = $2 AND member = $3)
+    `, id, tenant, member).Scan(&exists)
+	return exists, err
+}
+
+// ListMembers returns the members of the channel in the order they were added.
+func ListMembers(tx *sql.Tx, tenant string, id int64) ([]string, error) {
+	rows, err := tx.Query(
+		"SELECT member FROM channel_members WHERE channel_id = $1 AND tenant_id = $2 ORDER BY added_at ASC, member ASC",
+		id, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []string{}
+	for rows.Next() {
+		var member string
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// nameError translates the unique violation of a duplicate channel name into
+// ErrNameTaken.
+func nameError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrNameTaken
+	}
+	return err
+}
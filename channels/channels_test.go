@@ -0,0 +1,114 @@
+package channels
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestMain(m *testing.M) {
+	// Initialize the test database
+	database.InitDB("user=postgres password=postgres dbname=messages_test sslmode=disable")
+	defer database.DB.Close()
+
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run tests
+	code := m.Run()
+
+	// Clean up the test database
+	database.DB.Exec("TRUNCATE TABLE messages, channels RESTART IDENTITY CASCADE;")
+
+	os.Exit(code)
+}
+
+// inTenant runs fn in a committed transaction scoped to tenant "acme".
+func inTenant(t *testing.T, fn func(tx *sql.Tx) error) {
+	t.Helper()
+	tx, err := database.BeginTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, c := range []Channel{
+		{Name: ""},
+		{Name: "General"},
+		{Name: "-general"},
+		{Name: "general", MaxContentLength: -1},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", c)
+		}
+	}
+	if err := (&Channel{Name: "team_42-ops"}).Validate(); err != nil {
+		t.Errorf("Expected a valid channel, got %v", err)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	database.DB.Exec("TRUNCATE TABLE messages, channels RESTART IDENTITY CASCADE;")
+
+	secret := Channel{Name: "secret", IsPrivate: true, CreatedBy: "alice"}
+	inTenant(t, func(tx *sql.Tx) error {
+		if err := Create(tx, "acme", &Channel{Name: "general"}); err != nil {
+			return err
+		}
+		return Create(tx, "acme", &secret)
+	})
+
+	inTenant(t, func(tx *sql.Tx) error {
+		if err := Create(tx, "acme", &Channel{Name: "general"}); err != ErrNameTaken {
+			t.Errorf("Expected ErrNameTaken, got %v", err)
+		}
+		return nil
+	})
+
+	inTenant(t, func(tx *sql.Tx) error {
+		// The creator is a member of the private channel; others do not see it
+		if member, err := IsMember(tx, "acme", secret.ID, "alice"); err != nil || !member {
+			t.Errorf("Expected the creator to be a member, got %v (err %v)", member, err)
+		}
+		list, err := List(tx, "acme", "bob", false)
+		if err != nil {
+			return err
+		}
+		if len(list) != 1 || list[0].Name != "general" {
+			t.Errorf("Expected only the public channel, got %+v", list)
+		}
+
+		if err := AddMember(tx, "acme", secret.ID, "bob"); err != nil {
+			return err
+		}
+		if list, _ = List(tx, "acme", "bob", false); len(list) != 2 {
+			t.Errorf("Expected both channels once a member, got %+v", list)
+		}
+		members, err := ListMembers(tx, "acme", secret.ID)
+		if err != nil {
+			return err
+		}
+		if len(members) != 2 || members[0] != "alice" || members[1] != "bob" {
+			t.Errorf("Expected members [alice bob], got %v", members)
+		}
+
+		if removed, err := RemoveMember(tx, "acme", secret.ID, "bob"); err != nil || !removed {
+			t.Errorf("Expected bob to be removed, got %v (err %v)", removed, err)
+		}
+		return nil
+	})
+}
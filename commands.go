@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/shawn1912/messages-service/audit"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/jobs"
+)
+
+// runCommand runs one of the administrative subcommands instead of the server.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "migrate":
+		// Migrations have already been applied during startup.
+		log.Println("Database schema is up to date")
+		return nil
+	case "reanalyze":
+		return runReanalyze(args)
+	case "apikey":
+		return runAPIKey(args)
+	case "audit":
+		return runAudit(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// runReanalyze recomputes stale palindrome results, logging progress after
+// every batch. Interrupting it is safe; running it again resumes the work.
+func runReanalyze(args []string) error {
+	flags := flag.NewFlagSet("reanalyze", flag.ContinueOnError)
+	batchSize := flags.Int("batch-size", 500, "number of messages to recompute per transaction")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	progress, err := jobs.Reanalyze(ctx, jobs.ReanalyzeOptions{
+		BatchSize: *batchSize,
+		Progress: func(p jobs.ReanalyzeProgress) {
+			log.Printf("Reanalyzed %d messages (%d changed) up to id %d, %.0f messages/s",
+				p.Scanned, p.Changed, p.LastID, p.Rate())
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reanalysis complete: %d messages scanned, %d changed in %s",
+		progress.Scanned, progress.Changed, progress.Elapsed)
+	return nil
+}
+
+// runAPIKey manages API keys:
+//
+//	apikey create -name NAME -scopes messages:read,messages:write [-tenant ID | -any-tenant]
+//	apikey revoke ID
+//	apikey list
+func runAPIKey(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: apikey create|revoke|list")
+	}
+
+	switch args[0] {
+	case "create":
+		flags := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		name := flags.String("name", "", "description of the key's owner")
+		scopes := flags.String("scopes", "", "comma-separated scopes: "+strings.Join(auth.KnownScopes, ", "))
+		tenant := flags.String("tenant", database.DefaultTenant, "tenant the key is bound to")
+		anyTenant := flags.Bool("any-tenant", false, "let the key act on any tenant named in the X-Tenant-ID header")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *name == "" || *scopes == "" {
+			return fmt.Errorf("both -name and -scopes are required")
+		}
+		if *anyTenant {
+			*tenant = ""
+		}
+
+		id, key, err := auth.CreateAPIKey(*name, *tenant, strings.Split(*scopes, ","))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created API key %d. Store it now, it cannot be shown again:\n%s\n", id, key)
+		return nil
+
+	case "revoke":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: apikey revoke ID")
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid API key ID %q", args[1])
+		}
+		if err := auth.RevokeAPIKey(id); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked API key %d\n", id)
+		return nil
+
+	case "list":
+		keys, err := auth.ListAPIKeys()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tTENANT\tSCOPES\tCREATED\tREVOKED")
+		for _, key := range keys {
+			tenant := key.Tenant
+			if tenant == "" {
+				tenant = "*"
+			}
+			revoked := "-"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format("2006-01-02 15:04")
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Name, tenant, strings.Join(key.Scopes, ","),
+				key.CreatedAt.Format("2006-01-02 15:04"), revoked)
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("unknown apikey command %q", args[0])
+	}
+}
+
+// runAudit verifies the audit log's hash chains:
+//
+//	audit verify [-expect-head HASH,...]
+func runAudit(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		return fmt.Errorf("usage: audit verify [-expect-head HASH,...]")
+	}
+
+	flags := flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	expectHeads := flags.String("expect-head", "", "comma-separated head hashes reported by an earlier run, to detect entries removed from the end")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	checked, heads, err := audit.Verify(context.Background(), 0)
+	if err != nil {
+		return fmt.Errorf("audit log verification failed after %d entries: %w", checked, err)
+	}
+	log.Printf("Audit log verified: %d entries", checked)
+	tenants := make([]string, 0, len(heads))
+	for tenant := range heads {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	for _, tenant := range tenants {
+		log.Printf("Tenant %s: head %s", tenant, heads[tenant])
+	}
+
+	for _, head := range strings.Split(*expectHeads, ",") {
+		if head = strings.TrimSpace(head); head == "" {
+			continue
+		}
+		if err := audit.VerifyContains(context.Background(), head); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+// Package config reads the service settings from environment variables.
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shawn1912/messages-service/ratelimit"
+	"github.com/shawn1912/messages-service/validation"
+)
+
+// Config holds the service settings.
+type Config struct {
+	// DatabaseURL is the Postgres connection string (DATABASE_URL).
+	DatabaseURL string
+	// Addr is the address the HTTP server listens on (ADDR).
+	Addr string
+
+	// JWKSFile is the path of the local JWKS file holding the keys that
+	// bearer tokens are verified with (JWT_JWKS_FILE). Bearer tokens are
+	// rejected when it is empty.
+	JWKSFile string
+	// JWKSReloadInterval is how often the JWKS file is checked for changes
+	// (JWT_JWKS_RELOAD_INTERVAL).
+	JWKSReloadInterval time.Duration
+	// JWTIssuer is the required "iss" claim, if set (JWT_ISSUER).
+	JWTIssuer string
+	// JWTAudience is the required "aud" claim, if set (JWT_AUDIENCE).
+	JWTAudience string
+	// JWTClockSkew is the leeway allowed when checking "exp" and "nbf"
+	// (JWT_CLOCK_SKEW).
+	JWTClockSkew time.Duration
+
+	// TenantMaxMessages is the number of messages a tenant may store unless
+	// its row in the tenants table says otherwise; 0 is unlimited
+	// (TENANT_MAX_MESSAGES).
+	TenantMaxMessages int
+	// TenantMaxContentLength is the maximum content length, in characters,
+	// of a tenant's messages unless its row in the tenants table says
+	// otherwise; 0 only applies the global limit (TENANT_MAX_CONTENT_LENGTH).
+	TenantMaxContentLength int
+
+	// RateLimitDefault is the limit for routes without their own, written as
+	// requests/period; 0/1s disables it (RATE_LIMIT_DEFAULT).
+	RateLimitDefault ratelimit.Limit
+	// RateLimits holds per-route limits, written as semicolon-separated
+	// "METHOD /path=requests/period" rules (RATE_LIMITS).
+	RateLimits map[string]ratelimit.Limit
+	// RateLimitFailedAuth is how many failed authentications each client IP
+	// may make per period; 0/1s disables it (RATE_LIMIT_FAILED_AUTH).
+	RateLimitFailedAuth ratelimit.Limit
+	// TrustedProxies lists the comma-separated networks of reverse proxies
+	// whose X-Forwarded-For header is believed (TRUSTED_PROXIES).
+	TrustedProxies []*net.IPNet
+
+	// EventsReplaySize is the number of recent message events kept so that
+	// stream clients can resume after reconnecting (EVENTS_REPLAY_SIZE).
+	EventsReplaySize int
+	// EventsRetention is how long recorded message events are kept for
+	// replicas to catch up on; 0 keeps them forever (EVENTS_RETENTION).
+	EventsRetention time.Duration
+	// StreamHeartbeatInterval is how often idle event streams send a
+	// heartbeat (STREAM_HEARTBEAT_INTERVAL).
+	StreamHeartbeatInterval time.Duration
+	// WebSocketPingInterval is how often WebSocket clients are pinged; those
+	// silent for two intervals are disconnected (WEBSOCKET_PING_INTERVAL).
+	WebSocketPingInterval time.Duration
+	// WebSocketMaxConnections is the number of WebSocket connections each
+	// client may hold open (WEBSOCKET_MAX_CONNECTIONS).
+	WebSocketMaxConnections int
+
+	// WebhookTimeout limits each webhook delivery request (WEBHOOK_TIMEOUT).
+	WebhookTimeout time.Duration
+	// WebhookMaxAttempts is the number of attempts after which a delivery is
+	// dead (WEBHOOK_MAX_ATTEMPTS).
+	WebhookMaxAttempts int
+	// WebhookRetryBaseDelay is the delay before retrying a failed delivery,
+	// doubled after every later failure (WEBHOOK_RETRY_BASE_DELAY).
+	WebhookRetryBaseDelay time.Duration
+	// WebhookRetryMaxDelay caps the delay between attempts
+	// (WEBHOOK_RETRY_MAX_DELAY).
+	WebhookRetryMaxDelay time.Duration
+	// WebhookAllowPrivateAddresses lets webhooks be sent to loopback,
+	// link-local and private addresses (WEBHOOK_ALLOW_PRIVATE_ADDRESSES).
+	WebhookAllowPrivateAddresses bool
+
+	// ThreadDeleteMode is what happens to the replies of a deleted message:
+	// "orphan", "tombstone" or "cascade" (THREAD_DELETE_MODE).
+	ThreadDeleteMode string
+
+	// OutboxPublisher is where outbox messages are published: "stdout",
+	// "file:<path>" or an http(s) URL. Empty disables the outbox
+	// (OUTBOX_PUBLISHER).
+	OutboxPublisher string
+	// OutboxTimeout limits each publish to an HTTP publisher (OUTBOX_TIMEOUT).
+	OutboxTimeout time.Duration
+	// OutboxMaxAttempts is the number of failed publishes after which an
+	// outbox message is dead; 0 retries forever (OUTBOX_MAX_ATTEMPTS).
+	OutboxMaxAttempts int
+	// OutboxRetention is how long published outbox messages are kept
+	// (OUTBOX_RETENTION).
+	OutboxRetention time.Duration
+
+	// MessageRetention is the maximum age of messages, after which they
+	// expire. 0 keeps them until they are deleted (MESSAGE_RETENTION).
+	MessageRetention time.Duration
+
+	// AttachmentsDir is the directory attachment content is stored in
+	// (ATTACHMENTS_DIR).
+	AttachmentsDir string
+	// AttachmentMaxSize is the largest attachment accepted, in bytes
+	// (ATTACHMENT_MAX_SIZE).
+	AttachmentMaxSize int
+	// AttachmentTypes lists the comma-separated media types attachments may
+	// have, as sniffed from their content (ATTACHMENT_TYPES).
+	AttachmentTypes []string
+
+	// ModerationRulesFile is the path of the rule list messages are moderated
+	// with; empty disables moderation (MODERATION_RULES_FILE).
+	ModerationRulesFile string
+
+	// DuplicatePolicy is what happens to new messages that duplicate an
+	// existing one: "off", "flag", "reject" or "merge" (DUPLICATE_POLICY).
+	DuplicatePolicy string
+	// DuplicateSimilarity is the estimated share of text, from 0 to 1, that
+	// near duplicates have in common; 1 only detects exact duplicates
+	// (DUPLICATE_SIMILARITY).
+	DuplicateSimilarity float64
+
+	// ContentRules are the rules message content must meet: between
+	// CONTENT_MIN_LENGTH (default 1) and CONTENT_MAX_LENGTH (default and at
+	// most 1000) characters, with text other than whitespace unless
+	// CONTENT_REQUIRE_TEXT is false, without control characters unless
+	// CONTENT_ALLOW_CONTROL is true, and normalized to NFC unless
+	// CONTENT_NORMALIZE is false.
+	ContentRules validation.Rules
+	// AllowUnknownFields accepts message bodies with fields the API does not
+	// know, which are otherwise rejected (JSON_ALLOW_UNKNOWN_FIELDS).
+	AllowUnknownFields bool
+}
+
+// Load reads the configuration from the environment, falling back to defaults
+// suitable for local development.
+func Load() (Config, error) {
+	cfg := Config{
+		DatabaseURL:         getEnv("DATABASE_URL", "user=postgres password=postgres dbname=messages sslmode=disable"),
+		Addr:                getEnv("ADDR", ":8080"),
+		JWKSFile:            os.Getenv("JWT_JWKS_FILE"),
+		ThreadDeleteMode:    getEnv("THREAD_DELETE_MODE", "tombstone"),
+		OutboxPublisher:     os.Getenv("OUTBOX_PUBLISHER"),
+		JWTIssuer:           os.Getenv("JWT_ISSUER"),
+		JWTAudience:         os.Getenv("JWT_AUDIENCE"),
+		AttachmentsDir:      getEnv("ATTACHMENTS_DIR", "data/attachments"),
+		ModerationRulesFile: os.Getenv("MODERATION_RULES_FILE"),
+		DuplicatePolicy:     getEnv("DUPLICATE_POLICY", "off"),
+		AttachmentTypes:     getList("ATTACHMENT_TYPES", "image/png,image/jpeg,image/gif,image/webp,application/pdf,text/plain"),
+	}
+
+	var err error
+	if cfg.JWKSReloadInterval, err = getDuration("JWT_JWKS_RELOAD_INTERVAL", time.Minute); err != nil {
+		return Config{}, err
+	}
+	if cfg.JWTClockSkew, err = getDuration("JWT_CLOCK_SKEW", 30*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.TenantMaxMessages, err = getInt("TENANT_MAX_MESSAGES", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.TenantMaxContentLength, err = getInt("TENANT_MAX_CONTENT_LENGTH", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitDefault, err = ratelimit.ParseLimit(getEnv("RATE_LIMIT_DEFAULT", "600/1m")); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimits, err = ratelimit.ParseRoutes(getEnv("RATE_LIMITS", "POST /message=60/1m")); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitFailedAuth, err = ratelimit.ParseLimit(getEnv("RATE_LIMIT_FAILED_AUTH", "10/1m")); err != nil {
+		return Config{}, err
+	}
+	if cfg.TrustedProxies, err = ratelimit.ParseNetworks(os.Getenv("TRUSTED_PROXIES")); err != nil {
+		return Config{}, err
+	}
+	if cfg.EventsReplaySize, err = getInt("EVENTS_REPLAY_SIZE", 1000); err != nil {
+		return Config{}, err
+	}
+	if cfg.EventsRetention, err = getDuration("EVENTS_RETENTION", 24*time.Hour); err != nil {
+		return Config{}, err
+	}
+	if cfg.StreamHeartbeatInterval, err = getDuration("STREAM_HEARTBEAT_INTERVAL", 15*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.StreamHeartbeatInterval == 0 {
+		return Config{}, fmt.Errorf("invalid STREAM_HEARTBEAT_INTERVAL: must be greater than zero")
+	}
+	if cfg.WebSocketPingInterval, err = getDuration("WEBSOCKET_PING_INTERVAL", 30*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.WebSocketPingInterval == 0 {
+		return Config{}, fmt.Errorf("invalid WEBSOCKET_PING_INTERVAL: must be greater than zero")
+	}
+	if cfg.WebSocketMaxConnections, err = getInt("WEBSOCKET_MAX_CONNECTIONS", 5); err != nil {
+		return Config{}, err
+	}
+	if cfg.WebhookTimeout, err = getDuration("WEBHOOK_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.WebhookMaxAttempts, err = getInt("WEBHOOK_MAX_ATTEMPTS", 10); err != nil {
+		return Config{}, err
+	}
+	if cfg.WebhookMaxAttempts == 0 {
+		return Config{}, fmt.Errorf("invalid WEBHOOK_MAX_ATTEMPTS: must be at least 1")
+	}
+	if cfg.WebhookRetryBaseDelay, err = getDuration("WEBHOOK_RETRY_BASE_DELAY", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.WebhookRetryMaxDelay, err = getDuration("WEBHOOK_RETRY_MAX_DELAY", time.Hour); err != nil {
+		return Config{}, err
+	}
+	if cfg.WebhookAllowPrivateAddresses, err = getBool("WEBHOOK_ALLOW_PRIVATE_ADDRESSES", false); err != nil {
+		return Config{}, err
+	}
+	switch cfg.ThreadDeleteMode {
+	case "orphan", "tombstone", "cascade":
+	default:
+		return Config{}, fmt.Errorf("invalid THREAD_DELETE_MODE %q: must be orphan, tombstone or cascade", cfg.ThreadDeleteMode)
+	}
+	if cfg.OutboxTimeout, err = getDuration("OUTBOX_TIMEOUT", 10*time.Second); err != nil {
+		return Config{}, err
+	}
+	if cfg.OutboxMaxAttempts, err = getInt("OUTBOX_MAX_ATTEMPTS", 10); err != nil {
+		return Config{}, err
+	}
+	if cfg.OutboxRetention, err = getDuration("OUTBOX_RETENTION", 24*time.Hour); err != nil {
+		return Config{}, err
+	}
+	if cfg.MessageRetention, err = getDuration("MESSAGE_RETENTION", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.AttachmentMaxSize, err = getInt("ATTACHMENT_MAX_SIZE", 10<<20); err != nil {
+		return Config{}, err
+	}
+	switch cfg.DuplicatePolicy {
+	case "off", "flag", "reject", "merge":
+	default:
+		return Config{}, fmt.Errorf("invalid DUPLICATE_POLICY %q: must be off, flag, reject or merge", cfg.DuplicatePolicy)
+	}
+	if cfg.DuplicateSimilarity, err = getFraction("DUPLICATE_SIMILARITY", 0.8); err != nil {
+		return Config{}, err
+	}
+	rules := validation.DefaultRules
+	if rules.MinLength, err = getInt("CONTENT_MIN_LENGTH", rules.MinLength); err != nil {
+		return Config{}, err
+	}
+	if rules.MaxLength, err = getInt("CONTENT_MAX_LENGTH", rules.MaxLength); err != nil {
+		return Config{}, err
+	}
+	if rules.MaxLength < 1 || rules.MaxLength > validation.MaxLength || rules.MaxLength < rules.MinLength {
+		return Config{}, fmt.Errorf("invalid CONTENT_MAX_LENGTH %d: must be from CONTENT_MIN_LENGTH and 1 to %d",
+			rules.MaxLength, validation.MaxLength)
+	}
+	if rules.RequireText, err = getBool("CONTENT_REQUIRE_TEXT", rules.RequireText); err != nil {
+		return Config{}, err
+	}
+	if rules.AllowControl, err = getBool("CONTENT_ALLOW_CONTROL", rules.AllowControl); err != nil {
+		return Config{}, err
+	}
+	if rules.Normalize, err = getBool("CONTENT_NORMALIZE", rules.Normalize); err != nil {
+		return Config{}, err
+	}
+	cfg.ContentRules = rules
+	if cfg.AllowUnknownFields, err = getBool("JSON_ALLOW_UNKNOWN_FIELDS", false); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// getEnv returns the value of the environment variable name, or fallback if
+// it is unset or empty.
+func getEnv(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// getList splits the environment variable name, or fallback if it is unset or
+// empty, into its comma-separated values.
+func getList(name, fallback string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(name, fallback), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getDuration parses the environment variable name as a time.Duration, or
+// returns fallback if it is unset or empty.
+func getDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative duration such as 30s", name, value)
+	}
+	return d, nil
+}
+
+// getFraction parses the environment variable name as a number from 0 to 1,
+// or returns fallback if it is unset or empty.
+func getFraction(name string, fallback float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("invalid %s %q: must be a number from 0 to 1", name, value)
+	}
+	return f, nil
+}
+
+// getBool parses the environment variable name as a boolean such as true or
+// 0, or returns fallback if it is unset or empty.
+func getBool(name string, fallback bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: must be true or false", name, value)
+	}
+	return b, nil
+}
+
+// getInt parses the environment variable name as a non-negative integer, or
+// returns fallback if it is unset or empty.
+func getInt(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative integer", name, value)
+	}
+	return n, nil
+}
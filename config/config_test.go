@@ -0,0 +1,138 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/shawn1912/messages-service/validation"
+)
+
+func TestLoad_Defaults(t *testing.T) {
+	t.Setenv("DATABASE_URL", "")
+	t.Setenv("JWT_CLOCK_SKEW", "")
+	t.Setenv("RATE_LIMITS", "")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DatabaseURL != "user=postgres password=postgres dbname=messages sslmode=disable" {
+		t.Errorf("Unexpected default DatabaseURL %q", cfg.DatabaseURL)
+	}
+	if cfg.Addr != ":8080" {
+		t.Errorf("Expected default Addr ':8080', got %q", cfg.Addr)
+	}
+	if cfg.JWTClockSkew != 30*time.Second {
+		t.Errorf("Expected default JWTClockSkew 30s, got %s", cfg.JWTClockSkew)
+	}
+	if limit := cfg.RateLimits["POST /message"]; limit.Requests != 60 || limit.Period != time.Minute {
+		t.Errorf("Expected default POST /message limit 60/1m, got %+v", limit)
+	}
+	if cfg.EventsReplaySize != 1000 || cfg.StreamHeartbeatInterval != 15*time.Second {
+		t.Errorf("Expected default events replay size 1000 and heartbeat 15s, got %d and %s",
+			cfg.EventsReplaySize, cfg.StreamHeartbeatInterval)
+	}
+	if cfg.AttachmentMaxSize != 10<<20 || len(cfg.AttachmentTypes) != 6 {
+		t.Errorf("Expected a default attachment limit of 10 MiB and 6 types, got %d and %q",
+			cfg.AttachmentMaxSize, cfg.AttachmentTypes)
+	}
+	if cfg.ContentRules != validation.DefaultRules || cfg.AllowUnknownFields {
+		t.Errorf("Expected the default content rules and no unknown fields, got %+v and %v",
+			cfg.ContentRules, cfg.AllowUnknownFields)
+	}
+}
+
+func TestLoad_Environment(t *testing.T) {
+	t.Setenv("DATABASE_URL", "dbname=other")
+	t.Setenv("JWT_JWKS_FILE", "/etc/jwks.json")
+	t.Setenv("JWT_CLOCK_SKEW", "5s")
+	t.Setenv("MESSAGE_RETENTION", "720h")
+	t.Setenv("ATTACHMENT_TYPES", "image/png, application/zip")
+	t.Setenv("DUPLICATE_POLICY", "merge")
+	t.Setenv("DUPLICATE_SIMILARITY", "0.9")
+	t.Setenv("CONTENT_MIN_LENGTH", "0")
+	t.Setenv("CONTENT_MAX_LENGTH", "280")
+	t.Setenv("CONTENT_NORMALIZE", "false")
+	t.Setenv("JSON_ALLOW_UNKNOWN_FIELDS", "1")
+
+	cfg, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.DatabaseURL != "dbname=other" {
+		t.Errorf("Expected DatabaseURL 'dbname=other', got %q", cfg.DatabaseURL)
+	}
+	if cfg.JWKSFile != "/etc/jwks.json" {
+		t.Errorf("Expected JWKSFile '/etc/jwks.json', got %q", cfg.JWKSFile)
+	}
+	if cfg.JWTClockSkew != 5*time.Second {
+		t.Errorf("Expected JWTClockSkew 5s, got %s", cfg.JWTClockSkew)
+	}
+	if cfg.MessageRetention != 720*time.Hour {
+		t.Errorf("Expected MessageRetention 720h, got %s", cfg.MessageRetention)
+	}
+	if len(cfg.AttachmentTypes) != 2 || cfg.AttachmentTypes[1] != "application/zip" {
+		t.Errorf("Expected AttachmentTypes [image/png application/zip], got %q", cfg.AttachmentTypes)
+	}
+	if cfg.DuplicatePolicy != "merge" || cfg.DuplicateSimilarity != 0.9 {
+		t.Errorf("Expected duplicate policy merge at 0.9, got %s at %v", cfg.DuplicatePolicy, cfg.DuplicateSimilarity)
+	}
+	want := validation.Rules{MaxLength: 280, RequireText: true}
+	if cfg.ContentRules != want || !cfg.AllowUnknownFields {
+		t.Errorf("Expected content rules %+v allowing unknown fields, got %+v and %v", want, cfg.ContentRules, cfg.AllowUnknownFields)
+	}
+}
+
+func TestLoad_InvalidDuration(t *testing.T) {
+	t.Setenv("JWT_CLOCK_SKEW", "soon")
+
+	if _, err := Load(); err == nil {
+		t.Error("Expected an invalid duration to be rejected")
+	}
+}
+
+func TestLoad_InvalidRateLimit(t *testing.T) {
+	t.Setenv("RATE_LIMITS", "POST /message=lots")
+
+	if _, err := Load(); err == nil {
+		t.Error("Expected an invalid rate limit to be rejected")
+	}
+}
+
+func TestLoad_InvalidThreadDeleteMode(t *testing.T) {
+	t.Setenv("THREAD_DELETE_MODE", "shred")
+
+	if _, err := Load(); err == nil {
+		t.Error("Expected an unknown thread delete mode to be rejected")
+	}
+}
+
+func TestLoad_InvalidDuplicateSettings(t *testing.T) {
+	for name, value := range map[string]string{"DUPLICATE_POLICY": "ignore", "DUPLICATE_SIMILARITY": "1.5"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := Load(); err == nil {
+				t.Errorf("Expected %s=%s to be rejected", name, value)
+			}
+		})
+	}
+}
+
+func TestLoad_InvalidContentRules(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"CONTENT_MAX_LENGTH": "1001"},
+		{"CONTENT_MAX_LENGTH": "0"},
+		{"CONTENT_MIN_LENGTH": "20", "CONTENT_MAX_LENGTH": "10"},
+		{"CONTENT_NORMALIZE": "maybe"},
+	} {
+		t.Run(fmt.Sprint(env), func(t *testing.T) {
+			for name, value := range env {
+				t.Setenv(name, value)
+			}
+			if _, err := Load(); err == nil {
+				t.Errorf("Expected %v to be rejected", env)
+			}
+		})
+	}
+}
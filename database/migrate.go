@@ -0,0 +1,77 @@
+package database
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migrate applies every migration in database/migrations that has not yet been
+// recorded in the schema_migrations table. Migrations run in file name order,
+// each in its own transaction.
+func Migrate() error {
+	_, err := DB.Exec(`
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version TEXT PRIMARY KEY,
+            applied_at TIMESTAMP NOT NULL DEFAULT NOW()
+        )
+    `)
+	if err != nil {
+		return err
+	}
+
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := applyMigration(name); err != nil {
+			return fmt.Errorf("migration %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs a single migration file unless it has already been applied.
+func applyMigration(name string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Serialize concurrent instances starting up at the same time.
+	if _, err = tx.Exec("SELECT pg_advisory_xact_lock(hashtext('schema_migrations'))"); err != nil {
+		return err
+	}
+
+	version := path.Base(name)
+
+	var applied bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)", version).Scan(&applied)
+	if err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	script, err := migrationFiles.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(string(script)); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
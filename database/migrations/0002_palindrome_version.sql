@@ -0,0 +1,3 @@
+-- Rows written before results were versioned are treated as version 0 so the
+-- reanalyze command picks them up.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS palindrome_version INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+-- NULL marks rows written before signatures existed; the reanalyze command
+-- fills them in.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS anagram_signature TEXT;
+
+CREATE INDEX IF NOT EXISTS messages_anagram_signature_idx ON messages (anagram_signature, id);
@@ -0,0 +1,6 @@
+-- Messages created before ownership existed have no owner and can only be
+-- changed by admins.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS owner_id TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_private BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS messages_owner_id_idx ON messages (owner_id, id);
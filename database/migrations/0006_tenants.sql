@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS tenants (
+    id TEXT PRIMARY KEY,
+    max_messages INTEGER CHECK (max_messages >= 0),
+    max_content_length INTEGER CHECK (max_content_length >= 0),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+INSERT INTO tenants (id) VALUES ('default') ON CONFLICT DO NOTHING;
+
+-- Existing messages and API keys belong to the default tenant. API keys
+-- without a tenant may act on behalf of any tenant named in X-Tenant-ID.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tenant_id TEXT;
+UPDATE api_keys SET tenant_id = 'default' WHERE tenant_id IS NULL;
+
+DROP INDEX IF EXISTS messages_anagram_signature_idx;
+DROP INDEX IF EXISTS messages_owner_id_idx;
+CREATE INDEX IF NOT EXISTS messages_tenant_id_idx ON messages (tenant_id, id);
+CREATE INDEX IF NOT EXISTS messages_tenant_anagram_signature_idx ON messages (tenant_id, anagram_signature, id);
+CREATE INDEX IF NOT EXISTS messages_tenant_owner_id_idx ON messages (tenant_id, owner_id, id);
+
+-- Rows are only visible inside transactions scoped to their tenant with
+-- database.BeginTenant, or to maintenance jobs using database.BeginAllTenants.
+-- FORCE applies the policy to the table owner too; superusers always bypass
+-- row-level security, so the service should connect as an ordinary role.
+ALTER TABLE messages ENABLE ROW LEVEL SECURITY;
+ALTER TABLE messages FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON messages;
+CREATE POLICY tenant_isolation ON messages
+    USING (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    )
+    WITH CHECK (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    );
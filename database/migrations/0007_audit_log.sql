@@ -0,0 +1,31 @@
+-- Every entry's hash covers its contents and the previous entry's hash, so
+-- altering or removing an entry breaks the chain from that point on. See
+-- audit.Verify.
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    action TEXT NOT NULL,
+    message_id BIGINT NOT NULL,
+    before_hash TEXT,
+    after_hash TEXT,
+    request_id TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_tenant_id_idx ON audit_log (tenant_id, id);
+CREATE INDEX IF NOT EXISTS audit_log_message_id_idx ON audit_log (tenant_id, message_id, id);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
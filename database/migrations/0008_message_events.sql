@@ -0,0 +1,27 @@
+-- Changes to messages, in commit order. Writers hold an advisory lock until
+-- they commit, so a sequence number that is not visible once a later one is
+-- belongs to a rolled back transaction and will never appear. See
+-- events.Record and events.Listener.
+CREATE TABLE IF NOT EXISTS message_events (
+    seq BIGSERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    type TEXT NOT NULL,
+    message JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS message_events_created_at_idx ON message_events (created_at);
+
+ALTER TABLE message_events ENABLE ROW LEVEL SECURITY;
+ALTER TABLE message_events FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON message_events;
+CREATE POLICY tenant_isolation ON message_events
+    USING (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    )
+    WITH CHECK (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    );
@@ -0,0 +1,11 @@
+-- Replies point at the message they answer. thread_id is the root of the
+-- reply tree and is NULL for roots themselves; deleted_at marks tombstones,
+-- deleted messages kept because they still have replies.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS parent_id INTEGER REFERENCES messages (id);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_id INTEGER;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS messages_tenant_parent_id_idx ON messages (tenant_id, parent_id, id)
+    WHERE parent_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS messages_tenant_thread_id_idx ON messages (tenant_id, thread_id, id)
+    WHERE thread_id IS NOT NULL;
@@ -0,0 +1,60 @@
+-- Named channels grouping a tenant's messages. Private channels are only
+-- visible to their members; max_content_length (0 for none) and
+-- palindromes_only restrict the messages posted to them.
+CREATE TABLE IF NOT EXISTS channels (
+    id SERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    is_private BOOLEAN NOT NULL DEFAULT FALSE,
+    max_content_length INTEGER NOT NULL DEFAULT 0 CHECK (max_content_length >= 0),
+    palindromes_only BOOLEAN NOT NULL DEFAULT FALSE,
+    created_by TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (tenant_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS channel_members (
+    channel_id INTEGER NOT NULL REFERENCES channels (id) ON DELETE CASCADE,
+    tenant_id TEXT NOT NULL,
+    member TEXT NOT NULL,
+    added_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (channel_id, member)
+);
+
+CREATE INDEX IF NOT EXISTS channel_members_member_idx ON channel_members (tenant_id, member);
+
+-- Messages outside any channel have no channel_id. Channels cannot be deleted
+-- while they still have messages.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS channel_id INTEGER REFERENCES channels (id);
+
+CREATE INDEX IF NOT EXISTS messages_tenant_channel_id_idx ON messages (tenant_id, channel_id, id)
+    WHERE channel_id IS NOT NULL;
+
+ALTER TABLE channels ENABLE ROW LEVEL SECURITY;
+ALTER TABLE channels FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON channels;
+CREATE POLICY tenant_isolation ON channels
+    USING (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    )
+    WITH CHECK (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    );
+
+ALTER TABLE channel_members ENABLE ROW LEVEL SECURITY;
+ALTER TABLE channel_members FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON channel_members;
+CREATE POLICY tenant_isolation ON channel_members
+    USING (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    )
+    WITH CHECK (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    );
@@ -0,0 +1,61 @@
+-- Tags label messages. Automatic tags are derived from the message by
+-- analysis and recomputed whenever it changes; the others are added by users.
+CREATE TABLE IF NOT EXISTS tags (
+    id SERIAL PRIMARY KEY,
+    tenant_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (tenant_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS message_tags (
+    message_id INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    tag_id INTEGER NOT NULL REFERENCES tags (id) ON DELETE CASCADE,
+    tenant_id TEXT NOT NULL,
+    automatic BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS message_tags_tag_id_idx ON message_tags (tenant_id, tag_id, message_id);
+
+ALTER TABLE tags ENABLE ROW LEVEL SECURITY;
+ALTER TABLE tags FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON tags;
+CREATE POLICY tenant_isolation ON tags
+    USING (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    )
+    WITH CHECK (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    );
+
+ALTER TABLE message_tags ENABLE ROW LEVEL SECURITY;
+ALTER TABLE message_tags FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON message_tags;
+CREATE POLICY tenant_isolation ON message_tags
+    USING (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    )
+    WITH CHECK (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    );
+
+-- Tag the existing palindromes of every tenant.
+SELECT set_config('app.all_tenants', 'on', true);
+
+INSERT INTO tags (tenant_id, name)
+SELECT DISTINCT tenant_id, 'palindrome' FROM messages WHERE is_palindrome AND deleted_at IS NULL
+ON CONFLICT DO NOTHING;
+
+INSERT INTO message_tags (message_id, tag_id, tenant_id, automatic)
+SELECT m.id, t.id, m.tenant_id, TRUE
+FROM messages m JOIN tags t ON t.tenant_id = m.tenant_id AND t.name = 'palindrome'
+WHERE m.is_palindrome AND m.deleted_at IS NULL
+ON CONFLICT DO NOTHING;
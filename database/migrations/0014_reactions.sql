@@ -0,0 +1,28 @@
+-- Emoji reactions to messages; each user reacts with each emoji at most once.
+CREATE TABLE IF NOT EXISTS message_reactions (
+    message_id INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+    tenant_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
+
+CREATE INDEX IF NOT EXISTS message_reactions_message_id_idx ON message_reactions (tenant_id, message_id);
+
+ALTER TABLE message_reactions ENABLE ROW LEVEL SECURITY;
+ALTER TABLE message_reactions FORCE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS tenant_isolation ON message_reactions;
+CREATE POLICY tenant_isolation ON message_reactions
+    USING (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    )
+    WITH CHECK (
+        tenant_id = current_setting('app.tenant_id', true)
+        OR current_setting('app.all_tenants', true) = 'on'
+    );
+
+-- The reaction added or removed by reaction events.
+ALTER TABLE message_events ADD COLUMN IF NOT EXISTS reaction JSONB;
@@ -0,0 +1,6 @@
+-- publish_at is set while a message is scheduled: until then only its owner
+-- and admins can see it. The scheduler clears it once the time has come.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS publish_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS messages_publish_at_idx ON messages (publish_at)
+    WHERE publish_at IS NOT NULL;
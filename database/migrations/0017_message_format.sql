@@ -0,0 +1,4 @@
+-- The format content is written in. Markdown is rendered to sanitized HTML
+-- when messages are read, and analysed as the text it displays.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT 'plain'
+    CHECK (format IN ('plain', 'markdown'));
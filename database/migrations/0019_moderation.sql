@@ -0,0 +1,10 @@
+-- Moderation states of messages: only visible messages are shown to anyone
+-- but their owner and moderators. Moderators' decisions are recorded in the
+-- audit log.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS moderation_state TEXT NOT NULL DEFAULT 'visible'
+    CHECK (moderation_state IN ('visible', 'pending', 'quarantined', 'rejected'));
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS moderation_reason TEXT;
+
+-- The review queue
+CREATE INDEX IF NOT EXISTS messages_moderation_queue_idx ON messages (tenant_id, moderation_state, id)
+    WHERE moderation_state <> 'visible';
@@ -0,0 +1,15 @@
+-- Fingerprints of message text for duplicate detection: the hash of the
+-- normalized text, empty when there is nothing to hash, and the MinHash
+-- signature with its band keys. Messages from before this migration are
+-- fingerprinted by the reanalyze command.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS content_hash TEXT;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS minhash BIGINT[];
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS minhash_bands BIGINT[];
+
+-- The message a flagged duplicate repeats, and the number of duplicates
+-- merged into a message.
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS duplicate_of INTEGER REFERENCES messages (id) ON DELETE SET NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS duplicate_count INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS messages_content_hash_idx ON messages (tenant_id, content_hash) WHERE content_hash <> '';
+CREATE INDEX IF NOT EXISTS messages_minhash_bands_idx ON messages USING GIN (minhash_bands);
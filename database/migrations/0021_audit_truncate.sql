@@ -0,0 +1,6 @@
+-- TRUNCATE skips row triggers, so audit_log_append_only alone would still let
+-- the whole log be wiped.
+DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+CREATE TRIGGER audit_log_no_truncate
+    BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
@@ -0,0 +1,10 @@
+-- Outbox messages that failed every attempt. They are no longer published
+-- and no longer hold back later messages about the same message.
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS dead_at TIMESTAMPTZ;
+
+DROP INDEX IF EXISTS outbox_unpublished_idx;
+DROP INDEX IF EXISTS outbox_unpublished_aggregate_idx;
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (id) WHERE published_at IS NULL AND dead_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_pending_aggregate_idx ON outbox (tenant_id, aggregate_id, id)
+    WHERE published_at IS NULL AND dead_at IS NULL;
+CREATE INDEX IF NOT EXISTS outbox_dead_at_idx ON outbox (dead_at) WHERE dead_at IS NOT NULL;
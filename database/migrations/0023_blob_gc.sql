@@ -0,0 +1,23 @@
+-- Blob keys that may no longer be referenced by any attachment: those of
+-- deleted attachments and of uploads that were not saved. Blobs are shared by
+-- identical uploads of every tenant, so the table has no tenant and a sweep
+-- deletes each blob only once nothing refers to it.
+CREATE TABLE IF NOT EXISTS blob_gc (
+    blob_key TEXT PRIMARY KEY,
+    queued_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS message_attachments_blob_key_idx ON message_attachments (blob_key);
+
+CREATE OR REPLACE FUNCTION queue_attachment_blob() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO blob_gc (blob_key) VALUES (OLD.blob_key)
+    ON CONFLICT (blob_key) DO UPDATE SET queued_at = NOW();
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS message_attachments_queue_blob ON message_attachments;
+CREATE TRIGGER message_attachments_queue_blob
+    AFTER DELETE ON message_attachments
+    FOR EACH ROW EXECUTE FUNCTION queue_attachment_blob();
@@ -3,9 +3,57 @@ package database
 import "time"
 
 type Message struct {
-	ID           int64     `json:"id"`
-	Content      string    `json:"content"`
-	IsPalindrome bool      `json:"isPalindrome"`
-	CreatedAt    time.Time `json:"createdAt"`
-	UpdatedAt    time.Time `json:"updatedAt"`
+	ID             int64           `json:"id"`
+	Content        string          `json:"content"`
+	Format         string          `json:"format"`      // how content is written: plain or markdown
+	ContentHTML    string          `json:"contentHtml"` // content rendered to sanitized HTML
+	IsPalindrome   bool            `json:"isPalindrome"`
+	OwnerID        string          `json:"ownerId,omitempty"`
+	IsPrivate      bool            `json:"isPrivate"`
+	ParentID       *int64          `json:"parentId,omitempty"`       // the message this one replies to
+	ThreadID       int64           `json:"threadId"`                 // the root of the reply tree; the message's own ID for roots
+	ChannelID      *int64          `json:"channelId,omitempty"`      // the channel the message was posted to
+	ChannelPrivate bool            `json:"channelPrivate,omitempty"` // set if that channel is private, readable only by its members
+	Tags           []string        `json:"tags,omitempty"`
+	Reactions      []ReactionCount `json:"reactions,omitempty"`
+	Attachments    []Attachment    `json:"attachments,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
+	// PublishAt is set while the message is scheduled to be published later.
+	PublishAt *time.Time `json:"publishAt,omitempty"`
+	// ExpiresAt is when the message expires: it can no longer be read and is
+	// deleted soon after.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// ModerationState is visible, or pending, quarantined or rejected for
+	// messages hidden from everyone but their owner and moderators.
+	ModerationState string `json:"moderationState"`
+	// ModerationReason explains why a message is not visible.
+	ModerationReason string `json:"moderationReason,omitempty"`
+	// DuplicateOf is the message this one repeats, if it was flagged as a
+	// duplicate when it was created.
+	DuplicateOf *int64 `json:"duplicateOf,omitempty"`
+	// DuplicateCount is the number of duplicates merged into the message.
+	DuplicateCount int `json:"duplicateCount,omitempty"`
+	// DeletedAt is set on tombstones: deleted messages kept, without their
+	// content, because they still have replies.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+}
+
+// ReactionCount is the number of users who reacted to a message with an emoji.
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+}
+
+// Attachment is a file attached to a message. Its content is kept in the blob
+// store under the SHA-256 in BlobKey.
+type Attachment struct {
+	ID          int64     `json:"id"`
+	MessageID   int64     `json:"messageId"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	BlobKey     string    `json:"sha256"`
+	UploadedBy  string    `json:"uploadedBy"`
+	CreatedAt   time.Time `json:"createdAt"`
 }
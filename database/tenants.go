@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+)
+
+// DefaultTenant is the tenant of requests that do not name one.
+const DefaultTenant = "default"
+
+// TenantQuota limits what a tenant may store. A zero limit is unlimited.
+type TenantQuota struct {
+	MaxMessages      int
+	MaxContentLength int // in characters
+}
+
+// BeginTenant starts a transaction scoped to tenant. The row-level security
+// policies on tenant data only expose that tenant's rows inside it.
+func BeginTenant(ctx context.Context, tenant string) (*sql.Tx, error) {
+	return beginWithSetting(ctx, "app.tenant_id", tenant)
+}
+
+// BeginAllTenants starts a transaction that can read and write every tenant's
+// rows. It is meant for maintenance jobs, never for serving requests.
+func BeginAllTenants(ctx context.Context) (*sql.Tx, error) {
+	return beginWithSetting(ctx, "app.all_tenants", "on")
+}
+
+// beginWithSetting starts a transaction with a setting applied for its
+// duration only, like SET LOCAL.
+func beginWithSetting(ctx context.Context, name, value string) (*sql.Tx, error) {
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT set_config($1, $2, true)", name, value); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// LoadTenantQuota returns the quota of tenant, taking each limit from the
+// tenants table when it is set there and from defaults otherwise.
+func LoadTenantQuota(tx *sql.Tx, tenant string, defaults TenantQuota) (TenantQuota, error) {
+	var maxMessages, maxContentLength sql.NullInt64
+	err := tx.QueryRow("SELECT max_messages, max_content_length FROM tenants WHERE id = $1", tenant).
+		Scan(&maxMessages, &maxContentLength)
+	if err != nil && err != sql.ErrNoRows {
+		return TenantQuota{}, err
+	}
+
+	quota := defaults
+	if maxMessages.Valid {
+		quota.MaxMessages = int(maxMessages.Int64)
+	}
+	if maxContentLength.Valid {
+		quota.MaxContentLength = int(maxContentLength.Int64)
+	}
+	return quota, nil
+}
@@ -0,0 +1,172 @@
+// Package events delivers changes to messages to subscribers within the
+// process, keeping recent events so that subscribers can resume after a
+// disconnect.
+package events
+
+import (
+	"sync"
+	"time"
+
+	"github.com/shawn1912/messages-service/database"
+)
+
+// Event types.
+const (
+	MessageCreated  = "message.created"
+	MessageUpdated  = "message.updated"
+	MessageDeleted  = "message.deleted"
+	ReactionAdded   = "reaction.added"
+	ReactionRemoved = "reaction.removed"
+)
+
+// Types lists every event type.
+var Types = []string{MessageCreated, MessageUpdated, MessageDeleted, ReactionAdded, ReactionRemoved}
+
+// Event describes one change to a message. For MessageDeleted, Message holds
+// the message as it was before it was deleted. Reaction events also describe
+// the reaction, and Message holds the reaction counts after the change.
+type Event struct {
+	ID       int64            `json:"id"`
+	Type     string           `json:"type"`
+	Tenant   string           `json:"-"`
+	Message  database.Message `json:"message"`
+	Reaction *Reaction        `json:"reaction,omitempty"`
+	Time     time.Time        `json:"time"`
+}
+
+// Reaction is the reaction added or removed by a reaction event.
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	User  string `json:"user"`
+}
+
+// Broker fans events out to subscribers. Publishing never blocks: a
+// subscriber that falls too far behind is dropped, and can resume from the
+// replay buffer by subscribing again with the last event it saw.
+type Broker struct {
+	mu          sync.Mutex
+	replay      []Event // ring buffer of the most recent events
+	next        int     // index in replay of the next event to be written
+	lastID      int64
+	bufferSize  int
+	subscribers map[*Subscription]struct{}
+}
+
+// NewBroker returns a broker that keeps the last replaySize events and lets
+// each subscriber fall up to bufferSize events behind.
+func NewBroker(replaySize, bufferSize int) *Broker {
+	if replaySize < 1 {
+		replaySize = 1
+	}
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+	return &Broker{
+		replay:      make([]Event, 0, replaySize),
+		bufferSize:  bufferSize,
+		subscribers: map[*Subscription]struct{}{},
+	}
+}
+
+// Subscription receives the events accepted by its filter.
+type Subscription struct {
+	broker *Broker
+	filter func(Event) bool
+	events chan Event
+	lagged bool
+}
+
+// Events returns the channel events are delivered on. It is closed when the
+// subscription is closed or dropped for falling behind.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Lagged reports whether the subscription was dropped because its events were
+// not received quickly enough.
+func (s *Subscription) Lagged() bool {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	return s.lagged
+}
+
+// Close stops delivery to the subscription.
+func (s *Subscription) Close() {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	if _, ok := s.broker.subscribers[s]; ok {
+		delete(s.broker.subscribers, s)
+		close(s.events)
+	}
+}
+
+// Publish stores event for replay and delivers it to every interested
+// subscriber, returning it as published. An event without an ID is assigned
+// the next one; otherwise its ID must be greater than those published before.
+func (b *Broker) Publish(event Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if event.ID == 0 {
+		event.ID = b.lastID + 1
+	}
+	b.lastID = event.ID
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if len(b.replay) < cap(b.replay) {
+		b.replay = append(b.replay, event)
+	} else {
+		b.replay[b.next] = event
+	}
+	b.next = (b.next + 1) % cap(b.replay)
+
+	for s := range b.subscribers {
+		if s.filter != nil && !s.filter(event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			s.lagged = true
+			delete(b.subscribers, s)
+			close(s.events)
+		}
+	}
+	return event
+}
+
+// Subscribe registers a subscription for the events accepted by filter, which
+// may be nil to receive everything. When lastID is not zero, the buffered
+// events after it that filter accepts are returned for replay; complete is
+// false if some events after lastID are no longer buffered, in which case the
+// subscriber has missed changes and should reload its state.
+func (b *Broker) Subscribe(lastID int64, filter func(Event) bool) (sub *Subscription, backlog []Event, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub = &Subscription{broker: b, filter: filter, events: make(chan Event, b.bufferSize)}
+	b.subscribers[sub] = struct{}{}
+
+	if lastID == 0 {
+		return sub, nil, true
+	}
+
+	// An ID from the future was assigned before a restart, when IDs are not
+	// recorded. IDs from Record can skip numbers, so the check may be
+	// pessimistic.
+	complete = lastID <= b.lastID
+	// Until the ring first fills, next is its length, so the oldest event
+	// is at next modulo the length either way
+	if n := len(b.replay); n > 0 {
+		complete = complete && lastID >= b.replay[b.next%n].ID-1
+		for i := 0; i < n; i++ {
+			event := b.replay[(b.next+i)%n]
+			if event.ID > lastID && (filter == nil || filter(event)) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+	return sub, backlog, complete
+}
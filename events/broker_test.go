@@ -0,0 +1,99 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/shawn1912/messages-service/database"
+)
+
+func publishN(b *Broker, tenant string, n int) {
+	for i := 0; i < n; i++ {
+		b.Publish(Event{Type: MessageCreated, Tenant: tenant, Message: database.Message{Content: "hi"}})
+	}
+}
+
+func TestBroker_Deliver(t *testing.T) {
+	b := NewBroker(10, 10)
+	sub, backlog, complete := b.Subscribe(0, func(e Event) bool { return e.Tenant == "acme" })
+	defer sub.Close()
+	if len(backlog) != 0 || !complete {
+		t.Fatalf("Expected an empty, complete backlog, got %d events (complete %v)", len(backlog), complete)
+	}
+
+	b.Publish(Event{Type: MessageCreated, Tenant: "other"})
+	published := b.Publish(Event{Type: MessageCreated, Tenant: "acme"})
+
+	select {
+	case event := <-sub.Events():
+		if event.ID != published.ID || event.Tenant != "acme" {
+			t.Errorf("Expected event %d for acme, got %+v", published.ID, event)
+		}
+	default:
+		t.Fatal("Expected an event to be delivered")
+	}
+	if len(sub.Events()) != 0 {
+		t.Error("Expected events rejected by the filter not to be delivered")
+	}
+}
+
+func TestBroker_Replay(t *testing.T) {
+	b := NewBroker(5, 10)
+	publishN(b, "acme", 3)
+
+	// Resuming inside the buffer replays what was missed
+	sub, backlog, complete := b.Subscribe(1, nil)
+	sub.Close()
+	if !complete || len(backlog) != 2 || backlog[0].ID != 2 || backlog[1].ID != 3 {
+		t.Errorf("Expected complete replay of events 2 and 3, got %+v (complete %v)", backlog, complete)
+	}
+
+	// Once the ring wraps, only the last five are kept
+	publishN(b, "acme", 4)
+	sub, backlog, complete = b.Subscribe(1, nil)
+	sub.Close()
+	if complete {
+		t.Error("Expected replay from event 1 to be incomplete")
+	}
+	if len(backlog) != 5 || backlog[0].ID != 3 || backlog[4].ID != 7 {
+		t.Errorf("Expected events 3 to 7, got %+v", backlog)
+	}
+
+	sub, backlog, complete = b.Subscribe(2, nil)
+	sub.Close()
+	if !complete || len(backlog) != 5 {
+		t.Errorf("Expected complete replay of 5 events, got %d (complete %v)", len(backlog), complete)
+	}
+
+	// An ID the broker has not reached comes from before a restart
+	sub, _, complete = b.Subscribe(100, nil)
+	sub.Close()
+	if complete {
+		t.Error("Expected replay from an unknown ID to be incomplete")
+	}
+}
+
+func TestBroker_SlowSubscriber(t *testing.T) {
+	b := NewBroker(10, 2)
+	slow, _, _ := b.Subscribe(0, nil)
+	fast, _, _ := b.Subscribe(0, nil)
+	defer fast.Close()
+
+	for i := 0; i < 3; i++ {
+		b.Publish(Event{Type: MessageCreated})
+		<-fast.Events()
+	}
+
+	// The slow subscriber's buffered events are still delivered before the
+	// channel is closed
+	received := 0
+	for range slow.Events() {
+		received++
+	}
+	if received != 2 || !slow.Lagged() {
+		t.Errorf("Expected 2 events and a lagged subscription, got %d (lagged %v)", received, slow.Lagged())
+	}
+	if fast.Lagged() {
+		t.Error("Expected the fast subscriber to keep its subscription")
+	}
+	slow.Close()
+}
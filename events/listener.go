@@ -0,0 +1,239 @@
+package events
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+)
+
+// listenerPollInterval is how often the listener checks its connection,
+// catches up on any events it missed and prunes old ones.
+const listenerPollInterval = time.Minute
+
+// catchUpBatchSize is the number of events loaded per query when catching up.
+const catchUpBatchSize = 500
+
+// gapRetryInterval is how often the listener checks whether the transactions
+// that may fill a gap in the events have ended.
+const gapRetryInterval = 100 * time.Millisecond
+
+// Listener delivers the events recorded by every instance of the service to
+// the local Broker, in order.
+//
+// Notifications carry only the event's sequence number. When one arrives
+// that does not follow the last event delivered, notifications were missed,
+// for example while the connection was down, and the events in between are
+// loaded from the message_events table first.
+//
+// IDs are not assigned in commit order, so a number missing below a committed
+// event may belong to a transaction still in progress. Events after such a gap
+// are held back until every transaction that had started when the gap was
+// seen has ended; any number still missing then belongs to a rolled back
+// transaction.
+type Listener struct {
+	// ConnString is the Postgres connection string used for LISTEN.
+	ConnString string
+	Broker     *Broker
+	// Retention is how long events are kept in the table; zero keeps them.
+	Retention time.Duration
+
+	lastSeq int64
+	// gapEnd is the first event seen after a gap, and gapHorizon the end of
+	// the transaction IDs in use when it was seen. gapSettled is set once no
+	// transaction before the horizon is in progress.
+	gapEnd, gapHorizon int64
+	gapSettled         bool
+}
+
+// Run listens until ctx is done, reconnecting automatically. The broker's
+// replay buffer is first filled with the most recent events, so clients can
+// resume across restarts and replicas. It only returns early if the initial
+// setup fails.
+func (l *Listener) Run(ctx context.Context) error {
+	err := database.DB.QueryRowContext(ctx,
+		"SELECT GREATEST(COALESCE(MAX(seq), 0) - $1, 0) FROM message_events", cap(l.Broker.replay)).
+		Scan(&l.lastSeq)
+	if err != nil {
+		return err
+	}
+
+	listener := pq.NewListener(l.ConnString, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Event listener: %v", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(Channel); err != nil {
+		return err
+	}
+
+	// Events committed before LISTEN took effect were not announced to us
+	retry := l.catchUp(ctx, 0)
+
+	poll := time.NewTicker(listenerPollInterval)
+	defer poll.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-retry:
+			retry = l.catchUp(ctx, 0)
+
+		case notification := <-listener.Notify:
+			if notification == nil {
+				// Reconnected; anything announced meanwhile was lost
+				retry = l.catchUp(ctx, 0)
+				continue
+			}
+			seq, err := strconv.ParseInt(notification.Extra, 10, 64)
+			if err != nil {
+				log.Printf("Event listener: invalid notification %q", notification.Extra)
+				continue
+			}
+			if seq <= l.lastSeq {
+				continue
+			}
+			retry = l.catchUp(ctx, seq)
+
+		case <-poll.C:
+			if err := listener.Ping(); err != nil {
+				log.Printf("Event listener: %v", err)
+			}
+			retry = l.catchUp(ctx, 0)
+			l.prune(ctx)
+		}
+	}
+}
+
+// catchUp publishes the recorded events after the last one delivered, up to
+// and including upTo, or all of them if upTo is zero. If events are held back
+// by a gap, it returns a channel to call it again on. Errors are logged; the
+// next notification or poll tries again.
+func (l *Listener) catchUp(ctx context.Context, upTo int64) <-chan time.Time {
+	for {
+		more, waiting, err := l.publishBatch(ctx, upTo)
+		if err != nil {
+			log.Printf("Event listener: %v", err)
+			return nil
+		}
+		if waiting {
+			return time.After(gapRetryInterval)
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// publishBatch publishes up to catchUpBatchSize events after the last one
+// delivered. It reports whether there may be more to publish, and whether it
+// stopped at a gap that is not settled yet.
+func (l *Listener) publishBatch(ctx context.Context, upTo int64) (more, waiting bool, err error) {
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		return false, false, err
+	}
+	defer tx.Rollback()
+
+	batch, err := loadEvents(ctx, tx, l.lastSeq, upTo)
+	if err != nil {
+		return false, false, err
+	}
+	for _, event := range batch {
+		if event.ID > l.lastSeq+1 && !(l.gapSettled && event.ID <= l.gapEnd) {
+			settled, err := l.checkGap(ctx, tx, event.ID)
+			// Once settled, the events that filled the gap since the batch
+			// was loaded are loaded too
+			return settled, !settled, err
+		}
+		l.Broker.Publish(event)
+		l.lastSeq = event.ID
+		if l.lastSeq >= l.gapEnd {
+			l.gapEnd, l.gapHorizon, l.gapSettled = 0, 0, false
+		}
+	}
+	return len(batch) == catchUpBatchSize, false, nil
+}
+
+// checkGap reports whether the IDs missing below the committed event seq
+// will never appear, watching the gap from now on if it is a new one.
+func (l *Listener) checkGap(ctx context.Context, tx *sql.Tx, seq int64) (bool, error) {
+	if l.gapEnd == 0 || seq > l.gapEnd {
+		// The transactions holding the missing IDs had their transaction IDs
+		// before seq was assigned, so they are all below the horizon
+		err := tx.QueryRowContext(ctx, "SELECT pg_snapshot_xmax(pg_current_snapshot())::text::bigint").Scan(&l.gapHorizon)
+		if err != nil {
+			return false, err
+		}
+		l.gapEnd = seq
+	}
+	err := tx.QueryRowContext(ctx, "SELECT pg_snapshot_xmin(pg_current_snapshot())::text::bigint >= $1", l.gapHorizon).
+		Scan(&l.gapSettled)
+	return l.gapSettled, err
+}
+
+// loadEvents loads up to catchUpBatchSize events after the event after, up to
+// and including upTo unless it is zero.
+func loadEvents(ctx context.Context, tx *sql.Tx, after, upTo int64) ([]Event, error) {
+	rows, err := tx.QueryContext(ctx, `
+        SELECT seq, tenant_id, type, message, reaction, created_at
+        FROM message_events
+        WHERE seq > $1 AND ($2 = 0 OR seq <= $2)
+        ORDER BY seq ASC
+        LIMIT $3
+    `, after, upTo, catchUpBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []Event
+	for rows.Next() {
+		var event Event
+		var message, reaction []byte
+		if err := rows.Scan(&event.ID, &event.Tenant, &event.Type, &message, &reaction, &event.Time); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(message, &event.Message); err != nil {
+			return nil, err
+		}
+		if reaction != nil {
+			event.Reaction = new(Reaction)
+			if err := json.Unmarshal(reaction, event.Reaction); err != nil {
+				return nil, err
+			}
+		}
+		batch = append(batch, event)
+	}
+	return batch, rows.Err()
+}
+
+// prune deletes events older than the retention period.
+func (l *Listener) prune(ctx context.Context) {
+	if l.Retention <= 0 {
+		return
+	}
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		log.Printf("Event listener: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	cutoff := time.Now().Add(-l.Retention)
+	if _, err := tx.ExecContext(ctx, "DELETE FROM message_events WHERE created_at < $1", cutoff); err != nil {
+		log.Printf("Event listener: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Event listener: %v", err)
+	}
+}
@@ -0,0 +1,172 @@
+package events
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shawn1912/messages-service/database"
+)
+
+const testConnString = "user=postgres password=postgres dbname=messages_test sslmode=disable"
+
+func TestMain(m *testing.M) {
+	// Initialize the test database
+	database.InitDB(testConnString)
+	defer database.DB.Close()
+
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run tests
+	code := m.Run()
+
+	// Clean up the test database
+	database.DB.Exec("TRUNCATE TABLE message_events RESTART IDENTITY;")
+
+	os.Exit(code)
+}
+
+// recordTestEvent records a creation event for a message with the given ID.
+func recordTestEvent(t *testing.T, id int64, notify bool) int64 {
+	t.Helper()
+	tx, err := database.BeginTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	event := &Event{Type: MessageCreated, Tenant: "acme", Message: database.Message{ID: id, Content: "hi"}}
+	if notify {
+		err = Record(tx, event)
+	} else {
+		// As if the notification were lost
+		err = tx.QueryRow("INSERT INTO message_events (tenant_id, type, message) VALUES ('acme', $1, $2) RETURNING seq",
+			MessageCreated, `{"id": 0}`).Scan(&event.ID)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return event.ID
+}
+
+func receive(t *testing.T, sub *Subscription) Event {
+	t.Helper()
+	select {
+	case event := <-sub.Events():
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return Event{}
+	}
+}
+
+func TestListener(t *testing.T) {
+	database.DB.Exec("TRUNCATE TABLE message_events RESTART IDENTITY;")
+	before := recordTestEvent(t, 1, true)
+
+	broker := NewBroker(10, 10)
+	listener := &Listener{ConnString: testConnString, Broker: broker}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub, _, _ := broker.Subscribe(0, nil)
+	defer sub.Close()
+	go listener.Run(ctx)
+
+	// Recent events are loaded for replay at startup
+	if event := receive(t, sub); event.ID != before || event.Message.ID != 1 || event.Tenant != "acme" {
+		t.Errorf("Expected event %d for message 1, got %+v", before, event)
+	}
+
+	recorded := recordTestEvent(t, 2, true)
+	if event := receive(t, sub); event.ID != recorded || event.Message.Content != "hi" {
+		t.Errorf("Expected event %d, got %+v", recorded, event)
+	}
+
+	// A notification after a gap loads the events in between
+	missed := recordTestEvent(t, 3, false)
+	next := recordTestEvent(t, 4, true)
+	if event := receive(t, sub); event.ID != missed {
+		t.Errorf("Expected missed event %d first, got %d", missed, event.ID)
+	}
+	if event := receive(t, sub); event.ID != next {
+		t.Errorf("Expected event %d, got %d", next, event.ID)
+	}
+}
+
+func TestListener_OutOfOrderCommits(t *testing.T) {
+	database.DB.Exec("TRUNCATE TABLE message_events RESTART IDENTITY;")
+	broker := NewBroker(10, 10)
+	listener := &Listener{ConnString: testConnString, Broker: broker}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub, _, _ := broker.Subscribe(0, nil)
+	defer sub.Close()
+	go listener.Run(ctx)
+
+	// A slow writer takes the first ID, and a fast one commits the next
+	slow, err := database.BeginTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Rollback()
+	first := &Event{Type: MessageCreated, Tenant: "acme", Message: database.Message{ID: 1}}
+	if err := Record(slow, first); err != nil {
+		t.Fatal(err)
+	}
+	second := recordTestEvent(t, 2, true)
+
+	select {
+	case event := <-sub.Events():
+		t.Fatalf("Expected event %d to wait for the slow writer, got %d", second, event.ID)
+	case <-time.After(500 * time.Millisecond):
+	}
+	if err := slow.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if event := receive(t, sub); event.ID != first.ID {
+		t.Errorf("Expected event %d first, got %d", first.ID, event.ID)
+	}
+	if event := receive(t, sub); event.ID != second {
+		t.Errorf("Expected event %d, got %d", second, event.ID)
+	}
+
+	// A rolled back writer's ID is skipped
+	rolledBack, err := database.BeginTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Record(rolledBack, &Event{Type: MessageCreated, Tenant: "acme"}); err != nil {
+		t.Fatal(err)
+	}
+	third := recordTestEvent(t, 3, true)
+	rolledBack.Rollback()
+	if event := receive(t, sub); event.ID != third {
+		t.Errorf("Expected event %d after the rolled back one, got %d", third, event.ID)
+	}
+}
+
+func TestRecord_RolledBack(t *testing.T) {
+	tx, err := database.BeginTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &Event{Type: MessageDeleted, Tenant: "acme"}
+	if err := Record(tx, event); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	var count int
+	database.DB.QueryRow("SELECT COUNT(*) FROM message_events WHERE seq = $1", event.ID).Scan(&count)
+	if count != 0 {
+		t.Error("Expected the event to be rolled back with its transaction")
+	}
+}
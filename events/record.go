@@ -0,0 +1,42 @@
+package events
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+)
+
+// Channel is the Postgres notification channel recorded events are announced on.
+const Channel = "message_events"
+
+// Record stores event in the message_events table within tx, assigning its ID,
+// and announces it to every instance's Listener once tx commits. IDs are not
+// assigned in commit order: tx is given its transaction ID before the event's,
+// so that the Listener can tell when an ID missing below a committed one will
+// never appear.
+func Record(tx *sql.Tx, event *Event) error {
+	if _, err := tx.Exec("SELECT pg_current_xact_id()"); err != nil {
+		return err
+	}
+
+	message, err := json.Marshal(event.Message)
+	if err != nil {
+		return err
+	}
+	var reaction any // NULL unless there is a reaction
+	if event.Reaction != nil {
+		if reaction, err = json.Marshal(event.Reaction); err != nil {
+			return err
+		}
+	}
+	err = tx.QueryRow(
+		"INSERT INTO message_events (tenant_id, type, message, reaction) VALUES ($1, $2, $3, $4) RETURNING seq, created_at",
+		event.Tenant, event.Type, message, reaction).Scan(&event.ID, &event.Time)
+	if err != nil {
+		return err
+	}
+
+	// Notifications are only delivered if the transaction commits
+	_, err = tx.Exec("SELECT pg_notify($1, $2)", Channel, strconv.FormatInt(event.ID, 10))
+	return err
+}
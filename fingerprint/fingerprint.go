@@ -0,0 +1,133 @@
+// Package fingerprint identifies duplicate and near-duplicate message text.
+// Exact duplicates share a hash of their normalized text. Near duplicates
+// have similar MinHash signatures, which estimate how many of their
+// three-character shingles the texts share, and are found through the bands
+// of those signatures.
+package fingerprint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"strings"
+	"unicode"
+)
+
+// Size is the number of values in a MinHash signature.
+const Size = 32
+
+// Bands is the number of bands a signature is split into for lookups, each
+// of Size/Bands values. Texts sharing a band are candidate near duplicates:
+// with 8 bands of 4 values, texts that share 80% of their shingles almost
+// always do, and texts that share 30% rarely do.
+const Bands = 8
+
+// shingleSize is the number of characters in each shingle.
+const shingleSize = 3
+
+// Normalize returns text lowercased, without punctuation, and with its words
+// separated by single spaces, so that texts differing only in those respects
+// are exact duplicates.
+func Normalize(text string) string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsControl(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// Hash returns the hex SHA-256 of the normalized text, or an empty string if
+// nothing is left of text once normalized.
+func Hash(text string) string {
+	normalized := Normalize(text)
+	if normalized == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// MinHash returns the MinHash signature of the shingles of the normalized
+// text, or nil if nothing is left of text once normalized. Text shorter than
+// a shingle is a shingle of its own.
+func MinHash(text string) []uint32 {
+	runes := []rune(Normalize(text))
+	if len(runes) == 0 {
+		return nil
+	}
+
+	signature := make([]uint32, Size)
+	for i := range signature {
+		signature[i] = ^uint32(0)
+	}
+	add := func(shingle []rune) {
+		h := fnv.New64a()
+		h.Write([]byte(string(shingle)))
+		x := h.Sum64()
+		for i := range signature {
+			if v := uint32(mix(x ^ seeds[i])); v < signature[i] {
+				signature[i] = v
+			}
+		}
+	}
+	if len(runes) < shingleSize {
+		add(runes)
+	}
+	for i := 0; i+shingleSize <= len(runes); i++ {
+		add(runes[i : i+shingleSize])
+	}
+	return signature
+}
+
+// Similarity estimates the share of shingles two texts have in common from
+// their signatures, from 0 to 1.
+func Similarity(a, b []uint32) float64 {
+	if len(a) != Size || len(b) != Size {
+		return 0
+	}
+	same := 0
+	for i := range a {
+		if a[i] == b[i] {
+			same++
+		}
+	}
+	return float64(same) / Size
+}
+
+// BandKeys returns a key for each band of signature, tagged with the band's
+// position so that equal values in different bands do not match.
+func BandKeys(signature []uint32) []int64 {
+	if len(signature) != Size {
+		return nil
+	}
+	const rows = Size / Bands
+	keys := make([]int64, Bands)
+	for band := range keys {
+		h := fnv.New64a()
+		for _, v := range signature[band*rows : (band+1)*rows] {
+			h.Write([]byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)})
+		}
+		keys[band] = int64(uint64(band)<<56 | h.Sum64()&(1<<56-1))
+	}
+	return keys
+}
+
+// seeds derive the Size hash functions of signatures from one shingle hash.
+// They must never change, or stored signatures stop matching.
+var seeds = func() []uint64 {
+	seeds := make([]uint64, Size)
+	for i := range seeds {
+		seeds[i] = mix(uint64(i) + 1)
+	}
+	return seeds
+}()
+
+// mix is the splitmix64 finalizer, which makes every bit of its result depend
+// on every bit of x.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,65 @@
+package fingerprint
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	for text, want := range map[string]string{
+		"Hello, World!":          "hello world",
+		"  spaced\t\nout  text ": "spaced out text",
+		"It's über-cool":         "it s über cool",
+		"👍👍":                     "👍👍",
+		"?!...":                  "",
+	} {
+		if got := Normalize(text); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	if Hash("Hello, World!") != Hash("hello   world") {
+		t.Error("Expected texts differing in case, punctuation and spacing to have the same hash")
+	}
+	if Hash("Hello, World!") == Hash("Hello, Word!") {
+		t.Error("Expected different texts to have different hashes")
+	}
+	if Hash("...") != "" {
+		t.Error("Expected text without words to have no hash")
+	}
+}
+
+func TestMinHash(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		min, max float64
+	}{
+		{"Order 123 shipped to Berlin on Monday morning", "order 123 shipped to berlin, on monday morning!", 1, 1},
+		{"Order 123 shipped to Berlin on Monday morning", "Order 124 shipped to Berlin on Monday morning", 0.8, 1},
+		{"The deployment finished successfully on server 12", "The deployment finished successfully on server 13", 0.8, 1},
+		{"The deployment finished successfully on server 12", "Lunch is ready in the kitchen", 0, 0.3},
+	}
+	for _, tt := range tests {
+		a, b := MinHash(tt.a), MinHash(tt.b)
+		similarity := Similarity(a, b)
+		if similarity < tt.min || similarity > tt.max {
+			t.Errorf("Similarity(%q, %q) = %v, want between %v and %v", tt.a, tt.b, similarity, tt.min, tt.max)
+		}
+
+		// Near duplicates share a band, so that they can be found
+		shared := false
+		keysA, keysB := BandKeys(a), BandKeys(b)
+		for i := range keysA {
+			shared = shared || keysA[i] == keysB[i]
+		}
+		if shared != (tt.min >= 0.8) {
+			t.Errorf("Expected %q and %q to share a band: %v", tt.a, tt.b, !shared)
+		}
+	}
+
+	if MinHash("!!!") != nil {
+		t.Error("Expected text without words to have no signature")
+	}
+	if len(MinHash("ok")) != Size {
+		t.Error("Expected text shorter than a shingle to have a signature")
+	}
+}
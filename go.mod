@@ -5,3 +5,5 @@ go 1.23.2
 require github.com/lib/pq v1.10.9
 
 require github.com/gorilla/mux v1.8.1
+
+require golang.org/x/text v0.28.0
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/richtext"
+	"github.com/shawn1912/messages-service/utils"
+)
+
+// GetMessageAnagrams returns a paginated list of the messages that are anagrams
+// of the message with the given ID.
+func GetMessageAnagrams(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	page, limit, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	msg, ok := loadVisibleMessage(w, tx, principal, id)
+	if !ok {
+		return
+	}
+
+	writeAnagrams(w, tx, principal, utils.AnagramSignature(richtext.Text(msg.Format, msg.Content)), id, page, limit)
+}
+
+// FindAnagrams returns a paginated list of the messages that are anagrams of
+// the 'text' query parameter.
+func FindAnagrams(w http.ResponseWriter, r *http.Request) {
+	text := r.URL.Query().Get("text")
+	if text == "" {
+		http.Error(w, "Missing 'text' parameter", http.StatusBadRequest)
+		return
+	}
+
+	page, limit, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	writeAnagrams(w, tx, principal, utils.AnagramSignature(text), 0, page, limit)
+}
+
+// writeAnagrams writes the page of messages visible to principal with the
+// given anagram signature, leaving out the message with ID excludeID. Text
+// without any letters or numbers has no anagrams.
+func writeAnagrams(w http.ResponseWriter, tx *sql.Tx, principal auth.Principal, signature string, excludeID int64, page, limit int) {
+	if signature == "" {
+		writeMessagePage(w, []database.Message{}, page, limit, 0)
+		return
+	}
+
+	var where conditions
+	where.add("tenant_id = ?", principal.Tenant)
+	where.add("anagram_signature = ?", signature)
+	where.add("id <> ?", excludeID)
+	where.addVisibleTo(principal)
+
+	writeMessageList(w, tx, principal.Tenant, where, page, limit)
+}
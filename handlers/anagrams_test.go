@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/utils"
+)
+
+// insertAnagramTestMessages inserts a few messages and returns their IDs by content.
+func insertAnagramTestMessages(t *testing.T) map[string]int64 {
+	teardownTestDatabase()
+
+	ids := map[string]int64{}
+	for _, content := range []string{"Listen", "Silent", "Enlist!", "Hello World"} {
+		var id int64
+		err := testDB.QueryRow(
+			"INSERT INTO messages (content, is_palindrome, anagram_signature) VALUES ($1, $2, $3) RETURNING id",
+			content, utils.IsPalindrome(content), utils.AnagramSignature(content)).Scan(&id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[content] = id
+	}
+	return ids
+}
+
+// Tests GET /message/{id}/anagrams
+func TestGetMessageAnagrams(t *testing.T) {
+	ids := insertAnagramTestMessages(t)
+
+	req, err := http.NewRequest("GET", "/message/"+strconv.FormatInt(ids["Listen"], 10)+"/anagrams?limit=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/message/{id:[0-9]+}/anagrams", GetMessageAnagrams).Methods("GET")
+	database.DB = testDB
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, status)
+	}
+
+	var response messagePage
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	// "Silent" and "Enlist!" match, but not the message itself
+	if response.Pagination.TotalMessages != 2 {
+		t.Errorf("Expected TotalMessages 2, got %d", response.Pagination.TotalMessages)
+	}
+	if response.Pagination.TotalPages != 2 {
+		t.Errorf("Expected TotalPages 2, got %d", response.Pagination.TotalPages)
+	}
+	if len(response.Messages) != 1 || response.Messages[0].Content != "Silent" {
+		t.Errorf("Expected first page to contain 'Silent', got %+v", response.Messages)
+	}
+}
+
+// Tests GET /anagrams?text={}
+func TestFindAnagrams(t *testing.T) {
+	insertAnagramTestMessages(t)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/anagrams", FindAnagrams).Methods("GET")
+	database.DB = testDB
+
+	req, err := http.NewRequest("GET", "/anagrams?text=Tinsel", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, status)
+	}
+
+	var response messagePage
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Pagination.TotalMessages != 3 {
+		t.Errorf("Expected TotalMessages 3, got %d", response.Pagination.TotalMessages)
+	}
+
+	// The text parameter is required
+	req, err = http.NewRequest("GET", "/anagrams", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, status)
+	}
+}
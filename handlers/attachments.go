@@ -0,0 +1,499 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/blobs"
+	"github.com/shawn1912/messages-service/database"
+)
+
+// Blobs stores the content of attachments.
+var Blobs blobs.BlobStore
+
+// AttachmentMaxSize is the largest attachment accepted, in bytes.
+var AttachmentMaxSize int64 = 10 << 20
+
+// AttachmentTypes lists the media types attachments may have. The type is
+// sniffed from the content; what the client claims is ignored.
+var AttachmentTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "application/pdf", "text/plain"}
+
+// MaxAttachmentsPerMessage is the number of files a message may have.
+const MaxAttachmentsPerMessage = 10
+
+// multipartOverhead is what a request body may hold besides the file: part
+// headers, boundaries and other fields.
+const multipartOverhead = 64 << 10
+
+// sniffLen is the number of bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+var errAttachmentTooLarge = errors.New("attachment too large")
+
+const attachmentColumns = `id, message_id, filename, content_type, size, blob_key, uploaded_by, created_at`
+
+// UploadAttachment attaches the file in the 'file' field of a
+// multipart/form-data request to a message the caller can modify. The file
+// is streamed to the blob store rather than held in memory.
+func UploadAttachment(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		http.Error(w, "Content-Type must be multipart/form-data", http.StatusUnsupportedMediaType)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, AttachmentMaxSize+multipartOverhead)
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := loadModifiableMessage(w, tx, principal, id); !ok {
+		return
+	}
+	// Checked again once the file is stored, with the message locked
+	if !checkAttachmentCount(w, tx, principal.Tenant, id) {
+		return
+	}
+
+	part, ok := nextFilePart(w, multipart.NewReader(r.Body, params["boundary"]))
+	if !ok {
+		return
+	}
+	defer part.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		writeUploadError(w, err)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Attachment is empty", http.StatusBadRequest)
+		return
+	}
+	contentType := http.DetectContentType(head[:n])
+	if !allowedAttachmentType(contentType) {
+		http.Error(w, fmt.Sprintf("Attachments of type %s are not allowed", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	content := &sizeLimitedReader{r: io.MultiReader(bytes.NewReader(head[:n]), part), remaining: AttachmentMaxSize}
+	key, size, err := Blobs.Put(r.Context(), content)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	// Unless the attachment is saved, the blob is left for the sweeper to
+	// delete if nothing else refers to it
+	saved := false
+	defer func() {
+		if !saved {
+			queueBlob(key)
+		}
+	}()
+
+	// The sweeper does not delete blobs while they are being attached, but
+	// may have deleted this one between Put and here
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock_shared(hashtext('blob:' || $1))", key); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob, err := Blobs.Open(r.Context(), key)
+	if errors.Is(err, blobs.ErrNotFound) {
+		http.Error(w, "Attachment content was removed while uploading, try again", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	blob.Close()
+
+	// Concurrent uploads to the message wait for each other here, so that
+	// they cannot exceed the limit together
+	if _, err := tx.Exec("SELECT 1 FROM messages WHERE id = $1 AND tenant_id = $2 FOR UPDATE", id, principal.Tenant); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkAttachmentCount(w, tx, principal.Tenant, id) {
+		return
+	}
+
+	attachment := database.Attachment{
+		MessageID:   id,
+		Filename:    cleanFilename(part.FileName()),
+		ContentType: contentType,
+		Size:        size,
+		BlobKey:     key,
+		UploadedBy:  principal.Subject,
+	}
+	err = tx.QueryRow(`
+        INSERT INTO message_attachments (message_id, tenant_id, filename, content_type, size, blob_key, uploaded_by)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id, created_at
+    `, id, principal.Tenant, attachment.Filename, attachment.ContentType, attachment.Size, attachment.BlobKey,
+		attachment.UploadedBy).Scan(&attachment.ID, &attachment.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	saved = true
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// checkAttachmentCount checks that message id can have another attachment.
+// If not, it writes a 409 response and returns false.
+func checkAttachmentCount(w http.ResponseWriter, tx *sql.Tx, tenant string, id int64) bool {
+	var count int
+	err := tx.QueryRow("SELECT COUNT(*) FROM message_attachments WHERE message_id = $1 AND tenant_id = $2",
+		id, tenant).Scan(&count)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if count >= MaxAttachmentsPerMessage {
+		http.Error(w, fmt.Sprintf("Messages can have at most %d attachments", MaxAttachmentsPerMessage), http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// queueBlob queues the blob with key for the sweeper, logging failures: at
+// worst the blob is kept.
+func queueBlob(key string) {
+	_, err := database.DB.Exec(`
+        INSERT INTO blob_gc (blob_key) VALUES ($1)
+        ON CONFLICT (blob_key) DO UPDATE SET queued_at = NOW()
+    `, key)
+	if err != nil {
+		log.Printf("Queueing blob %s for deletion: %v", key, err)
+	}
+}
+
+// BlobSweeper deletes the blobs that no attachment refers to any more, a
+// batch at a time. Attachments queue their blob when they are deleted, and
+// so do uploads that are not saved. Every replica can run one: queued blobs
+// are claimed with row locks that the others skip.
+type BlobSweeper struct {
+	BatchSize    int
+	PollInterval time.Duration
+}
+
+// Run deletes unreferenced blobs until ctx is done.
+func (s *BlobSweeper) Run(ctx context.Context) {
+	poll := time.NewTicker(s.PollInterval)
+	defer poll.Stop()
+
+	for {
+		for {
+			n, err := s.RunOnce(ctx)
+			if err != nil {
+				log.Printf("Blob sweeper: %v", err)
+			}
+			// Keep going while there is a backlog
+			if err != nil || n < s.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// RunOnce claims up to BatchSize queued blobs, deleting those no attachment
+// refers to, and returns how many it claimed. Blobs being attached are left
+// queued for a later batch.
+func (s *BlobSweeper) RunOnce(ctx context.Context) (int, error) {
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+        SELECT blob_key FROM blob_gc
+        ORDER BY queued_at ASC
+        LIMIT $1
+        FOR UPDATE SKIP LOCKED
+    `, s.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		var locked, referenced bool
+		err := tx.QueryRowContext(ctx, "SELECT pg_try_advisory_xact_lock(hashtext('blob:' || $1))", key).Scan(&locked)
+		if err != nil {
+			return 0, err
+		}
+		if !locked {
+			continue
+		}
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM message_attachments WHERE blob_key = $1)", key).
+			Scan(&referenced)
+		if err != nil {
+			return 0, err
+		}
+		if !referenced {
+			if err := Blobs.Delete(ctx, key); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM blob_gc WHERE blob_key = $1", key); err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), tx.Commit()
+}
+
+// ListAttachments returns the attachments of a message the caller can read,
+// oldest first.
+func ListAttachments(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	msg, ok := loadVisibleMessage(w, tx, principal, id)
+	if !ok {
+		return
+	}
+	messages := []database.Message{msg}
+	if err := loadAttachments(tx, principal.Tenant, messages); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	attachments := messages[0].Attachments
+	if attachments == nil {
+		attachments = []database.Attachment{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachments)
+}
+
+// GetAttachment streams the content of an attachment of a message the caller
+// can read. Range and conditional requests are supported.
+func GetAttachment(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	attachmentID, ok := parseIDVar(w, r, "attachmentId")
+	if !ok {
+		return
+	}
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := loadVisibleMessage(w, tx, principal, id); !ok {
+		return
+	}
+	var attachment database.Attachment
+	err := tx.QueryRow(`SELECT `+attachmentColumns+` FROM message_attachments
+        WHERE id = $1 AND message_id = $2 AND tenant_id = $3`, attachmentID, id, principal.Tenant).Scan(
+		&attachment.ID, &attachment.MessageID, &attachment.Filename, &attachment.ContentType, &attachment.Size,
+		&attachment.BlobKey, &attachment.UploadedBy, &attachment.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The content is immutable, so there is no need to hold the transaction
+	// while it streams
+	tx.Rollback()
+
+	blob, err := Blobs.Open(r.Context(), attachment.BlobKey)
+	if errors.Is(err, blobs.ErrNotFound) {
+		http.Error(w, "Attachment content is missing", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(attachment.ContentType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	w.Header().Set("ETag", `"`+attachment.BlobKey+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", attachment.CreatedAt, blob)
+}
+
+// loadAttachments fills in the attachments of messages.
+func loadAttachments(tx *sql.Tx, tenant string, messages []database.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	rows, err := tx.Query(`SELECT `+attachmentColumns+` FROM message_attachments
+        WHERE tenant_id = $1 AND message_id = ANY($2) ORDER BY id`, tenant, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	byMessage := map[int64][]database.Attachment{}
+	for rows.Next() {
+		var a database.Attachment
+		err := rows.Scan(&a.ID, &a.MessageID, &a.Filename, &a.ContentType, &a.Size, &a.BlobKey, &a.UploadedBy, &a.CreatedAt)
+		if err != nil {
+			return err
+		}
+		byMessage[a.MessageID] = append(byMessage[a.MessageID], a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Attachments = byMessage[messages[i].ID]
+	}
+	return nil
+}
+
+// nextFilePart skips to the 'file' part of a multipart body. If there is
+// none, it writes a 400 response and returns false.
+func nextFilePart(w http.ResponseWriter, reader *multipart.Reader) (*multipart.Part, bool) {
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "'file' is required", http.StatusBadRequest)
+			return nil, false
+		}
+		if err != nil {
+			writeUploadError(w, err)
+			return nil, false
+		}
+		if part.FormName() == "file" {
+			return part, true
+		}
+		part.Close()
+	}
+}
+
+// writeUploadError writes the response for an upload that could not be read.
+func writeUploadError(w http.ResponseWriter, err error) {
+	var maxBytes *http.MaxBytesError
+	if errors.Is(err, errAttachmentTooLarge) || errors.As(err, &maxBytes) {
+		http.Error(w, fmt.Sprintf("Attachments can be at most %d bytes", AttachmentMaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+}
+
+// allowedAttachmentType reports whether contentType, ignoring parameters
+// such as charset, is one of the AttachmentTypes.
+func allowedAttachmentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range AttachmentTypes {
+		if strings.EqualFold(mediaType, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanFilename returns the base name of a client supplied filename without
+// control characters, at most 255 bytes long.
+func cleanFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name))
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	if name == "" || name == "." || name == "/" {
+		return "attachment"
+	}
+	return name
+}
+
+// sizeLimitedReader fails with errAttachmentTooLarge once more than
+// remaining bytes have been read.
+type sizeLimitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errAttachmentTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/blobs"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestAttachments(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+	store, err := blobs.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	Blobs = store
+	defer func() { Blobs = nil }()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/message/{id:[0-9]+}", GetMessage).Methods("GET")
+	router.HandleFunc("/message/{id:[0-9]+}/attachments", UploadAttachment).Methods("POST")
+	router.HandleFunc("/message/{id:[0-9]+}/attachments", ListAttachments).Methods("GET")
+	router.HandleFunc("/message/{id:[0-9]+}/attachments/{attachmentId:[0-9]+}", GetAttachment).Methods("GET")
+	send := newMessageRouter(t)
+
+	upload := func(id int64, subject, filename string, content []byte) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		form.WriteField("note", "ignored")
+		// The client's claimed type is ignored in favour of sniffing
+		part, _ := form.CreateFormFile("file", filename)
+		part.Write(content)
+		form.Close()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/message/%d/attachments", id), &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withPrincipal(req, subject, auth.ScopeRead, auth.ScopeWrite))
+		return rr
+	}
+	get := func(path, subject string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withPrincipal(req, subject, auth.ScopeRead))
+		return rr
+	}
+
+	var msg database.Message
+	json.Unmarshal(send("POST", "/message", "alice", map[string]any{"content": "See attached"}).Body.Bytes(), &msg)
+
+	content := []byte("Meeting notes: the quick brown fox jumps over the lazy dog.\n")
+	rr := upload(msg.ID, "alice", `C:\Users\alice\notes.exe`, content)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+	var attachment database.Attachment
+	json.Unmarshal(rr.Body.Bytes(), &attachment)
+	if attachment.Filename != "notes.exe" || attachment.ContentType != "text/plain; charset=utf-8" ||
+		attachment.Size != int64(len(content)) || len(attachment.BlobKey) != 64 {
+		t.Errorf("Unexpected attachment %+v", attachment)
+	}
+
+	// Only the owner can attach files, and only allowed types
+	if rr := upload(msg.ID, "bob", "notes.txt", content); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d for another user, got %d", http.StatusForbidden, rr.Code)
+	}
+	if rr := upload(msg.ID, "alice", "run.sh", []byte("\x7fELF\x02\x01\x01\x00binary")); rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status code %d for a disallowed type, got %d", http.StatusUnsupportedMediaType, rr.Code)
+	}
+	if rr := upload(msg.ID, "alice", "empty.txt", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an empty file, got %d", http.StatusBadRequest, rr.Code)
+	}
+	AttachmentMaxSize = 16
+	rr = upload(msg.ID, "alice", "notes.txt", content)
+	AttachmentMaxSize = 10 << 20
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status code %d for a large file, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+
+	json.Unmarshal(get(fmt.Sprintf("/message/%d", msg.ID), "bob", nil).Body.Bytes(), &msg)
+	if len(msg.Attachments) != 1 || msg.Attachments[0].ID != attachment.ID {
+		t.Errorf("Expected the message to list its attachment, got %+v", msg.Attachments)
+	}
+
+	path := fmt.Sprintf("/message/%d/attachments/%d", msg.ID, attachment.ID)
+	rr = get(path, "bob", nil)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), content) {
+		t.Fatalf("Expected the attachment content, got %d: %q", rr.Code, rr.Body)
+	}
+	if rr.Header().Get("X-Content-Type-Options") != "nosniff" ||
+		!strings.HasPrefix(rr.Header().Get("Content-Disposition"), "attachment;") {
+		t.Errorf("Unexpected headers %v", rr.Header())
+	}
+
+	rr = get(path, "bob", map[string]string{"Range": "bytes=8-12"})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "notes" {
+		t.Errorf("Expected %d with %q, got %d with %q", http.StatusPartialContent, "notes", rr.Code, rr.Body)
+	}
+	rr = get(path, "bob", map[string]string{"If-None-Match": rr.Header().Get("ETag")})
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("Expected status code %d for a matching ETag, got %d", http.StatusNotModified, rr.Code)
+	}
+	if rr := get(fmt.Sprintf("/message/%d/attachments/%d", msg.ID, attachment.ID+100), "bob", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for a missing attachment, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	// Attachments of private messages are as private as the message
+	var private database.Message
+	json.Unmarshal(send("POST", "/message", "alice", map[string]any{"content": "Secret", "isPrivate": true}).Body.Bytes(), &private)
+	upload(private.ID, "alice", "secret.txt", content)
+	if rr := get(fmt.Sprintf("/message/%d/attachments", private.ID), "bob", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for another user's private message, got %d", http.StatusNotFound, rr.Code)
+	}
+	var list []database.Attachment
+	json.Unmarshal(get(fmt.Sprintf("/message/%d/attachments", private.ID), "alice", nil).Body.Bytes(), &list)
+	if len(list) != 1 || list[0].BlobKey != attachment.BlobKey {
+		t.Errorf("Expected the same content to be stored once, got %+v", list)
+	}
+
+	// Blobs are deleted once no attachment refers to them
+	sweeper := &BlobSweeper{BatchSize: 10, PollInterval: time.Second}
+	blobExists := func() bool {
+		blob, err := store.Open(context.Background(), attachment.BlobKey)
+		if err == nil {
+			blob.Close()
+		}
+		return err == nil
+	}
+	send("DELETE", fmt.Sprintf("/message/%d", msg.ID), "alice", nil)
+	if n, err := sweeper.RunOnce(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Expected 1 blob to be swept, got %d (err %v)", n, err)
+	}
+	if !blobExists() {
+		t.Error("Expected the blob of the private message's attachment to be kept")
+	}
+	send("DELETE", fmt.Sprintf("/message/%d", private.ID), "alice", nil)
+	if n, err := sweeper.RunOnce(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Expected 1 blob to be swept, got %d (err %v)", n, err)
+	}
+	if blobExists() {
+		t.Error("Expected the unreferenced blob to be deleted")
+	}
+}
+
+func TestCleanFilename(t *testing.T) {
+	for name, want := range map[string]string{
+		"report.pdf":             "report.pdf",
+		"../../etc/passwd":       "passwd",
+		`C:\temp\photo.png`:      "photo.png",
+		"evil\r\nname.txt":       "evilname.txt",
+		"":                       "attachment",
+		"dir/":                   "dir",
+		strings.Repeat("é", 200): strings.Repeat("é", 127),
+	} {
+		if got := cleanFilename(name); got != want {
+			t.Errorf("cleanFilename(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/shawn1912/messages-service/audit"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/requestinfo"
+)
+
+// recordAudit appends an audit entry for a change to a message made in tx by
+// the caller of r. An empty beforeHash or afterHash means the message did not
+// exist before or after the change.
+func recordAudit(tx *sql.Tx, r *http.Request, principal auth.Principal, action string, messageID int64, beforeHash, afterHash string) error {
+	info := requestinfo.FromContext(r.Context())
+	return audit.Record(tx, &audit.Entry{
+		TenantID:   principal.Tenant,
+		Actor:      principal.Subject,
+		Action:     action,
+		MessageID:  messageID,
+		BeforeHash: beforeHash,
+		AfterHash:  afterHash,
+		RequestID:  info.ID,
+		IP:         info.ClientIP,
+	})
+}
+
+// ListAuditLog returns a paginated list of the audit entries of the caller's
+// tenant, newest first. Entries can be filtered by 'actor', 'action',
+// 'messageId' and an RFC 3339 'from'/'to' range.
+func ListAuditLog(w http.ResponseWriter, r *http.Request) {
+	page, limit, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	queryParams := r.URL.Query()
+	filter := audit.Filter{
+		Actor:  queryParams.Get("actor"),
+		Action: queryParams.Get("action"),
+	}
+
+	if idStr := queryParams.Get("messageId"); idStr != "" {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil || id <= 0 {
+			http.Error(w, "Invalid 'messageId' parameter. It must be a positive integer.", http.StatusBadRequest)
+			return
+		}
+		filter.MessageID = id
+	}
+
+	var err error
+	if filter.From, err = parseTimeParam(queryParams.Get("from")); err != nil {
+		http.Error(w, "Invalid 'from' parameter. It must be an RFC 3339 timestamp.", http.StatusBadRequest)
+		return
+	}
+	if filter.To, err = parseTimeParam(queryParams.Get("to")); err != nil {
+		http.Error(w, "Invalid 'to' parameter. It must be an RFC 3339 timestamp.", http.StatusBadRequest)
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	entries, total, err := audit.List(tx, principal.Tenant, filter, limit, (page-1)*limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Entries    []audit.Entry `json:"entries"`
+		Pagination struct {
+			CurrentPage  int `json:"currentPage"`
+			PageSize     int `json:"pageSize"`
+			TotalPages   int `json:"totalPages"`
+			TotalEntries int `json:"totalEntries"`
+		} `json:"pagination"`
+	}{Entries: entries}
+	response.Pagination.CurrentPage = page
+	response.Pagination.PageSize = limit
+	response.Pagination.TotalPages = (total + limit - 1) / limit
+	response.Pagination.TotalEntries = total
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/audit"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/requestinfo"
+)
+
+// Tests that message changes are recorded and listed by GET /audit
+func TestAuditLog(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+
+	router := mux.NewRouter()
+	router.Use(requestinfo.Middleware(nil))
+	router.HandleFunc("/message", CreateMessage).Methods("POST")
+	router.HandleFunc("/message/{id:[0-9]+}", DeleteMessage).Methods("DELETE")
+	router.HandleFunc("/audit", ListAuditLog).Methods("GET")
+
+	body, _ := json.Marshal(map[string]string{"content": "Racecar"})
+	req, _ := http.NewRequest("POST", "/message", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(requestinfo.Header, "create-request")
+	req.RemoteAddr = "203.0.113.7:1234"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, withPrincipal(req, "alice", auth.ScopeWrite))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d", http.StatusCreated, rr.Code)
+	}
+	var msg database.Message
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	id := strconv.FormatInt(msg.ID, 10)
+
+	req, _ = http.NewRequest("DELETE", "/message/"+id, nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, withPrincipal(req, "alice", auth.ScopeDelete))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d, got %d", http.StatusNoContent, rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/audit?messageId="+id, nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, withPrincipal(req, "admin", auth.ScopeAdmin))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var response struct {
+		Entries []audit.Entry `json:"entries"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(response.Entries))
+	}
+
+	// Newest first
+	deleted, created := response.Entries[0], response.Entries[1]
+	if deleted.Action != audit.ActionDelete || deleted.BeforeHash != audit.ContentHash("Racecar") || deleted.AfterHash != "" {
+		t.Errorf("Unexpected delete entry %+v", deleted)
+	}
+	if created.Action != audit.ActionCreate || created.AfterHash != audit.ContentHash("Racecar") || created.BeforeHash != "" {
+		t.Errorf("Unexpected create entry %+v", created)
+	}
+	if created.Actor != "alice" || created.RequestID != "create-request" || created.IP != "203.0.113.7" {
+		t.Errorf("Unexpected request details in %+v", created)
+	}
+	if deleted.PrevHash != created.Hash {
+		t.Error("Expected the delete entry to chain to the create entry")
+	}
+
+	// Filters are validated
+	req, _ = http.NewRequest("GET", "/audit?from=yesterday", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, withPrincipal(req, "admin", auth.ScopeAdmin))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid 'from', got %d", http.StatusBadRequest, rr.Code)
+	}
+}
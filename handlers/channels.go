@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/channels"
+	"github.com/shawn1912/messages-service/richtext"
+	"github.com/shawn1912/messages-service/utils"
+)
+
+// channelRequest is the body of requests creating or updating a channel.
+// Fields left out of an update keep their values.
+type channelRequest struct {
+	Name             *string `json:"name"`
+	IsPrivate        *bool   `json:"isPrivate"`
+	MaxContentLength *int    `json:"maxContentLength"`
+	PalindromesOnly  *bool   `json:"palindromesOnly"`
+}
+
+// apply copies the fields set in the request to c.
+func (req channelRequest) apply(c *channels.Channel) {
+	if req.Name != nil {
+		c.Name = *req.Name
+	}
+	if req.IsPrivate != nil {
+		c.IsPrivate = *req.IsPrivate
+	}
+	if req.MaxContentLength != nil {
+		c.MaxContentLength = *req.MaxContentLength
+	}
+	if req.PalindromesOnly != nil {
+		c.PalindromesOnly = *req.PalindromesOnly
+	}
+}
+
+// decodeChannelRequest reads a channel request body. On failure it writes a
+// 4xx response and returns false.
+func decodeChannelRequest(w http.ResponseWriter, r *http.Request) (channelRequest, bool) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return channelRequest{}, false
+	}
+	var req channelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return channelRequest{}, false
+	}
+	return req, true
+}
+
+// CreateChannel creates a channel in the caller's tenant. The caller becomes
+// its first member and may manage it.
+func CreateChannel(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeChannelRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Name == nil {
+		http.Error(w, "'name' is required", http.StatusBadRequest)
+		return
+	}
+	var channel channels.Channel
+	req.apply(&channel)
+	if err := channel.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	channel.CreatedBy = principal.Subject
+	if !saveChannel(w, channels.Create(tx, principal.Tenant, &channel)) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(channel)
+}
+
+// ListChannels returns the channels the caller can see: every public channel
+// and the private ones they are a member of. Admins see every channel.
+func ListChannels(w http.ResponseWriter, r *http.Request) {
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	list, err := channels.List(tx, principal.Tenant, principal.Subject, principal.IsAdmin())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Channels []channels.Channel `json:"channels"`
+	}{list})
+}
+
+// GetChannel returns a channel the caller can see.
+func GetChannel(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	channel, ok := loadChannel(w, tx, principal, id)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channel)
+}
+
+// UpdateChannel changes a channel's name or settings. Only the channel's
+// creator or an admin may change it.
+func UpdateChannel(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	req, ok := decodeChannelRequest(w, r)
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	channel, ok := loadManageableChannel(w, tx, principal, id)
+	if !ok {
+		return
+	}
+	req.apply(&channel)
+	if err := channel.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !saveChannel(w, channels.Update(tx, principal.Tenant, &channel)) {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channel)
+}
+
+// DeleteChannel deletes an empty channel. Only the channel's creator or an
+// admin may delete it.
+func DeleteChannel(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := loadManageableChannel(w, tx, principal, id); !ok {
+		return
+	}
+	hasMessages, err := channels.HasMessages(tx, principal.Tenant, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if hasMessages {
+		http.Error(w, "Channel still has messages", http.StatusConflict)
+		return
+	}
+
+	if _, err := channels.Delete(tx, principal.Tenant, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListChannelMembers returns the members of a channel the caller can see.
+func ListChannelMembers(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := loadChannel(w, tx, principal, id); !ok {
+		return
+	}
+	members, err := channels.ListMembers(tx, principal.Tenant, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Members []string `json:"members"`
+	}{members})
+}
+
+// AddChannelMember adds the subject in the 'member' route variable to a
+// channel. Only the channel's creator or an admin may add members.
+func AddChannelMember(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	member := mux.Vars(r)["member"]
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := loadManageableChannel(w, tx, principal, id); !ok {
+		return
+	}
+	if err := channels.AddMember(tx, principal.Tenant, id, member); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RemoveChannelMember removes the subject in the 'member' route variable from
+// a channel. The channel's creator and admins may remove anyone; members may
+// remove themselves.
+func RemoveChannelMember(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	member := mux.Vars(r)["member"]
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	if member == principal.Subject {
+		if _, ok := loadChannel(w, tx, principal, id); !ok {
+			return
+		}
+	} else if _, ok := loadManageableChannel(w, tx, principal, id); !ok {
+		return
+	}
+	removed, err := channels.RemoveMember(tx, principal.Tenant, id, member)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateChannelMessage posts a new message, owned by the caller, to a channel
+// they can see.
+func CreateChannelMessage(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	createMessage(w, r, 0, id)
+}
+
+// ListChannelMessages returns a paginated list of the messages in a channel
+// the caller can see, filtered by tags like ListMessages.
+func ListChannelMessages(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	page, limit, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := loadChannel(w, tx, principal, id); !ok {
+		return
+	}
+
+	var where conditions
+	where.add("tenant_id = ?", principal.Tenant)
+	where.add("channel_id = ?", id)
+	where.addVisibleTo(principal)
+	if !addTagFilter(w, r, &where) {
+		return
+	}
+
+	writeMessageList(w, tx, principal.Tenant, where, page, limit)
+}
+
+// loadChannel fetches the channel with the given ID if the caller can see it:
+// it is public, they are a member or they are an admin. Otherwise it writes a
+// 404, so that the existence of private channels is not revealed, and returns
+// false.
+func loadChannel(w http.ResponseWriter, tx *sql.Tx, principal auth.Principal, id int64) (channels.Channel, bool) {
+	channel, err := channels.Get(tx, principal.Tenant, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Channel not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return channels.Channel{}, false
+	}
+
+	if channel.IsPrivate && !principal.IsAdmin() {
+		member, err := channels.IsMember(tx, principal.Tenant, id, principal.Subject)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return channels.Channel{}, false
+		}
+		if !member {
+			http.Error(w, "Channel not found", http.StatusNotFound)
+			return channels.Channel{}, false
+		}
+	}
+	return channel, true
+}
+
+// loadManageableChannel fetches the channel with the given ID if the caller
+// may change it: they created it or are an admin. Otherwise it writes a 404
+// or 403 and returns false.
+func loadManageableChannel(w http.ResponseWriter, tx *sql.Tx, principal auth.Principal, id int64) (channels.Channel, bool) {
+	channel, ok := loadChannel(w, tx, principal, id)
+	if !ok {
+		return channels.Channel{}, false
+	}
+	if !principal.IsAdmin() && (channel.CreatedBy == "" || channel.CreatedBy != principal.Subject) {
+		http.Error(w, "Only the channel's creator can change it", http.StatusForbidden)
+		return channels.Channel{}, false
+	}
+	return channel, true
+}
+
+// saveChannel reports whether a channel was saved. If err is not nil it
+// writes a 409 for a duplicate name or a 500 otherwise, and returns false.
+func saveChannel(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+	if err == channels.ErrNameTaken {
+		http.Error(w, err.Error(), http.StatusConflict)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
+
+// checkChannelSettings verifies content in format may be posted to channel.
+// If not, it writes a 400 response and returns false.
+func checkChannelSettings(w http.ResponseWriter, channel channels.Channel, format, content string) bool {
+	if channel.MaxContentLength > 0 && utf8.RuneCountInString(content) > channel.MaxContentLength {
+		http.Error(w, fmt.Sprintf("Message content exceeds the channel's limit of %d characters", channel.MaxContentLength),
+			http.StatusBadRequest)
+		return false
+	}
+	if channel.PalindromesOnly && !utils.IsPalindrome(richtext.Text(format, content)) {
+		http.Error(w, "Channel only accepts palindromes", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/channels"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestChannels(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+
+	router := mux.NewRouter()
+	router.HandleFunc("/channels", CreateChannel).Methods("POST")
+	router.HandleFunc("/channels", ListChannels).Methods("GET")
+	router.HandleFunc("/channels/{id:[0-9]+}", GetChannel).Methods("GET")
+	router.HandleFunc("/channels/{id:[0-9]+}", UpdateChannel).Methods("PATCH")
+	router.HandleFunc("/channels/{id:[0-9]+}", DeleteChannel).Methods("DELETE")
+	router.HandleFunc("/channels/{id:[0-9]+}/members/{member}", AddChannelMember).Methods("PUT")
+	router.HandleFunc("/channels/{id:[0-9]+}/messages", CreateChannelMessage).Methods("POST")
+	router.HandleFunc("/channels/{id:[0-9]+}/messages", ListChannelMessages).Methods("GET")
+	router.HandleFunc("/message/{id:[0-9]+}", GetMessage).Methods("GET")
+	router.HandleFunc("/messages", ListMessages).Methods("GET")
+
+	send := newSender(t, router)
+
+	rr := send("POST", "/channels", "alice", map[string]any{"name": "mirrors", "isPrivate": true, "palindromesOnly": true})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+	var channel channels.Channel
+	json.Unmarshal(rr.Body.Bytes(), &channel)
+	path := fmt.Sprintf("/channels/%d", channel.ID)
+
+	if rr := send("POST", "/channels", "bob", map[string]any{"name": "mirrors"}); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d for a duplicate name, got %d", http.StatusConflict, rr.Code)
+	}
+	if rr := send("POST", "/channels", "bob", map[string]any{"name": "No Spaces"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid name, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// The channel only takes palindromes
+	if rr := send("POST", path+"/messages", "alice", map[string]any{"content": "Hello"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for a non-palindrome, got %d", http.StatusBadRequest, rr.Code)
+	}
+	rr = send("POST", path+"/messages", "alice", map[string]any{"content": "Racecar"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+	var msg database.Message
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	if msg.ChannelID == nil || *msg.ChannelID != channel.ID || !msg.ChannelPrivate {
+		t.Errorf("Expected the message in private channel %d, got %+v", channel.ID, msg)
+	}
+
+	// Non-members cannot see the private channel or its messages
+	if rr := send("GET", path, "bob", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for a non-member, got %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := send("GET", fmt.Sprintf("/message/%d", msg.ID), "bob", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for a message in a private channel, got %d", http.StatusNotFound, rr.Code)
+	}
+	var page messagePage
+	json.Unmarshal(send("GET", "/messages", "bob", nil).Body.Bytes(), &page)
+	if page.Pagination.TotalMessages != 0 {
+		t.Errorf("Expected no visible messages for a non-member, got %+v", page.Messages)
+	}
+	if rr := send("PUT", path+"/members/bob", "bob", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d adding oneself to a private channel, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	// Once added, Bob can read the channel but not manage it
+	if rr := send("PUT", path+"/members/bob", "alice", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("Expected status code %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	page = messagePage{}
+	json.Unmarshal(send("GET", path+"/messages", "bob", nil).Body.Bytes(), &page)
+	if page.Pagination.TotalMessages != 1 || page.Messages[0].ID != msg.ID {
+		t.Errorf("Expected the channel's message, got %+v", page.Messages)
+	}
+	if rr := send("PATCH", path, "bob", map[string]any{"isPrivate": false}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d updating someone else's channel, got %d", http.StatusForbidden, rr.Code)
+	}
+
+	// Channels with messages cannot be deleted
+	if rr := send("DELETE", path, "alice", nil); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d deleting a channel with messages, got %d", http.StatusConflict, rr.Code)
+	}
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/fingerprint"
+	"github.com/shawn1912/messages-service/richtext"
+)
+
+// Duplicate policies.
+const (
+	// DuplicatesOff creates duplicates like any other message.
+	DuplicatesOff = "off"
+	// DuplicatesFlag creates duplicates with 'duplicateOf' set to the
+	// message they repeat.
+	DuplicatesFlag = "flag"
+	// DuplicatesReject refuses duplicates with a 409.
+	DuplicatesReject = "reject"
+	// DuplicatesMerge responds to duplicates with the message they repeat,
+	// counting them in its 'duplicateCount' instead of creating them.
+	DuplicatesMerge = "merge"
+)
+
+// DuplicatePolicy is what happens to new messages that duplicate a message
+// their author can read, in the same channel and thread: one of
+// DuplicatesOff, DuplicatesFlag, DuplicatesReject or DuplicatesMerge.
+var DuplicatePolicy = DuplicatesOff
+
+// DuplicateSimilarity is the similarity from which messages are near
+// duplicates. At 1, only exact duplicates are.
+var DuplicateSimilarity = 0.8
+
+// SimilarMessage is a message along with how similar it is to another.
+type SimilarMessage struct {
+	database.Message
+	Similarity float64 `json:"similarity"`
+}
+
+// messageFingerprint holds the values stored to find duplicates of a message.
+type messageFingerprint struct {
+	hash      string
+	signature []int64
+	bands     []int64
+}
+
+// fingerprintOf returns the fingerprint of content in format, computed on the
+// text it displays.
+func fingerprintOf(format, content string) messageFingerprint {
+	text := richtext.Text(format, content)
+	signature := fingerprint.MinHash(text)
+	fp := messageFingerprint{hash: fingerprint.Hash(text), bands: fingerprint.BandKeys(signature)}
+	for _, v := range signature {
+		fp.signature = append(fp.signature, int64(v))
+	}
+	return fp
+}
+
+// similarity returns the SQL expression for the similarity of a message's
+// signature to the signature in the placeholder.
+func similarity(placeholder string) string {
+	return fmt.Sprintf(`(SELECT COUNT(*) FROM unnest(minhash, %s::bigint[]) AS s(a, b) WHERE a = b)::float8 / %d`,
+		placeholder, fingerprint.Size)
+}
+
+// addSimilarTo limits the conditions to messages with the same hash as fp or,
+// unless minSimilarity is 1, a signature at least that similar.
+func (c *conditions) addSimilarTo(fp messageFingerprint, minSimilarity float64) {
+	if minSimilarity >= 1 || fp.signature == nil {
+		c.add("content_hash = ?", fp.hash)
+		return
+	}
+	c.add("(content_hash = ? OR (minhash_bands && ? AND "+similarity("?")+" >= ?))",
+		fp.hash, pq.Array(fp.bands), pq.Array(fp.signature), minSimilarity)
+}
+
+// withExtra is a rowScanner reading columns selected after messageColumns
+// into extra.
+type withExtra struct {
+	row   rowScanner
+	extra []any
+}
+
+func (s withExtra) Scan(dest ...any) error {
+	return s.row.Scan(append(dest, s.extra...)...)
+}
+
+// querySimilar returns up to limit messages matching where, most similar to fp
+// first, with exact duplicates ahead of near ones and older messages ahead of
+// newer ones.
+func querySimilar(tx *sql.Tx, where conditions, fp messageFingerprint, limit int) ([]SimilarMessage, error) {
+	n := len(where.args)
+	query := fmt.Sprintf(`SELECT %s, COALESCE(content_hash = $%d, FALSE) AS exact, %s AS similarity FROM messages%s
+        ORDER BY exact DESC, similarity DESC, id ASC LIMIT $%d`,
+		messageColumns, n+1, similarity(fmt.Sprintf("$%d", n+2)), where.where(), n+3)
+	rows, err := tx.Query(query, append(where.args, fp.hash, pq.Array(fp.signature), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	similar := []SimilarMessage{}
+	for rows.Next() {
+		var msg SimilarMessage
+		var exact bool
+		if err := scanMessage(withExtra{rows, []any{&exact, &msg.Similarity}}, &msg.Message); err != nil {
+			return nil, err
+		}
+		if exact {
+			msg.Similarity = 1
+		}
+		msg.Similarity = math.Round(msg.Similarity*1000) / 1000
+		similar = append(similar, msg)
+	}
+	return similar, rows.Err()
+}
+
+// handleDuplicate applies the DuplicatePolicy to msg, a new message with
+// fingerprint fp. Under DuplicatesMerge it returns the message msg duplicates,
+// with its count incremented, for the caller to respond with instead. It
+// returns false if it wrote a response instead, rejecting msg.
+func handleDuplicate(w http.ResponseWriter, tx *sql.Tx, principal auth.Principal, msg *database.Message, fp messageFingerprint) (*database.Message, bool) {
+	if DuplicatePolicy == DuplicatesOff || fp.hash == "" {
+		return nil, true
+	}
+
+	// Identical messages sent at once wait for each other here, so that the
+	// later ones find the first
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('duplicate:' || $1 || ':' || $2))", principal.Tenant, fp.hash)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	var where conditions
+	where.add("tenant_id = ?", principal.Tenant)
+	where.addVisibleTo(principal)
+	where.add("deleted_at IS NULL")
+	where.add("channel_id IS NOT DISTINCT FROM ?", msg.ChannelID)
+	where.add("parent_id IS NOT DISTINCT FROM ?", msg.ParentID)
+	where.addSimilarTo(fp, DuplicateSimilarity)
+	similar, err := querySimilar(tx, where, fp, 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if len(similar) == 0 {
+		return nil, true
+	}
+	original := similar[0].Message
+
+	switch DuplicatePolicy {
+	case DuplicatesFlag:
+		msg.DuplicateOf = &original.ID
+		return nil, true
+
+	case DuplicatesReject:
+		w.Header().Set("Location", fmt.Sprintf("/message/%d", original.ID))
+		http.Error(w, fmt.Sprintf("Message duplicates message %d", original.ID), http.StatusConflict)
+		return nil, false
+	}
+
+	err = tx.QueryRow("UPDATE messages SET duplicate_count = duplicate_count + 1 WHERE id = $1 AND tenant_id = $2 RETURNING duplicate_count",
+		original.ID, principal.Tenant).Scan(&original.DuplicateCount)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	messages := []database.Message{original}
+	if err := loadDetails(tx, principal.Tenant, messages); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return &messages[0], true
+}
+
+// GetSimilarMessages returns the near duplicates of a message, most similar
+// first: up to 'limit' (default 10, at most 100) messages at least
+// 'minSimilarity' similar (default DuplicateSimilarity), from 0 to 1.
+func GetSimilarMessages(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	limit := 10
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "Invalid 'limit' parameter. It must be between 1 and 100.", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	minSimilarity := DuplicateSimilarity
+	if s := r.URL.Query().Get("minSimilarity"); s != "" {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f < 0 || f > 1 {
+			http.Error(w, "Invalid 'minSimilarity' parameter. It must be a number from 0 to 1.", http.StatusBadRequest)
+			return
+		}
+		minSimilarity = f
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	msg, ok := loadVisibleMessage(w, tx, principal, id)
+	if !ok {
+		return
+	}
+	similar := []SimilarMessage{}
+	if fp := fingerprintOf(msg.Format, msg.Content); fp.hash != "" && msg.DeletedAt == nil {
+		var where conditions
+		where.add("tenant_id = ?", principal.Tenant)
+		where.addVisibleTo(principal)
+		where.add("deleted_at IS NULL")
+		where.add("id <> ?", id)
+		where.addSimilarTo(fp, minSimilarity)
+		var err error
+		if similar, err = querySimilar(tx, where, fp, limit); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		messages := make([]database.Message, len(similar))
+		for i := range similar {
+			messages[i] = similar[i].Message
+		}
+		if err := loadDetails(tx, principal.Tenant, messages); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range similar {
+			similar[i].Message = messages[i]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(similar)
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestDuplicatePolicies(t *testing.T) {
+	defer func() { DuplicatePolicy, DuplicateSimilarity = DuplicatesOff, 0.8 }()
+	send := newMessageRouter(t)
+	create := func(subject string, payload map[string]any) *httptest.ResponseRecorder {
+		return send("POST", "/message", subject, payload)
+	}
+
+	tests := []struct {
+		policy  string
+		content string
+		code    int
+	}{
+		{DuplicatesOff, "Order 123 shipped to Berlin on Monday morning", http.StatusCreated},
+		{DuplicatesFlag, "order 123 shipped to berlin, on monday morning!", http.StatusCreated},
+		{DuplicatesFlag, "Order 124 shipped to Berlin on Monday morning", http.StatusCreated},
+		{DuplicatesReject, "Order 123 shipped to Berlin on Monday morning", http.StatusConflict},
+		{DuplicatesMerge, "Order 123 shipped to Berlin on Monday morning", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			teardownTestDatabase()
+			database.DB = testDB
+			DuplicatePolicy = DuplicatesOff
+			rr := create("alice", map[string]any{"content": "Order 123 shipped to Berlin on Monday morning"})
+			var original database.Message
+			json.Unmarshal(rr.Body.Bytes(), &original)
+			// Messages the author cannot read are not duplicated
+			create("bob", map[string]any{"content": tt.content, "isPrivate": true})
+
+			DuplicatePolicy = tt.policy
+			rr = create("alice", map[string]any{"content": tt.content})
+			if rr.Code != tt.code {
+				t.Fatalf("Expected status code %d, got %d: %s", tt.code, rr.Code, rr.Body)
+			}
+			var msg database.Message
+			json.Unmarshal(rr.Body.Bytes(), &msg)
+
+			location := fmt.Sprintf("/message/%d", original.ID)
+			switch tt.policy {
+			case DuplicatesOff:
+				if msg.DuplicateOf != nil {
+					t.Errorf("Expected no duplicate detection, got duplicateOf %d", *msg.DuplicateOf)
+				}
+			case DuplicatesFlag:
+				if msg.DuplicateOf == nil || *msg.DuplicateOf != original.ID {
+					t.Errorf("Expected the message to be flagged as a duplicate of %d, got %v", original.ID, msg.DuplicateOf)
+				}
+			case DuplicatesReject:
+				if rr.Header().Get("Location") != location {
+					t.Errorf("Expected Location %q, got %q", location, rr.Header().Get("Location"))
+				}
+			case DuplicatesMerge:
+				if msg.ID != original.ID || msg.DuplicateCount != 1 || rr.Header().Get("Location") != location {
+					t.Errorf("Expected the original message with a count of 1, got %+v", msg)
+				}
+				var count int
+				testDB.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count)
+				if count != 2 {
+					t.Errorf("Expected no message to be created, got %d messages", count)
+				}
+				var audited, announced int
+				testDB.QueryRow("SELECT COUNT(*) FROM audit_log WHERE action = 'message.merge' AND message_id = $1", original.ID).Scan(&audited)
+				testDB.QueryRow("SELECT COUNT(*) FROM message_events WHERE type = 'message.updated' AND (message->>'id')::int = $1 AND (message->>'duplicateCount')::int = 1", original.ID).Scan(&announced)
+				if audited != 1 || announced != 1 {
+					t.Errorf("Expected the merge to be audited and announced, got %d audit records and %d events", audited, announced)
+				}
+			}
+
+			// Replies are only compared with their siblings
+			if tt.policy != DuplicatesOff {
+				rr = send("POST", location+"/replies", "alice", map[string]any{"content": tt.content})
+				if rr.Code != http.StatusCreated {
+					t.Errorf("Expected status code %d for a reply, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+				}
+			}
+		})
+	}
+
+	t.Run("exact only", func(t *testing.T) {
+		teardownTestDatabase()
+		database.DB = testDB
+		DuplicatePolicy, DuplicateSimilarity = DuplicatesReject, 1
+		create("alice", map[string]any{"content": "Order 123 shipped to Berlin on Monday morning"})
+		if rr := create("alice", map[string]any{"content": "Order 124 shipped to Berlin on Monday morning"}); rr.Code != http.StatusCreated {
+			t.Errorf("Expected near duplicates to be created, got %d", rr.Code)
+		}
+		if rr := create("alice", map[string]any{"content": "ORDER 123 shipped to Berlin on Monday morning."}); rr.Code != http.StatusConflict {
+			t.Errorf("Expected exact duplicates to be rejected, got %d", rr.Code)
+		}
+	})
+}
+
+func TestGetSimilarMessages(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+	send := newMessageRouter(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/message/{id:[0-9]+}/similar", GetSimilarMessages).Methods("GET")
+	similar := func(path, subject string) (*httptest.ResponseRecorder, []SimilarMessage) {
+		req, _ := http.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, withPrincipal(req, subject, auth.ScopeRead))
+		var messages []SimilarMessage
+		json.Unmarshal(rr.Body.Bytes(), &messages)
+		return rr, messages
+	}
+
+	var ids []int64
+	for _, content := range []string{
+		"The deployment finished successfully on server 12",
+		"The deployment finished successfully on server 13",
+		"Lunch is ready in the kitchen",
+		"the deployment finished successfully, on server 12",
+	} {
+		var msg database.Message
+		json.Unmarshal(send("POST", "/message", "alice", map[string]any{"content": content}).Body.Bytes(), &msg)
+		ids = append(ids, msg.ID)
+	}
+	send("POST", "/message", "alice", map[string]any{"content": "The deployment finished successfully on server 12", "isPrivate": true})
+
+	rr, messages := similar(fmt.Sprintf("/message/%d/similar", ids[0]), "bob")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if len(messages) != 2 || messages[0].ID != ids[3] || messages[0].Similarity != 1 ||
+		messages[1].ID != ids[1] || messages[1].Similarity < 0.8 || messages[1].Similarity >= 1 {
+		t.Fatalf("Expected the exact then the near duplicate, got %+v", messages)
+	}
+
+	if _, messages := similar(fmt.Sprintf("/message/%d/similar", ids[0]), "alice"); len(messages) != 3 {
+		t.Errorf("Expected the owner to see their private duplicate, got %d messages", len(messages))
+	}
+	if _, messages := similar(fmt.Sprintf("/message/%d/similar?minSimilarity=1&limit=5", ids[0]), "bob"); len(messages) != 1 {
+		t.Errorf("Expected only the exact duplicate, got %d messages", len(messages))
+	}
+	if _, messages := similar(fmt.Sprintf("/message/%d/similar", ids[2]), "bob"); messages == nil || len(messages) != 0 {
+		t.Errorf("Expected no similar messages, got %+v", messages)
+	}
+	if rr, _ := similar(fmt.Sprintf("/message/%d/similar?minSimilarity=2", ids[0]), "bob"); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid similarity, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/shawn1912/messages-service/audit"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+	"github.com/shawn1912/messages-service/validation"
+)
+
+// MessageRetention is the maximum age of messages: older ones expire as if
+// their 'expiresAt' time had passed. 0 keeps messages until they are deleted.
+var MessageRetention time.Duration
+
+// ReaperActor is the audit log actor of the deletions of expired messages.
+const ReaperActor = "system:reaper"
+
+var (
+	reaperMetrics = expvar.NewMap("reaper")
+	reapedTotal   = new(expvar.Int)
+	reaperBatches = new(expvar.Int)
+	reaperErrors  = new(expvar.Int)
+	reaperSeconds = new(expvar.Float)
+)
+
+func init() {
+	reaperMetrics.Set("reaped_total", reapedTotal)
+	reaperMetrics.Set("batches_total", reaperBatches)
+	reaperMetrics.Set("errors_total", reaperErrors)
+	reaperMetrics.Set("last_batch_seconds", reaperSeconds)
+}
+
+// Reaper deletes expired messages, a batch at a time, as if their owners had
+// deleted them: replies are handled according to ThreadDeleteMode and every
+// deletion is audited and announced. Every replica can run one: expired
+// messages and their replies are claimed with row locks that the others skip,
+// so reapers never wait for each other.
+type Reaper struct {
+	BatchSize    int
+	PollInterval time.Duration
+}
+
+// Run deletes expired messages until ctx is done.
+func (rp *Reaper) Run(ctx context.Context) {
+	poll := time.NewTicker(rp.PollInterval)
+	defer poll.Stop()
+
+	for {
+		for {
+			n, err := rp.RunOnce(ctx)
+			if err != nil {
+				reaperErrors.Add(1)
+				log.Printf("Reaper: %v", err)
+			}
+			// Keep going while there is a backlog
+			if err != nil || n < rp.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// RunOnce deletes up to BatchSize expired messages, along with any replies
+// deleted with them, in a single transaction and returns how many expired
+// messages it claimed.
+func (rp *Reaper) RunOnce(ctx context.Context) (int, error) {
+	start := time.Now()
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+        SELECT id, tenant_id FROM messages
+        WHERE deleted_at IS NULL AND (expires_at <= NOW()
+            OR ($2::float8 > 0 AND publish_at IS NULL AND created_at <= NOW() - $2 * INTERVAL '1 second'))
+        ORDER BY id ASC
+        LIMIT $1
+        FOR UPDATE SKIP LOCKED
+    `, rp.BatchSize, MessageRetention.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	var ids []int64
+	var tenants []string
+	for rows.Next() {
+		var id int64
+		var tenant string
+		if err := rows.Scan(&id, &tenant); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		tenants = append(tenants, tenant)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var reaped int64
+	for i, id := range ids {
+		var msg database.Message
+		row := tx.QueryRowContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE id = $1`, id)
+		if err := scanMessage(row, &msg); err == sql.ErrNoRows {
+			continue // deleted along with an earlier message of the batch
+		} else if err != nil {
+			return 0, err
+		}
+
+		principal := auth.Principal{Subject: ReaperActor, Tenant: tenants[i]}
+		if claimed, err := claimReplies(ctx, tx, principal.Tenant, msg.ID); err != nil {
+			return 0, err
+		} else if !claimed {
+			continue // reaped in a later batch
+		}
+		deleted, err := deleteMessage(tx, principal, msg)
+		if err != nil {
+			return 0, err
+		}
+		for _, msg := range deleted {
+			err := audit.Record(tx, &audit.Entry{
+				TenantID:   principal.Tenant,
+				Actor:      ReaperActor,
+				Action:     audit.ActionDelete,
+				MessageID:  msg.ID,
+				BeforeHash: audit.ContentHash(msg.Content),
+			})
+			if err != nil {
+				return 0, err
+			}
+			if err := recordEvent(tx, events.MessageDeleted, principal, msg); err != nil {
+				return 0, err
+			}
+		}
+		reaped += int64(len(deleted))
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	reapedTotal.Add(reaped)
+	reaperBatches.Add(1)
+	reaperSeconds.Set(time.Since(start).Seconds())
+	return len(ids), nil
+}
+
+// claimReplies locks every reply under message id, which deleting it may
+// delete or update, reporting false if another transaction holds any of them.
+func claimReplies(ctx context.Context, tx *sql.Tx, tenant string, id int64) (bool, error) {
+	var replies, locked int
+	err := tx.QueryRowContext(ctx, `
+        WITH RECURSIVE subtree AS (
+            SELECT id FROM messages WHERE parent_id = $1 AND tenant_id = $2
+            UNION ALL
+            SELECT m.id FROM messages m JOIN subtree ON m.parent_id = subtree.id
+            WHERE m.tenant_id = $2
+        ), locked AS (
+            SELECT id FROM messages WHERE id IN (SELECT id FROM subtree)
+            FOR UPDATE SKIP LOCKED
+        )
+        SELECT (SELECT COUNT(*) FROM subtree), (SELECT COUNT(*) FROM locked)
+    `, id, tenant).Scan(&replies, &locked)
+	return replies == locked, err
+}
+
+// parseExpiry returns the expiry time requested with either 'expiresAt' or
+// 'ttlSeconds', counting the TTL from start, the time the message is
+// published. Expiry times must come after start. On invalid values it writes
+// a 400 response with the field error and returns false.
+func parseExpiry(w http.ResponseWriter, expiresAt *time.Time, ttlSeconds *int64, start time.Time) (*time.Time, bool) {
+	switch {
+	case expiresAt != nil && ttlSeconds != nil:
+		writeValidationErrors(w, validation.Errors{{Field: "ttlSeconds", Code: validation.CodeInvalid,
+			Message: "Use either 'expiresAt' or 'ttlSeconds', not both"}})
+		return nil, false
+	case ttlSeconds != nil:
+		if *ttlSeconds <= 0 || *ttlSeconds > math.MaxInt64/int64(time.Second) {
+			writeValidationErrors(w, validation.Errors{{Field: "ttlSeconds", Code: validation.CodeInvalid,
+				Message: "'ttlSeconds' must be a positive number of seconds"}})
+			return nil, false
+		}
+		expiry := start.Add(time.Duration(*ttlSeconds) * time.Second)
+		return &expiry, true
+	case expiresAt != nil:
+		if !expiresAt.After(start) {
+			writeValidationErrors(w, validation.Errors{{Field: "expiresAt", Code: validation.CodeInvalid,
+				Message: "'expiresAt' must be in the future, after 'publishAt' if the message is scheduled"}})
+			return nil, false
+		}
+		return expiresAt, true
+	}
+	return nil, true
+}
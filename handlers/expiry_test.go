@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestMessageExpiry(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+	send := newMessageRouter(t)
+
+	create := func(payload map[string]any) *database.Message {
+		rr := send("POST", "/message", "alice", payload)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+		}
+		var msg database.Message
+		json.Unmarshal(rr.Body.Bytes(), &msg)
+		return &msg
+	}
+
+	ephemeral := create(map[string]any{"content": "Gone soon", "ttlSeconds": 60})
+	if ephemeral.ExpiresAt == nil || time.Until(*ephemeral.ExpiresAt) > time.Minute {
+		t.Fatalf("Expected the message to expire within a minute, got %v", ephemeral.ExpiresAt)
+	}
+	lasting := create(map[string]any{"content": "Here to stay"})
+
+	for _, payload := range []map[string]any{
+		{"content": "x", "ttlSeconds": 0},
+		{"content": "x", "expiresAt": time.Now().Add(-time.Minute)},
+		{"content": "x", "ttlSeconds": 60, "expiresAt": time.Now().Add(time.Hour)},
+	} {
+		if rr := send("POST", "/message", "alice", payload); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status code %d for %v, got %d", http.StatusBadRequest, payload, rr.Code)
+		}
+	}
+
+	// Updates can set and remove the expiry
+	path := fmt.Sprintf("/message/%d", lasting.ID)
+	rr := send("PATCH", path, "alice", map[string]any{"expiresAt": time.Now().Add(time.Hour)})
+	json.Unmarshal(rr.Body.Bytes(), lasting)
+	if rr.Code != http.StatusOK || lasting.ExpiresAt == nil {
+		t.Fatalf("Expected an expiry to be set, got %d: %s", rr.Code, rr.Body)
+	}
+	rr = send("PATCH", path, "alice", map[string]any{"expiresAt": nil})
+	lasting.ExpiresAt = nil
+	json.Unmarshal(rr.Body.Bytes(), lasting)
+	if lasting.ExpiresAt != nil {
+		t.Errorf("Expected the expiry to be removed, got %v", lasting.ExpiresAt)
+	}
+
+	// Expired messages disappear straight away, before the reaper runs
+	testDB.Exec("UPDATE messages SET expires_at = NOW() - INTERVAL '1 second' WHERE id = $1", ephemeral.ID)
+	if rr := send("GET", fmt.Sprintf("/message/%d", ephemeral.ID), "alice", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for an expired message, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	reaper := &Reaper{BatchSize: 10, PollInterval: time.Second}
+	if n, err := reaper.RunOnce(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Expected 1 message to be reaped, got %d (err %v)", n, err)
+	}
+	var remaining int
+	testDB.QueryRow("SELECT COUNT(*) FROM messages").Scan(&remaining)
+	if remaining != 1 {
+		t.Errorf("Expected 1 message left, got %d", remaining)
+	}
+	var actor string
+	testDB.QueryRow("SELECT actor FROM audit_log WHERE action = 'message.delete' AND message_id = $1", ephemeral.ID).Scan(&actor)
+	if actor != ReaperActor {
+		t.Errorf("Expected the deletion to be audited as %q, got %q", ReaperActor, actor)
+	}
+
+	// The retention applies a maximum age to every message
+	MessageRetention = time.Hour
+	defer func() { MessageRetention = 0 }()
+	testDB.Exec("UPDATE messages SET created_at = created_at - INTERVAL '2 hours' WHERE id = $1", lasting.ID)
+	if rr := send("GET", path, "alice", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for a message past the retention, got %d", http.StatusNotFound, rr.Code)
+	}
+	if n, err := reaper.RunOnce(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Expected 1 message to be reaped, got %d (err %v)", n, err)
+	}
+}
+
+// Tests that the reaper skips, rather than waits for, expired messages whose
+// replies another transaction has locked
+func TestReaper_LockedReplies(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+	defer func(mode string) { ThreadDeleteMode = mode }(ThreadDeleteMode)
+	ThreadDeleteMode = DeleteCascade
+	send := newMessageRouter(t)
+	root, a, _, _ := createThread(t, send)
+	testDB.Exec("UPDATE messages SET expires_at = NOW() - INTERVAL '1 second' WHERE id = $1", root)
+
+	locker, err := testDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer locker.Rollback()
+	if _, err := locker.Exec("SELECT id FROM messages WHERE id = $1 FOR UPDATE", a); err != nil {
+		t.Fatal(err)
+	}
+
+	reaper := &Reaper{BatchSize: 10, PollInterval: time.Second}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := reaper.RunOnce(ctx); err != nil {
+		t.Fatalf("Expected the reaper not to wait for the locked reply, got %v", err)
+	}
+	var remaining int
+	testDB.QueryRow("SELECT COUNT(*) FROM messages").Scan(&remaining)
+	if remaining != 4 {
+		t.Fatalf("Expected the thread to be kept while a reply is locked, got %d messages", remaining)
+	}
+
+	locker.Rollback()
+	if _, err := reaper.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	testDB.QueryRow("SELECT COUNT(*) FROM messages").Scan(&remaining)
+	if remaining != 0 {
+		t.Errorf("Expected the thread to be reaped, got %d messages left", remaining)
+	}
+}
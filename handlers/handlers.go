@@ -7,57 +7,219 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/audit"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/channels"
 	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+	"github.com/shawn1912/messages-service/moderation"
+	"github.com/shawn1912/messages-service/richtext"
 	"github.com/shawn1912/messages-service/utils"
+	"github.com/shawn1912/messages-service/validation"
 )
 
-// CreateMessage creates a new message.
+// CreateMessage creates a new message owned by the authenticated caller. With
+// a future 'publishAt' time the message is scheduled: only its owner and
+// admins see it until a Scheduler publishes it. An 'expiresAt' time, or a
+// 'ttlSeconds' counted from publication, makes it expire. Invalid bodies get a
+// 400 listing their field errors as JSON; every other error is plain text.
 func CreateMessage(w http.ResponseWriter, r *http.Request) {
+	createMessage(w, r, 0, 0)
+}
+
+// createMessage creates a message owned by the authenticated caller, as a
+// reply to the message with ID parentID if it is not 0, in its channel, or
+// else in the channel with ID channelID if that is not 0.
+func createMessage(w http.ResponseWriter, r *http.Request, parentID, channelID int64) {
 	if r.Header.Get("Content-Type") != "application/json" {
 		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
 		return
 	}
 
-	var msg database.Message
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	err = json.Unmarshal(body, &msg)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Everything else about the message, from its owner to its thread, is
+	// decided by the server
+	var req struct {
+		Content    string     `json:"content"`
+		Format     string     `json:"format"`
+		IsPrivate  bool       `json:"isPrivate"`
+		PublishAt  *time.Time `json:"publishAt"`
+		ExpiresAt  *time.Time `json:"expiresAt"`
+		TTLSeconds *int64     `json:"ttlSeconds"`
+	}
+	errs, ok := decodeMessageBody(w, body, &req)
+	if !ok {
 		return
 	}
+	msg := database.Message{
+		Content:   req.Content,
+		Format:    req.Format,
+		IsPrivate: req.IsPrivate,
+		PublishAt: req.PublishAt,
+		ExpiresAt: req.ExpiresAt,
+	}
 
-	if len(msg.Content) > 1000 {
-		http.Error(w, "Message content exceeds 1000 characters", http.StatusBadRequest)
+	msg.Content, errs = checkContent(errs, msg.Content)
+	if msg.Format == "" {
+		msg.Format = richtext.Plain
+	}
+	if err := richtext.ValidateFormat(msg.Format); err != nil {
+		errs = append(errs, validation.FieldError{Field: "format", Code: validation.CodeInvalid, Message: err.Error()})
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+	// Messages due already are published straight away
+	start := time.Now()
+	if msg.PublishAt != nil && !msg.PublishAt.After(start) {
+		msg.PublishAt = nil
+	}
+	if msg.PublishAt != nil {
+		start = *msg.PublishAt
+	}
+	expiresAt, ok := parseExpiry(w, msg.ExpiresAt, req.TTLSeconds, start)
+	if !ok {
 		return
 	}
+	msg.ExpiresAt = expiresAt
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	// Threads and channels are decided by the route
+	var threadID *int64
+	if parentID != 0 {
+		parent, ok := loadVisibleMessage(w, tx, principal, parentID)
+		if !ok {
+			return
+		}
+		if parent.DeletedAt != nil {
+			http.Error(w, "Cannot reply to a deleted message", http.StatusConflict)
+			return
+		}
+		if parent.PublishAt != nil {
+			http.Error(w, "Cannot reply to a scheduled message", http.StatusConflict)
+			return
+		}
+		if moderation.Hidden(parent.ModerationState) {
+			http.Error(w, "Cannot reply to a message awaiting moderation", http.StatusConflict)
+			return
+		}
+		msg.ParentID = &parent.ID
+		threadID = &parent.ThreadID
+		msg.ChannelID = parent.ChannelID
+	} else if channelID != 0 {
+		msg.ChannelID = &channelID
+	}
+	if msg.ChannelID != nil {
+		channel, ok := loadChannel(w, tx, principal, *msg.ChannelID)
+		if !ok || !checkChannelSettings(w, channel, msg.Format, msg.Content) {
+			return
+		}
+		msg.ChannelPrivate = channel.IsPrivate
+	}
 
-	msg.IsPalindrome = utils.IsPalindrome(msg.Content)
+	quota, err := database.LoadTenantQuota(tx, principal.Tenant, DefaultQuota)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkContentQuota(w, quota, msg.Content) || !checkMessageQuota(w, tx, principal.Tenant, quota) {
+		return
+	}
+	verdict, ok := moderateContent(w, r, msg.Format, msg.Content)
+	if !ok {
+		return
+	}
+	msg.ModerationState, msg.ModerationReason = verdict.Action.State(), verdict.Reason
+
+	// The owner always comes from the credentials
+	msg.OwnerID = principal.Subject
+	fp := fingerprintOf(msg.Format, msg.Content)
+	merged, ok := handleDuplicate(w, tx, principal, &msg, fp)
+	if !ok {
+		return
+	}
+	if merged != nil {
+		hash := audit.ContentHash(merged.Content)
+		if err := recordAudit(tx, r, principal, audit.ActionMerge, merged.ID, hash, hash); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := recordEvent(tx, events.MessageUpdated, principal, *merged); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprintf("/message/%d", merged.ID))
+		json.NewEncoder(w).Encode(merged)
+		return
+	}
+	// Markup is not analysed, only the text it displays
+	text := richtext.Text(msg.Format, msg.Content)
+	msg.IsPalindrome = utils.IsPalindrome(text)
+	msg.ContentHTML = richtext.HTML(msg.Format, msg.Content)
 
 	query := `
-        INSERT INTO messages (content, is_palindrome)
-        VALUES ($1, $2)
-        RETURNING id, created_at, updated_at
+        INSERT INTO messages (content, format, is_palindrome, palindrome_version, anagram_signature, owner_id,
+            is_private, tenant_id, parent_id, thread_id, channel_id, publish_at, expires_at, moderation_state,
+            moderation_reason, content_hash, minhash, minhash_bands, duplicate_of)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
+        RETURNING id, COALESCE(thread_id, id), created_at, updated_at
     `
 
-	err = database.DB.QueryRow(query, msg.Content, msg.IsPalindrome).
-		Scan(&msg.ID, &msg.CreatedAt, &msg.UpdatedAt)
+	err = tx.QueryRow(query, msg.Content, msg.Format, msg.IsPalindrome, utils.PalindromeVersion,
+		utils.AnagramSignature(text), nullIfEmpty(msg.OwnerID), msg.IsPrivate, principal.Tenant,
+		msg.ParentID, threadID, msg.ChannelID, msg.PublishAt, msg.ExpiresAt, msg.ModerationState,
+		nullIfEmpty(msg.ModerationReason), fp.hash, pq.Array(fp.signature), pq.Array(fp.bands), msg.DuplicateOf).
+		Scan(&msg.ID, &msg.ThreadID, &msg.CreatedAt, &msg.UpdatedAt)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err = setAutomaticTags(tx, principal.Tenant, &msg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = recordAudit(tx, r, principal, audit.ActionCreate, msg.ID, "", audit.ContentHash(msg.Content))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err = recordEvent(tx, events.MessageCreated, principal, msg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(msg)
 }
 
-// GetMessage retrieves a message by its ID.
+// GetMessage retrieves a message by its ID. Other users' private messages are
+// reported as not found.
 func GetMessage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -67,30 +229,31 @@ func GetMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var msg database.Message
-
-	query := `
-        SELECT id, content, is_palindrome, created_at, updated_at 
-		FROM messages 
-		WHERE id = $1
-    `
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
 
-	err = database.DB.QueryRow(query, id).
-		Scan(&msg.ID, &msg.Content, &msg.IsPalindrome, &msg.CreatedAt, &msg.UpdatedAt)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Message not found", http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	msg, ok := loadVisibleMessage(w, tx, principal, id)
+	if !ok {
+		return
+	}
+	messages := []database.Message{msg}
+	if err := loadDetails(tx, principal.Tenant, messages); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(msg)
+	json.NewEncoder(w).Encode(messages[0])
 }
 
-// UpdateMessage updates an existing message by its ID.
+// UpdateMessage updates an existing message by its ID. Only the message's
+// owner or an admin may update it, unless it is quarantined or rejected. Its
+// expiry can be changed with 'expiresAt' or 'ttlSeconds', or removed with a
+// null 'expiresAt'. New content is moderated again. Like CreateMessage, it
+// reports invalid bodies as JSON field errors and other errors as plain text.
 func UpdateMessage(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("Content-Type") != "application/json" {
 		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
@@ -105,60 +268,165 @@ func UpdateMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
 	// Retrieve existing message from the database
-	var existingMsg database.Message
-	err = database.DB.QueryRow("SELECT id, content, is_palindrome, created_at, updated_at FROM messages WHERE id = $1", id).
-		Scan(&existingMsg.ID, &existingMsg.Content, &existingMsg.IsPalindrome, &existingMsg.CreatedAt, &existingMsg.UpdatedAt)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Message not found", http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
+	existingMsg, ok := loadModifiableMessage(w, tx, principal, id)
+	if !ok {
+		return
+	}
+	if existingMsg.ModerationState == moderation.Quarantined || existingMsg.ModerationState == moderation.Rejected {
+		http.Error(w, "Message is "+existingMsg.ModerationState+" and cannot be changed", http.StatusConflict)
 		return
 	}
 
 	// Read and parse the request body
 	var msgUpdates struct {
-		Content *string `json:"content"`
+		Content    *string         `json:"content"`
+		Format     *string         `json:"format"`
+		IsPrivate  *bool           `json:"isPrivate"`
+		ExpiresAt  json.RawMessage `json:"expiresAt"` // null removes the expiry
+		TTLSeconds *int64          `json:"ttlSeconds"`
 	}
-	err = json.NewDecoder(r.Body).Decode(&msgUpdates)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	errs, ok := decodeMessageBody(w, body, &msgUpdates)
+	if !ok {
+		return
+	}
+	if msgUpdates.Content != nil {
+		*msgUpdates.Content, errs = checkContent(errs, *msgUpdates.Content)
+	}
+	if msgUpdates.Format != nil {
+		if err := richtext.ValidateFormat(*msgUpdates.Format); err != nil {
+			errs = append(errs, validation.FieldError{Field: "format", Code: validation.CodeInvalid, Message: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	before := existingMsg
+	beforeHash := audit.ContentHash(existingMsg.Content)
 
 	// Update fields if they are provided
+	if msgUpdates.Format != nil {
+		existingMsg.Format = *msgUpdates.Format
+	}
 	if msgUpdates.Content != nil {
-		if len(*msgUpdates.Content) > 1000 {
-			http.Error(w, "Message content exceeds 1000 characters", http.StatusBadRequest)
+		quota, err := database.LoadTenantQuota(tx, principal.Tenant, DefaultQuota)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if !checkContentQuota(w, quota, *msgUpdates.Content) {
+			return
+		}
+
 		existingMsg.Content = *msgUpdates.Content
-		existingMsg.IsPalindrome = utils.IsPalindrome(existingMsg.Content)
 	}
+	if (msgUpdates.Content != nil || msgUpdates.Format != nil) && existingMsg.ChannelID != nil {
+		channel, ok := loadChannel(w, tx, principal, *existingMsg.ChannelID)
+		if !ok || !checkChannelSettings(w, channel, existingMsg.Format, existingMsg.Content) {
+			return
+		}
+	}
+	if msgUpdates.Content != nil || msgUpdates.Format != nil {
+		verdict, ok := moderateContent(w, r, existingMsg.Format, existingMsg.Content)
+		if !ok {
+			return
+		}
+		existingMsg.ModerationState, existingMsg.ModerationReason = verdict.Action.State(), verdict.Reason
+	}
+	if msgUpdates.IsPrivate != nil {
+		existingMsg.IsPrivate = *msgUpdates.IsPrivate
+	}
+	if msgUpdates.ExpiresAt != nil || msgUpdates.TTLSeconds != nil {
+		var expiresAt *time.Time
+		if msgUpdates.ExpiresAt != nil {
+			if err := json.Unmarshal(msgUpdates.ExpiresAt, &expiresAt); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		start := time.Now()
+		if existingMsg.PublishAt != nil {
+			start = *existingMsg.PublishAt
+		}
+		existingMsg.ExpiresAt = nil
+		if expiresAt != nil || msgUpdates.TTLSeconds != nil {
+			if existingMsg.ExpiresAt, ok = parseExpiry(w, expiresAt, msgUpdates.TTLSeconds, start); !ok {
+				return
+			}
+		}
+	}
+
+	// Always recompute so the stored result matches the current rules version
+	text := richtext.Text(existingMsg.Format, existingMsg.Content)
+	existingMsg.IsPalindrome = utils.IsPalindrome(text)
+	existingMsg.ContentHTML = richtext.HTML(existingMsg.Format, existingMsg.Content)
+	fp := fingerprintOf(existingMsg.Format, existingMsg.Content)
 
 	// Update the message in the database
 	query := `
         UPDATE messages
-        SET content = $1, is_palindrome = $2, updated_at = NOW()
-        WHERE id = $3
+        SET content = $1, format = $2, is_palindrome = $3, palindrome_version = $4, anagram_signature = $5,
+            is_private = $6, expires_at = $7, moderation_state = $8, moderation_reason = $9, content_hash = $12,
+            minhash = $13, minhash_bands = $14, updated_at = NOW()
+        WHERE id = $10 AND tenant_id = $11
         RETURNING created_at, updated_at
     `
 
-	err = database.DB.QueryRow(query, existingMsg.Content, existingMsg.IsPalindrome, id).
+	err = tx.QueryRow(query, existingMsg.Content, existingMsg.Format, existingMsg.IsPalindrome, utils.PalindromeVersion,
+		utils.AnagramSignature(text), existingMsg.IsPrivate, existingMsg.ExpiresAt, existingMsg.ModerationState,
+		nullIfEmpty(existingMsg.ModerationReason), id, principal.Tenant, fp.hash, pq.Array(fp.signature), pq.Array(fp.bands)).
 		Scan(&existingMsg.CreatedAt, &existingMsg.UpdatedAt)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if err = setAutomaticTags(tx, principal.Tenant, &existingMsg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = recordAudit(tx, r, principal, audit.ActionUpdate, id, beforeHash, audit.ContentHash(existingMsg.Content))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Edits that change whether readers see the message are announced as if
+	// it were created or deleted
+	announced, err := recordModerationEvent(tx, principal, before, existingMsg)
+	if err == nil && !announced {
+		err = recordEvent(tx, events.MessageUpdated, principal, existingMsg)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	// Respond with the updated message
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(existingMsg)
 }
 
-// DeleteMessage deletes a message by its ID.
+// DeleteMessage deletes a message by its ID. Only the message's owner or an
+// admin may delete it. Its replies are orphaned, kept under a tombstone or
+// deleted too, depending on ThreadDeleteMode.
 func DeleteMessage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
@@ -168,20 +436,37 @@ func DeleteMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := database.DB.Exec("DELETE FROM messages WHERE id = $1", id)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	existingMsg, ok := loadModifiableMessage(w, tx, principal, id)
+	if !ok {
 		return
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	// What happens to the replies depends on ThreadDeleteMode
+	deleted, err := deleteMessage(tx, principal, existingMsg)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if rowsAffected == 0 {
-		http.Error(w, "Message not found", http.StatusNotFound)
+	for _, msg := range deleted {
+		err = recordAudit(tx, r, principal, audit.ActionDelete, msg.ID, audit.ContentHash(msg.Content), "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err = recordEvent(tx, events.MessageDeleted, principal, msg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
@@ -189,108 +474,127 @@ func DeleteMessage(w http.ResponseWriter, r *http.Request) {
 }
 
 // ListMessages returns a paginated list of messages, up to a maximum of 100 per page.
+// Private messages are only listed for their owner. The 'owner' parameter
+// filters by owner; 'owner=me' lists the caller's own messages. Repeated 'tag'
+// parameters filter by tags, as described by addTagFilter.
 func ListMessages(w http.ResponseWriter, r *http.Request) {
-	// Set default values
-	const maxLimit = 100
-	defaultLimit := 10
-	defaultPage := 1
-
-	// Parse query parameters
-	queryParams := r.URL.Query()
-	limitStr := queryParams.Get("limit")
-	pageStr := queryParams.Get("page")
-
-	// Convert limit to integer
-	limit := defaultLimit
-	if limitStr != "" {
-		parsedLimit, err := strconv.Atoi(limitStr)
-		if err != nil || parsedLimit <= 0 {
-			http.Error(w, "Invalid 'limit' parameter. It must be a positive integer.", http.StatusBadRequest)
-			return
-		}
-		if parsedLimit > maxLimit {
-			http.Error(w, fmt.Sprintf("'limit' parameter cannot exceed %d", maxLimit), http.StatusBadRequest)
-			return
-		}
-		limit = parsedLimit
+	page, limit, ok := parsePagination(w, r)
+	if !ok {
+		return
 	}
 
-	// Convert page to integer
-	page := defaultPage
-	if pageStr != "" {
-		parsedPage, err := strconv.Atoi(pageStr)
-		if err != nil || parsedPage <= 0 {
-			http.Error(w, "Invalid 'page' parameter. It must be a positive integer.", http.StatusBadRequest)
-			return
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	var where conditions
+	where.add("tenant_id = ?", principal.Tenant)
+	where.addVisibleTo(principal)
+	if owner := r.URL.Query().Get("owner"); owner != "" {
+		if owner == "me" {
+			owner = principal.Subject
 		}
-		page = parsedPage
+		where.add("owner_id = ?", owner)
+	}
+	if !addTagFilter(w, r, &where) {
+		return
 	}
 
-	// Calculate offset
-	offset := (page - 1) * limit
+	writeMessageList(w, tx, principal.Tenant, where, page, limit)
+}
 
+// writeMessageList writes the page of messages matching where, in ID order,
+// along with the total number of matching messages.
+func writeMessageList(w http.ResponseWriter, tx *sql.Tx, tenant string, where conditions, page, limit int) {
 	// Prepare SQL query with LIMIT and OFFSET
-	query := `
-        SELECT id, content, is_palindrome, created_at, updated_at
-        FROM messages
-        ORDER BY id ASC
-        LIMIT $1 OFFSET $2
-    `
+	limitClause, args := where.page(limit, (page-1)*limit)
+	query := `SELECT ` + messageColumns + ` FROM messages` + where.where() + ` ORDER BY id ASC` + limitClause
 
 	// Execute the query
-	rows, err := database.DB.Query(query, limit, offset)
+	rows, err := tx.Query(query, args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
-
-	// Fetch messages
-	messages := []database.Message{}
-	for rows.Next() {
-		var msg database.Message
-		err := rows.Scan(&msg.ID, &msg.Content, &msg.IsPalindrome, &msg.CreatedAt, &msg.UpdatedAt)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		messages = append(messages, msg)
+	messages, err := scanMessages(rows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
-
-	if err = rows.Err(); err != nil {
+	if err := loadDetails(tx, tenant, messages); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	// Count total messages.
 	var totalMessages int
-	err = database.DB.QueryRow("SELECT COUNT(*) FROM messages").Scan(&totalMessages)
+	err = tx.QueryRow("SELECT COUNT(*) FROM messages"+where.where(), where.args...).Scan(&totalMessages)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Calculate total pages.
-	totalPages := (totalMessages + limit - 1) / limit // Integer division rounding up
+	writeMessagePage(w, messages, page, limit, totalMessages)
+}
+
+// loadVisibleMessage fetches the message with the given ID in the caller's
+// tenant if the caller may read it, including being a member of its channel
+// if that is private, and it has not expired. Otherwise it writes a 404, so
+// that the existence of other users' private messages is not revealed, and
+// returns false.
+func loadVisibleMessage(w http.ResponseWriter, tx *sql.Tx, principal auth.Principal, id int64) (database.Message, bool) {
+	var where conditions
+	where.add("id = ?", id)
+	where.add("tenant_id = ?", principal.Tenant)
+	where.addUnexpired()
+
+	var msg database.Message
+	row := tx.QueryRow(`SELECT `+messageColumns+` FROM messages`+where.where(), where.args...)
+	if err := scanMessage(row, &msg); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Message not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return database.Message{}, false
+	}
 
-	response := struct {
-		Messages   []database.Message `json:"messages"`
-		Pagination struct {
-			CurrentPage   int `json:"currentPage"`
-			PageSize      int `json:"pageSize"`
-			TotalPages    int `json:"totalPages"`
-			TotalMessages int `json:"totalMessages"`
-		} `json:"pagination"`
-	}{
-		Messages: messages,
+	if !canRead(principal, msg) {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return database.Message{}, false
+	}
+	if msg.ChannelPrivate && !principal.IsAdmin() {
+		member, err := channels.IsMember(tx, principal.Tenant, *msg.ChannelID, principal.Subject)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return database.Message{}, false
+		}
+		if !member {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return database.Message{}, false
+		}
 	}
+	return msg, true
+}
 
-	response.Pagination.CurrentPage = page
-	response.Pagination.PageSize = limit
-	response.Pagination.TotalPages = totalPages
-	response.Pagination.TotalMessages = totalMessages
+// loadModifiableMessage fetches the message with the given ID if the caller
+// may change it. Messages the caller cannot read are reported as not found;
+// public messages owned by someone else get a 403 and tombstones a 410.
+func loadModifiableMessage(w http.ResponseWriter, tx *sql.Tx, principal auth.Principal, id int64) (database.Message, bool) {
+	msg, ok := loadVisibleMessage(w, tx, principal, id)
+	if !ok {
+		return database.Message{}, false
+	}
 
-	// Set headers and write the response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	if !canModify(principal, msg) {
+		http.Error(w, "Only the message's owner can change it", http.StatusForbidden)
+		return database.Message{}, false
+	}
+	if msg.DeletedAt != nil {
+		http.Error(w, "Message has been deleted", http.StatusGone)
+		return database.Message{}, false
+	}
+	return msg, true
 }
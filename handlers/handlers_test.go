@@ -14,6 +14,7 @@ import (
 
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
+	"github.com/shawn1912/messages-service/auth"
 	"github.com/shawn1912/messages-service/database"
 )
 
@@ -35,6 +36,12 @@ func TestMain(m *testing.M) {
 		log.Fatalf("Error pinging test database: %v", err)
 	}
 
+	// Bring the test database schema up to date
+	database.DB = testDB
+	if err = database.Migrate(); err != nil {
+		log.Fatalf("Error migrating test database: %v", err)
+	}
+
 	// Run the tests
 	code := m.Run()
 
@@ -45,7 +52,58 @@ func TestMain(m *testing.M) {
 }
 
 func teardownTestDatabase() {
-	testDB.Exec("TRUNCATE TABLE messages RESTART IDENTITY CASCADE;")
+	// The audit log can only be emptied with the trigger forbidding it disabled
+	testDB.Exec("ALTER TABLE audit_log DISABLE TRIGGER audit_log_no_truncate")
+	testDB.Exec("TRUNCATE TABLE messages, channels, tags, audit_log, message_events, outbox, blob_gc RESTART IDENTITY CASCADE;")
+	testDB.Exec("ALTER TABLE audit_log ENABLE TRIGGER audit_log_no_truncate")
+}
+
+// withPrincipal returns req as sent by an authenticated caller with the given
+// subject and scopes.
+func withPrincipal(req *http.Request, subject string, scopes ...string) *http.Request {
+	principal := auth.Principal{Subject: subject, Scopes: scopes}
+	return req.WithContext(auth.WithPrincipal(req.Context(), principal))
+}
+
+// serveJSON makes a request to router as principal, with payload as its JSON
+// body unless it is nil, and returns the response.
+func serveJSON(t *testing.T, router http.Handler, method, path string, principal auth.Principal, payload any) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	if payload != nil {
+		json.NewEncoder(&body).Encode(payload)
+	}
+	req, err := http.NewRequest(method, path, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req.WithContext(auth.WithPrincipal(req.Context(), principal)))
+	return rr
+}
+
+// newSender returns a function making requests to router as the given
+// subject, with the read, write and delete scopes.
+func newSender(t *testing.T, router http.Handler) func(method, path, subject string, payload any) *httptest.ResponseRecorder {
+	return func(method, path, subject string, payload any) *httptest.ResponseRecorder {
+		principal := auth.Principal{Subject: subject, Scopes: []string{auth.ScopeRead, auth.ScopeWrite, auth.ScopeDelete}}
+		return serveJSON(t, router, method, path, principal, payload)
+	}
+}
+
+// newMessageRouter returns a router for the message and thread endpoints,
+// and a function making requests to it as the given subject.
+func newMessageRouter(t *testing.T) func(method, path, subject string, payload any) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	router.HandleFunc("/message", CreateMessage).Methods("POST")
+	router.HandleFunc("/message/{id:[0-9]+}", GetMessage).Methods("GET")
+	router.HandleFunc("/message/{id:[0-9]+}", UpdateMessage).Methods("PATCH")
+	router.HandleFunc("/message/{id:[0-9]+}", DeleteMessage).Methods("DELETE")
+	router.HandleFunc("/message/{id:[0-9]+}/replies", CreateReply).Methods("POST")
+	router.HandleFunc("/message/{id:[0-9]+}/thread", GetThread).Methods("GET")
+
+	return newSender(t, router)
 }
 
 // Tests POST /message
@@ -229,7 +287,7 @@ func TestListMessages(t *testing.T) {
 
 func TestUpdateMessage(t *testing.T) {
 	// Clean the database before the test
-	testDB.Exec("TRUNCATE TABLE messages RESTART IDENTITY CASCADE;")
+	teardownTestDatabase()
 
 	// Insert a test message into the test database
 	var msgID int64
@@ -251,6 +309,9 @@ func TestUpdateMessage(t *testing.T) {
 	}
 	req.Header.Set("Content-Type", "application/json")
 
+	// The message has no owner, so only an admin may update it
+	req = withPrincipal(req, "admin", auth.ScopeAdmin)
+
 	// Use httptest to record the response
 	rr := httptest.NewRecorder()
 
@@ -306,7 +367,7 @@ func TestUpdateMessage(t *testing.T) {
 
 func TestDeleteMessage(t *testing.T) {
 	// Clean the database before the test
-	testDB.Exec("TRUNCATE TABLE messages RESTART IDENTITY CASCADE;")
+	teardownTestDatabase()
 
 	// Insert a test message into the test database
 	var msgID int64
@@ -323,6 +384,9 @@ func TestDeleteMessage(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// The message has no owner, so only an admin may delete it
+	req = withPrincipal(req, "admin", auth.ScopeAdmin)
+
 	// Use httptest to record the response
 	rr := httptest.NewRecorder()
 
@@ -365,3 +429,187 @@ func TestDeleteMessage(t *testing.T) {
 		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, status)
 	}
 }
+
+func TestMessageOwnership(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+
+	router := mux.NewRouter()
+	router.HandleFunc("/message", CreateMessage).Methods("POST")
+	router.HandleFunc("/message/{id:[0-9]+}", GetMessage).Methods("GET")
+	router.HandleFunc("/message/{id:[0-9]+}", UpdateMessage).Methods("PATCH")
+	router.HandleFunc("/message/{id:[0-9]+}", DeleteMessage).Methods("DELETE")
+	router.HandleFunc("/messages", ListMessages).Methods("GET")
+
+	send := newSender(t, router)
+
+	// Alice creates a private message; she cannot set its owner
+	rr := send("POST", "/message", "alice", map[string]any{"content": "Racecar", "isPrivate": true, "ownerId": "bob"})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an owner in the body to be rejected with %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+	rr = send("POST", "/message", "alice", map[string]any{"content": "Racecar", "isPrivate": true})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d", http.StatusCreated, rr.Code)
+	}
+	var created database.Message
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.OwnerID != "alice" {
+		t.Errorf("Expected owner 'alice', got %q", created.OwnerID)
+	}
+	path := "/message/" + strconv.FormatInt(created.ID, 10)
+
+	// Bob cannot tell the private message exists
+	if rr := send("GET", path, "bob", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected GET by another user to return %d, got %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := send("PATCH", path, "bob", map[string]any{"content": "Hijacked"}); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected PATCH by another user to return %d, got %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := send("GET", path, "alice", nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected GET by the owner to return %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	// Once public, Bob can read it but still not change it
+	if rr := send("PATCH", path, "alice", map[string]any{"isPrivate": false}); rr.Code != http.StatusOK {
+		t.Errorf("Expected PATCH by the owner to return %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := send("GET", path, "bob", nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected GET of a public message to return %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := send("DELETE", path, "bob", nil); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected DELETE by another user to return %d, got %d", http.StatusForbidden, rr.Code)
+	}
+
+	// Each user only sees their own messages with owner=me
+	send("POST", "/message", "bob", map[string]any{"content": "Hello World", "isPrivate": true})
+	var response messagePage
+	rr = send("GET", "/messages?owner=me", "bob", nil)
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Pagination.TotalMessages != 1 || response.Messages[0].OwnerID != "bob" {
+		t.Errorf("Expected only Bob's message, got %+v", response.Messages)
+	}
+
+	// Alice sees her public message but not Bob's private one
+	rr = send("GET", "/messages", "alice", nil)
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Pagination.TotalMessages != 1 || response.Messages[0].OwnerID != "alice" {
+		t.Errorf("Expected only Alice's message, got %+v", response.Messages)
+	}
+
+	if rr := send("DELETE", path, "alice", nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected DELETE by the owner to return %d, got %d", http.StatusNoContent, rr.Code)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	teardownTestDatabase()
+	testDB.Exec("DELETE FROM tenants WHERE id <> 'default'")
+	database.DB = testDB
+
+	router := mux.NewRouter()
+	router.HandleFunc("/message", CreateMessage).Methods("POST")
+	router.HandleFunc("/message/{id:[0-9]+}", GetMessage).Methods("GET")
+	router.HandleFunc("/messages", ListMessages).Methods("GET")
+
+	// send makes a request as an admin of the given tenant
+	send := func(method, path, tenant string, payload any) *httptest.ResponseRecorder {
+		principal := auth.Principal{Subject: "admin", Scopes: []string{auth.ScopeAdmin}, Tenant: tenant}
+		return serveJSON(t, router, method, path, principal, payload)
+	}
+
+	// Acme may store a single message of up to 10 characters
+	_, err := testDB.Exec("INSERT INTO tenants (id, max_messages, max_content_length) VALUES ('acme', 1, 10)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := send("POST", "/message", "acme", map[string]string{"content": "Too long for acme"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected content over the tenant limit to return %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	rr := send("POST", "/message", "acme", map[string]string{"content": "Racecar"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d", http.StatusCreated, rr.Code)
+	}
+	var created database.Message
+	if err := json.Unmarshal(rr.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr := send("POST", "/message", "acme", map[string]string{"content": "Madam"}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected a create over the message quota to return %d, got %d", http.StatusForbidden, rr.Code)
+	}
+
+	// Another tenant cannot see Acme's message, even as an admin
+	if rr := send("GET", "/message/"+strconv.FormatInt(created.ID, 10), "globex", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected GET from another tenant to return %d, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	var response messagePage
+	rr = send("GET", "/messages", "globex", nil)
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Pagination.TotalMessages != 0 {
+		t.Errorf("Expected no messages for another tenant, got %d", response.Pagination.TotalMessages)
+	}
+
+	rr = send("GET", "/messages", "acme", nil)
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Pagination.TotalMessages != 1 {
+		t.Errorf("Expected 1 message for acme, got %d", response.Pagination.TotalMessages)
+	}
+}
+
+func TestMarkdownMessages(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+	send := newMessageRouter(t)
+
+	rr := send("POST", "/message", "alice", map[string]any{
+		"content": "**Race**car <script>alert(1)</script>",
+		"format":  "markdown",
+	})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+	var msg database.Message
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	if msg.ContentHTML != "<p><strong>Race</strong>car </p>" {
+		t.Errorf("Expected sanitized HTML, got %q", msg.ContentHTML)
+	}
+	if !msg.IsPalindrome {
+		t.Error("Expected the rendered text to be analysed as a palindrome")
+	}
+
+	rr = send("GET", "/message/"+strconv.FormatInt(msg.ID, 10), "bob", nil)
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	if msg.Content != "**Race**car <script>alert(1)</script>" || msg.Format != "markdown" || msg.ContentHTML == "" {
+		t.Errorf("Expected both the raw and rendered content, got %+v", msg)
+	}
+
+	// Switching to plain text analyses the markup too
+	rr = send("PATCH", "/message/"+strconv.FormatInt(msg.ID, 10), "alice", map[string]any{"format": "plain", "content": "**Racecar**!"})
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	if msg.ContentHTML != "**Racecar**!" || !msg.IsPalindrome {
+		t.Errorf("Expected escaped plain text, got %+v", msg)
+	}
+	rr = send("PATCH", "/message/"+strconv.FormatInt(msg.ID, 10), "alice", map[string]any{"content": "<b>Hello</b>"})
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	if msg.ContentHTML != "&lt;b&gt;Hello&lt;/b&gt;" {
+		t.Errorf("Expected plain text to be escaped, got %q", msg.ContentHTML)
+	}
+
+	if rr := send("POST", "/message", "alice", map[string]any{"content": "x", "format": "html"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an unknown format, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
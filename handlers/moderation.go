@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/audit"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+	"github.com/shawn1912/messages-service/moderation"
+	"github.com/shawn1912/messages-service/richtext"
+)
+
+// Moderator checks the content of new and updated messages. If nil, every
+// message is visible straight away.
+var Moderator moderation.Moderator
+
+// moderateContent asks the Moderator about content in format. Markup is
+// checked along with the text it displays, so that neither hides words from
+// the rules. If the content is rejected, it writes a 422 response and returns
+// false.
+func moderateContent(w http.ResponseWriter, r *http.Request, format, content string) (moderation.Verdict, bool) {
+	verdict := moderation.Verdict{Action: moderation.Allow}
+	if Moderator == nil {
+		return verdict, true
+	}
+	texts := []string{richtext.Text(format, content)}
+	if format != richtext.Plain {
+		texts = append(texts, content)
+	}
+	for _, text := range texts {
+		v, err := Moderator.Moderate(r.Context(), text)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return moderation.Verdict{}, false
+		}
+		if v.Action > verdict.Action {
+			verdict = v
+		}
+	}
+	if verdict.Action == moderation.Reject {
+		http.Error(w, "Message rejected by moderation: "+verdict.Reason, http.StatusUnprocessableEntity)
+		return moderation.Verdict{}, false
+	}
+	return verdict, true
+}
+
+// ListModerationQueue returns a paginated list of the messages awaiting a
+// moderator, oldest first: pending and quarantined ones, or those in the
+// moderation state given by the 'state' parameter.
+func ListModerationQueue(w http.ResponseWriter, r *http.Request) {
+	page, limit, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+	states := []string{moderation.Pending, moderation.Quarantined}
+	if state := r.URL.Query().Get("state"); state != "" {
+		if !moderation.Hidden(state) {
+			http.Error(w, "Invalid 'state' parameter. It must be pending, quarantined or rejected.", http.StatusBadRequest)
+			return
+		}
+		states = []string{state}
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	var where conditions
+	where.add("tenant_id = ?", principal.Tenant)
+	where.add("deleted_at IS NULL")
+	where.addUnexpired()
+	where.add("moderation_state = ANY(?)", pq.Array(states))
+
+	writeMessageList(w, tx, principal.Tenant, where, page, limit)
+}
+
+// ApproveMessage makes a message visible. Messages that were hidden are then
+// announced as created.
+func ApproveMessage(w http.ResponseWriter, r *http.Request) {
+	decideModeration(w, r, moderation.Visible, audit.ActionApprove)
+}
+
+// RejectMessage hides a message from everyone but its owner and moderators,
+// with the reason in the optional 'reason' field. Messages that were visible
+// are then announced as deleted.
+func RejectMessage(w http.ResponseWriter, r *http.Request) {
+	decideModeration(w, r, moderation.Rejected, audit.ActionReject)
+}
+
+// decideModeration moves a message to state on a moderator's decision,
+// recorded in the audit log as action.
+func decideModeration(w http.ResponseWriter, r *http.Request, state, action string) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if state == moderation.Visible {
+		req.Reason = ""
+	} else if req.Reason == "" {
+		req.Reason = "rejected by a moderator"
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	// Moderators see messages whoever may read them
+	var where conditions
+	where.add("id = ?", id)
+	where.add("tenant_id = ?", principal.Tenant)
+	where.addUnexpired()
+	var msg database.Message
+	err := scanMessage(tx.QueryRow(`SELECT `+messageColumns+` FROM messages`+where.where()+` FOR UPDATE`, where.args...), &msg)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if msg.DeletedAt != nil {
+		http.Error(w, "Message has been deleted", http.StatusGone)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE messages SET moderation_state = $1, moderation_reason = $2 WHERE id = $3 AND tenant_id = $4",
+		state, nullIfEmpty(req.Reason), id, principal.Tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	before := msg
+	msg.ModerationState, msg.ModerationReason = state, req.Reason
+
+	messages := []database.Message{msg}
+	if err := loadDetails(tx, principal.Tenant, messages); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	msg = messages[0]
+
+	hash := audit.ContentHash(msg.Content)
+	if err := recordAudit(tx, r, principal, action, id, hash, hash); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := recordModerationEvent(tx, principal, before, msg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// recordModerationEvent announces msg as created if moderation revealed it,
+// having been hidden as before, or as deleted if moderation hid it, and
+// reports whether it did either.
+func recordModerationEvent(tx *sql.Tx, principal auth.Principal, before, msg database.Message) (bool, error) {
+	wasHidden, hidden := moderation.Hidden(before.ModerationState), moderation.Hidden(msg.ModerationState)
+	switch {
+	case wasHidden && !hidden:
+		return true, recordEvent(tx, events.MessageCreated, principal, msg)
+	case !wasHidden && hidden:
+		// Announced while it is still visible, so that subscribers hear of it
+		before.Tags, before.Reactions, before.Attachments = msg.Tags, msg.Reactions, msg.Attachments
+		return true, recordEvent(tx, events.MessageDeleted, principal, before)
+	}
+	return false, nil
+}
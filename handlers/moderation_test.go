@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/moderation"
+)
+
+func TestModeration(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+	rules, err := moderation.ParseRules(strings.NewReader("hold spam\nquarantine scam\nreject /fr[e3]{2} money/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	Moderator = rules
+	defer func() { Moderator = nil }()
+
+	send := newMessageRouter(t)
+	router := mux.NewRouter()
+	router.HandleFunc("/moderation/queue", ListModerationQueue).Methods("GET")
+	router.HandleFunc("/moderation/queue/{id:[0-9]+}/approve", ApproveMessage).Methods("POST")
+	router.HandleFunc("/moderation/queue/{id:[0-9]+}/reject", RejectMessage).Methods("POST")
+	moderate := func(method, path string, payload any) *httptest.ResponseRecorder {
+		return serveJSON(t, router, method, path, auth.Principal{Subject: "mod", Scopes: []string{auth.ScopeModerate}}, payload)
+	}
+	create := func(content string) database.Message {
+		rr := send("POST", "/message", "alice", map[string]any{"content": content})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+		}
+		var msg database.Message
+		json.Unmarshal(rr.Body.Bytes(), &msg)
+		return msg
+	}
+
+	if rr := send("POST", "/message", "alice", map[string]any{"content": "Free money!"}); rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status code %d for rejected content, got %d", http.StatusUnprocessableEntity, rr.Code)
+	}
+	clean := create("Hello")
+	held := create("Buy my spam")
+	quarantined := create("Totally not a scam")
+	if clean.ModerationState != moderation.Visible || held.ModerationState != moderation.Pending ||
+		quarantined.ModerationState != moderation.Quarantined || held.ModerationReason == "" {
+		t.Fatalf("Unexpected states %q, %+v and %q", clean.ModerationState, held, quarantined.ModerationState)
+	}
+
+	// Hidden messages are only shown to their owner
+	for _, msg := range []database.Message{held, quarantined} {
+		path := fmt.Sprintf("/message/%d", msg.ID)
+		if rr := send("GET", path, "bob", nil); rr.Code != http.StatusNotFound {
+			t.Errorf("Expected status code %d for a %s message, got %d", http.StatusNotFound, msg.ModerationState, rr.Code)
+		}
+		if rr := send("GET", path, "alice", nil); rr.Code != http.StatusOK {
+			t.Errorf("Expected the owner to see their %s message, got %d", msg.ModerationState, rr.Code)
+		}
+		if rr := send("POST", path+"/replies", "alice", map[string]any{"content": "Reply"}); rr.Code != http.StatusConflict {
+			t.Errorf("Expected status code %d replying to a %s message, got %d", http.StatusConflict, msg.ModerationState, rr.Code)
+		}
+	}
+	if rr := send("PATCH", fmt.Sprintf("/message/%d", quarantined.ID), "alice", map[string]any{"content": "Fine"}); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d editing a quarantined message, got %d", http.StatusConflict, rr.Code)
+	}
+
+	var page messagePage
+	json.Unmarshal(moderate("GET", "/moderation/queue", nil).Body.Bytes(), &page)
+	if len(page.Messages) != 2 || page.Messages[0].ID != held.ID || page.Messages[1].ID != quarantined.ID {
+		t.Fatalf("Expected the held and quarantined messages in the queue, got %+v", page.Messages)
+	}
+
+	// Editing a pending message moderates it again
+	var edited database.Message
+	json.Unmarshal(send("PATCH", fmt.Sprintf("/message/%d", held.ID), "alice", map[string]any{"content": "Buy my ham"}).Body.Bytes(), &edited)
+	if edited.ModerationState != moderation.Visible || edited.ModerationReason != "" {
+		t.Errorf("Expected the edited message to be visible, got %q (%q)", edited.ModerationState, edited.ModerationReason)
+	}
+
+	// Edits that reveal or hide a message are announced as creating or
+	// deleting it
+	eventsOf := func(id int64) string {
+		var types []string
+		rows, _ := testDB.Query("SELECT type || ':' || (message->>'content') FROM message_events WHERE (message->>'id')::int = $1 ORDER BY seq", id)
+		for rows.Next() {
+			var event string
+			rows.Scan(&event)
+			types = append(types, event)
+		}
+		rows.Close()
+		return strings.Join(types, ",")
+	}
+	if got := eventsOf(held.ID); got != "message.created:Buy my ham" {
+		t.Errorf("Expected the revealed message to be announced as created, got %q", got)
+	}
+	hidden := create("Nothing to see")
+	send("PATCH", fmt.Sprintf("/message/%d", hidden.ID), "alice", map[string]any{"content": "Nothing to see, just spam"})
+	if got := eventsOf(hidden.ID); got != "message.created:Nothing to see,message.deleted:Nothing to see" {
+		t.Errorf("Expected the hidden message to be announced as deleted, got %q", got)
+	}
+
+	rr := moderate("POST", fmt.Sprintf("/moderation/queue/%d/approve", quarantined.ID), nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if rr := send("GET", fmt.Sprintf("/message/%d", quarantined.ID), "bob", nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected an approved message to be visible, got %d", rr.Code)
+	}
+	var created int
+	testDB.QueryRow("SELECT COUNT(*) FROM message_events WHERE type = 'message.created' AND (message->>'id')::int = $1", quarantined.ID).Scan(&created)
+	if created != 1 {
+		t.Errorf("Expected the approved message to be announced once, got %d events", created)
+	}
+
+	// Visible messages can be taken down
+	rr = moderate("POST", fmt.Sprintf("/moderation/queue/%d/reject", clean.ID), map[string]string{"reason": "Off topic"})
+	var rejected database.Message
+	json.Unmarshal(rr.Body.Bytes(), &rejected)
+	if rr.Code != http.StatusOK || rejected.ModerationState != moderation.Rejected || rejected.ModerationReason != "Off topic" {
+		t.Fatalf("Expected the message to be rejected, got %d: %s", rr.Code, rr.Body)
+	}
+	if rr := send("GET", fmt.Sprintf("/message/%d", clean.ID), "bob", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected a rejected message to be hidden, got %d", rr.Code)
+	}
+	json.Unmarshal(moderate("GET", "/moderation/queue?state=rejected", nil).Body.Bytes(), &page)
+	if len(page.Messages) != 1 || page.Messages[0].ID != clean.ID {
+		t.Errorf("Expected the rejected message in the queue, got %+v", page.Messages)
+	}
+	if rr := moderate("GET", "/moderation/queue?state=visible", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid state, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	var actions []string
+	rows, _ := testDB.Query("SELECT action FROM audit_log WHERE actor = 'mod' ORDER BY id")
+	for rows.Next() {
+		var action string
+		rows.Scan(&action)
+		actions = append(actions, action)
+	}
+	if strings.Join(actions, ",") != "message.approve,message.reject" {
+		t.Errorf("Expected the decisions to be audited, got %v", actions)
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/shawn1912/messages-service/database"
+)
+
+const (
+	maxLimit     = 100
+	defaultLimit = 10
+	defaultPage  = 1
+)
+
+// messagePage is the response body of every paginated list of messages.
+type messagePage struct {
+	Messages   []database.Message `json:"messages"`
+	Pagination struct {
+		CurrentPage   int `json:"currentPage"`
+		PageSize      int `json:"pageSize"`
+		TotalPages    int `json:"totalPages"`
+		TotalMessages int `json:"totalMessages"`
+	} `json:"pagination"`
+}
+
+// parsePagination reads the 'page' and 'limit' query parameters. If either is
+// invalid it writes a 400 response and returns false.
+func parsePagination(w http.ResponseWriter, r *http.Request) (page, limit int, ok bool) {
+	// Parse query parameters
+	queryParams := r.URL.Query()
+	limitStr := queryParams.Get("limit")
+	pageStr := queryParams.Get("page")
+
+	// Convert limit to integer
+	limit = defaultLimit
+	if limitStr != "" {
+		parsedLimit, err := strconv.Atoi(limitStr)
+		if err != nil || parsedLimit <= 0 {
+			http.Error(w, "Invalid 'limit' parameter. It must be a positive integer.", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		if parsedLimit > maxLimit {
+			http.Error(w, fmt.Sprintf("'limit' parameter cannot exceed %d", maxLimit), http.StatusBadRequest)
+			return 0, 0, false
+		}
+		limit = parsedLimit
+	}
+
+	// Convert page to integer
+	page = defaultPage
+	if pageStr != "" {
+		parsedPage, err := strconv.Atoi(pageStr)
+		if err != nil || parsedPage <= 0 {
+			http.Error(w, "Invalid 'page' parameter. It must be a positive integer.", http.StatusBadRequest)
+			return 0, 0, false
+		}
+		page = parsedPage
+	}
+
+	return page, limit, true
+}
+
+// writeMessagePage writes one page of messages along with its pagination metadata.
+func writeMessagePage(w http.ResponseWriter, messages []database.Message, page, limit, totalMessages int) {
+	response := messagePage{Messages: messages}
+	response.Pagination.CurrentPage = page
+	response.Pagination.PageSize = limit
+	response.Pagination.TotalPages = (totalMessages + limit - 1) / limit // Integer division rounding up
+	response.Pagination.TotalMessages = totalMessages
+
+	// Set headers and write the response
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/moderation"
+	"github.com/shawn1912/messages-service/richtext"
+)
+
+// messageColumns is the column list selected for a database.Message, in the
+// order scanMessage expects.
+const messageColumns = `id, content, format, is_palindrome, COALESCE(owner_id, ''), is_private, parent_id,
+    COALESCE(thread_id, id), channel_id,
+    COALESCE((SELECT channels.is_private FROM channels WHERE channels.id = channel_id), FALSE),
+    created_at, updated_at, publish_at, expires_at, deleted_at, moderation_state, COALESCE(moderation_reason, ''),
+    duplicate_of, duplicate_count`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanMessage reads a row selected with messageColumns into msg, rendering
+// its content.
+func scanMessage(row rowScanner, msg *database.Message) error {
+	err := row.Scan(&msg.ID, &msg.Content, &msg.Format, &msg.IsPalindrome, &msg.OwnerID, &msg.IsPrivate,
+		&msg.ParentID, &msg.ThreadID, &msg.ChannelID, &msg.ChannelPrivate, &msg.CreatedAt, &msg.UpdatedAt,
+		&msg.PublishAt, &msg.ExpiresAt, &msg.DeletedAt, &msg.ModerationState, &msg.ModerationReason,
+		&msg.DuplicateOf, &msg.DuplicateCount)
+	if err != nil {
+		return err
+	}
+	msg.ContentHTML = richtext.HTML(msg.Format, msg.Content)
+	return nil
+}
+
+// scanMessages reads every row selected with messageColumns and closes rows.
+func scanMessages(rows *sql.Rows) ([]database.Message, error) {
+	defer rows.Close()
+
+	messages := []database.Message{}
+	for rows.Next() {
+		var msg database.Message
+		if err := scanMessage(rows, &msg); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// conditions accumulates the conditions of a WHERE clause along with their
+// arguments.
+type conditions struct {
+	clauses []string
+	args    []any
+}
+
+// add appends a condition, replacing each '?' in clause with the positional
+// placeholder of the matching argument.
+func (c *conditions) add(clause string, args ...any) {
+	for _, arg := range args {
+		c.args = append(c.args, arg)
+		clause = strings.Replace(clause, "?", fmt.Sprintf("$%d", len(c.args)), 1)
+	}
+	c.clauses = append(c.clauses, clause)
+}
+
+// where returns the WHERE clause, or an empty string if there are no conditions.
+func (c *conditions) where() string {
+	if len(c.clauses) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(c.clauses, " AND ")
+}
+
+// page returns a LIMIT/OFFSET clause following the conditions' placeholders,
+// along with the full argument list for the query.
+func (c *conditions) page(limit, offset int) (string, []any) {
+	n := len(c.args)
+	args := append(append([]any{}, c.args...), limit, offset)
+	return fmt.Sprintf(" LIMIT $%d OFFSET $%d", n+1, n+2), args
+}
+
+// addVisibleTo limits the conditions to messages principal may read: public,
+// published messages that passed moderation and their own private, scheduled
+// or moderated ones, outside private channels they are not a member of.
+// Admins can read everything but expired messages.
+func (c *conditions) addVisibleTo(principal auth.Principal) {
+	c.addUnexpired()
+	if principal.IsAdmin() {
+		return
+	}
+	c.add("((NOT is_private AND publish_at IS NULL AND moderation_state = 'visible') OR owner_id = ?)", principal.Subject)
+	c.add(`(channel_id IS NULL
+        OR channel_id IN (SELECT id FROM channels WHERE NOT is_private)
+        OR channel_id IN (SELECT channel_id FROM channel_members WHERE member = ?))`, principal.Subject)
+}
+
+// addUnexpired limits the conditions to messages that have not expired, by
+// their own expiry time or by MessageRetention. Tombstones and scheduled
+// messages are not subject to the retention.
+func (c *conditions) addUnexpired() {
+	c.add("(expires_at IS NULL OR expires_at > NOW())")
+	if MessageRetention > 0 {
+		c.add("(created_at > NOW() - ? * INTERVAL '1 second' OR deleted_at IS NOT NULL OR publish_at IS NOT NULL)",
+			MessageRetention.Seconds())
+	}
+}
+
+// canRead reports whether principal may see msg.
+func canRead(principal auth.Principal, msg database.Message) bool {
+	return (!msg.IsPrivate && msg.PublishAt == nil && !moderation.Hidden(msg.ModerationState)) || canModify(principal, msg)
+}
+
+// canModify reports whether principal may update or delete msg. Only owners
+// and admins may; messages without an owner can only be changed by admins.
+func canModify(principal auth.Principal, msg database.Message) bool {
+	return principal.IsAdmin() || (msg.OwnerID != "" && msg.OwnerID == principal.Subject)
+}
+
+// nullIfEmpty converts an empty string to a SQL NULL.
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+	"github.com/shawn1912/messages-service/reactions"
+)
+
+// PutReaction adds the caller's reaction with the emoji in the 'emoji' route
+// variable to a message they can read. Reacting twice with the same emoji is
+// a no-op.
+func PutReaction(w http.ResponseWriter, r *http.Request) {
+	changeReaction(w, r, events.ReactionAdded, reactions.Add)
+}
+
+// DeleteReaction removes the caller's reaction with the emoji in the 'emoji'
+// route variable from a message. Removing a reaction that does not exist is a
+// no-op.
+func DeleteReaction(w http.ResponseWriter, r *http.Request) {
+	changeReaction(w, r, events.ReactionRemoved, reactions.Remove)
+}
+
+// changeReaction applies change to the caller's reaction to a message and, if
+// it changed anything, records an event of eventType.
+func changeReaction(w http.ResponseWriter, r *http.Request, eventType string,
+	change func(tx *sql.Tx, tenant string, messageID int64, user, emoji string) (bool, error)) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	emoji, err := reactions.Normalize(mux.Vars(r)["emoji"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	msg, ok := loadVisibleMessage(w, tx, principal, id)
+	if !ok {
+		return
+	}
+	if msg.DeletedAt != nil {
+		http.Error(w, "Message has been deleted", http.StatusGone)
+		return
+	}
+	changed, err := change(tx, principal.Tenant, id, principal.Subject, emoji)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		messages := []database.Message{msg}
+		if err := loadDetails(tx, principal.Tenant, messages); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		event := events.Event{
+			Type:     eventType,
+			Tenant:   principal.Tenant,
+			Message:  messages[0],
+			Reaction: &events.Reaction{Emoji: emoji, User: principal.Subject},
+		}
+		if err := publishEvent(tx, event); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadDetails fills in the tags, reaction counts and attachments of
+// messages, with one query each however many messages there are.
+func loadDetails(tx *sql.Tx, tenant string, messages []database.Message) error {
+	if err := loadTags(tx, tenant, messages); err != nil {
+		return err
+	}
+	if err := loadReactions(tx, tenant, messages); err != nil {
+		return err
+	}
+	return loadAttachments(tx, tenant, messages)
+}
+
+// loadReactions fills in the reaction counts of messages.
+func loadReactions(tx *sql.Tx, tenant string, messages []database.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	counts, err := reactions.Counts(tx, tenant, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Reactions = counts[messages[i].ID]
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestReactions(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+
+	router := mux.NewRouter()
+	router.HandleFunc("/message", CreateMessage).Methods("POST")
+	router.HandleFunc("/message/{id:[0-9]+}", GetMessage).Methods("GET")
+	router.HandleFunc("/message/{id:[0-9]+}/reactions/{emoji}", PutReaction).Methods("PUT")
+	router.HandleFunc("/message/{id:[0-9]+}/reactions/{emoji}", DeleteReaction).Methods("DELETE")
+	router.HandleFunc("/messages", ListMessages).Methods("GET")
+
+	send := newSender(t, router)
+	react := func(method string, id int64, subject, emoji string) int {
+		return send(method, fmt.Sprintf("/message/%d/reactions/%s", id, url.PathEscape(emoji)), subject, nil).Code
+	}
+
+	var msg database.Message
+	json.Unmarshal(send("POST", "/message", "alice", map[string]any{"content": "Ship it"}).Body.Bytes(), &msg)
+
+	for _, reaction := range []struct {
+		subject, emoji string
+	}{{"alice", "🚀"}, {"bob", "👍"}, {"carol", "👍"}, {"bob", "👍"}} {
+		if code := react("PUT", msg.ID, reaction.subject, reaction.emoji); code != http.StatusNoContent {
+			t.Fatalf("Expected status code %d, got %d", http.StatusNoContent, code)
+		}
+	}
+	if code := react("PUT", msg.ID, "bob", "thumbsup"); code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid emoji, got %d", http.StatusBadRequest, code)
+	}
+	if code := react("PUT", msg.ID+100, "bob", "👍"); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for a missing message, got %d", http.StatusNotFound, code)
+	}
+
+	want := []database.ReactionCount{{Emoji: "👍", Count: 2}, {Emoji: "🚀", Count: 1}}
+	json.Unmarshal(send("GET", fmt.Sprintf("/message/%d", msg.ID), "bob", nil).Body.Bytes(), &msg)
+	if !reflect.DeepEqual(msg.Reactions, want) {
+		t.Errorf("Expected reactions %v, got %v", want, msg.Reactions)
+	}
+	var page messagePage
+	json.Unmarshal(send("GET", "/messages", "bob", nil).Body.Bytes(), &page)
+	if len(page.Messages) != 1 || !reflect.DeepEqual(page.Messages[0].Reactions, want) {
+		t.Errorf("Expected listed reactions %v, got %+v", want, page.Messages)
+	}
+
+	if code := react("DELETE", msg.ID, "carol", "👍"); code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, got %d", http.StatusNoContent, code)
+	}
+	if code := react("DELETE", msg.ID, "carol", "👍"); code != http.StatusNoContent {
+		t.Errorf("Expected removing a missing reaction to succeed, got %d", code)
+	}
+	json.Unmarshal(send("GET", fmt.Sprintf("/message/%d", msg.ID), "bob", nil).Body.Bytes(), &msg)
+	want = []database.ReactionCount{{Emoji: "👍", Count: 1}, {Emoji: "🚀", Count: 1}}
+	if !reflect.DeepEqual(msg.Reactions, want) {
+		t.Errorf("Expected reactions %v after removal, got %v", want, msg.Reactions)
+	}
+
+	// Only changes are recorded as events
+	rows, err := testDB.Query("SELECT type, reaction->>'user' FROM message_events WHERE reaction IS NOT NULL ORDER BY seq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var recorded []string
+	for rows.Next() {
+		var eventType, user string
+		rows.Scan(&eventType, &user)
+		recorded = append(recorded, eventType+" "+user)
+	}
+	expected := []string{"reaction.added alice", "reaction.added bob", "reaction.added carol", "reaction.removed carol"}
+	if !reflect.DeepEqual(recorded, expected) {
+		t.Errorf("Expected events %v, got %v", expected, recorded)
+	}
+}
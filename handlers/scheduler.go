@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+)
+
+// Scheduler publishes scheduled messages once their 'publishAt' time comes,
+// announcing them as if they had just been created. Every replica can run
+// one: due messages are claimed with row locks that the others skip.
+type Scheduler struct {
+	BatchSize    int
+	PollInterval time.Duration
+}
+
+// Run publishes due messages until ctx is done.
+func (s *Scheduler) Run(ctx context.Context) {
+	poll := time.NewTicker(s.PollInterval)
+	defer poll.Stop()
+
+	for {
+		for {
+			n, err := s.RunOnce(ctx)
+			if err != nil {
+				log.Printf("Scheduler: %v", err)
+			}
+			// Keep going while there is a backlog
+			if err != nil || n < s.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// RunOnce publishes up to BatchSize due messages in a single transaction and
+// returns how many it published.
+func (s *Scheduler) RunOnce(ctx context.Context) (int, error) {
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Published messages look freshly created
+	rows, err := tx.QueryContext(ctx, `
+        UPDATE messages SET publish_at = NULL, created_at = NOW(), updated_at = NOW()
+        WHERE id IN (
+            SELECT id FROM messages
+            WHERE publish_at <= NOW()
+            ORDER BY publish_at ASC, id ASC
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, tenant_id
+    `, s.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	published := map[string][]int64{}
+	var tenants []string
+	n := 0
+	for rows.Next() {
+		var id int64
+		var tenant string
+		if err := rows.Scan(&id, &tenant); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if _, ok := published[tenant]; !ok {
+			tenants = append(tenants, tenant)
+		}
+		published[tenant] = append(published[tenant], id)
+		n++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, tenant := range tenants {
+		rows, err := tx.QueryContext(ctx, `SELECT `+messageColumns+` FROM messages WHERE id = ANY($1) ORDER BY id ASC`,
+			pq.Array(published[tenant]))
+		if err != nil {
+			return 0, err
+		}
+		messages, err := scanMessages(rows)
+		if err != nil {
+			return 0, err
+		}
+		if err := loadDetails(tx, tenant, messages); err != nil {
+			return 0, err
+		}
+		for _, msg := range messages {
+			event := events.Event{Type: events.MessageCreated, Tenant: tenant, Message: msg}
+			if err := publishEvent(tx, event); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, tx.Commit()
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestScheduledMessages(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+
+	router := mux.NewRouter()
+	router.HandleFunc("/message", CreateMessage).Methods("POST")
+	router.HandleFunc("/message/{id:[0-9]+}", GetMessage).Methods("GET")
+	router.HandleFunc("/message/{id:[0-9]+}/replies", CreateReply).Methods("POST")
+	router.HandleFunc("/messages", ListMessages).Methods("GET")
+
+	send := newSender(t, router)
+	listed := func(subject string) int {
+		var page messagePage
+		json.Unmarshal(send("GET", "/messages", subject, nil).Body.Bytes(), &page)
+		return len(page.Messages)
+	}
+	createdEvents := func() int {
+		var count int
+		testDB.QueryRow("SELECT COUNT(*) FROM message_events WHERE type = 'message.created'").Scan(&count)
+		return count
+	}
+
+	rr := send("POST", "/message", "alice", map[string]any{"content": "Later", "publishAt": time.Now().Add(time.Hour)})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+	var msg database.Message
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	if msg.PublishAt == nil {
+		t.Fatal("Expected the message to be scheduled")
+	}
+	rr = send("POST", "/message", "alice", map[string]any{"content": "Now", "publishAt": time.Now().Add(-time.Hour)})
+	var now database.Message
+	json.Unmarshal(rr.Body.Bytes(), &now)
+	if now.PublishAt != nil {
+		t.Errorf("Expected a message due already to be published, got %v", now.PublishAt)
+	}
+
+	path := fmt.Sprintf("/message/%d", msg.ID)
+	if rr := send("GET", path, "bob", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d for someone else's scheduled message, got %d", http.StatusNotFound, rr.Code)
+	}
+	if rr := send("GET", path, "alice", nil); rr.Code != http.StatusOK {
+		t.Errorf("Expected the owner to see their scheduled message, got %d", rr.Code)
+	}
+	if n := listed("bob"); n != 1 {
+		t.Errorf("Expected 1 message listed for bob, got %d", n)
+	}
+	if n := listed("alice"); n != 2 {
+		t.Errorf("Expected 2 messages listed for alice, got %d", n)
+	}
+	if rr := send("POST", path+"/replies", "alice", map[string]any{"content": "Early"}); rr.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d replying to a scheduled message, got %d", http.StatusConflict, rr.Code)
+	}
+	if n := createdEvents(); n != 1 {
+		t.Errorf("Expected only the published message to be announced, got %d events", n)
+	}
+
+	scheduler := &Scheduler{BatchSize: 10, PollInterval: time.Second}
+	if n, err := scheduler.RunOnce(context.Background()); err != nil || n != 0 {
+		t.Fatalf("Expected nothing to publish yet, got %d (err %v)", n, err)
+	}
+	testDB.Exec("UPDATE messages SET publish_at = NOW() - INTERVAL '1 second' WHERE id = $1", msg.ID)
+	if n, err := scheduler.RunOnce(context.Background()); err != nil || n != 1 {
+		t.Fatalf("Expected 1 message to be published, got %d (err %v)", n, err)
+	}
+
+	rr = send("GET", path, "bob", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected the published message to be visible, got %d", rr.Code)
+	}
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	if msg.PublishAt != nil {
+		t.Errorf("Expected publishAt to be cleared, got %v", msg.PublishAt)
+	}
+	if n := listed("bob"); n != 2 {
+		t.Errorf("Expected 2 messages listed for bob, got %d", n)
+	}
+	if n := createdEvents(); n != 2 {
+		t.Errorf("Expected the published message to be announced, got %d events", n)
+	}
+}
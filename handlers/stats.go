@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/validation"
+)
+
+// statsCacheTTL is how long a computed report is served before the aggregates
+// are run again.
+const statsCacheTTL = 30 * time.Second
+
+// longestPalindromesLimit is the number of palindromes listed in a report.
+const longestPalindromesLimit = 5
+
+// lengthBucketSize is the width, in characters, of each length histogram bucket.
+const lengthBucketSize = 100
+
+// StatsBucket counts the messages created in one day or week.
+type StatsBucket struct {
+	Start       time.Time `json:"start"`
+	Total       int       `json:"total"`
+	Palindromes int       `json:"palindromes"`
+}
+
+// LengthBucket counts the messages whose content length, in characters, is in
+// the range [Min, Max].
+type LengthBucket struct {
+	Min   int `json:"min"`
+	Max   int `json:"max"`
+	Count int `json:"count"`
+}
+
+// Stats is the aggregate report returned by GetStats.
+type Stats struct {
+	From               *time.Time         `json:"from,omitempty"`
+	To                 *time.Time         `json:"to,omitempty"`
+	TotalMessages      int                `json:"totalMessages"`
+	Palindromes        int                `json:"palindromes"`
+	PalindromeRatio    float64            `json:"palindromeRatio"`
+	Daily              []StatsBucket      `json:"daily"`
+	Weekly             []StatsBucket      `json:"weekly"`
+	LengthHistogram    []LengthBucket     `json:"lengthHistogram"`
+	LongestPalindromes []database.Message `json:"longestPalindromes"`
+	GeneratedAt        time.Time          `json:"generatedAt"`
+}
+
+type cachedStats struct {
+	stats   Stats
+	expires time.Time
+}
+
+// statsCache holds recent reports keyed by their tenant and time range.
+var statsCache = struct {
+	sync.Mutex
+	entries map[string]cachedStats
+}{entries: map[string]cachedStats{}}
+
+// GetStats returns aggregate statistics about messages, optionally restricted
+// to those created in the range given by the RFC 3339 'from' (inclusive) and
+// 'to' (exclusive) query parameters. Reports cover the caller's tenant, are
+// shared by all of its callers and are cached for a short time, so only public
+// messages outside private channels are listed in them.
+func GetStats(w http.ResponseWriter, r *http.Request) {
+	queryParams := r.URL.Query()
+
+	from, err := parseTimeParam(queryParams.Get("from"))
+	if err != nil {
+		http.Error(w, "Invalid 'from' parameter. It must be an RFC 3339 timestamp.", http.StatusBadRequest)
+		return
+	}
+	to, err := parseTimeParam(queryParams.Get("to"))
+	if err != nil {
+		http.Error(w, "Invalid 'to' parameter. It must be an RFC 3339 timestamp.", http.StatusBadRequest)
+		return
+	}
+	if from != nil && to != nil && !from.Before(*to) {
+		http.Error(w, "'from' must be before 'to'", http.StatusBadRequest)
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	key := principal.Tenant + "|" + queryParams.Get("from") + "|" + queryParams.Get("to")
+	now := time.Now()
+
+	statsCache.Lock()
+	cached, ok := statsCache.entries[key]
+	statsCache.Unlock()
+
+	if !ok || now.After(cached.expires) {
+		stats, err := computeStats(tx, principal.Tenant, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cached = cachedStats{stats: stats, expires: now.Add(statsCacheTTL)}
+
+		statsCache.Lock()
+		for k, entry := range statsCache.entries {
+			if now.After(entry.expires) {
+				delete(statsCache.entries, k)
+			}
+		}
+		statsCache.entries[key] = cached
+		statsCache.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cached.stats)
+}
+
+// parseTimeParam parses an optional RFC 3339 query parameter.
+func parseTimeParam(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// computeStats runs the aggregate queries behind a report for tenant. A nil
+// from or to leaves that end of the range open.
+func computeStats(tx *sql.Tx, tenant string, from, to *time.Time) (Stats, error) {
+	stats := Stats{
+		From:               from,
+		To:                 to,
+		Daily:              []StatsBucket{},
+		Weekly:             []StatsBucket{},
+		LengthHistogram:    []LengthBucket{},
+		LongestPalindromes: []database.Message{},
+		GeneratedAt:        time.Now(),
+	}
+
+	// Every query filters on the tenant and the same optional range, leaving
+	// out tombstones, scheduled, expired and moderated messages, and those
+	// past MessageRetention ($4)
+	const inRange = `tenant_id = $1 AND deleted_at IS NULL AND publish_at IS NULL AND moderation_state = 'visible'
+        AND (expires_at IS NULL OR expires_at > NOW())
+        AND ($4::float8 <= 0 OR created_at > NOW() - $4 * INTERVAL '1 second')
+        AND ($2::timestamptz IS NULL OR created_at >= $2)
+        AND ($3::timestamptz IS NULL OR created_at < $3)`
+	retention := MessageRetention.Seconds()
+
+	err := tx.QueryRow(`
+        SELECT COUNT(*), COUNT(*) FILTER (WHERE is_palindrome)
+        FROM messages
+        WHERE `+inRange, tenant, from, to, retention).
+		Scan(&stats.TotalMessages, &stats.Palindromes)
+	if err != nil {
+		return Stats{}, err
+	}
+	if stats.TotalMessages > 0 {
+		stats.PalindromeRatio = float64(stats.Palindromes) / float64(stats.TotalMessages)
+	}
+
+	for _, period := range []struct {
+		unit    string
+		buckets *[]StatsBucket
+	}{
+		{"day", &stats.Daily},
+		{"week", &stats.Weekly},
+	} {
+		rows, err := tx.Query(`
+            SELECT date_trunc('`+period.unit+`', created_at) AS bucket,
+                   COUNT(*), COUNT(*) FILTER (WHERE is_palindrome)
+            FROM messages
+            WHERE `+inRange+`
+            GROUP BY bucket
+            ORDER BY bucket ASC
+        `, tenant, from, to, retention)
+		if err != nil {
+			return Stats{}, err
+		}
+		for rows.Next() {
+			var bucket StatsBucket
+			if err := rows.Scan(&bucket.Start, &bucket.Total, &bucket.Palindromes); err != nil {
+				rows.Close()
+				return Stats{}, err
+			}
+			*period.buckets = append(*period.buckets, bucket)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return Stats{}, err
+		}
+	}
+
+	// Content is at most validation.MaxLength characters, so the final bucket
+	// also takes the messages of exactly that length
+	lastBucket := (validation.MaxLength+lengthBucketSize-1)/lengthBucketSize - 1
+	rows, err := tx.Query(`
+        SELECT LEAST(char_length(content) / $5, $6) AS bucket, COUNT(*)
+        FROM messages
+        WHERE `+inRange+`
+        GROUP BY bucket
+        ORDER BY bucket ASC
+    `, tenant, from, to, retention, lengthBucketSize, lastBucket)
+	if err != nil {
+		return Stats{}, err
+	}
+	for rows.Next() {
+		var bucket, count int
+		if err := rows.Scan(&bucket, &count); err != nil {
+			rows.Close()
+			return Stats{}, err
+		}
+		stats.LengthHistogram = append(stats.LengthHistogram, LengthBucket{
+			Min:   bucket * lengthBucketSize,
+			Max:   (bucket+1)*lengthBucketSize - 1,
+			Count: count,
+		})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Stats{}, err
+	}
+	if n := len(stats.LengthHistogram); n > 0 && stats.LengthHistogram[n-1].Min == lastBucket*lengthBucketSize {
+		stats.LengthHistogram[n-1].Max = validation.MaxLength
+	}
+
+	rows, err = tx.Query(`
+        SELECT `+messageColumns+`
+        FROM messages
+        WHERE is_palindrome AND NOT is_private AND `+inRange+`
+          AND (channel_id IS NULL OR channel_id IN (SELECT id FROM channels WHERE NOT is_private))
+        ORDER BY char_length(content) DESC, id ASC
+        LIMIT $5
+    `, tenant, from, to, retention, longestPalindromesLimit)
+	if err != nil {
+		return Stats{}, err
+	}
+	stats.LongestPalindromes, err = scanMessages(rows)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/database"
+)
+
+// Tests GET /stats
+func TestGetStats(t *testing.T) {
+	teardownTestDatabase()
+
+	// Clear cached reports from earlier tests
+	statsCache.Lock()
+	statsCache.entries = map[string]cachedStats{}
+	statsCache.Unlock()
+
+	messages := []struct {
+		content      string
+		isPalindrome bool
+	}{
+		{"Racecar", true},
+		{"A man a plan a canal Panama", true},
+		{"Hello World", false},
+		{strings.Repeat("a", 1000), true},
+	}
+	for _, msg := range messages {
+		_, err := testDB.Exec(
+			"INSERT INTO messages (content, is_palindrome) VALUES ($1, $2)",
+			msg.content, msg.isPalindrome)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Messages past the retention period are left out, even before the reaper
+	// deletes them
+	MessageRetention = 24 * time.Hour
+	defer func() { MessageRetention = 0 }()
+	if _, err := testDB.Exec("INSERT INTO messages (content, is_palindrome, created_at) VALUES ('Level', TRUE, NOW() - INTERVAL '2 days')"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Palindromes in private channels are counted but not listed
+	_, err := testDB.Exec(`
+        WITH channel AS (INSERT INTO channels (tenant_id, name, is_private) VALUES ('default', 'secret', TRUE) RETURNING id)
+        INSERT INTO messages (content, is_palindrome, channel_id) SELECT 'Was it a car or a cat I saw', TRUE, id FROM channel`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+
+	router := mux.NewRouter()
+	router.HandleFunc("/stats", GetStats).Methods("GET")
+	database.DB = testDB
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, status)
+	}
+
+	var stats Stats
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.TotalMessages != 5 {
+		t.Errorf("Expected TotalMessages 5, got %d", stats.TotalMessages)
+	}
+	if stats.Palindromes != 4 {
+		t.Errorf("Expected Palindromes 4, got %d", stats.Palindromes)
+	}
+	if stats.PalindromeRatio != 0.8 {
+		t.Errorf("Expected PalindromeRatio 0.8, got %v", stats.PalindromeRatio)
+	}
+	if len(stats.Daily) != 1 || stats.Daily[0].Total != 5 {
+		t.Errorf("Expected a single daily bucket of 5 messages, got %+v", stats.Daily)
+	}
+	if len(stats.LengthHistogram) != 2 {
+		t.Fatalf("Expected 2 length buckets, got %+v", stats.LengthHistogram)
+	}
+	if last := stats.LengthHistogram[1]; last.Min != 900 || last.Max != 1000 || last.Count != 1 {
+		t.Errorf("Expected the 1000 character message in the last bucket, got %+v", last)
+	}
+	if len(stats.LongestPalindromes) != 3 || len(stats.LongestPalindromes[0].Content) != 1000 {
+		t.Errorf("Expected the longest palindrome first, got %+v", stats.LongestPalindromes)
+	}
+
+	// An invalid range is rejected
+	req, err = http.NewRequest("GET", "/stats?from=yesterday", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, status)
+	}
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/channels"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+	"github.com/shawn1912/messages-service/moderation"
+	"github.com/shawn1912/messages-service/outbox"
+	"github.com/shawn1912/messages-service/webhooks"
+)
+
+// Events delivers the changes recorded by every instance of the service to
+// this instance's streams. An events.Listener feeds it.
+var Events = events.NewBroker(1000, 64)
+
+// StreamHeartbeatInterval is how often an idle stream sends a comment so that
+// proxies and clients can tell it is still alive.
+var StreamHeartbeatInterval = 15 * time.Second
+
+// OutboxEnabled is whether changes are also written to the outbox, to be
+// published to the event bus by an outbox.Relay.
+var OutboxEnabled = false
+
+// recordEvent records a change to msg in tx, to be announced to subscribers,
+// delivered to webhooks and, if OutboxEnabled, published to the event bus once
+// tx commits.
+func recordEvent(tx *sql.Tx, eventType string, principal auth.Principal, msg database.Message) error {
+	return publishEvent(tx, events.Event{Type: eventType, Tenant: principal.Tenant, Message: msg})
+}
+
+// publishEvent records event in tx like recordEvent, for events carrying more
+// than the message. Nothing is recorded about scheduled messages, or messages
+// hidden by moderation: they are announced as created once a Scheduler
+// publishes them or a moderator approves them.
+func publishEvent(tx *sql.Tx, event events.Event) error {
+	if event.Message.PublishAt != nil || moderation.Hidden(event.Message.ModerationState) {
+		return nil
+	}
+	if err := events.Record(tx, &event); err != nil {
+		return err
+	}
+	if OutboxEnabled {
+		if err := outbox.Write(tx, event); err != nil {
+			return err
+		}
+	}
+	return webhooks.Enqueue(tx, event)
+}
+
+// StreamMessages streams the changes to the caller's tenant's messages as
+// Server-Sent Events. Clients resume with the Last-Event-ID header, or the
+// 'lastEventId' query parameter; if events after it are no longer buffered, a
+// 'reset' event tells them to reload instead. Clients that cannot keep up are
+// disconnected and can reconnect to resume.
+func StreamMessages(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	lastIDStr := r.Header.Get("Last-Event-ID")
+	if lastIDStr == "" {
+		lastIDStr = r.URL.Query().Get("lastEventId")
+	}
+	lastID, err := parseLastEventID(lastIDStr)
+	if err != nil {
+		http.Error(w, "Invalid last event ID", http.StatusBadRequest)
+		return
+	}
+
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	if principal.Tenant == "" {
+		principal.Tenant = database.DefaultTenant
+	}
+
+	sub, backlog, complete := Events.Subscribe(lastID, visibleEvents(principal, nil))
+	defer sub.Close()
+	access := newChannelAccess(principal)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range backlog {
+		if access.allows(r.Context(), event) {
+			writeEvent(w, event)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(StreamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case event, ok := <-sub.Events():
+			if !ok {
+				// Dropped for falling behind; the client resumes on reconnect
+				return
+			}
+			if access.allows(r.Context(), event) {
+				writeEvent(w, event)
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// visibleEvents returns a subscription filter for the events about messages
+// principal may read in its tenant that also pass match, if not nil. Filters
+// run for every event published, so they cannot look up channel membership:
+// subscribers check events about messages in private channels with a
+// channelAccess as they deliver them.
+func visibleEvents(principal auth.Principal, match func(events.Event) bool) func(events.Event) bool {
+	return func(event events.Event) bool {
+		return event.Tenant == principal.Tenant && canRead(principal, event.Message) &&
+			(match == nil || match(event))
+	}
+}
+
+// channelMembershipTTL is how long a subscriber's membership of a private
+// channel is trusted before it is looked up again.
+const channelMembershipTTL = 30 * time.Second
+
+// channelAccess decides whether events about messages in private channels
+// reach one subscriber: their authors, admins and the channels' members. It
+// caches the memberships it looks up, and is not safe for concurrent use.
+type channelAccess struct {
+	principal auth.Principal
+	members   map[int64]channelMembership
+}
+
+type channelMembership struct {
+	member  bool
+	checked time.Time
+}
+
+func newChannelAccess(principal auth.Principal) *channelAccess {
+	return &channelAccess{principal: principal, members: map[int64]channelMembership{}}
+}
+
+// allows reports whether event may be delivered to the subscriber. Events are
+// withheld if membership cannot be looked up.
+func (a *channelAccess) allows(ctx context.Context, event events.Event) bool {
+	msg := event.Message
+	if !msg.ChannelPrivate || msg.ChannelID == nil || canModify(a.principal, msg) {
+		return true
+	}
+	membership, ok := a.members[*msg.ChannelID]
+	if !ok || time.Since(membership.checked) > channelMembershipTTL {
+		member, err := isChannelMember(ctx, a.principal, *msg.ChannelID)
+		if err != nil {
+			log.Printf("Checking membership of channel %d: %v", *msg.ChannelID, err)
+			return false
+		}
+		membership = channelMembership{member: member, checked: time.Now()}
+		a.members[*msg.ChannelID] = membership
+	}
+	return membership.member
+}
+
+// isChannelMember reports whether principal is a member of the channel with
+// ID id in its tenant.
+func isChannelMember(ctx context.Context, principal auth.Principal, id int64) (bool, error) {
+	tx, err := database.BeginTenant(ctx, principal.Tenant)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	return channels.IsMember(tx, principal.Tenant, id, principal.Subject)
+}
+
+// parseLastEventID parses an optional event ID to resume from.
+func parseLastEventID(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid event ID %q", value)
+	}
+	return id, nil
+}
+
+// writeEvent writes event in the text/event-stream format.
+func writeEvent(w http.ResponseWriter, event events.Event) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/channels"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+)
+
+// publishTestEvent publishes a change to msg as if it had been recorded.
+func publishTestEvent(eventType string, principal auth.Principal, msg database.Message) {
+	Events.Publish(events.Event{Type: eventType, Tenant: principal.Tenant, Message: msg})
+}
+
+// readEvent reads the next event from an SSE stream, skipping comments, and
+// returns its fields.
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	t.Helper()
+	fields := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if len(fields) > 0 {
+				return fields
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, ": ")
+		fields[name] = value
+	}
+}
+
+// Tests GET /messages/stream
+func TestStreamMessages(t *testing.T) {
+	Events = events.NewBroker(10, 10)
+	StreamHeartbeatInterval = 10 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := auth.Principal{Subject: "alice", Scopes: []string{auth.ScopeRead}, Tenant: "acme"}
+		StreamMessages(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	}))
+	defer server.Close()
+
+	acme := auth.Principal{Subject: "bob", Tenant: "acme"}
+	publishTestEvent(events.MessageCreated, acme, database.Message{ID: 1, Content: "before"})
+	Events.Publish(events.Event{Type: events.MessageUpdated, Tenant: acme.Tenant,
+		Message: database.Message{ID: 1, Content: "replayed"}})
+
+	// Resuming from the first event replays the rest of the buffer
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected Content-Type text/event-stream, got %q", ct)
+	}
+	reader := bufio.NewReader(resp.Body)
+
+	event := readEvent(t, reader)
+	if event["id"] != "2" || event["event"] != events.MessageUpdated || !strings.Contains(event["data"], "replayed") {
+		t.Errorf("Expected replayed event 2, got %v", event)
+	}
+
+	// Other tenants' changes and other users' private messages are not sent
+	publishTestEvent(events.MessageCreated, auth.Principal{Subject: "carol", Tenant: "other"}, database.Message{ID: 2, Content: "other tenant"})
+	publishTestEvent(events.MessageCreated, acme, database.Message{ID: 3, Content: "secret", OwnerID: "bob", IsPrivate: true})
+	publishTestEvent(events.MessageDeleted, acme, database.Message{ID: 1, Content: "replayed"})
+
+	event = readEvent(t, reader)
+	if event["event"] != events.MessageDeleted || event["id"] != "5" {
+		t.Errorf("Expected delete event 5, got %v", event)
+	}
+
+	// Heartbeats keep idle streams alive
+	line, err := reader.ReadString('\n')
+	if err != nil || line != ": heartbeat\n" {
+		t.Errorf("Expected a heartbeat, got %q (%v)", line, err)
+	}
+}
+
+// Tests that a stream resuming from an event no longer buffered is told to reset
+func TestStreamMessages_Reset(t *testing.T) {
+	Events = events.NewBroker(2, 10)
+	for i := 0; i < 5; i++ {
+		publishTestEvent(events.MessageCreated, auth.Principal{Tenant: database.DefaultTenant}, database.Message{ID: int64(i)})
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(StreamMessages))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+
+	if event := readEvent(t, reader); event["event"] != "reset" {
+		t.Errorf("Expected a reset event, got %v", event)
+	}
+	if event := readEvent(t, reader); event["id"] != "4" {
+		t.Errorf("Expected the oldest buffered event 4, got %v", event)
+	}
+
+	req, _ = http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+// Tests that events about messages in private channels reach the channels'
+// members only
+func TestStreamMessages_PrivateChannel(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+	Events = events.NewBroker(10, 10)
+
+	tx, err := database.BeginTenant(context.Background(), database.DefaultTenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := channels.Channel{Name: "secrets", IsPrivate: true, CreatedBy: "alice"}
+	if err := channels.Create(tx, database.DefaultTenant, &channel); err != nil {
+		t.Fatal(err)
+	}
+	if err := channels.AddMember(tx, database.DefaultTenant, channel.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := auth.Principal{Subject: r.URL.Query().Get("as"), Scopes: []string{auth.ScopeRead}, Tenant: database.DefaultTenant}
+		StreamMessages(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	}))
+	defer server.Close()
+
+	alice := auth.Principal{Subject: "alice", Tenant: database.DefaultTenant}
+	publishTestEvent(events.MessageCreated, alice, database.Message{ID: 1, Content: "before", OwnerID: "alice"})
+	publishTestEvent(events.MessageCreated, alice, database.Message{ID: 2, Content: "secret", OwnerID: "alice",
+		ChannelID: &channel.ID, ChannelPrivate: true})
+	publishTestEvent(events.MessageCreated, alice, database.Message{ID: 3, Content: "public", OwnerID: "alice"})
+
+	for _, tt := range []struct {
+		subject string
+		id      string
+	}{
+		{"bob", "2"},
+		{"carol", "3"},
+	} {
+		req, _ := http.NewRequest("GET", server.URL+"?as="+tt.subject, nil)
+		req.Header.Set("Last-Event-ID", "1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event := readEvent(t, bufio.NewReader(resp.Body)); event["id"] != tt.id {
+			t.Errorf("Expected %s's first event to be %s, got %v", tt.subject, tt.id, event)
+		}
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/tags"
+)
+
+// AddMessageTags adds the tags in the body, {"tags": [...]}, to a message and
+// returns all of its tags. Only the message's owner or an admin may tag it.
+func AddMessageTags(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names, ok := normalizeTags(w, req.Tags)
+	if !ok {
+		return
+	}
+	if len(names) == 0 {
+		http.Error(w, "'tags' is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	msg, ok := loadModifiableMessage(w, tx, principal, id)
+	if !ok {
+		return
+	}
+	if err := tags.Add(tx, principal.Tenant, id, names, false); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	messages := []database.Message{msg}
+	if err := loadTags(tx, principal.Tenant, messages); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Tags []string `json:"tags"`
+	}{messages[0].Tags})
+}
+
+// RemoveMessageTag removes the tag in the 'tag' route variable from a message.
+// Only the message's owner or an admin may untag it. Automatic tags can be
+// removed too, but come back when the message next changes.
+func RemoveMessageTag(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	name, err := tags.Normalize(mux.Vars(r)["tag"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := loadModifiableMessage(w, tx, principal, id); !ok {
+		return
+	}
+	removed, err := tags.Remove(tx, principal.Tenant, id, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addTagFilter adds the conditions of the 'tag' query parameters, which may
+// be repeated, to where. Messages must have every tag, or with 'tagMode=any'
+// at least one of them. On invalid parameters it writes a 400 response and
+// returns false.
+func addTagFilter(w http.ResponseWriter, r *http.Request, where *conditions) bool {
+	query := r.URL.Query()
+	names, ok := normalizeTags(w, query["tag"])
+	if !ok {
+		return false
+	}
+	mode := query.Get("tagMode")
+	if mode != "" && mode != "all" && mode != "any" {
+		http.Error(w, "Invalid 'tagMode' parameter. It must be all or any.", http.StatusBadRequest)
+		return false
+	}
+	if len(names) == 0 {
+		return true
+	}
+
+	tagged := `SELECT mt.message_id FROM message_tags mt JOIN tags t ON t.id = mt.tag_id WHERE t.name = ANY(?)`
+	if mode == "any" {
+		where.add("id IN ("+tagged+")", pq.Array(names))
+	} else {
+		where.add("id IN ("+tagged+" GROUP BY mt.message_id HAVING COUNT(*) = ?)", pq.Array(names), len(names))
+	}
+	return true
+}
+
+// normalizeTags normalizes and deduplicates tag names. If one is invalid it
+// writes a 400 response and returns false.
+func normalizeTags(w http.ResponseWriter, names []string) ([]string, bool) {
+	normalized := []string{}
+	for _, name := range names {
+		name, err := tags.Normalize(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, false
+		}
+		if !slices.Contains(normalized, name) {
+			normalized = append(normalized, name)
+		}
+	}
+	return normalized, true
+}
+
+// loadTags fills in the tags of messages.
+func loadTags(tx *sql.Tx, tenant string, messages []database.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	tagged, err := tags.ForMessages(tx, tenant, ids)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].Tags = tagged[messages[i].ID]
+	}
+	return nil
+}
+
+// setAutomaticTags recomputes the automatic tags of msg and fills in all of
+// its tags and reactions.
+func setAutomaticTags(tx *sql.Tx, tenant string, msg *database.Message) error {
+	if err := tags.SetAutomatic(tx, tenant, msg.ID, tags.Automatic(*msg)); err != nil {
+		return err
+	}
+	messages := []database.Message{*msg}
+	if err := loadDetails(tx, tenant, messages); err != nil {
+		return err
+	}
+	msg.Tags, msg.Reactions = messages[0].Tags, messages[0].Reactions
+	return nil
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestTags(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+
+	router := mux.NewRouter()
+	router.HandleFunc("/message", CreateMessage).Methods("POST")
+	router.HandleFunc("/message/{id:[0-9]+}", GetMessage).Methods("GET")
+	router.HandleFunc("/message/{id:[0-9]+}", UpdateMessage).Methods("PATCH")
+	router.HandleFunc("/message/{id:[0-9]+}/tags", AddMessageTags).Methods("POST")
+	router.HandleFunc("/message/{id:[0-9]+}/tags/{tag}", RemoveMessageTag).Methods("DELETE")
+	router.HandleFunc("/messages", ListMessages).Methods("GET")
+
+	send := newSender(t, router)
+	create := func(content string) database.Message {
+		var msg database.Message
+		json.Unmarshal(send("POST", "/message", "alice", map[string]any{"content": content}).Body.Bytes(), &msg)
+		return msg
+	}
+
+	racecar := create("Racecar")
+	hello := create("Hello")
+	if !slices.Equal(racecar.Tags, []string{"palindrome"}) || len(hello.Tags) != 0 {
+		t.Errorf("Expected only the palindrome to be tagged automatically, got %v and %v", racecar.Tags, hello.Tags)
+	}
+
+	rr := send("POST", fmt.Sprintf("/message/%d/tags", racecar.ID), "alice", map[string]any{"tags": []string{"Cars", "fun"}})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	send("POST", fmt.Sprintf("/message/%d/tags", hello.ID), "alice", map[string]any{"tags": []string{"fun"}})
+	if rr := send("POST", fmt.Sprintf("/message/%d/tags", hello.ID), "bob", map[string]any{"tags": []string{"spam"}}); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d tagging someone else's message, got %d", http.StatusForbidden, rr.Code)
+	}
+	if rr := send("POST", fmt.Sprintf("/message/%d/tags", hello.ID), "alice", map[string]any{"tags": []string{"no spaces"}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid tag, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	list := func(query string) []int64 {
+		var page messagePage
+		json.Unmarshal(send("GET", "/messages?"+query, "bob", nil).Body.Bytes(), &page)
+		var ids []int64
+		for _, msg := range page.Messages {
+			ids = append(ids, msg.ID)
+		}
+		if page.Pagination.TotalMessages != len(ids) {
+			t.Errorf("Expected a total of %d for %q, got %d", len(ids), query, page.Pagination.TotalMessages)
+		}
+		return ids
+	}
+	if ids := list("tag=fun&tag=cars"); !slices.Equal(ids, []int64{racecar.ID}) {
+		t.Errorf("Expected only %d with both tags, got %v", racecar.ID, ids)
+	}
+	if ids := list("tag=palindrome&tag=fun&tagMode=any"); !slices.Equal(ids, []int64{racecar.ID, hello.ID}) {
+		t.Errorf("Expected both messages with either tag, got %v", ids)
+	}
+
+	// Automatic tags follow the content
+	var updated database.Message
+	json.Unmarshal(send("PATCH", fmt.Sprintf("/message/%d", racecar.ID), "alice", map[string]any{"content": "Cars"}).Body.Bytes(), &updated)
+	if !slices.Equal(updated.Tags, []string{"cars", "fun"}) {
+		t.Errorf("Expected the palindrome tag to be dropped, got %v", updated.Tags)
+	}
+
+	if rr := send("DELETE", fmt.Sprintf("/message/%d/tags/fun", hello.ID), "alice", nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	if rr := send("DELETE", fmt.Sprintf("/message/%d/tags/fun", hello.ID), "alice", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d removing a missing tag, got %d", http.StatusNotFound, rr.Code)
+	}
+}
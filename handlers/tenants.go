@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+)
+
+// DefaultQuota applies to tenants whose row in the tenants table does not set
+// their own limits.
+var DefaultQuota database.TenantQuota
+
+// beginTenantTx starts a transaction scoped to the caller's tenant and returns
+// it along with the caller. Requests that did not pass through the
+// authentication middleware act on the default tenant. On failure it writes a
+// 500 response and returns false.
+func beginTenantTx(w http.ResponseWriter, r *http.Request) (*sql.Tx, auth.Principal, bool) {
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	if principal.Tenant == "" {
+		principal.Tenant = database.DefaultTenant
+	}
+
+	tx, err := database.BeginTenant(r.Context(), principal.Tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, auth.Principal{}, false
+	}
+	return tx, principal, true
+}
+
+// checkContentQuota verifies content fits the tenant's content length limit.
+// If not, it writes a 400 response and returns false.
+func checkContentQuota(w http.ResponseWriter, quota database.TenantQuota, content string) bool {
+	if quota.MaxContentLength > 0 && utf8.RuneCountInString(content) > quota.MaxContentLength {
+		http.Error(w, fmt.Sprintf("Message content exceeds the tenant's limit of %d characters", quota.MaxContentLength),
+			http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// checkMessageQuota verifies the tenant may store another message. It holds a
+// transaction-level lock so concurrent creates cannot both take the last slot.
+// If the quota is used up it writes a 403 response and returns false.
+func checkMessageQuota(w http.ResponseWriter, tx *sql.Tx, tenant string, quota database.TenantQuota) bool {
+	if quota.MaxMessages <= 0 {
+		return true
+	}
+
+	_, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", "messages:"+tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	var count int
+	err = tx.QueryRow("SELECT COUNT(*) FROM messages WHERE tenant_id = $1", tenant).Scan(&count)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if count >= quota.MaxMessages {
+		http.Error(w, fmt.Sprintf("Tenant message quota of %d messages exceeded", quota.MaxMessages), http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+)
+
+// What happens to the replies of a deleted message.
+const (
+	// DeleteOrphan deletes the message and makes each of its replies the
+	// root of a thread of its own.
+	DeleteOrphan = "orphan"
+	// DeleteTombstone keeps a message that has replies as a tombstone,
+	// without its content, so that the thread stays intact. Tombstones are
+	// deleted once their last reply is.
+	DeleteTombstone = "tombstone"
+	// DeleteCascade deletes the message along with all of its replies.
+	DeleteCascade = "cascade"
+)
+
+// ThreadDeleteMode is what happens to the replies of deleted messages: one of
+// DeleteOrphan, DeleteTombstone or DeleteCascade.
+var ThreadDeleteMode = DeleteTombstone
+
+const (
+	defaultThreadDepth = 3
+	maxThreadDepth     = 10
+)
+
+// threadNode is a message along with the replies to it.
+type threadNode struct {
+	database.Message
+	Replies []*threadNode `json:"replies"`
+}
+
+// threadPage is the response body of GET /message/{id}/thread.
+type threadPage struct {
+	Message    *threadNode `json:"message"`
+	Pagination struct {
+		CurrentPage  int `json:"currentPage"`
+		PageSize     int `json:"pageSize"`
+		TotalPages   int `json:"totalPages"`
+		TotalReplies int `json:"totalReplies"`
+	} `json:"pagination"`
+}
+
+// CreateReply creates a message replying to the message with the given ID,
+// in the same thread.
+func CreateReply(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	createMessage(w, r, id, 0)
+}
+
+// GetThread returns a message along with the tree of replies to it, oldest
+// first. The direct replies are paginated with 'page' and 'limit'; 'depth'
+// sets how many levels of replies are included, up to 10. Replies the caller
+// cannot read are left out along with the replies to them.
+func GetThread(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	page, limit, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+	depth := defaultThreadDepth
+	if depthStr := r.URL.Query().Get("depth"); depthStr != "" {
+		depth, err = strconv.Atoi(depthStr)
+		if err != nil || depth <= 0 || depth > maxThreadDepth {
+			http.Error(w, fmt.Sprintf("Invalid 'depth' parameter. It must be an integer from 1 to %d.", maxThreadDepth),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	root, ok := loadVisibleMessage(w, tx, principal, id)
+	if !ok {
+		return
+	}
+
+	// The same visibility conditions apply at every level of the tree
+	var visible conditions
+	visible.add("tenant_id = ?", principal.Tenant)
+	visible.addVisibleTo(principal)
+	clause := strings.Join(visible.clauses, " AND ")
+	n := len(visible.args)
+	args := append(append([]any{}, visible.args...), id, depth, limit, (page-1)*limit)
+
+	query := fmt.Sprintf(`
+        WITH RECURSIVE top AS (
+            SELECT id FROM messages
+            WHERE %[1]s AND parent_id = $%[2]d
+            ORDER BY id ASC
+            LIMIT $%[4]d OFFSET $%[5]d
+        ), tree AS (
+            SELECT id, 1 AS depth FROM top
+            UNION ALL
+            SELECT m.id, tree.depth + 1
+            FROM messages m JOIN tree ON m.parent_id = tree.id
+            WHERE %[1]s AND tree.depth < $%[3]d
+        )
+        SELECT `+messageColumns+`
+        FROM messages JOIN tree USING (id)
+        ORDER BY tree.depth ASC, id ASC
+    `, clause, n+1, n+2, n+3, n+4)
+
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	replies, err := scanMessages(rows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var totalReplies int
+	err = tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM messages WHERE %s AND parent_id = $%d", clause, n+1),
+		append(append([]any{}, visible.args...), id)...).Scan(&totalReplies)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	messages := append([]database.Message{root}, replies...)
+	if err := loadDetails(tx, principal.Tenant, messages); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	root, replies = messages[0], messages[1:]
+
+	// Parents come before their replies, since the rows are ordered by depth
+	response := threadPage{Message: &threadNode{Message: root, Replies: []*threadNode{}}}
+	nodes := map[int64]*threadNode{root.ID: response.Message}
+	for _, reply := range replies {
+		node := &threadNode{Message: reply, Replies: []*threadNode{}}
+		nodes[reply.ID] = node
+		if parent := nodes[*reply.ParentID]; parent != nil {
+			parent.Replies = append(parent.Replies, node)
+		}
+	}
+	response.Pagination.CurrentPage = page
+	response.Pagination.PageSize = limit
+	response.Pagination.TotalPages = (totalReplies + limit - 1) / limit
+	response.Pagination.TotalReplies = totalReplies
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// deleteMessage deletes msg according to ThreadDeleteMode and returns the
+// messages deleted, as they were before. In DeleteTombstone mode, the
+// tombstones left without replies are deleted too.
+func deleteMessage(tx *sql.Tx, principal auth.Principal, msg database.Message) ([]database.Message, error) {
+	switch ThreadDeleteMode {
+	case DeleteCascade:
+		rows, err := tx.Query(`
+            WITH RECURSIVE subtree AS (
+                SELECT id FROM messages WHERE id = $1 AND tenant_id = $2
+                UNION ALL
+                SELECT m.id FROM messages m JOIN subtree ON m.parent_id = subtree.id
+                WHERE m.tenant_id = $2
+            )
+            DELETE FROM messages WHERE id IN (SELECT id FROM subtree)
+            RETURNING `+messageColumns, msg.ID, principal.Tenant)
+		if err != nil {
+			return nil, err
+		}
+		return scanMessages(rows)
+
+	case DeleteTombstone:
+		var hasReplies bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM messages WHERE parent_id = $1 AND tenant_id = $2)",
+			msg.ID, principal.Tenant).Scan(&hasReplies)
+		if err != nil {
+			return nil, err
+		}
+		if hasReplies {
+			_, err = tx.Exec(`
+                UPDATE messages
+                SET content = '', is_palindrome = FALSE, anagram_signature = NULL, expires_at = NULL,
+                    content_hash = '', minhash = NULL, minhash_bands = NULL, deleted_at = NOW(), updated_at = NOW()
+                WHERE id = $1 AND tenant_id = $2
+            `, msg.ID, principal.Tenant)
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.Exec("DELETE FROM message_tags WHERE message_id = $1 AND tenant_id = $2", msg.ID, principal.Tenant)
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.Exec("DELETE FROM message_attachments WHERE message_id = $1 AND tenant_id = $2", msg.ID, principal.Tenant)
+			if err != nil {
+				return nil, err
+			}
+			_, err = tx.Exec("DELETE FROM message_reactions WHERE message_id = $1 AND tenant_id = $2", msg.ID, principal.Tenant)
+			if err != nil {
+				return nil, err
+			}
+			return []database.Message{msg}, nil
+		}
+
+	default:
+		// Each direct reply becomes the root of its subtree's thread
+		_, err := tx.Exec(`
+            WITH RECURSIVE orphans AS (
+                SELECT id, id AS root FROM messages WHERE parent_id = $1 AND tenant_id = $2
+                UNION ALL
+                SELECT m.id, orphans.root FROM messages m JOIN orphans ON m.parent_id = orphans.id
+                WHERE m.tenant_id = $2
+            )
+            UPDATE messages
+            SET parent_id = NULLIF(messages.parent_id, $1), thread_id = NULLIF(orphans.root, messages.id)
+            FROM orphans
+            WHERE messages.id = orphans.id
+        `, msg.ID, principal.Tenant)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM messages WHERE id = $1 AND tenant_id = $2", msg.ID, principal.Tenant); err != nil {
+		return nil, err
+	}
+	deleted := []database.Message{msg}
+	if ThreadDeleteMode == DeleteTombstone {
+		pruned, err := pruneTombstones(tx, principal.Tenant, msg.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, pruned...)
+	}
+	return deleted, nil
+}
+
+// pruneTombstones deletes the tombstone parent, and then each tombstone above
+// it, for as long as they are left without replies, and returns them as they
+// were before.
+func pruneTombstones(tx *sql.Tx, tenant string, parent *int64) ([]database.Message, error) {
+	var pruned []database.Message
+	for parent != nil {
+		// Locking the parent before looking for replies makes a concurrent
+		// deletion of its last other reply wait, and then see this one gone
+		var msg database.Message
+		row := tx.QueryRow(`SELECT `+messageColumns+` FROM messages WHERE id = $1 AND tenant_id = $2 FOR UPDATE`, *parent, tenant)
+		if err := scanMessage(row, &msg); err == sql.ErrNoRows {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if msg.DeletedAt == nil {
+			break
+		}
+		var hasReplies bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM messages WHERE parent_id = $1 AND tenant_id = $2)",
+			msg.ID, tenant).Scan(&hasReplies)
+		if err != nil {
+			return nil, err
+		}
+		if hasReplies {
+			break
+		}
+		if _, err := tx.Exec("DELETE FROM messages WHERE id = $1 AND tenant_id = $2", msg.ID, tenant); err != nil {
+			return nil, err
+		}
+		pruned = append(pruned, msg)
+		parent = msg.ParentID
+	}
+	return pruned, nil
+}
@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/shawn1912/messages-service/database"
+)
+
+// createThread creates a root message by alice with replies
+// root <- a <- b and root <- c, returning their IDs.
+func createThread(t *testing.T, send func(method, path, subject string, payload any) *httptest.ResponseRecorder) (root, a, b, c int64) {
+	t.Helper()
+	create := func(path, content string) int64 {
+		rr := send("POST", path, "alice", map[string]any{"content": content})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status code %d creating %q, got %d: %s", http.StatusCreated, content, rr.Code, rr.Body)
+		}
+		var msg database.Message
+		json.Unmarshal(rr.Body.Bytes(), &msg)
+		return msg.ID
+	}
+	root = create("/message", "root")
+	a = create(fmt.Sprintf("/message/%d/replies", root), "a")
+	b = create(fmt.Sprintf("/message/%d/replies", a), "b")
+	c = create(fmt.Sprintf("/message/%d/replies", root), "c")
+	return root, a, b, c
+}
+
+func TestThreads(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+	send := newMessageRouter(t)
+	root, a, b, c := createThread(t, send)
+
+	var reply database.Message
+	json.Unmarshal(send("GET", fmt.Sprintf("/message/%d", b), "bob", nil).Body.Bytes(), &reply)
+	if reply.ParentID == nil || *reply.ParentID != a || reply.ThreadID != root {
+		t.Errorf("Expected reply to %d in thread %d, got %+v", a, root, reply)
+	}
+
+	var thread threadPage
+	rr := send("GET", fmt.Sprintf("/message/%d/thread", root), "bob", nil)
+	if err := json.Unmarshal(rr.Body.Bytes(), &thread); err != nil {
+		t.Fatal(err)
+	}
+	if thread.Message.ID != root || len(thread.Message.Replies) != 2 || thread.Pagination.TotalReplies != 2 {
+		t.Fatalf("Expected root with 2 replies, got %s", rr.Body)
+	}
+	first := thread.Message.Replies[0]
+	if first.ID != a || len(first.Replies) != 1 || first.Replies[0].ID != b || thread.Message.Replies[1].ID != c {
+		t.Errorf("Unexpected reply tree %s", rr.Body)
+	}
+
+	// Depth and pagination limit the tree
+	thread = threadPage{}
+	json.Unmarshal(send("GET", fmt.Sprintf("/message/%d/thread?depth=1&limit=1&page=2", root), "bob", nil).Body.Bytes(), &thread)
+	if len(thread.Message.Replies) != 1 || thread.Message.Replies[0].ID != c || thread.Pagination.TotalPages != 2 {
+		t.Errorf("Expected only reply %d on page 2, got %+v", c, thread.Message.Replies)
+	}
+	thread = threadPage{}
+	json.Unmarshal(send("GET", fmt.Sprintf("/message/%d/thread?depth=1", root), "bob", nil).Body.Bytes(), &thread)
+	if len(thread.Message.Replies[0].Replies) != 0 {
+		t.Errorf("Expected no nested replies at depth 1, got %+v", thread.Message.Replies[0].Replies)
+	}
+	if rr := send("GET", fmt.Sprintf("/message/%d/thread?depth=11", root), "bob", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for too deep a thread, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// Private replies are hidden from others along with their replies
+	send("PATCH", fmt.Sprintf("/message/%d", a), "alice", map[string]any{"isPrivate": true})
+	thread = threadPage{}
+	json.Unmarshal(send("GET", fmt.Sprintf("/message/%d/thread", root), "bob", nil).Body.Bytes(), &thread)
+	if len(thread.Message.Replies) != 1 || thread.Message.Replies[0].ID != c {
+		t.Errorf("Expected only the public reply, got %+v", thread.Message.Replies)
+	}
+	if rr := send("POST", fmt.Sprintf("/message/%d/replies", a), "bob", map[string]any{"content": "hi"}); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d replying to a hidden message, got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestDeleteThread(t *testing.T) {
+	defer func(mode string) { ThreadDeleteMode = mode }(ThreadDeleteMode)
+	database.DB = testDB
+
+	t.Run("tombstone", func(t *testing.T) {
+		teardownTestDatabase()
+		ThreadDeleteMode = DeleteTombstone
+		send := newMessageRouter(t)
+		root, a, b, c := createThread(t, send)
+		testDB.Exec("INSERT INTO message_reactions (message_id, tenant_id, user_id, emoji) VALUES ($1, $2, 'bob', '👍')",
+			root, database.DefaultTenant)
+
+		if rr := send("DELETE", fmt.Sprintf("/message/%d", root), "alice", nil); rr.Code != http.StatusNoContent {
+			t.Fatalf("Expected status code %d, got %d", http.StatusNoContent, rr.Code)
+		}
+		var msg database.Message
+		json.Unmarshal(send("GET", fmt.Sprintf("/message/%d", root), "alice", nil).Body.Bytes(), &msg)
+		if msg.DeletedAt == nil || msg.Content != "" {
+			t.Errorf("Expected a tombstone, got %+v", msg)
+		}
+		if rr := send("PATCH", fmt.Sprintf("/message/%d", root), "alice", map[string]any{"content": "back"}); rr.Code != http.StatusGone {
+			t.Errorf("Expected status code %d updating a tombstone, got %d", http.StatusGone, rr.Code)
+		}
+		if rr := send("POST", fmt.Sprintf("/message/%d/replies", root), "alice", map[string]any{"content": "hi"}); rr.Code != http.StatusConflict {
+			t.Errorf("Expected status code %d replying to a tombstone, got %d", http.StatusConflict, rr.Code)
+		}
+
+		var reactions int
+		testDB.QueryRow("SELECT COUNT(*) FROM message_reactions WHERE message_id = $1", root).Scan(&reactions)
+		if reactions != 0 {
+			t.Errorf("Expected the tombstone's reactions to be deleted, got %d", reactions)
+		}
+
+		// Messages without replies are deleted outright, along with the
+		// tombstones they leave without replies
+		send("DELETE", fmt.Sprintf("/message/%d", a), "alice", nil)
+		send("DELETE", fmt.Sprintf("/message/%d", c), "alice", nil)
+		if rr := send("GET", fmt.Sprintf("/message/%d", root), "alice", nil); rr.Code != http.StatusOK {
+			t.Errorf("Expected the tombstone with a reply left to be kept, got %d", rr.Code)
+		}
+		send("DELETE", fmt.Sprintf("/message/%d", b), "alice", nil)
+		for _, id := range []int64{b, a, root} {
+			if rr := send("GET", fmt.Sprintf("/message/%d", id), "alice", nil); rr.Code != http.StatusNotFound {
+				t.Errorf("Expected status code %d for %d, got %d", http.StatusNotFound, id, rr.Code)
+			}
+		}
+		var announced int
+		testDB.QueryRow("SELECT COUNT(*) FROM message_events WHERE type = 'message.deleted' AND (message->>'id')::int = $1", root).Scan(&announced)
+		if announced != 2 {
+			t.Errorf("Expected the tombstone's deletion to be announced, got %d deletion events", announced)
+		}
+	})
+
+	t.Run("orphan", func(t *testing.T) {
+		teardownTestDatabase()
+		ThreadDeleteMode = DeleteOrphan
+		send := newMessageRouter(t)
+		_, a, b, _ := createThread(t, send)
+
+		send("DELETE", fmt.Sprintf("/message/%d", a), "alice", nil)
+		var msg database.Message
+		json.Unmarshal(send("GET", fmt.Sprintf("/message/%d", b), "alice", nil).Body.Bytes(), &msg)
+		if msg.ParentID != nil || msg.ThreadID != b {
+			t.Errorf("Expected %d to become a thread root, got %+v", b, msg)
+		}
+	})
+
+	t.Run("cascade", func(t *testing.T) {
+		teardownTestDatabase()
+		ThreadDeleteMode = DeleteCascade
+		send := newMessageRouter(t)
+		root, _, _, _ := createThread(t, send)
+
+		send("DELETE", fmt.Sprintf("/message/%d", root), "alice", nil)
+		var count int
+		if err := testDB.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			t.Errorf("Expected the whole thread to be deleted, found %d messages", count)
+		}
+	})
+}
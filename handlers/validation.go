@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/shawn1912/messages-service/validation"
+)
+
+// ContentRules are the rules the content of new and updated messages must
+// meet.
+var ContentRules = validation.DefaultRules
+
+// AllowUnknownFields accepts message bodies with fields the API does not know
+// instead of rejecting them.
+var AllowUnknownFields bool
+
+// decodeMessageBody decodes the JSON body of a message request into v,
+// returning the field errors it has. If the body is not a JSON object, it
+// writes a 400 response and returns false.
+func decodeMessageBody(w http.ResponseWriter, body []byte, v any) (validation.Errors, bool) {
+	errs, err := validation.DecodeJSON(body, v, AllowUnknownFields)
+	if err != nil {
+		writeValidationErrors(w, validation.Errors{{Code: validation.CodeInvalid, Message: "Invalid request body: " + err.Error()}})
+		return nil, false
+	}
+	return errs, true
+}
+
+// checkContent checks content against the ContentRules unless errs already
+// has an error about it, returning content normalized and errs with any
+// violations added.
+func checkContent(errs validation.Errors, content string) (string, validation.Errors) {
+	if errs.HasField("content") {
+		return content, errs
+	}
+	content, contentErrs := ContentRules.Content("content", content)
+	return content, append(errs, contentErrs...)
+}
+
+// writeValidationErrors writes a 400 response listing errs as
+// {"errors": [{"field": ..., "code": ..., "message": ...}]}. It is the only
+// JSON error response: only message bodies are reported this way, and every
+// other error, including other 400s, is written by http.Error as plain text.
+func writeValidationErrors(w http.ResponseWriter, errs validation.Errors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Errors validation.Errors `json:"errors"`
+	}{errs})
+}
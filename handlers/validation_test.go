@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/validation"
+)
+
+func TestContentValidation(t *testing.T) {
+	teardownTestDatabase()
+	database.DB = testDB
+	send := newMessageRouter(t)
+	fieldErrors := func(body []byte) string {
+		var resp struct {
+			Errors validation.Errors `json:"errors"`
+		}
+		json.Unmarshal(body, &resp)
+		var errs []string
+		for _, err := range resp.Errors {
+			errs = append(errs, err.Field+":"+err.Code)
+		}
+		return strings.Join(errs, ",")
+	}
+
+	// Lengths are counted in characters, after normalization
+	for _, content := range []string{strings.Repeat("\u00e9", 1000), strings.Repeat("e\u0301", 1000)} {
+		rr := send("POST", "/message", "alice", map[string]any{"content": content})
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("Expected status code %d for 1000 characters, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+		}
+		var msg database.Message
+		json.Unmarshal(rr.Body.Bytes(), &msg)
+		if msg.Content != strings.Repeat("\u00e9", 1000) {
+			t.Errorf("Expected the content to be normalized, got %.20q", msg.Content)
+		}
+	}
+
+	tests := []struct {
+		payload map[string]any
+		errors  string
+	}{
+		{map[string]any{"content": strings.Repeat("\u00e9", 1001)}, "content:too_long"},
+		{map[string]any{"content": ""}, "content:too_short"},
+		{map[string]any{}, "content:too_short"},
+		{map[string]any{"content": " \n "}, "content:blank"},
+		{map[string]any{"content": "null\x00byte"}, "content:control_character"},
+		{map[string]any{"content": 42}, "content:invalid_type"},
+		// Fields set by the server cannot be sent
+		{map[string]any{"content": "x", "moderationState": "visible"}, "moderationState:unknown_field"},
+		// Every violation is reported at once
+		{map[string]any{"content": "\t", "format": "html", "colour": "red"}, "colour:unknown_field,content:blank,format:invalid"},
+	}
+	for _, tt := range tests {
+		rr := send("POST", "/message", "alice", tt.payload)
+		if rr.Code != http.StatusBadRequest || fieldErrors(rr.Body.Bytes()) != tt.errors {
+			t.Errorf("Expected %s for %v, got %d: %s", tt.errors, tt.payload, rr.Code, rr.Body)
+		}
+	}
+
+	var msg database.Message
+	json.Unmarshal(send("POST", "/message", "alice", map[string]any{"content": "Hello"}).Body.Bytes(), &msg)
+	path := fmt.Sprintf("/message/%d", msg.ID)
+	rr := send("PATCH", path, "alice", map[string]any{"content": "", "isPrivate": "yes"})
+	if rr.Code != http.StatusBadRequest || fieldErrors(rr.Body.Bytes()) != "isPrivate:invalid_type,content:too_short" {
+		t.Errorf("Expected the invalid update to be rejected, got %d: %s", rr.Code, rr.Body)
+	}
+	rr = send("PATCH", path, "alice", map[string]any{"content": "Cafe\u0301"})
+	json.Unmarshal(rr.Body.Bytes(), &msg)
+	if rr.Code != http.StatusOK || msg.Content != "Caf\u00e9" {
+		t.Errorf("Expected the updated content to be normalized, got %d: %s", rr.Code, rr.Body)
+	}
+
+	// The rules are configurable
+	ContentRules, AllowUnknownFields = validation.Rules{MaxLength: 10}, true
+	defer func() { ContentRules, AllowUnknownFields = validation.DefaultRules, false }()
+	if rr := send("POST", "/message", "alice", map[string]any{"content": "", "colour": "red"}); rr.Code != http.StatusCreated {
+		t.Errorf("Expected empty content to be allowed, got %d: %s", rr.Code, rr.Body)
+	}
+	if rr := send("POST", "/message", "alice", map[string]any{"content": "Eleven char"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected content over the configured limit to be rejected, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,314 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/webhooks"
+)
+
+// webhookRequest is the body of requests creating or updating a webhook.
+// Fields left out of an update keep their values.
+type webhookRequest struct {
+	URL             *string   `json:"url"`
+	EventTypes      *[]string `json:"eventTypes"`
+	PalindromesOnly *bool     `json:"palindromesOnly"`
+	Active          *bool     `json:"active"`
+}
+
+// apply copies the fields set in the request to h.
+func (req webhookRequest) apply(h *webhooks.Webhook) {
+	if req.URL != nil {
+		h.URL = *req.URL
+	}
+	if req.EventTypes != nil {
+		h.EventTypes = *req.EventTypes
+	}
+	if req.PalindromesOnly != nil {
+		h.PalindromesOnly = *req.PalindromesOnly
+	}
+	if req.Active != nil {
+		h.Active = *req.Active
+	}
+}
+
+// decodeWebhookRequest reads a webhook request body. On failure it writes a
+// 4xx response and returns false.
+func decodeWebhookRequest(w http.ResponseWriter, r *http.Request) (webhookRequest, bool) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return webhookRequest{}, false
+	}
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return webhookRequest{}, false
+	}
+	return req, true
+}
+
+// parseIDVar parses the positive integer route variable name. On failure it
+// writes a 400 response and returns false.
+func parseIDVar(w http.ResponseWriter, r *http.Request, name string) (int64, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)[name], 10, 64)
+	if err != nil || id <= 0 {
+		http.Error(w, "Invalid "+name, http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+// CreateWebhook subscribes a URL to the tenant's message events. The response
+// includes the secret deliveries are signed with, which is not shown again.
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	req, ok := decodeWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.URL == nil {
+		http.Error(w, "'url' is required", http.StatusBadRequest)
+		return
+	}
+	hook := webhooks.Webhook{Active: true}
+	req.apply(&hook)
+	if err := hook.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	if err := webhooks.Create(tx, principal.Tenant, &hook); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// ListWebhooks returns the tenant's webhooks.
+func ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	hooks, err := webhooks.List(tx, principal.Tenant)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Webhooks []webhooks.Webhook `json:"webhooks"`
+	}{hooks})
+}
+
+// GetWebhook returns one of the tenant's webhooks.
+func GetWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	hook, ok := loadWebhook(w, tx, principal.Tenant, id)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook)
+}
+
+// UpdateWebhook changes a webhook's URL, filters or active flag.
+func UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	req, ok := decodeWebhookRequest(w, r)
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	hook, ok := loadWebhook(w, tx, principal.Tenant, id)
+	if !ok {
+		return
+	}
+	req.apply(&hook)
+	if err := hook.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := webhooks.Update(tx, principal.Tenant, &hook); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hook)
+}
+
+// DeleteWebhook removes a webhook and its deliveries.
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	deleted, err := webhooks.Delete(tx, principal.Tenant, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListWebhookDeliveries returns a paginated list of a webhook's deliveries,
+// newest first. The 'status' parameter selects 'pending', 'delivered' or
+// 'dead' deliveries.
+func ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	page, limit, ok := parsePagination(w, r)
+	if !ok {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", webhooks.StatusPending, webhooks.StatusDelivered, webhooks.StatusDead:
+	default:
+		http.Error(w, "Invalid 'status' parameter. It must be pending, delivered or dead.", http.StatusBadRequest)
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	if _, ok := loadWebhook(w, tx, principal.Tenant, id); !ok {
+		return
+	}
+	deliveries, total, err := webhooks.ListDeliveries(tx, principal.Tenant, id, status, limit, (page-1)*limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		Deliveries []webhooks.Delivery `json:"deliveries"`
+		Pagination struct {
+			CurrentPage     int `json:"currentPage"`
+			PageSize        int `json:"pageSize"`
+			TotalPages      int `json:"totalPages"`
+			TotalDeliveries int `json:"totalDeliveries"`
+		} `json:"pagination"`
+	}{Deliveries: deliveries}
+	response.Pagination.CurrentPage = page
+	response.Pagination.PageSize = limit
+	response.Pagination.TotalPages = (total + limit - 1) / limit
+	response.Pagination.TotalDeliveries = total
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RedeliverWebhookDelivery schedules a dead delivery to be attempted again.
+func RedeliverWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseIDVar(w, r, "id")
+	if !ok {
+		return
+	}
+	deliveryID, ok := parseIDVar(w, r, "deliveryId")
+	if !ok {
+		return
+	}
+
+	tx, principal, ok := beginTenantTx(w, r)
+	if !ok {
+		return
+	}
+	defer tx.Rollback()
+
+	requeued, err := webhooks.Redeliver(tx, principal.Tenant, id, deliveryID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requeued {
+		http.Error(w, "Dead delivery not found", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// loadWebhook fetches the tenant's webhook with the given ID, writing a 404
+// and returning false if there is none.
+func loadWebhook(w http.ResponseWriter, tx *sql.Tx, tenant string, id int64) (webhooks.Webhook, bool) {
+	hook, err := webhooks.Get(tx, tenant, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return webhooks.Webhook{}, false
+	}
+	return hook, true
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/webhooks"
+)
+
+// Tests the webhook endpoints and that message changes are queued for delivery
+func TestWebhooks(t *testing.T) {
+	teardownTestDatabase()
+	testDB.Exec("TRUNCATE TABLE webhooks RESTART IDENTITY CASCADE;")
+	database.DB = testDB
+
+	router := mux.NewRouter()
+	router.HandleFunc("/message", CreateMessage).Methods("POST")
+	router.HandleFunc("/webhooks", CreateWebhook).Methods("POST")
+	router.HandleFunc("/webhooks", ListWebhooks).Methods("GET")
+	router.HandleFunc("/webhooks/{id:[0-9]+}", UpdateWebhook).Methods("PATCH")
+	router.HandleFunc("/webhooks/{id:[0-9]+}", DeleteWebhook).Methods("DELETE")
+	router.HandleFunc("/webhooks/{id:[0-9]+}/deliveries", ListWebhookDeliveries).Methods("GET")
+
+	do := func(method, url string, payload any) *httptest.ResponseRecorder {
+		return serveJSON(t, router, method, url, auth.Principal{Subject: "admin", Scopes: []string{auth.ScopeAdmin}}, payload)
+	}
+
+	if rr := do("POST", "/webhooks", map[string]any{"url": "ftp://example.com"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an invalid URL, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if rr := do("POST", "/webhooks", map[string]any{"url": "https://example.com", "eventTypes": []string{"nope"}}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for an unknown event type, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	rr := do("POST", "/webhooks", map[string]any{"url": "https://example.com/hook", "palindromesOnly": true})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body)
+	}
+	var hook webhooks.Webhook
+	json.Unmarshal(rr.Body.Bytes(), &hook)
+	if hook.Secret == "" || !hook.Active || !hook.PalindromesOnly {
+		t.Errorf("Unexpected webhook %+v", hook)
+	}
+	id := strconv.FormatInt(hook.ID, 10)
+
+	// The secret is only shown once
+	rr = do("GET", "/webhooks", nil)
+	var list struct {
+		Webhooks []webhooks.Webhook `json:"webhooks"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if len(list.Webhooks) != 1 || list.Webhooks[0].Secret != "" {
+		t.Errorf("Expected one webhook without its secret, got %+v", list.Webhooks)
+	}
+
+	// Only the palindrome is queued
+	for _, content := range []string{"Racecar", "Hello"} {
+		req, _ := http.NewRequest("POST", "/message", bytes.NewReader([]byte(`{"content": "`+content+`"}`)))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(httptest.NewRecorder(), withPrincipal(req, "alice", auth.ScopeWrite))
+	}
+	rr = do("GET", "/webhooks/"+id+"/deliveries?status=pending", nil)
+	var deliveries struct {
+		Deliveries []webhooks.Delivery `json:"deliveries"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &deliveries)
+	if len(deliveries.Deliveries) != 1 || !bytes.Contains(deliveries.Deliveries[0].Payload, []byte("Racecar")) {
+		t.Errorf("Expected one pending delivery of the palindrome, got %+v", deliveries.Deliveries)
+	}
+
+	rr = do("PATCH", "/webhooks/"+id, map[string]any{"active": false})
+	json.Unmarshal(rr.Body.Bytes(), &hook)
+	if rr.Code != http.StatusOK || hook.Active || hook.URL != "https://example.com/hook" {
+		t.Errorf("Expected the webhook to be deactivated, got %d %+v", rr.Code, hook)
+	}
+
+	if rr := do("DELETE", "/webhooks/"+id, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	if rr := do("GET", "/webhooks/"+id+"/deliveries", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d after deletion, got %d", http.StatusNotFound, rr.Code)
+	}
+}
@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+	"github.com/shawn1912/messages-service/requestinfo"
+	"github.com/shawn1912/messages-service/websocket"
+)
+
+// WebSocketPingInterval is how often the server pings each WebSocket client.
+// Connections that send nothing, not even a pong, for two intervals are
+// closed.
+var WebSocketPingInterval = 30 * time.Second
+
+// WebSocketMaxConnections is the number of WebSocket connections each client
+// may hold open at once.
+var WebSocketMaxConnections = 5
+
+// Per-connection limits.
+const (
+	wsMaxMessageSize   = 4 << 10
+	wsMaxSubscriptions = 16
+	wsWriteTimeout     = 10 * time.Second
+	wsCloseTimeout     = 5 * time.Second
+	wsOutgoingBuffer   = 16
+)
+
+// errLagged ends a connection that did not read its events quickly enough.
+var errLagged = errors.New("client is not keeping up with its events")
+
+// wsConnections counts the open WebSocket connections of each client.
+var wsConnections = struct {
+	sync.Mutex
+	counts map[string]int
+}{counts: map[string]int{}}
+
+// wsFilter selects the events a subscription receives. Zero fields match
+// everything.
+type wsFilter struct {
+	Types      []string `json:"types,omitempty"`
+	Palindrome *bool    `json:"palindrome,omitempty"`
+	Owner      string   `json:"owner,omitempty"` // "me" is the caller
+}
+
+// matches reports whether event passes f for principal.
+func (f wsFilter) matches(principal auth.Principal, event events.Event) bool {
+	if len(f.Types) > 0 && !slices.Contains(f.Types, event.Type) {
+		return false
+	}
+	if f.Palindrome != nil && event.Message.IsPalindrome != *f.Palindrome {
+		return false
+	}
+	owner := f.Owner
+	if owner == "me" {
+		owner = principal.Subject
+	}
+	return owner == "" || event.Message.OwnerID == owner
+}
+
+// wsClientMessage is a request sent by a WebSocket client.
+type wsClientMessage struct {
+	Type        string   `json:"type"` // "subscribe" or "unsubscribe"
+	ID          string   `json:"id"`
+	Filter      wsFilter `json:"filter"`
+	LastEventID int64    `json:"lastEventId"`
+}
+
+// wsServerMessage is sent to a WebSocket client.
+type wsServerMessage struct {
+	Type         string        `json:"type"` // "subscribed", "unsubscribed", "event" or "error"
+	Subscription string        `json:"subscription,omitempty"`
+	Reset        bool          `json:"reset,omitempty"`
+	Event        *events.Event `json:"event,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// wsSession is the state of one WebSocket connection.
+type wsSession struct {
+	conn      *websocket.Conn
+	principal auth.Principal
+	ctx       context.Context
+	cancel    context.CancelCauseFunc
+	outgoing  chan wsServerMessage
+	// subscriptions is only used by the read loop
+	subscriptions map[string]*events.Subscription
+	forwarders    sync.WaitGroup
+}
+
+// ServeWebSocket upgrades the request to a WebSocket connection on which the
+// client subscribes to changes to its tenant's messages:
+//
+//	{"type": "subscribe", "id": "mine", "filter": {"owner": "me", "palindrome": true}, "lastEventId": 42}
+//	{"type": "unsubscribe", "id": "mine"}
+//
+// Each subscription is acknowledged with a "subscribed" message, whose
+// "reset" field is set when events after lastEventId are no longer buffered,
+// and then receives "event" messages. Clients that cannot keep up are
+// disconnected with status 1013 and can reconnect to resume.
+func ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	if principal.Tenant == "" {
+		principal.Tenant = database.DefaultTenant
+	}
+
+	client := principal.Subject
+	if client == "" {
+		client = "ip:" + requestinfo.FromContext(r.Context()).ClientIP
+	}
+	if !acquireWSConnection(client) {
+		http.Error(w, "Too many WebSocket connections", http.StatusTooManyRequests)
+		return
+	}
+	defer releaseWSConnection(client)
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.MaxMessageSize = wsMaxMessageSize
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	session := &wsSession{
+		conn:          conn,
+		principal:     principal,
+		ctx:           ctx,
+		cancel:        cancel,
+		outgoing:      make(chan wsServerMessage, wsOutgoingBuffer),
+		subscriptions: map[string]*events.Subscription{},
+	}
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		session.readLoop()
+	}()
+	session.writeLoop()
+
+	// Give the client a moment to answer our close frame, then hang up
+	conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+	<-readDone
+	for _, sub := range session.subscriptions {
+		sub.Close()
+	}
+	session.forwarders.Wait()
+}
+
+// readLoop handles the client's requests until the connection fails, the
+// client closes it or the session ends.
+func (s *wsSession) readLoop() {
+	extendDeadline := func() {
+		s.conn.SetReadDeadline(time.Now().Add(2 * WebSocketPingInterval))
+	}
+	extendDeadline()
+	s.conn.PongHandler = extendDeadline
+
+	for {
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			s.cancel(err)
+			return
+		}
+		// Requests arriving after the session ended are not handled
+		if s.ctx.Err() != nil {
+			return
+		}
+		extendDeadline()
+
+		if messageType != websocket.TextMessage {
+			s.cancel(&websocket.CloseError{Code: websocket.CloseUnsupportedData, Reason: "expected a JSON text message"})
+			return
+		}
+		var request wsClientMessage
+		if err := json.Unmarshal(data, &request); err != nil {
+			s.send(wsServerMessage{Type: "error", Error: "invalid JSON: " + err.Error()})
+			continue
+		}
+
+		switch request.Type {
+		case "subscribe":
+			s.subscribe(request)
+		case "unsubscribe":
+			sub, ok := s.subscriptions[request.ID]
+			if !ok {
+				s.send(wsServerMessage{Type: "error", Subscription: request.ID, Error: "unknown subscription"})
+				continue
+			}
+			sub.Close()
+			delete(s.subscriptions, request.ID)
+			s.send(wsServerMessage{Type: "unsubscribed", Subscription: request.ID})
+		default:
+			s.send(wsServerMessage{Type: "error", Error: "unknown request type " + request.Type})
+		}
+	}
+}
+
+// subscribe starts delivering the events matching request's filter.
+func (s *wsSession) subscribe(request wsClientMessage) {
+	switch {
+	case request.ID == "":
+		s.send(wsServerMessage{Type: "error", Error: "subscriptions need an id"})
+		return
+	case s.subscriptions[request.ID] != nil:
+		s.send(wsServerMessage{Type: "error", Subscription: request.ID, Error: "subscription already exists"})
+		return
+	case len(s.subscriptions) >= wsMaxSubscriptions:
+		s.send(wsServerMessage{Type: "error", Subscription: request.ID, Error: "too many subscriptions"})
+		return
+	case request.LastEventID < 0:
+		s.send(wsServerMessage{Type: "error", Subscription: request.ID, Error: "invalid lastEventId"})
+		return
+	}
+
+	filter := request.Filter
+	sub, backlog, complete := Events.Subscribe(request.LastEventID, visibleEvents(s.principal, func(event events.Event) bool {
+		return filter.matches(s.principal, event)
+	}))
+	s.subscriptions[request.ID] = sub
+	s.send(wsServerMessage{Type: "subscribed", Subscription: request.ID, Reset: !complete})
+
+	s.forwarders.Add(1)
+	go func() {
+		defer s.forwarders.Done()
+		access := newChannelAccess(s.principal)
+		for _, event := range backlog {
+			if access.allows(s.ctx, event) && !s.send(wsServerMessage{Type: "event", Subscription: request.ID, Event: &event}) {
+				return
+			}
+		}
+		for event := range sub.Events() {
+			if access.allows(s.ctx, event) && !s.send(wsServerMessage{Type: "event", Subscription: request.ID, Event: &event}) {
+				return
+			}
+		}
+		if sub.Lagged() {
+			s.cancel(errLagged)
+		}
+	}()
+}
+
+// send queues message for the write loop, waiting while the queue is full.
+// It returns false once the connection is ending.
+func (s *wsSession) send(message wsServerMessage) bool {
+	select {
+	case s.outgoing <- message:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// writeLoop writes queued messages and pings until the session ends, then
+// sends a close frame explaining why.
+func (s *wsSession) writeLoop() {
+	ping := time.NewTicker(WebSocketPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case <-s.ctx.Done():
+			s.close(context.Cause(s.ctx))
+			return
+		case <-ping.C:
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err = s.conn.WriteControl(websocket.PingMessage, nil)
+		case message := <-s.outgoing:
+			data, _ := json.Marshal(message)
+			s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			err = s.conn.WriteMessage(websocket.TextMessage, data)
+		}
+		if err != nil {
+			// The client is gone or too slow to accept writes
+			s.cancel(err)
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// close sends the close frame for the reason the session ended. When the
+// client closed the connection, ReadMessage has already answered it.
+func (s *wsSession) close(cause error) {
+	code, reason := websocket.CloseGoingAway, ""
+	var closeErr *websocket.CloseError
+	switch {
+	case errors.Is(cause, errLagged):
+		code, reason = websocket.CloseTryAgainLater, errLagged.Error()
+	case errors.As(cause, &closeErr):
+		code, reason = closeErr.Code, closeErr.Reason
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	s.conn.WriteClose(code, reason)
+}
+
+// acquireWSConnection reserves one of client's connections, returning false
+// if it already has as many as allowed.
+func acquireWSConnection(client string) bool {
+	wsConnections.Lock()
+	defer wsConnections.Unlock()
+	if wsConnections.counts[client] >= WebSocketMaxConnections {
+		return false
+	}
+	wsConnections.counts[client]++
+	return true
+}
+
+// releaseWSConnection returns a connection reserved by acquireWSConnection.
+func releaseWSConnection(client string) {
+	wsConnections.Lock()
+	defer wsConnections.Unlock()
+	if wsConnections.counts[client]--; wsConnections.counts[client] <= 0 {
+		delete(wsConnections.counts, client)
+	}
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+	"github.com/shawn1912/messages-service/websocket"
+)
+
+// newWebSocketServer serves /ws to callers authenticated as alice of tenant acme.
+func newWebSocketServer(t *testing.T) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal := auth.Principal{Subject: "alice", Scopes: []string{auth.ScopeRead}, Tenant: "acme"}
+		ServeWebSocket(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	}))
+	t.Cleanup(server.Close)
+	return "ws://" + strings.TrimPrefix(server.URL, "http://")
+}
+
+func sendJSON(t *testing.T, conn *websocket.Conn, v any) {
+	t.Helper()
+	data, _ := json.Marshal(v)
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readJSON(t *testing.T, conn *websocket.Conn) wsServerMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Error reading message: %v", err)
+	}
+	var message wsServerMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+// Tests subscriptions on /ws
+func TestServeWebSocket(t *testing.T) {
+	Events = events.NewBroker(10, 10)
+	conn, err := websocket.Dial(newWebSocketServer(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sendJSON(t, conn, map[string]any{"type": "subscribe", "id": "palindromes", "filter": map[string]any{"palindrome": true}})
+	if message := readJSON(t, conn); message.Type != "subscribed" || message.Subscription != "palindromes" {
+		t.Fatalf("Expected subscription to be acknowledged, got %+v", message)
+	}
+	sendJSON(t, conn, map[string]any{"type": "subscribe", "id": "mine", "filter": map[string]any{"owner": "me"}})
+	if message := readJSON(t, conn); message.Type != "subscribed" || message.Subscription != "mine" {
+		t.Fatalf("Expected subscription to be acknowledged, got %+v", message)
+	}
+
+	acme := auth.Principal{Tenant: "acme"}
+	publishTestEvent(events.MessageCreated, auth.Principal{Tenant: "other"}, database.Message{ID: 1, IsPalindrome: true})
+	publishTestEvent(events.MessageCreated, acme, database.Message{ID: 2, OwnerID: "bob"})
+	publishTestEvent(events.MessageCreated, acme, database.Message{ID: 3, IsPalindrome: true, OwnerID: "bob"})
+	publishTestEvent(events.MessageCreated, acme, database.Message{ID: 4, OwnerID: "alice"})
+
+	received := map[int64]string{}
+	for i := 0; i < 2; i++ {
+		message := readJSON(t, conn)
+		if message.Type != "event" || message.Event == nil {
+			t.Fatalf("Expected an event, got %+v", message)
+		}
+		received[message.Event.Message.ID] = message.Subscription
+	}
+	if received[3] != "palindromes" || received[4] != "mine" {
+		t.Errorf("Expected message 3 for 'palindromes' and 4 for 'mine', got %v", received)
+	}
+
+	// Resuming replays what the subscription missed
+	sendJSON(t, conn, map[string]any{"type": "subscribe", "id": "replay", "lastEventId": 2})
+	if message := readJSON(t, conn); message.Type != "subscribed" || message.Reset {
+		t.Fatalf("Expected complete replay to be acknowledged, got %+v", message)
+	}
+	for _, id := range []int64{3, 4} {
+		if message := readJSON(t, conn); message.Event == nil || message.Event.Message.ID != id {
+			t.Errorf("Expected replay of message %d, got %+v", id, message)
+		}
+	}
+
+	sendJSON(t, conn, map[string]any{"type": "unsubscribe", "id": "unknown"})
+	if message := readJSON(t, conn); message.Type != "error" {
+		t.Errorf("Expected an error for an unknown subscription, got %+v", message)
+	}
+
+	conn.WriteClose(websocket.CloseNormal, "")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseNormal {
+		t.Errorf("Expected the close to be echoed, got %v", err)
+	}
+}
+
+// Tests that requests after a binary message are not handled
+func TestServeWebSocket_BinaryMessage(t *testing.T) {
+	Events = events.NewBroker(10, 10)
+	conn, err := websocket.Dial(newWebSocketServer(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	sendJSON(t, conn, map[string]any{"type": "subscribe", "id": "all"})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseUnsupportedData {
+		t.Errorf("Expected the connection to be closed with %d, got %q, %v", websocket.CloseUnsupportedData, data, err)
+	}
+}
+
+// Tests the limit on connections per client
+func TestServeWebSocket_ConnectionLimit(t *testing.T) {
+	WebSocketMaxConnections = 1
+	defer func() { WebSocketMaxConnections = 5 }()
+
+	url := newWebSocketServer(t)
+	conn, err := websocket.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := websocket.Dial(url, nil); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("Expected a second connection to be refused with 429, got %v", err)
+	}
+}
+
+// Tests that clients that stop reading are disconnected
+func TestServeWebSocket_SlowClient(t *testing.T) {
+	Events = events.NewBroker(10, 1)
+	conn, err := websocket.Dial(newWebSocketServer(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.MaxMessageSize = 1 << 20
+
+	sendJSON(t, conn, map[string]any{"type": "subscribe", "id": "all"})
+	readJSON(t, conn)
+
+	// Publish more than fits in the outgoing queue, the socket buffers and
+	// the subscription buffer without reading
+	payload := strings.Repeat("x", 64<<10)
+	for i := 0; i < 200; i++ {
+		publishTestEvent(events.MessageCreated, auth.Principal{Tenant: "acme"}, database.Message{Content: payload})
+	}
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseTryAgainLater {
+			t.Errorf("Expected the connection to be closed with %d, got %v", websocket.CloseTryAgainLater, err)
+		}
+		return
+	}
+}
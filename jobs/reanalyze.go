@@ -0,0 +1,187 @@
+package jobs
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/fingerprint"
+	"github.com/shawn1912/messages-service/richtext"
+	"github.com/shawn1912/messages-service/tags"
+	"github.com/shawn1912/messages-service/utils"
+)
+
+// ReanalyzeProgress reports how far a reanalysis run has got.
+type ReanalyzeProgress struct {
+	Scanned int64         // rows recomputed so far
+	Changed int64         // rows whose is_palindrome result changed
+	LastID  int64         // highest message ID processed
+	Elapsed time.Duration // time since the run started
+}
+
+// Rate returns the throughput of the run in rows per second.
+func (p ReanalyzeProgress) Rate() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Scanned) / p.Elapsed.Seconds()
+}
+
+// ReanalyzeOptions configures a reanalysis run.
+type ReanalyzeOptions struct {
+	BatchSize int                     // rows per batch, defaults to 500
+	Progress  func(ReanalyzeProgress) // called after every batch, may be nil
+}
+
+// Reanalyze recomputes is_palindrome and anagram_signature for every message
+// whose stored results were produced by an older utils.PalindromeVersion, along
+// with the automatic tags that depend on them. Messages stored before
+// duplicate detection also get their fingerprint. The table is walked in keyset
+// batches ordered by ID, and each batch is committed with the current version,
+// so an interrupted run can simply be started again and picks up where it left
+// off.
+func Reanalyze(ctx context.Context, opts ReanalyzeOptions) (ReanalyzeProgress, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+
+	var progress ReanalyzeProgress
+	start := time.Now()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+
+		scanned, changed, lastID, err := reanalyzeBatch(ctx, progress.LastID, opts.BatchSize)
+		if err != nil {
+			return progress, err
+		}
+		if scanned == 0 {
+			progress.Elapsed = time.Since(start)
+			return progress, nil
+		}
+
+		progress.Scanned += scanned
+		progress.Changed += changed
+		progress.LastID = lastID
+		progress.Elapsed = time.Since(start)
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+}
+
+// reanalyzeBatch recomputes up to limit stale messages with an ID greater than
+// afterID in a single transaction.
+func reanalyzeBatch(ctx context.Context, afterID int64, limit int) (scanned, changed, lastID int64, err error) {
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+        SELECT id, tenant_id, content, format, is_palindrome, deleted_at
+        FROM messages
+        WHERE id > $1 AND (palindrome_version < $2 OR anagram_signature IS NULL OR content_hash IS NULL)
+        ORDER BY id ASC
+        LIMIT $3
+        FOR UPDATE
+    `
+
+	rows, err := tx.QueryContext(ctx, query, afterID, utils.PalindromeVersion, limit)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	var ids []int64
+	var palindromes []bool
+	var signatures []string
+	var hashes, minhashes, bands []string
+	var retag []database.Message // messages whose automatic tags change
+	var tenants []string
+	for rows.Next() {
+		var id int64
+		var tenant, content, format string
+		var stored bool
+		var deletedAt *time.Time
+		if err := rows.Scan(&id, &tenant, &content, &format, &stored, &deletedAt); err != nil {
+			rows.Close()
+			return 0, 0, 0, err
+		}
+
+		text := richtext.Text(format, content)
+		isPalindrome := utils.IsPalindrome(text)
+		if isPalindrome != stored {
+			changed++
+			retag = append(retag, database.Message{ID: id, IsPalindrome: isPalindrome, DeletedAt: deletedAt})
+			tenants = append(tenants, tenant)
+		}
+		ids = append(ids, id)
+		palindromes = append(palindromes, isPalindrome)
+		signatures = append(signatures, utils.AnagramSignature(text))
+		minhash := fingerprint.MinHash(text)
+		values := make([]int64, len(minhash))
+		for i, v := range minhash {
+			values[i] = int64(v)
+		}
+		hashes = append(hashes, fingerprint.Hash(text))
+		minhashes = append(minhashes, arrayLiteral(values))
+		bands = append(bands, arrayLiteral(fingerprint.BandKeys(minhash)))
+		lastID = id
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, 0, 0, err
+	}
+	if len(ids) == 0 {
+		return 0, 0, 0, nil
+	}
+
+	update := `
+        UPDATE messages AS m
+        SET is_palindrome = v.is_palindrome,
+            anagram_signature = v.anagram_signature,
+            palindrome_version = $1,
+            content_hash = v.content_hash,
+            minhash = NULLIF(v.minhash, '')::bigint[],
+            minhash_bands = NULLIF(v.minhash_bands, '')::bigint[]
+        FROM unnest($2::bigint[], $3::boolean[], $4::text[], $5::text[], $6::text[], $7::text[])
+            AS v(id, is_palindrome, anagram_signature, content_hash, minhash, minhash_bands)
+        WHERE m.id = v.id
+    `
+
+	_, err = tx.ExecContext(ctx, update, utils.PalindromeVersion, pq.Array(ids), pq.Array(palindromes),
+		pq.Array(signatures), pq.Array(hashes), pq.Array(minhashes), pq.Array(bands))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	for i, msg := range retag {
+		if err = tags.SetAutomatic(tx, tenants[i], msg.ID, tags.Automatic(msg)); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, 0, 0, err
+	}
+	return int64(len(ids)), changed, lastID, nil
+}
+
+// arrayLiteral returns values as a Postgres array literal, or an empty string
+// if there are none, since arrays of arrays cannot be unnested row by row.
+func arrayLiteral(values []int64) string {
+	if len(values) == 0 {
+		return ""
+	}
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = strconv.FormatInt(v, 10)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
@@ -0,0 +1,100 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"os"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/utils"
+)
+
+func TestMain(m *testing.M) {
+	// Initialize the test database
+	database.InitDB("user=postgres password=postgres dbname=messages_test sslmode=disable")
+	defer database.DB.Close()
+
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run tests
+	code := m.Run()
+
+	// Clean up the test database
+	database.DB.Exec("TRUNCATE TABLE messages RESTART IDENTITY CASCADE;")
+
+	os.Exit(code)
+}
+
+func TestReanalyze(t *testing.T) {
+	database.DB.Exec("TRUNCATE TABLE messages RESTART IDENTITY CASCADE;")
+
+	// Insert messages with stale results: one wrong, one right, and one
+	// already analyzed with the current rules
+	rows := []struct {
+		content      string
+		isPalindrome bool
+		version      int
+	}{
+		{"Racecar", false, 0},
+		{"Hello World", false, 0},
+		{"Madam", true, utils.PalindromeVersion},
+	}
+	for _, row := range rows {
+		_, err := database.DB.Exec(
+			"INSERT INTO messages (content, is_palindrome, palindrome_version) VALUES ($1, $2, $3)",
+			row.content, row.isPalindrome, row.version)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batches := 0
+	progress, err := Reanalyze(context.Background(), ReanalyzeOptions{
+		BatchSize: 1,
+		Progress:  func(ReanalyzeProgress) { batches++ },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if progress.Scanned != 2 {
+		t.Errorf("Expected 2 messages scanned, got %d", progress.Scanned)
+	}
+	if progress.Changed != 1 {
+		t.Errorf("Expected 1 message changed, got %d", progress.Changed)
+	}
+	if batches != 2 {
+		t.Errorf("Expected 2 progress reports, got %d", batches)
+	}
+
+	var isPalindrome bool
+	err = database.DB.QueryRow("SELECT is_palindrome FROM messages WHERE content = 'Racecar'").Scan(&isPalindrome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isPalindrome {
+		t.Error("Expected 'Racecar' to be recomputed as a palindrome")
+	}
+
+	var stale int
+	err = database.DB.QueryRow("SELECT COUNT(*) FROM messages WHERE palindrome_version < $1", utils.PalindromeVersion).Scan(&stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale != 0 {
+		t.Errorf("Expected no stale messages, found %d", stale)
+	}
+
+	// A second run has nothing left to do
+	progress, err = Reanalyze(context.Background(), ReanalyzeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Scanned != 0 {
+		t.Errorf("Expected rerun to scan 0 messages, got %d", progress.Scanned)
+	}
+}
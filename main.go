@@ -1,33 +1,217 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/auth/jwt"
+	"github.com/shawn1912/messages-service/blobs"
+	"github.com/shawn1912/messages-service/config"
 	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
 	"github.com/shawn1912/messages-service/handlers"
+	"github.com/shawn1912/messages-service/moderation"
+	"github.com/shawn1912/messages-service/outbox"
+	"github.com/shawn1912/messages-service/ratelimit"
+	"github.com/shawn1912/messages-service/requestinfo"
+	"github.com/shawn1912/messages-service/webhooks"
 )
 
 func main() {
-	// TODO: Use environment variables
-	database.InitDB("user=postgres password=postgres dbname=messages sslmode=disable")
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	database.InitDB(cfg.DatabaseURL)
+
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := setupJWT(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	handlers.DefaultQuota = database.TenantQuota{
+		MaxMessages:      cfg.TenantMaxMessages,
+		MaxContentLength: cfg.TenantMaxContentLength,
+	}
+	handlers.Events = events.NewBroker(cfg.EventsReplaySize, 64)
+	handlers.StreamHeartbeatInterval = cfg.StreamHeartbeatInterval
+	handlers.WebSocketPingInterval = cfg.WebSocketPingInterval
+	handlers.WebSocketMaxConnections = cfg.WebSocketMaxConnections
+	handlers.ThreadDeleteMode = cfg.ThreadDeleteMode
+	handlers.MessageRetention = cfg.MessageRetention
+	if handlers.Blobs, err = blobs.NewLocalStore(cfg.AttachmentsDir); err != nil {
+		log.Fatal(err)
+	}
+	handlers.AttachmentMaxSize = int64(cfg.AttachmentMaxSize)
+	handlers.AttachmentTypes = cfg.AttachmentTypes
+	handlers.DuplicatePolicy = cfg.DuplicatePolicy
+	handlers.ContentRules = cfg.ContentRules
+	handlers.AllowUnknownFields = cfg.AllowUnknownFields
+	handlers.DuplicateSimilarity = cfg.DuplicateSimilarity
+	if cfg.ModerationRulesFile != "" {
+		if handlers.Moderator, err = moderation.LoadRules(cfg.ModerationRulesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	listener := &events.Listener{
+		ConnString: cfg.DatabaseURL,
+		Broker:     handlers.Events,
+		Retention:  cfg.EventsRetention,
+	}
+	go func() {
+		if err := listener.Run(context.Background()); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	webhooks.AllowPrivateAddresses = cfg.WebhookAllowPrivateAddresses
+	worker := &webhooks.Worker{
+		Client:       webhooks.NewClient(cfg.WebhookTimeout),
+		MaxAttempts:  cfg.WebhookMaxAttempts,
+		BaseDelay:    cfg.WebhookRetryBaseDelay,
+		MaxDelay:     cfg.WebhookRetryMaxDelay,
+		BatchSize:    20,
+		PollInterval: time.Second,
+	}
+	go worker.Run(context.Background())
+
+	scheduler := &handlers.Scheduler{BatchSize: 100, PollInterval: time.Second}
+	go scheduler.Run(context.Background())
+	reaper := &handlers.Reaper{BatchSize: 500, PollInterval: 10 * time.Second}
+	go reaper.Run(context.Background())
+	sweeper := &handlers.BlobSweeper{BatchSize: 100, PollInterval: time.Minute}
+	go sweeper.Run(context.Background())
+
+	if cfg.OutboxPublisher != "" {
+		publisher, err := outbox.NewPublisher(cfg.OutboxPublisher, &http.Client{Timeout: cfg.OutboxTimeout})
+		if err != nil {
+			log.Fatal(err)
+		}
+		handlers.OutboxEnabled = true
+		relay := &outbox.Relay{
+			Publisher:    publisher,
+			BatchSize:    100,
+			PollInterval: time.Second,
+			Lease:        100*cfg.OutboxTimeout + time.Minute,
+			MaxAttempts:  cfg.OutboxMaxAttempts,
+			RetryDelay:   time.Second,
+			MaxDelay:     5 * time.Minute,
+			Retention:    cfg.OutboxRetention,
+		}
+		go relay.Run(context.Background())
+	}
 
 	router := setupRouter()
+	setupMiddleware(router, cfg)
+
+	log.Printf("Server is running on %s", cfg.Addr)
+	log.Fatal(http.ListenAndServe(cfg.Addr, router))
+}
+
+// setupMiddleware installs the middleware every route goes through. Failed
+// authentications are limited by client IP before credentials are checked,
+// and requests by their principal once they are.
+func setupMiddleware(router *mux.Router, cfg config.Config) {
+	limiter := &ratelimit.Limiter{
+		Store:          ratelimit.NewMemoryStore(),
+		Default:        cfg.RateLimitDefault,
+		Routes:         cfg.RateLimits,
+		FailedAuth:     cfg.RateLimitFailedAuth,
+		TrustedProxies: cfg.TrustedProxies,
+	}
+	router.Use(requestinfo.Middleware(cfg.TrustedProxies), limiter.AuthFailures, auth.Authenticate, limiter.Middleware)
+}
+
+// setupJWT enables bearer token authentication when a JWKS file is
+// configured, reloading the keys in the background as the file changes.
+func setupJWT(cfg config.Config) error {
+	if cfg.JWKSFile == "" {
+		return nil
+	}
+
+	keys, err := jwt.LoadKeySet(cfg.JWKSFile)
+	if err != nil {
+		return err
+	}
+	if cfg.JWKSReloadInterval > 0 {
+		go keys.Watch(context.Background(), cfg.JWKSReloadInterval)
+	}
 
-	log.Println("Server is running on port 8080")
-	http.ListenAndServe(":8080", router)
+	auth.JWT = &jwt.Verifier{
+		Keys:      keys,
+		Issuer:    cfg.JWTIssuer,
+		Audience:  cfg.JWTAudience,
+		ClockSkew: cfg.JWTClockSkew,
+	}
+	return nil
 }
 
 // setupRouter sets up the routes for the HTTP server.
 func setupRouter() *mux.Router {
 	router := mux.NewRouter()
 
-	router.HandleFunc("/message", handlers.CreateMessage).Methods("POST")
-	router.HandleFunc("/message/{id:[0-9]+}", handlers.GetMessage).Methods("GET")
-	router.HandleFunc("/message/{id:[0-9]+}", handlers.UpdateMessage).Methods("PATCH")
-	router.HandleFunc("/message/{id:[0-9]+}", handlers.DeleteMessage).Methods("DELETE")
-	router.HandleFunc("/messages", handlers.ListMessages).Methods("GET")
+	router.Handle("/message", auth.Require(auth.ScopeWrite, handlers.CreateMessage)).Methods("POST")
+	router.Handle("/message/{id:[0-9]+}", auth.Require(auth.ScopeRead, handlers.GetMessage)).Methods("GET")
+	router.Handle("/message/{id:[0-9]+}", auth.Require(auth.ScopeWrite, handlers.UpdateMessage)).Methods("PATCH")
+	router.Handle("/message/{id:[0-9]+}", auth.Require(auth.ScopeDelete, handlers.DeleteMessage)).Methods("DELETE")
+	router.Handle("/message/{id:[0-9]+}/tags", auth.Require(auth.ScopeWrite, handlers.AddMessageTags)).Methods("POST")
+	router.Handle("/message/{id:[0-9]+}/tags/{tag}", auth.Require(auth.ScopeWrite, handlers.RemoveMessageTag)).Methods("DELETE")
+	router.Handle("/message/{id:[0-9]+}/reactions/{emoji}", auth.Require(auth.ScopeWrite, handlers.PutReaction)).Methods("PUT")
+	router.Handle("/message/{id:[0-9]+}/reactions/{emoji}", auth.Require(auth.ScopeWrite, handlers.DeleteReaction)).Methods("DELETE")
+	router.Handle("/message/{id:[0-9]+}/attachments", auth.Require(auth.ScopeWrite, handlers.UploadAttachment)).Methods("POST")
+	router.Handle("/message/{id:[0-9]+}/attachments", auth.Require(auth.ScopeRead, handlers.ListAttachments)).Methods("GET")
+	router.Handle("/message/{id:[0-9]+}/attachments/{attachmentId:[0-9]+}",
+		auth.Require(auth.ScopeRead, handlers.GetAttachment)).Methods("GET")
+	router.Handle("/message/{id:[0-9]+}/replies", auth.Require(auth.ScopeWrite, handlers.CreateReply)).Methods("POST")
+	router.Handle("/message/{id:[0-9]+}/thread", auth.Require(auth.ScopeRead, handlers.GetThread)).Methods("GET")
+	router.Handle("/message/{id:[0-9]+}/similar", auth.Require(auth.ScopeRead, handlers.GetSimilarMessages)).Methods("GET")
+	router.Handle("/message/{id:[0-9]+}/anagrams", auth.Require(auth.ScopeRead, handlers.GetMessageAnagrams)).Methods("GET")
+	router.Handle("/messages", auth.Require(auth.ScopeRead, handlers.ListMessages)).Methods("GET")
+	router.Handle("/messages/stream", auth.Require(auth.ScopeRead, handlers.StreamMessages)).Methods("GET")
+	router.Handle("/ws", auth.Require(auth.ScopeRead, handlers.ServeWebSocket)).Methods("GET")
+	router.Handle("/channels", auth.Require(auth.ScopeWrite, handlers.CreateChannel)).Methods("POST")
+	router.Handle("/channels", auth.Require(auth.ScopeRead, handlers.ListChannels)).Methods("GET")
+	router.Handle("/channels/{id:[0-9]+}", auth.Require(auth.ScopeRead, handlers.GetChannel)).Methods("GET")
+	router.Handle("/channels/{id:[0-9]+}", auth.Require(auth.ScopeWrite, handlers.UpdateChannel)).Methods("PATCH")
+	router.Handle("/channels/{id:[0-9]+}", auth.Require(auth.ScopeDelete, handlers.DeleteChannel)).Methods("DELETE")
+	router.Handle("/channels/{id:[0-9]+}/members", auth.Require(auth.ScopeRead, handlers.ListChannelMembers)).Methods("GET")
+	router.Handle("/channels/{id:[0-9]+}/members/{member}", auth.Require(auth.ScopeWrite, handlers.AddChannelMember)).Methods("PUT")
+	router.Handle("/channels/{id:[0-9]+}/members/{member}", auth.Require(auth.ScopeWrite, handlers.RemoveChannelMember)).Methods("DELETE")
+	router.Handle("/channels/{id:[0-9]+}/messages", auth.Require(auth.ScopeWrite, handlers.CreateChannelMessage)).Methods("POST")
+	router.Handle("/channels/{id:[0-9]+}/messages", auth.Require(auth.ScopeRead, handlers.ListChannelMessages)).Methods("GET")
+	router.Handle("/anagrams", auth.Require(auth.ScopeRead, handlers.FindAnagrams)).Methods("GET")
+	router.Handle("/stats", auth.Require(auth.ScopeRead, handlers.GetStats)).Methods("GET")
+	router.Handle("/moderation/queue", auth.Require(auth.ScopeModerate, handlers.ListModerationQueue)).Methods("GET")
+	router.Handle("/moderation/queue/{id:[0-9]+}/approve", auth.Require(auth.ScopeModerate, handlers.ApproveMessage)).Methods("POST")
+	router.Handle("/moderation/queue/{id:[0-9]+}/reject", auth.Require(auth.ScopeModerate, handlers.RejectMessage)).Methods("POST")
+	router.Handle("/audit", auth.Require(auth.ScopeAdmin, handlers.ListAuditLog)).Methods("GET")
+	router.Handle("/webhooks", auth.Require(auth.ScopeAdmin, handlers.CreateWebhook)).Methods("POST")
+	router.Handle("/webhooks", auth.Require(auth.ScopeAdmin, handlers.ListWebhooks)).Methods("GET")
+	router.Handle("/webhooks/{id:[0-9]+}", auth.Require(auth.ScopeAdmin, handlers.GetWebhook)).Methods("GET")
+	router.Handle("/webhooks/{id:[0-9]+}", auth.Require(auth.ScopeAdmin, handlers.UpdateWebhook)).Methods("PATCH")
+	router.Handle("/webhooks/{id:[0-9]+}", auth.Require(auth.ScopeAdmin, handlers.DeleteWebhook)).Methods("DELETE")
+	router.Handle("/webhooks/{id:[0-9]+}/deliveries", auth.Require(auth.ScopeAdmin, handlers.ListWebhookDeliveries)).Methods("GET")
+	router.Handle("/webhooks/{id:[0-9]+}/deliveries/{deliveryId:[0-9]+}/redeliver",
+		auth.Require(auth.ScopeAdmin, handlers.RedeliverWebhookDelivery)).Methods("POST")
+	router.Handle("/debug/vars", auth.Require(auth.ScopeAdmin, expvar.Handler().ServeHTTP)).Methods("GET")
 
 	return router
 }
@@ -3,24 +3,43 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/config"
 	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/ratelimit"
 )
 
+// testAPIKey is granted every scope and authenticates the route tests.
+var testAPIKey string
+
 func TestMain(m *testing.M) {
 	// Initialize the test database
 	database.InitDB("user=postgres password=postgres dbname=messages_test sslmode=disable")
 	defer database.DB.Close()
 
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	var err error
+	_, testAPIKey, err = auth.CreateAPIKey("main tests", database.DefaultTenant, auth.KnownScopes)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Run tests
 	code := m.Run()
 
 	// Clean up the test database
 	database.DB.Exec("TRUNCATE TABLE messages RESTART IDENTITY CASCADE;")
+	database.DB.Exec("TRUNCATE TABLE api_keys RESTART IDENTITY CASCADE;")
 
 	os.Exit(code)
 }
@@ -43,6 +62,7 @@ func TestCreateMessageRoute(t *testing.T) {
 		t.Fatal(err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(auth.APIKeyHeader, testAPIKey)
 
 	// Record the response
 	rr := httptest.NewRecorder()
@@ -68,3 +88,72 @@ func TestCreateMessageRoute(t *testing.T) {
 		t.Error("Expected IsPalindrome to be true")
 	}
 }
+
+func TestRouteAuthentication(t *testing.T) {
+	setupTestDatabase()
+
+	router := setupRouter()
+
+	_, readOnlyKey, err := auth.CreateAPIKey("read only", database.DefaultTenant, []string{auth.ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		method   string
+		apiKey   string
+		expected int
+	}{
+		{"missing key", "GET", "", http.StatusUnauthorized},
+		{"unknown key", "GET", "msk_unknown", http.StatusUnauthorized},
+		{"read with read scope", "GET", readOnlyKey, http.StatusOK},
+		{"delete without delete scope", "DELETE", readOnlyKey, http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		path := "/messages"
+		if tc.method == "DELETE" {
+			path = "/message/1"
+		}
+		req, err := http.NewRequest(tc.method, path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.apiKey != "" {
+			req.Header.Set(auth.APIKeyHeader, tc.apiKey)
+		}
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != tc.expected {
+			t.Errorf("%s: expected status code %d, got %d", tc.name, tc.expected, status)
+		}
+	}
+}
+
+func TestFailedAuthenticationLimit(t *testing.T) {
+	router := setupRouter()
+	setupMiddleware(router, config.Config{RateLimitFailedAuth: ratelimit.Limit{Requests: 3, Period: time.Minute}})
+	send := func(apiKey string) int {
+		req, _ := http.NewRequest("GET", "/messages", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(auth.APIKeyHeader, apiKey)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	for i := 0; i < 3; i++ {
+		if code := send("msk_guess"); code != http.StatusUnauthorized {
+			t.Fatalf("Expected status code %d for guess %d, got %d", http.StatusUnauthorized, i+1, code)
+		}
+	}
+	// Even a valid key waits once the client has guessed too often
+	for _, key := range []string{"msk_guess", testAPIKey} {
+		if code := send(key); code != http.StatusTooManyRequests {
+			t.Errorf("Expected status code %d, got %d", http.StatusTooManyRequests, code)
+		}
+	}
+}
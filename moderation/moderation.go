@@ -0,0 +1,198 @@
+// Package moderation decides whether message content may be published
+// straight away, must wait for a moderator, or is refused.
+package moderation
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Moderation states of a message.
+const (
+	// Visible messages are shown to everyone allowed to read them.
+	Visible = "visible"
+	// Pending messages wait for a moderator; their owner can still edit them.
+	Pending = "pending"
+	// Quarantined messages wait for a moderator and cannot be edited.
+	Quarantined = "quarantined"
+	// Rejected messages were turned down by a moderator.
+	Rejected = "rejected"
+)
+
+// Hidden reports whether messages in state are hidden from everyone but their
+// owner and moderators.
+func Hidden(state string) bool {
+	return state == Pending || state == Quarantined || state == Rejected
+}
+
+// Action is what a Moderator decides to do with content. Actions are ordered
+// from least to most severe.
+type Action int
+
+const (
+	// Allow publishes the content.
+	Allow Action = iota
+	// Hold keeps the content pending until a moderator approves it.
+	Hold
+	// Quarantine keeps the content quarantined until a moderator approves it.
+	Quarantine
+	// Reject refuses to store the content.
+	Reject
+)
+
+var actionNames = []string{"allow", "hold", "quarantine", "reject"}
+
+func (a Action) String() string {
+	if a < 0 || int(a) >= len(actionNames) {
+		return fmt.Sprintf("Action(%d)", int(a))
+	}
+	return actionNames[a]
+}
+
+// State returns the state of a message stored after action. Rejected content
+// is not stored, so Reject has no state.
+func (a Action) State() string {
+	switch a {
+	case Hold:
+		return Pending
+	case Quarantine:
+		return Quarantined
+	case Reject:
+		return ""
+	}
+	return Visible
+}
+
+// Verdict is the decision of a Moderator, with the reason for it shown to the
+// author and to moderators.
+type Verdict struct {
+	Action Action
+	Reason string
+}
+
+// Moderator checks content before it is stored.
+type Moderator interface {
+	Moderate(ctx context.Context, text string) (Verdict, error)
+}
+
+// Rule applies its Action to content matching its pattern.
+type Rule struct {
+	Action  Action
+	Pattern string
+	re      *regexp.Regexp
+}
+
+// RuleList is a Moderator applying the most severe of the rules that match
+// the content, allowing content that matches none.
+type RuleList struct {
+	Rules []Rule
+}
+
+// wordBoundary matches where words start and end: letters, digits and
+// underscores in any script make up words.
+const wordBoundary = `(?:^|[^\p{L}\p{N}_])`
+
+// NewRule returns a rule applying action to content matching pattern. A
+// pattern between slashes, as in /sp[a4]m/, is a regular expression matched
+// anywhere in the content; anything else is a word or phrase matched as a
+// whole. Both ignore case.
+func NewRule(action Action, pattern string) (Rule, error) {
+	if action == Allow {
+		return Rule{}, fmt.Errorf("rule %q: allow rules are not supported", pattern)
+	}
+	var expr string
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		expr = "(?i)" + pattern[1:len(pattern)-1]
+	} else {
+		words := strings.Fields(pattern)
+		if len(words) == 0 {
+			return Rule{}, fmt.Errorf("empty %s rule", action)
+		}
+		for i, word := range words {
+			words[i] = regexp.QuoteMeta(word)
+		}
+		expr = "(?i)" + wordBoundary + strings.Join(words, `\s+`) + `(?:$|[^\p{L}\p{N}_])`
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return Rule{}, fmt.Errorf("rule %q: %v", pattern, err)
+	}
+	return Rule{Action: action, Pattern: pattern, re: re}, nil
+}
+
+// Matches reports whether text matches the rule.
+func (r Rule) Matches(text string) bool {
+	return r.re.MatchString(text)
+}
+
+// Moderate returns the verdict of the most severe rule matching text, or the
+// first of those if several are as severe.
+func (l *RuleList) Moderate(ctx context.Context, text string) (Verdict, error) {
+	verdict := Verdict{Action: Allow}
+	for _, rule := range l.Rules {
+		if rule.Action > verdict.Action && rule.Matches(text) {
+			verdict = Verdict{Action: rule.Action, Reason: fmt.Sprintf("matched %s rule %q", rule.Action, rule.Pattern)}
+		}
+	}
+	return verdict, nil
+}
+
+// ParseRules reads a rule list with one rule per line: an action (hold,
+// quarantine or reject), whitespace, and a pattern as described by NewRule.
+// Blank lines and lines starting with '#' are ignored.
+func ParseRules(r io.Reader) (*RuleList, error) {
+	list := &RuleList{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, pattern := line, ""
+		if i := strings.IndexFunc(line, unicode.IsSpace); i >= 0 {
+			name, pattern = line[:i], line[i:]
+		}
+		action, ok := parseAction(name)
+		if !ok {
+			return nil, fmt.Errorf("line %d: unknown action %q: must be hold, quarantine or reject", n, name)
+		}
+		rule, err := NewRule(action, strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		list.Rules = append(list.Rules, rule)
+	}
+	return list, scanner.Err()
+}
+
+// LoadRules reads a rule list from the file at path, as described by
+// ParseRules.
+func LoadRules(path string) (*RuleList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	list, err := ParseRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return list, nil
+}
+
+// parseAction returns the action named name, other than allow.
+func parseAction(name string) (Action, bool) {
+	for i, actionName := range actionNames {
+		if i > int(Allow) && strings.EqualFold(name, actionName) {
+			return Action(i), true
+		}
+	}
+	return Allow, false
+}
@@ -0,0 +1,81 @@
+package moderation
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+const rules = `
+# Words and phrases match whole words, ignoring case
+hold spam
+quarantine buy now
+reject /fr[e3]{2}\s*m[o0]ney/
+quarantine ärger
+`
+
+func TestRuleList(t *testing.T) {
+	list, err := ParseRules(strings.NewReader(rules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for text, want := range map[string]Action{
+		"Hello there":                      Allow,
+		"No SPAM please":                   Hold,
+		"spammer":                          Allow,
+		"Buy\n  now!":                      Quarantine,
+		"spam: buy now":                    Quarantine,
+		"Fr33 money, buy now, spam":        Reject,
+		"Kein Ärger":                       Quarantine,
+		"Verärgert":                        Allow,
+		"free_money is one word to a rule": Allow,
+	} {
+		verdict, err := list.Moderate(context.Background(), text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verdict.Action != want {
+			t.Errorf("Moderate(%q) = %s, want %s", text, verdict.Action, want)
+		}
+		if (verdict.Reason == "") != (want == Allow) {
+			t.Errorf("Moderate(%q) has reason %q", text, verdict.Reason)
+		}
+	}
+}
+
+func TestParseRules_Whitespace(t *testing.T) {
+	list, err := ParseRules(strings.NewReader("quarantine\tbuy now\nhold \t spam \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for text, want := range map[string]Action{"Buy now": Quarantine, "No spam": Hold} {
+		if verdict, _ := list.Moderate(context.Background(), text); verdict.Action != want {
+			t.Errorf("Moderate(%q) = %s, want %s", text, verdict.Action, want)
+		}
+	}
+}
+
+func TestParseRules_Invalid(t *testing.T) {
+	for _, rules := range []string{
+		"delete spam",
+		"allow spam",
+		"hold",
+		"reject /([a-z]/",
+	} {
+		if _, err := ParseRules(strings.NewReader(rules)); err == nil {
+			t.Errorf("Expected %q to be rejected", rules)
+		}
+	}
+}
+
+func TestActionState(t *testing.T) {
+	for action, want := range map[Action]string{Allow: Visible, Hold: Pending, Quarantine: Quarantined, Reject: ""} {
+		if got := action.State(); got != want {
+			t.Errorf("%s.State() = %q, want %q", action, got, want)
+		}
+	}
+	if Hidden(Visible) || !Hidden(Pending) || !Hidden(Quarantined) || !Hidden(Rejected) {
+		t.Error("Expected only visible messages not to be hidden")
+	}
+}
@@ -0,0 +1,34 @@
+// Package outbox publishes message changes to an event bus through a
+// transactional outbox: changes are written to the outbox table in the
+// transaction that makes them, and a Relay publishes them afterwards.
+package outbox
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/shawn1912/messages-service/events"
+)
+
+// Message is an outbox entry as handed to a Publisher.
+type Message struct {
+	ID        int64           `json:"id"` // increases with every message; consumers can deduplicate on it
+	Tenant    string          `json:"tenant"`
+	Key       int64           `json:"key"` // the message ID, which publishing is ordered by
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// Write adds event to the outbox within tx, to be published if tx commits.
+func Write(tx *sql.Tx, event events.Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO outbox (tenant_id, aggregate_id, event_type, payload) VALUES ($1, $2, $3, $4)",
+		event.Tenant, event.Message.ID, event.Type, payload)
+	return err
+}
@@ -0,0 +1,220 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+)
+
+func TestMain(m *testing.M) {
+	// Initialize the test database
+	database.InitDB("user=postgres password=postgres dbname=messages_test sslmode=disable")
+	defer database.DB.Close()
+
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run tests
+	code := m.Run()
+
+	// Clean up the test database
+	database.DB.Exec("TRUNCATE TABLE outbox RESTART IDENTITY CASCADE;")
+
+	os.Exit(code)
+}
+
+// recordingPublisher records the messages it publishes, failing those for
+// which fail returns true.
+type recordingPublisher struct {
+	published []Message
+	fail      func(Message) bool
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, msg Message) error {
+	if p.fail != nil && p.fail(msg) {
+		return errors.New("bus unavailable")
+	}
+	p.published = append(p.published, msg)
+	return nil
+}
+
+// writeEvents writes an event for each of the given message IDs to the
+// outbox of tenant "acme".
+func writeEvents(t *testing.T, messageIDs ...int64) {
+	t.Helper()
+	database.DB.Exec("TRUNCATE TABLE outbox RESTART IDENTITY CASCADE;")
+	tx, err := database.BeginTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, id := range messageIDs {
+		event := events.Event{Type: events.MessageUpdated, Tenant: "acme", Message: database.Message{ID: id}}
+		if err := Write(tx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelay_PublishesInOrder(t *testing.T) {
+	writeEvents(t, 1, 2, 1, 3)
+	publisher := &recordingPublisher{}
+	relay := &Relay{Publisher: publisher, BatchSize: 10, Lease: time.Minute, RetryDelay: time.Second, MaxDelay: time.Minute}
+
+	// Only the first change to each message is eligible per batch.
+	for {
+		n, err := relay.RunOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	var keys []int64
+	for _, msg := range publisher.published {
+		keys = append(keys, msg.Key)
+		if msg.Tenant != "acme" || msg.Type != events.MessageUpdated {
+			t.Errorf("Unexpected message %+v", msg)
+		}
+	}
+	if len(keys) != 4 || keys[0] != 1 || keys[1] != 2 || keys[2] != 3 || keys[3] != 1 {
+		t.Errorf("Expected messages published as [1 2 3 1], got %v", keys)
+	}
+}
+
+func TestRelay_RetriesFailures(t *testing.T) {
+	writeEvents(t, 1, 1, 2)
+	publisher := &recordingPublisher{fail: func(msg Message) bool { return msg.Key == 1 }}
+	relay := &Relay{Publisher: publisher, BatchSize: 10, Lease: time.Minute, RetryDelay: time.Hour, MaxDelay: time.Hour}
+
+	if _, err := relay.RunOnce(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(publisher.published) != 1 || publisher.published[0].Key != 2 {
+		t.Fatalf("Expected only message 2 to be published, got %+v", publisher.published)
+	}
+
+	// The failed message waits for its retry, holding back the later change
+	// to the same message.
+	if n, err := relay.RunOnce(context.Background()); err != nil || n != 0 {
+		t.Fatalf("Expected nothing due, got %d messages (err %v)", n, err)
+	}
+
+	var attempts int
+	var lastError sql.NullString
+	tx, err := database.BeginAllTenants(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow("SELECT attempts, last_error FROM outbox WHERE id = 1").Scan(&attempts, &lastError)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 || lastError.String != "bus unavailable" {
+		t.Errorf("Expected 1 attempt with the error recorded, got %d and %q", attempts, lastError.String)
+	}
+}
+
+func TestRelay_DeadMessages(t *testing.T) {
+	writeEvents(t, 1, 1, 2)
+	publisher := &recordingPublisher{fail: func(msg Message) bool { return msg.ID == 1 }}
+	relay := &Relay{Publisher: publisher, BatchSize: 10, Lease: time.Minute, MaxAttempts: 1, RetryDelay: time.Hour, MaxDelay: time.Hour}
+
+	// The message that used its attempts no longer holds back the next one
+	// about the same message.
+	for i := 0; i < 2; i++ {
+		if _, err := relay.RunOnce(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(publisher.published) != 2 || publisher.published[0].ID != 3 || publisher.published[1].ID != 2 {
+		t.Fatalf("Expected messages 3 then 2 to be published, got %+v", publisher.published)
+	}
+
+	tx, err := database.BeginAllTenants(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	var dead bool
+	if err := tx.QueryRow("SELECT dead_at IS NOT NULL FROM outbox WHERE id = 1").Scan(&dead); err != nil || !dead {
+		t.Errorf("Expected message 1 to be dead (err %v)", err)
+	}
+}
+
+func TestRelay_LeasesClaims(t *testing.T) {
+	writeEvents(t, 1)
+	relay := &Relay{BatchSize: 10, Lease: time.Minute}
+
+	// Claims are committed, so publishing holds no locks, and leased
+	// messages are not claimed again until the lease expires.
+	batch, err := relay.claim(context.Background())
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("Expected 1 message claimed, got %d (err %v)", len(batch), err)
+	}
+	if batch, err := relay.claim(context.Background()); err != nil || len(batch) != 0 {
+		t.Errorf("Expected the leased message not to be claimed again, got %d (err %v)", len(batch), err)
+	}
+}
+
+func TestWriterPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	publisher := NewWriterPublisher(&buf)
+	msg := Message{ID: 7, Tenant: "acme", Key: 3, Type: events.MessageCreated, Payload: json.RawMessage(`{"id":1}`)}
+	if err := publisher.Publish(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Message
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 7 || got.Key != 3 || string(got.Payload) != `{"id":1}` {
+		t.Errorf("Unexpected message %+v", got)
+	}
+}
+
+func TestHTTPPublisher(t *testing.T) {
+	var key string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key = r.Header.Get("Idempotency-Key")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	publisher, err := NewPublisher(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish(context.Background(), Message{ID: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if key != "42" {
+		t.Errorf("Expected Idempotency-Key 42, got %q", key)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := publisher.Publish(context.Background(), Message{ID: 43}); err == nil {
+		t.Error("Expected an error for a 503 response")
+	}
+}
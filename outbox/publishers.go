@@ -0,0 +1,100 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Publisher sends outbox messages to an event bus. Publish must not report
+// success until the message is durably accepted; it may be called again with
+// a message it already published.
+type Publisher interface {
+	Publish(ctx context.Context, msg Message) error
+}
+
+// WriterPublisher writes each message as a line of JSON.
+type WriterPublisher struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterPublisher returns a publisher writing to w.
+func NewWriterPublisher(w io.Writer) *WriterPublisher {
+	return &WriterPublisher{w: w}
+}
+
+// Publish writes msg, syncing it to disk if w is a file.
+func (p *WriterPublisher) Publish(ctx context.Context, msg Message) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if f, ok := p.w.(*os.File); ok && f != os.Stdout && f != os.Stderr {
+		return f.Sync()
+	}
+	return nil
+}
+
+// HTTPPublisher posts each message as JSON to a URL.
+type HTTPPublisher struct {
+	URL    string
+	Client *http.Client
+}
+
+// Publish posts msg, treating any status other than 2xx as a failure.
+func (p *HTTPPublisher) Publish(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", fmt.Sprint(msg.ID))
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// NewPublisher returns the publisher described by spec: "stdout",
+// "file:<path>" or an http(s) URL.
+func NewPublisher(spec string, client *http.Client) (Publisher, error) {
+	switch {
+	case spec == "stdout":
+		return NewWriterPublisher(os.Stdout), nil
+	case strings.HasPrefix(spec, "file:"):
+		f, err := os.OpenFile(strings.TrimPrefix(spec, "file:"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		return NewWriterPublisher(f), nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &HTTPPublisher{URL: spec, Client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown outbox publisher %q: use stdout, file:<path> or an http(s) URL", spec)
+	}
+}
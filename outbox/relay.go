@@ -0,0 +1,239 @@
+package outbox
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"expvar"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/shawn1912/messages-service/database"
+)
+
+// Metrics, published under "outbox" at /debug/vars.
+var (
+	metrics         = expvar.NewMap("outbox")
+	publishedTotal  = new(expvar.Int)
+	failedTotal     = new(expvar.Int)
+	deadTotal       = new(expvar.Int)
+	batchesTotal    = new(expvar.Int)
+	lagSeconds      = new(expvar.Float)
+	pendingMessages = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("published_total", publishedTotal)
+	metrics.Set("failed_total", failedTotal)
+	metrics.Set("dead_total", deadTotal)
+	metrics.Set("batches_total", batchesTotal)
+	metrics.Set("lag_seconds", lagSeconds)
+	metrics.Set("pending", pendingMessages)
+}
+
+// Relay publishes outbox messages. Any number of relays can run at once; each
+// claims messages by leasing them, so a message whose relay dies is published
+// once its lease expires, and only the oldest pending message of each message
+// ID is eligible, so messages about the same message are published in order.
+// A message is marked published only after Publish succeeds, so it is
+// published at least once, and again if the relay fails before recording
+// that. Messages that fail MaxAttempts times are marked dead, releasing the
+// later messages about the same message.
+type Relay struct {
+	Publisher    Publisher
+	BatchSize    int
+	PollInterval time.Duration
+	Lease        time.Duration // how long a claimed batch is reserved for publishing
+	MaxAttempts  int           // attempts before a message is dead; zero retries forever
+	RetryDelay   time.Duration // delay after the first failure, doubled for each later one
+	MaxDelay     time.Duration
+	Retention    time.Duration // how long published and dead messages are kept; zero keeps them
+}
+
+// Run publishes messages until ctx is done.
+func (r *Relay) Run(ctx context.Context) {
+	poll := time.NewTicker(r.PollInterval)
+	defer poll.Stop()
+	lastPrune := time.Time{}
+
+	for {
+		for {
+			n, err := r.RunOnce(ctx)
+			if err != nil {
+				log.Printf("Outbox relay: %v", err)
+			}
+			if err != nil || n < r.BatchSize {
+				break
+			}
+		}
+		if time.Since(lastPrune) > time.Minute {
+			r.prune(ctx)
+			lastPrune = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// claimed is a message leased by a relay.
+type claimed struct {
+	msg      Message
+	attempts int
+}
+
+// RunOnce claims and publishes one batch of due messages, returning how many
+// it claimed.
+func (r *Relay) RunOnce(ctx context.Context) (int, error) {
+	batch, err := r.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range batch {
+		if err := r.recordAttempt(ctx, c, r.Publisher.Publish(ctx, c.msg)); err != nil {
+			return len(batch), err
+		}
+	}
+	batchesTotal.Add(1)
+
+	r.updateLag(ctx)
+	return len(batch), nil
+}
+
+// claim leases a batch of due messages long enough to publish them all.
+func (r *Relay) claim(ctx context.Context) ([]claimed, error) {
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+        UPDATE outbox
+        SET next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+        WHERE id IN (
+            SELECT id
+            FROM outbox o
+            WHERE published_at IS NULL AND dead_at IS NULL AND next_attempt_at <= NOW()
+              AND NOT EXISTS (
+                  SELECT 1 FROM outbox earlier
+                  WHERE earlier.published_at IS NULL AND earlier.dead_at IS NULL
+                    AND earlier.tenant_id = o.tenant_id
+                    AND earlier.aggregate_id = o.aggregate_id
+                    AND earlier.id < o.id
+              )
+            ORDER BY id ASC
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, tenant_id, aggregate_id, event_type, payload, created_at, attempts
+    `, r.BatchSize, r.Lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []claimed
+	for rows.Next() {
+		var c claimed
+		err := rows.Scan(&c.msg.ID, &c.msg.Tenant, &c.msg.Key, &c.msg.Type, &c.msg.Payload, &c.msg.CreatedAt, &c.attempts)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// UPDATE ... RETURNING does not keep the subquery's order
+	slices.SortFunc(batch, func(a, b claimed) int { return cmp.Compare(a.msg.ID, b.msg.ID) })
+	return batch, tx.Commit()
+}
+
+// recordAttempt stores the outcome of publishing a message, scheduling a
+// retry or marking it dead once it has used all of its attempts.
+func (r *Relay) recordAttempt(ctx context.Context, c claimed, publishErr error) error {
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	attempts := c.attempts + 1
+	if publishErr == nil {
+		publishedTotal.Add(1)
+		_, err = tx.ExecContext(ctx,
+			"UPDATE outbox SET attempts = $2, last_error = NULL, published_at = NOW() WHERE id = $1", c.msg.ID, attempts)
+	} else {
+		failedTotal.Add(1)
+		dead := r.MaxAttempts > 0 && attempts >= r.MaxAttempts
+		if dead {
+			deadTotal.Add(1)
+			log.Printf("Outbox relay: giving up on message %d after %d attempts: %v", c.msg.ID, attempts, publishErr)
+		}
+		_, err = tx.ExecContext(ctx, `
+            UPDATE outbox
+            SET attempts = $2, last_error = $3, next_attempt_at = NOW() + $4 * INTERVAL '1 second',
+                dead_at = CASE WHEN $5 THEN NOW() END
+            WHERE id = $1
+        `, c.msg.ID, attempts, publishErr.Error(), r.backoff(attempts).Seconds(), dead)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateLag records how many messages are waiting and the age of the oldest.
+func (r *Relay) updateLag(ctx context.Context) {
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var pending int64
+	var lag sql.NullFloat64
+	err = tx.QueryRowContext(ctx,
+		"SELECT COUNT(*), EXTRACT(EPOCH FROM NOW() - MIN(created_at)) FROM outbox WHERE published_at IS NULL AND dead_at IS NULL").
+		Scan(&pending, &lag)
+	if err != nil {
+		return
+	}
+	pendingMessages.Set(pending)
+	lagSeconds.Set(lag.Float64)
+}
+
+// prune deletes published and dead messages older than the retention period.
+func (r *Relay) prune(ctx context.Context) {
+	if r.Retention <= 0 {
+		return
+	}
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		log.Printf("Outbox relay: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM outbox WHERE published_at < $1 OR dead_at < $1", time.Now().Add(-r.Retention)); err != nil {
+		log.Printf("Outbox relay: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Outbox relay: %v", err)
+	}
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func (r *Relay) backoff(attempts int) time.Duration {
+	delay := r.RetryDelay
+	for i := 1; i < attempts && delay < r.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, r.MaxDelay)
+}
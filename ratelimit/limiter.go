@@ -0,0 +1,214 @@
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/auth"
+	"github.com/shawn1912/messages-service/requestinfo"
+)
+
+// Limiter is middleware that limits how often each client may call each
+// route. Clients are identified by their authenticated principal (an API key
+// or token subject, within its tenant) or, for anonymous requests, their IP
+// address.
+type Limiter struct {
+	Store Store
+	// Default applies to routes without their own limit. A zero limit
+	// leaves them unlimited.
+	Default Limit
+	// Routes holds per-route limits keyed by method and path template, such
+	// as "POST /message" or "GET /message/{id}".
+	Routes map[string]Limit
+	// FailedAuth limits how often each client IP may fail to authenticate,
+	// on any route. A zero limit leaves failures unlimited.
+	FailedAuth Limit
+	// TrustedProxies are the networks of reverse proxies whose
+	// X-Forwarded-For header is believed.
+	TrustedProxies []*net.IPNet
+
+	now func() time.Time // replaced in tests
+}
+
+// Middleware enforces the limits, reporting the state of the client's bucket
+// in RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+// Requests over the limit get a 429 with a Retry-After header.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeKey(r)
+		limit, ok := l.Routes[route]
+		if !ok {
+			limit = l.Default
+		}
+		if limit.Requests <= 0 || limit.Period <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		result, err := l.Store.Take(r.Context(), route+"|"+l.clientKey(r), limit, l.clock())
+		if err != nil {
+			// Fail open: an unavailable store must not take the service down
+			log.Printf("Rate limit store error: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", ceilSeconds(result.Reset))
+
+		if !result.Allowed {
+			w.Header().Set("Retry-After", ceilSeconds(result.RetryAfter))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AuthFailures is middleware, to run before authentication, that charges
+// every failure to authenticate to the FailedAuth bucket of the client's IP
+// address, so that credentials cannot be guessed at the pace of the service.
+// Once the bucket is empty, requests with credentials get a 429 with a
+// Retry-After header before the credentials are checked.
+func (l *Limiter) AuthFailures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := l.FailedAuth
+		if limit.Requests <= 0 || limit.Period <= 0 || !auth.HasCredentials(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := "auth|ip:" + requestinfo.ClientIP(r, l.TrustedProxies)
+		result, err := l.Store.Peek(r.Context(), key, limit, l.clock())
+		if err != nil {
+			log.Printf("Rate limit store error: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !result.Allowed {
+			w.Header().Set("Retry-After", ceilSeconds(result.RetryAfter))
+			http.Error(w, "Too many failed authentications", http.StatusTooManyRequests)
+			return
+		}
+
+		ctx := auth.WithFailureHook(r.Context(), func() {
+			if _, err := l.Store.Take(r.Context(), key, limit, l.clock()); err != nil {
+				log.Printf("Rate limit store error: %v", err)
+			}
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clock returns the current time.
+func (l *Limiter) clock() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// clientKey identifies the client making r.
+func (l *Limiter) clientKey(r *http.Request) string {
+	if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+		return "principal:" + principal.Tenant + "/" + principal.Subject
+	}
+	return "ip:" + requestinfo.ClientIP(r, l.TrustedProxies)
+}
+
+// routeVariable matches a path variable with a pattern, such as {id:[0-9]+}.
+var routeVariable = regexp.MustCompile(`\{([^}:]+):[^}]*\}`)
+
+// routeKey returns the method and path template of the route r matched, with
+// variable patterns removed.
+func routeKey(r *http.Request) string {
+	path := r.URL.Path
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			path = routeVariable.ReplaceAllString(template, "{$1}")
+		}
+	}
+	return r.Method + " " + path
+}
+
+// ParseLimit parses a limit written as requests per period, such as "60/1m".
+func ParseLimit(s string) (Limit, error) {
+	requests, period, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: expected requests/period such as 60/1m", s)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: requests must be a non-negative integer", s)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate limit %q: period must be a positive duration", s)
+	}
+	return Limit{Requests: n, Period: d}, nil
+}
+
+// ParseRoutes parses semicolon-separated per-route limits, such as
+// "POST /message=60/1m; GET /messages=600/1m".
+func ParseRoutes(s string) (map[string]Limit, error) {
+	routes := map[string]Limit{}
+	for _, rule := range strings.Split(s, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		route, limit, ok := strings.Cut(rule, "=")
+		method, path, hasPath := strings.Cut(strings.TrimSpace(route), " ")
+		if !ok || !hasPath || method == "" || !strings.HasPrefix(strings.TrimSpace(path), "/") {
+			return nil, fmt.Errorf("invalid rate limit rule %q: expected METHOD /path=requests/period", rule)
+		}
+		parsed, err := ParseLimit(limit)
+		if err != nil {
+			return nil, err
+		}
+		routes[strings.ToUpper(method)+" "+strings.TrimSpace(path)] = parsed
+	}
+	return routes, nil
+}
+
+// ParseNetworks parses a comma-separated list of CIDR networks or single IP
+// addresses.
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// ceilSeconds formats d as a whole number of seconds, rounded up.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
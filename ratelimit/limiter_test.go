@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shawn1912/messages-service/auth"
+)
+
+func TestLimiter_Middleware(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	limiter := &Limiter{
+		Store:   NewMemoryStore(),
+		Default: Limit{Requests: 100, Period: time.Minute},
+		Routes:  map[string]Limit{"POST /message/{id}": {Requests: 1, Period: time.Minute}},
+		now:     func() time.Time { return now },
+	}
+
+	router := mux.NewRouter()
+	router.Use(limiter.Middleware)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	router.HandleFunc("/message/{id:[0-9]+}", ok).Methods("POST")
+	router.HandleFunc("/messages", ok).Methods("GET")
+
+	send := func(method, path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send("POST", "/message/1", "192.0.2.1:1234")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr.Header().Get("RateLimit-Limit") != "1" || rr.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected rate limit headers %v", rr.Header())
+	}
+
+	// The route limit applies to every ID
+	rr = send("POST", "/message/2", "192.0.2.1:1234")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected Retry-After 60, got %q", rr.Header().Get("Retry-After"))
+	}
+
+	// Other routes use the default limit, and other clients their own buckets
+	if rr := send("GET", "/messages", "192.0.2.1:1234"); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "100" {
+		t.Errorf("Expected default limit on another route, got %d %v", rr.Code, rr.Header())
+	}
+	if rr := send("POST", "/message/1", "192.0.2.2:1234"); rr.Code != http.StatusOK {
+		t.Errorf("Expected another client to be allowed, got %d", rr.Code)
+	}
+}
+
+func TestLimiter_AuthFailures(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	limiter := &Limiter{
+		Store:      NewMemoryStore(),
+		FailedAuth: Limit{Requests: 2, Period: time.Minute},
+		now:        func() time.Time { return now },
+	}
+	handler := limiter.AuthFailures(auth.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	send := func(remoteAddr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/messages", nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Bearer tokens are all invalid without a verifier
+	for i := 0; i < 2; i++ {
+		if rr := send("192.0.2.1:1234", "guess"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected status code %d for guess %d, got %d", http.StatusUnauthorized, i+1, rr.Code)
+		}
+	}
+	rr := send("192.0.2.1:1234", "guess")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected a 429 once the failures are used up, got %d %v", rr.Code, rr.Header())
+	}
+
+	// Requests without credentials and other clients are not affected
+	if rr := send("192.0.2.1:1234", ""); rr.Code != http.StatusOK {
+		t.Errorf("Expected an anonymous request to pass, got %d", rr.Code)
+	}
+	if rr := send("192.0.2.2:1234", "guess"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected another client to be authenticated, got %d", rr.Code)
+	}
+
+	now = now.Add(30 * time.Second)
+	if rr := send("192.0.2.1:1234", "guess"); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a failure to be allowed after the bucket refilled, got %d", rr.Code)
+	}
+}
+
+func TestLimiter_ClientKey(t *testing.T) {
+	proxies, err := ParseNetworks("10.0.0.0/8, 192.0.2.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := &Limiter{TrustedProxies: proxies}
+
+	testCases := []struct {
+		remoteAddr   string
+		forwardedFor string
+		expected     string
+	}{
+		{"198.51.100.7:1234", "", "ip:198.51.100.7"},
+		// Headers from untrusted clients are ignored
+		{"198.51.100.7:1234", "203.0.113.1", "ip:198.51.100.7"},
+		{"10.1.2.3:1234", "203.0.113.1", "ip:203.0.113.1"},
+		// Spoofed entries left of the first untrusted hop are ignored
+		{"10.1.2.3:1234", "1.1.1.1, 203.0.113.1, 192.0.2.10", "ip:203.0.113.1"},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/messages", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if key := limiter.clientKey(req); key != tc.expected {
+			t.Errorf("clientKey(%s, %q) = %q; expected %q", tc.remoteAddr, tc.forwardedFor, key, tc.expected)
+		}
+	}
+
+	// Authenticated callers are limited by principal rather than address
+	req := httptest.NewRequest("GET", "/messages", nil)
+	req = req.WithContext(auth.WithPrincipal(req.Context(), auth.Principal{Subject: "apikey:1", Tenant: "acme"}))
+	if key := limiter.clientKey(req); key != "principal:acme/apikey:1" {
+		t.Errorf("Expected principal key, got %q", key)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes("post /message=60/1m; GET /message/{id}=10/1s;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit := routes["POST /message"]; limit.Requests != 60 || limit.Period != time.Minute {
+		t.Errorf("Unexpected limit for POST /message: %+v", limit)
+	}
+	if limit := routes["GET /message/{id}"]; limit.Requests != 10 || limit.Period != time.Second {
+		t.Errorf("Unexpected limit for GET /message/{id}: %+v", limit)
+	}
+
+	for _, invalid := range []string{"POST=1/1m", "POST /message", "POST /message=1/forever", "POST /message=-1/1m"} {
+		if _, err := ParseRoutes(invalid); err == nil {
+			t.Errorf("Expected ParseRoutes(%q) to fail", invalid)
+		}
+	}
+}
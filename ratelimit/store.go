@@ -0,0 +1,124 @@
+// Package ratelimit limits how often each client may call each route, using
+// token buckets.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limit allows Requests requests per Period. Clients may use a full period's
+// requests in a burst; the bucket then refills evenly over the period.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// rate returns the refill rate in tokens per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// Result is the outcome of taking a token from a bucket.
+type Result struct {
+	Allowed    bool
+	Limit      int           // bucket capacity
+	Remaining  int           // whole tokens left after this request
+	Reset      time.Duration // time until the bucket is full again
+	RetryAfter time.Duration // time until a request would be allowed, if denied
+}
+
+// Store keeps token buckets. The in-process MemoryStore suits a single
+// instance; a shared implementation lets several replicas enforce one limit.
+type Store interface {
+	// Take removes a token from the bucket identified by key, creating a full
+	// bucket for limit if there is none.
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+	// Peek reports whether Take would allow a request, without taking a
+	// token.
+	Peek(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+// MemoryStore keeps token buckets in process memory.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+// sweepInterval is how often buckets that have refilled completely, and so
+// are indistinguishable from new ones, are dropped.
+const sweepInterval = time.Minute
+
+// Take implements Store.
+func (s *MemoryStore) Take(_ context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	return s.use(key, limit, now, true), nil
+}
+
+// Peek implements Store.
+func (s *MemoryStore) Peek(_ context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	return s.use(key, limit, now, false), nil
+}
+
+// use refills the bucket identified by key and checks it has a token left,
+// taking it if take is set.
+func (s *MemoryStore) use(key string, limit Limit, now time.Time, take bool) Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Requests), updated: now, limit: limit}
+		s.buckets[key] = b
+	}
+
+	rate := limit.rate()
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Requests), b.tokens+elapsed*rate)
+		b.updated = now
+	}
+
+	result := Result{Limit: limit.Requests}
+	if b.tokens >= 1 {
+		if take {
+			b.tokens--
+		}
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.tokens) / rate)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = seconds((float64(limit.Requests) - b.tokens) / rate)
+	return result
+}
+
+// sweep drops the buckets that are full at now.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*b.limit.rate() >= float64(b.limit.Requests) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
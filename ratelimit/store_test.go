@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore_Take(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Requests: 3, Period: 3 * time.Second}
+	now := time.Unix(1_700_000_000, 0)
+
+	take := func() Result {
+		result, err := store.Take(context.Background(), "client", limit, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	// The full burst is available straight away
+	for i := 2; i >= 0; i-- {
+		result := take()
+		if !result.Allowed || result.Remaining != i {
+			t.Errorf("Expected request to be allowed with %d remaining, got %+v", i, result)
+		}
+	}
+
+	result := take()
+	if result.Allowed {
+		t.Error("Expected request over the limit to be denied")
+	}
+	if result.RetryAfter != time.Second {
+		t.Errorf("Expected RetryAfter 1s, got %s", result.RetryAfter)
+	}
+	if result.Reset != 3*time.Second {
+		t.Errorf("Expected Reset 3s, got %s", result.Reset)
+	}
+
+	// One token refills every second
+	now = now.Add(time.Second)
+	if result := take(); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("Expected a refilled token to be allowed, got %+v", result)
+	}
+
+	// Buckets never hold more than the limit
+	now = now.Add(time.Hour)
+	if result := take(); result.Remaining != 2 {
+		t.Errorf("Expected 2 remaining after a long pause, got %+v", result)
+	}
+
+	// Other clients have their own bucket
+	if result, _ := store.Take(context.Background(), "other", limit, now); result.Remaining != 2 {
+		t.Errorf("Expected a new bucket for another client, got %+v", result)
+	}
+}
+
+func TestMemoryStore_Sweep(t *testing.T) {
+	store := NewMemoryStore()
+	limit := Limit{Requests: 1, Period: time.Second}
+	now := time.Unix(1_700_000_000, 0)
+
+	store.Take(context.Background(), "client", limit, now)
+	store.Take(context.Background(), "other", limit, now.Add(sweepInterval))
+
+	// The first bucket refilled long ago and was dropped
+	if len(store.buckets) != 1 {
+		t.Errorf("Expected 1 bucket after sweeping, got %d", len(store.buckets))
+	}
+}
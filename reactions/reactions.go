@@ -0,0 +1,120 @@
+// Package reactions stores the emoji reactions of users to messages.
+package reactions
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+)
+
+// maxEmojiLength bounds an emoji in runes, enough for ZWJ sequences such as
+// families.
+const maxEmojiLength = 10
+
+// Normalize returns emoji in its stored form, without variation selectors so
+// that the text and emoji presentations of a symbol count together, or an
+// error if it is not a single emoji. Emoji are recognised by code point
+// ranges approximating the Unicode Extended_Pictographic property, along with
+// the modifiers and joiners of emoji sequences.
+func Normalize(emoji string) (string, error) {
+	normalized := strings.ReplaceAll(emoji, "\uFE0F", "")
+	n := utf8.RuneCountInString(normalized)
+	if n == 0 || n > maxEmojiLength {
+		return "", fmt.Errorf("invalid emoji %q", emoji)
+	}
+
+	pictographs, keycaps := 0, 0
+	for _, r := range normalized {
+		switch {
+		case isPictographic(r), r >= 0x1F1E6 && r <= 0x1F1FF: // regional indicators make flags
+			pictographs++
+		case r == 0x20E3: // combining keycap
+			keycaps++
+		case r == 0x200D, // zero width joiner
+			r >= 0x1F3FB && r <= 0x1F3FF,             // skin tone modifiers
+			r >= 0xE0020 && r <= 0xE007F,             // tag characters of subdivision flags
+			r >= '0' && r <= '9', r == '#', r == '*': // keycap bases
+		default:
+			return "", fmt.Errorf("invalid emoji %q", emoji)
+		}
+	}
+	if pictographs == 0 && keycaps != 1 {
+		return "", fmt.Errorf("invalid emoji %q", emoji)
+	}
+	return normalized, nil
+}
+
+// isPictographic reports whether r is in one of the blocks of emoji symbols.
+func isPictographic(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF, // emoticons, symbols and pictographs
+		r >= 0x2600 && r <= 0x27BF, // miscellaneous symbols and dingbats
+		r >= 0x2300 && r <= 0x23FF, // miscellaneous technical
+		r >= 0x2B00 && r <= 0x2BFF, // arrows
+		r >= 0x2190 && r <= 0x21FF, // arrows
+		r >= 0x25A0 && r <= 0x25FF, // geometric shapes
+		r == 0x00A9, r == 0x00AE, r == 0x203C, r == 0x2049, r == 0x2122, r == 0x2139,
+		r == 0x24C2, r == 0x2934, r == 0x2935, r == 0x3030, r == 0x303D, r == 0x3297, r == 0x3299:
+		return true
+	}
+	return false
+}
+
+// Add records user's reaction to a message with emoji, which must be
+// normalized, reporting whether it is new.
+func Add(tx *sql.Tx, tenant string, messageID int64, user, emoji string) (bool, error) {
+	result, err := tx.Exec(`
+        INSERT INTO message_reactions (message_id, tenant_id, user_id, emoji) VALUES ($1, $2, $3, $4)
+        ON CONFLICT DO NOTHING
+    `, messageID, tenant, user, emoji)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// Remove removes user's reaction to a message with emoji, reporting whether
+// there was one.
+func Remove(tx *sql.Tx, tenant string, messageID int64, user, emoji string) (bool, error) {
+	result, err := tx.Exec(
+		"DELETE FROM message_reactions WHERE message_id = $1 AND tenant_id = $2 AND user_id = $3 AND emoji = $4",
+		messageID, tenant, user, emoji)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// Counts returns the reaction counts of each of the given messages, most
+// popular first and then in the order the emoji were first used. Messages
+// without reactions are left out.
+func Counts(tx *sql.Tx, tenant string, messageIDs []int64) (map[int64][]database.ReactionCount, error) {
+	rows, err := tx.Query(`
+        SELECT message_id, emoji, COUNT(*)
+        FROM message_reactions
+        WHERE tenant_id = $1 AND message_id = ANY($2)
+        GROUP BY message_id, emoji
+        ORDER BY COUNT(*) DESC, MIN(created_at) ASC, emoji ASC
+    `, tenant, pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[int64][]database.ReactionCount{}
+	for rows.Next() {
+		var id int64
+		var count database.ReactionCount
+		if err := rows.Scan(&id, &count.Emoji, &count.Count); err != nil {
+			return nil, err
+		}
+		counts[id] = append(counts[id], count)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,100 @@
+package reactions
+
+import (
+	"context"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestMain(m *testing.M) {
+	// Initialize the test database
+	database.InitDB("user=postgres password=postgres dbname=messages_test sslmode=disable")
+	defer database.DB.Close()
+
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run tests
+	code := m.Run()
+
+	// Clean up the test database
+	database.DB.Exec("TRUNCATE TABLE messages RESTART IDENTITY CASCADE;")
+
+	os.Exit(code)
+}
+
+func TestNormalize(t *testing.T) {
+	valid := map[string]string{
+		"👍":   "👍",
+		"❤️":  "❤",
+		"👍🏽":  "👍🏽",
+		"👩‍💻": "👩‍💻",
+		"🇳🇿":  "🇳🇿",
+		"1️⃣": "1⃣",
+	}
+	for emoji, want := range valid {
+		if got, err := Normalize(emoji); err != nil || got != want {
+			t.Errorf("Normalize(%q) = %q, %v; expected %q", emoji, got, err, want)
+		}
+	}
+	for _, emoji := range []string{"", "a", "ok", "1", "‍", "👍👍👍👍👍👍👍👍👍👍👍"} {
+		if _, err := Normalize(emoji); err == nil {
+			t.Errorf("Expected %q to be invalid", emoji)
+		}
+	}
+}
+
+func TestReactions(t *testing.T) {
+	database.DB.Exec("TRUNCATE TABLE messages RESTART IDENTITY CASCADE;")
+	ctx := context.Background()
+
+	tx, err := database.BeginTenant(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	var first, second int64
+	for _, id := range []*int64{&first, &second} {
+		err = tx.QueryRow("INSERT INTO messages (content, tenant_id) VALUES ('hello', 'acme') RETURNING id").Scan(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, reaction := range []struct {
+		user, emoji string
+	}{{"alice", "👍"}, {"bob", "🎉"}, {"bob", "👍"}, {"carol", "🎉"}, {"carol", "👀"}} {
+		if added, err := Add(tx, "acme", first, reaction.user, reaction.emoji); err != nil || !added {
+			t.Fatalf("Expected %s's %s to be added, got %v (err %v)", reaction.user, reaction.emoji, added, err)
+		}
+	}
+	if added, err := Add(tx, "acme", first, "alice", "👍"); err != nil || added {
+		t.Errorf("Expected a repeated reaction not to be added, got %v (err %v)", added, err)
+	}
+
+	counts, err := Counts(tx, "acme", []int64{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []database.ReactionCount{{Emoji: "👍", Count: 2}, {Emoji: "🎉", Count: 2}, {Emoji: "👀", Count: 1}}
+	if !reflect.DeepEqual(counts[first], want) {
+		t.Errorf("Expected counts %v, got %v", want, counts[first])
+	}
+	if _, ok := counts[second]; ok {
+		t.Errorf("Expected no counts for a message without reactions, got %v", counts[second])
+	}
+
+	if removed, err := Remove(tx, "acme", first, "carol", "👀"); err != nil || !removed {
+		t.Errorf("Expected the reaction to be removed, got %v (err %v)", removed, err)
+	}
+	if removed, err := Remove(tx, "acme", first, "carol", "👀"); err != nil || removed {
+		t.Errorf("Expected nothing to remove, got %v (err %v)", removed, err)
+	}
+}
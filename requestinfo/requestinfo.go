@@ -0,0 +1,103 @@
+// Package requestinfo assigns every request an ID and works out the address of
+// the client that made it.
+package requestinfo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Header carries the request ID. A well-formed ID sent by the client is kept so
+// that requests can be traced across services; otherwise one is generated.
+const Header = "X-Request-ID"
+
+// Info describes the request being served.
+type Info struct {
+	ID       string
+	ClientIP string
+}
+
+type infoKey struct{}
+
+// FromContext returns the Info stored by Middleware, or the zero Info.
+func FromContext(ctx context.Context) Info {
+	info, _ := ctx.Value(infoKey{}).(Info)
+	return info
+}
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// Middleware records the request's Info in its context and echoes the request
+// ID in the response. X-Forwarded-For is only believed when the request comes
+// from one of trustedProxies.
+func Middleware(trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(Header)
+			if !validID.MatchString(id) {
+				id = newID()
+			}
+			w.Header().Set(Header, id)
+
+			info := Info{ID: id, ClientIP: ClientIP(r, trustedProxies)}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), infoKey{}, info)))
+		})
+	}
+}
+
+// ClientIP returns the address of the client making r. When the request comes
+// from a trusted proxy, the X-Forwarded-For chain is walked from the right and
+// the first address that is not a trusted proxy is the client.
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trusted(host, trustedProxies) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			break
+		}
+		if !trusted(hops[i], trustedProxies) || i == 0 {
+			return hops[i]
+		}
+	}
+	return host
+}
+
+// trusted reports whether addr belongs to one of networks.
+func trusted(addr string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newID returns a random 128-bit request ID.
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
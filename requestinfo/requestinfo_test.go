@@ -0,0 +1,73 @@
+package requestinfo
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies := []*net.IPNet{proxies}
+
+	testCases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"direct", "203.0.113.7:1234", "", "203.0.113.7"},
+		{"untrusted peer ignores header", "203.0.113.7:1234", "198.51.100.1", "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.1", "198.51.100.1"},
+		{"chain of proxies", "10.0.0.1:1234", "198.51.100.1, 10.0.0.2", "198.51.100.1"},
+		{"spoofed leftmost hop", "10.0.0.1:1234", "192.0.2.9, 198.51.100.1", "198.51.100.1"},
+		{"garbage hop", "10.0.0.1:1234", "not-an-ip", "10.0.0.1"},
+		{"no header", "10.0.0.1:1234", "", "10.0.0.1"},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := ClientIP(req, trustedProxies); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var seen Info
+	handler := Middleware(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = FromContext(r.Context())
+	}))
+
+	// A well-formed ID is kept
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:1234"
+	req.Header.Set(Header, "trace-123")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if seen.ID != "trace-123" || rr.Header().Get(Header) != "trace-123" {
+		t.Errorf("Expected request ID 'trace-123', got %q (response %q)", seen.ID, rr.Header().Get(Header))
+	}
+	if seen.ClientIP != "203.0.113.7" {
+		t.Errorf("Expected client IP '203.0.113.7', got %q", seen.ClientIP)
+	}
+
+	// A malformed one is replaced
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(Header, "bad id\n")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if seen.ID == "bad id\n" || len(seen.ID) != 32 {
+		t.Errorf("Expected a generated request ID, got %q", seen.ID)
+	}
+	if rr.Header().Get(Header) != seen.ID {
+		t.Errorf("Expected response to echo %q, got %q", seen.ID, rr.Header().Get(Header))
+	}
+}
@@ -0,0 +1,576 @@
+package richtext
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Block-level syntax, matched against single lines.
+var (
+	atxHeading    = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	thematicBreak = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fenceOpen     = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`]*)$")
+	blockquote    = regexp.MustCompile(`^ {0,3}> ?(.*)$`)
+	bulletItem    = regexp.MustCompile(`^( {0,3})([-*+])(?:[ \t]+(.*))?$`)
+	orderedItem   = regexp.MustCompile(`^( {0,3})([0-9]{1,9})([.)])(?:[ \t]+(.*))?$`)
+)
+
+// Inline syntax, matched at the current position.
+var (
+	entity     = regexp.MustCompile(`^&(?:#[0-9]{1,7}|#[xX][0-9a-fA-F]{1,6}|[A-Za-z][A-Za-z0-9]{1,31});`)
+	autolink   = regexp.MustCompile(`^<([A-Za-z][A-Za-z0-9+.-]{1,31}:[^\s<>]*)>`)
+	inlineHTML = regexp.MustCompile(`^(?:<!--[\s\S]*?-->|</?[A-Za-z][A-Za-z0-9-]*(?:\s+[^\s"'<>/=]+(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s"'=<>` + "`" + `]+))?)*\s*/?>)`)
+	linkTail   = regexp.MustCompile(`^\(\s*(<[^<>\n]*>|[^\s()]*)(?:\s+("[^"]*"|'[^']*'))?\s*\)`)
+)
+
+// markdownToHTML renders a subset of CommonMark, with GitHub's strikethrough,
+// to HTML: ATX headings, paragraphs, block quotes, bullet and ordered lists,
+// fenced code blocks, thematic breaks, emphasis, code spans, links and hard
+// line breaks. Inline HTML is passed through, so the result must be
+// sanitized.
+func markdownToHTML(src string) string {
+	src = strings.ReplaceAll(strings.ReplaceAll(src, "\r\n", "\n"), "\r", "\n")
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(src, "\n"), false)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// renderBlocks renders lines as a sequence of blocks. In tight lists the
+// paragraphs of list items are not wrapped in <p> elements.
+func renderBlocks(b *strings.Builder, lines []string, tight bool) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case fenceOpen.MatchString(line):
+			i = renderFence(b, lines, i)
+
+		case atxHeading.MatchString(line):
+			m := atxHeading.FindStringSubmatch(line)
+			level := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + level + ">" + renderInline(strings.TrimSpace(m[2])) + "</h" + level + ">\n")
+			i++
+
+		case thematicBreak.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		case blockquote.MatchString(line):
+			var inner []string
+			for ; i < len(lines); i++ {
+				m := blockquote.FindStringSubmatch(lines[i])
+				if m != nil {
+					inner = append(inner, m[1])
+				} else if len(inner) > 0 && strings.TrimSpace(inner[len(inner)-1]) != "" &&
+					strings.TrimSpace(lines[i]) != "" && !startsBlock(lines[i]) {
+					// Lazy continuation of a paragraph in the quote
+					inner = append(inner, lines[i])
+				} else {
+					break
+				}
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, inner, false)
+			b.WriteString("</blockquote>\n")
+
+		case bulletItem.MatchString(line) || orderedItem.MatchString(line):
+			i = renderList(b, lines, i)
+
+		default:
+			var para []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				if len(para) > 0 && startsBlock(lines[i]) {
+					break
+				}
+				para = append(para, lines[i])
+			}
+			content := renderInline(strings.TrimSpace(strings.Join(para, "\n")))
+			if tight {
+				b.WriteString(content + "\n")
+			} else {
+				b.WriteString("<p>" + content + "</p>\n")
+			}
+		}
+	}
+}
+
+// startsBlock reports whether line interrupts a paragraph.
+func startsBlock(line string) bool {
+	if m := orderedItem.FindStringSubmatch(line); m != nil {
+		// Only lists starting at 1 interrupt paragraphs
+		return m[4] != "" && m[2] == "1"
+	}
+	if m := bulletItem.FindStringSubmatch(line); m != nil {
+		return m[3] != ""
+	}
+	return fenceOpen.MatchString(line) || atxHeading.MatchString(line) ||
+		thematicBreak.MatchString(line) || blockquote.MatchString(line)
+}
+
+// renderFence renders the fenced code block opening at lines[i] and returns
+// the index of the line after it.
+func renderFence(b *strings.Builder, lines []string, i int) int {
+	m := fenceOpen.FindStringSubmatch(lines[i])
+	indent, fence := len(m[1]), m[2]
+	info := strings.Fields(html.UnescapeString(m[3]))
+
+	var code []string
+	for i++; i < len(lines); i++ {
+		closing := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(closing, fence) && strings.Trim(closing, fence[:1]) == "" &&
+			len(lines[i])-len(strings.TrimLeft(lines[i], " ")) <= 3 {
+			i++
+			break
+		}
+		line := lines[i]
+		for n := 0; n < indent && strings.HasPrefix(line, " "); n++ {
+			line = line[1:]
+		}
+		code = append(code, line)
+	}
+
+	b.WriteString("<pre><code")
+	if len(info) > 0 {
+		b.WriteString(` class="language-` + html.EscapeString(info[0]) + `"`)
+	}
+	b.WriteString(">")
+	for _, line := range code {
+		b.WriteString(html.EscapeString(line) + "\n")
+	}
+	b.WriteString("</code></pre>\n")
+	return i
+}
+
+// renderList renders the list starting at lines[i] and returns the index of
+// the line after it. Items continue on lines indented past their marker, and
+// the list is loose if blank lines separate its items or their blocks.
+func renderList(b *strings.Builder, lines []string, i int) int {
+	ordered := !bulletItem.MatchString(lines[i])
+	marker, start := listMarker(lines[i])
+
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		m, width := listItem(lines[i])
+		if m == "" || m != marker {
+			break
+		}
+		item := []string{strings.TrimLeft(lines[i][min(width, len(lines[i])):], " \t")}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if strings.TrimSpace(line) == "" {
+				// A blank line ends the list unless more of it follows
+				j := i + 1
+				for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+					j++
+				}
+				if j == len(lines) {
+					i = j
+					break
+				}
+				if indentWidth(lines[j]) >= width {
+					item = append(item, "")
+					loose = true
+					continue
+				}
+				if next, _ := listItem(lines[j]); next == marker {
+					loose = true
+					i = j
+				}
+				break
+			}
+			if indentWidth(line) >= width {
+				item = append(item, stripIndent(line, width))
+				continue
+			}
+			// Lazy continuation of the item's paragraph
+			if next, _ := listItem(line); next != "" || startsBlock(line) {
+				break
+			}
+			item = append(item, line)
+		}
+		items = append(items, item)
+		if i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+			break
+		}
+	}
+
+	if ordered {
+		if start != 1 {
+			b.WriteString(`<ol start="` + strconv.Itoa(start) + `">` + "\n")
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+	for _, item := range items {
+		b.WriteString("<li>")
+		var inner strings.Builder
+		renderBlocks(&inner, item, !loose)
+		b.WriteString(strings.TrimSuffix(inner.String(), "\n"))
+		b.WriteString("</li>\n")
+	}
+	if ordered {
+		b.WriteString("</ol>\n")
+	} else {
+		b.WriteString("</ul>\n")
+	}
+	return i
+}
+
+// listMarker returns the marker character of the list item on line, and the
+// number of an ordered item.
+func listMarker(line string) (string, int) {
+	if m := orderedItem.FindStringSubmatch(line); m != nil {
+		start, _ := strconv.Atoi(m[2])
+		return m[3], start
+	}
+	if m := bulletItem.FindStringSubmatch(line); m != nil {
+		return m[2], 0
+	}
+	return "", 0
+}
+
+// listItem returns the marker of the list item starting on line, or "" if
+// none does, and the indentation of its content.
+func listItem(line string) (string, int) {
+	if thematicBreak.MatchString(line) {
+		return "", 0
+	}
+	if m := orderedItem.FindStringSubmatch(line); m != nil {
+		return m[3], len(m[1]) + len(m[2]) + 1 + contentOffset(m[4], line)
+	}
+	if m := bulletItem.FindStringSubmatch(line); m != nil {
+		return m[2], len(m[1]) + 1 + contentOffset(m[3], line)
+	}
+	return "", 0
+}
+
+// contentOffset returns the spaces between a list marker and content, the
+// rest of line, treating up to four spaces as part of the marker.
+func contentOffset(content, line string) int {
+	if content == "" {
+		return 1
+	}
+	spaces := len(line) - len(content) - len(strings.TrimRight(line[:len(line)-len(content)], " \t"))
+	if spaces > 4 {
+		return 1
+	}
+	return spaces
+}
+
+// indentWidth returns the number of leading spaces of line, counting tabs as
+// four.
+func indentWidth(line string) int {
+	width := 0
+	for _, r := range line {
+		switch r {
+		case ' ':
+			width++
+		case '\t':
+			width += 4
+		default:
+			return width
+		}
+	}
+	return width
+}
+
+// stripIndent removes width columns of indentation from line, counting tabs
+// as four.
+func stripIndent(line string, width int) string {
+	for width > 0 && line != "" {
+		switch line[0] {
+		case ' ':
+			width--
+		case '\t':
+			if width < 4 {
+				return strings.Repeat(" ", 4-width) + line[1:]
+			}
+			width -= 4
+		default:
+			return line
+		}
+		line = line[1:]
+	}
+	return line
+}
+
+// delimiter is a run of emphasis characters that may open or close emphasis.
+type delimiter struct {
+	char              byte
+	count, origCount  int
+	canOpen, canClose bool
+	node              int // index of the run's node
+}
+
+// inlineNode is a piece of rendered inline content. Delimiter runs keep their
+// remaining characters in text, with the tags emphasis wraps around them.
+type inlineNode struct {
+	open, text, close string
+}
+
+// renderInline renders the inline content of a block.
+func renderInline(s string) string {
+	var nodes []inlineNode
+	var delims []*delimiter
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			nodes = append(nodes, inlineNode{text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			text.WriteString("<br>\n")
+			i += 2
+
+		case c == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]):
+			text.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+
+		case c == ' ' && strings.HasPrefix(strings.TrimLeft(s[i:], " "), "\n"):
+			spaces := len(s[i:]) - len(strings.TrimLeft(s[i:], " "))
+			if spaces >= 2 {
+				text.WriteString("<br>")
+			}
+			i += spaces
+
+		case c == '`':
+			run := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			fence := s[i : i+run]
+			end := findCodeSpanEnd(s[i+run:], run)
+			if end < 0 {
+				text.WriteString(fence)
+				i += run
+				break
+			}
+			code := strings.ReplaceAll(s[i+run:i+run+end], "\n", " ")
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+				code = code[1 : len(code)-1]
+			}
+			text.WriteString("<code>" + html.EscapeString(code) + "</code>")
+			i += run + end + run
+
+		case c == '&':
+			if m := entity.FindString(s[i:]); m != "" {
+				text.WriteString(html.EscapeString(html.UnescapeString(m)))
+				i += len(m)
+			} else {
+				text.WriteString("&amp;")
+				i++
+			}
+
+		case c == '<':
+			if m := autolink.FindStringSubmatch(s[i:]); m != nil {
+				text.WriteString(`<a href="` + html.EscapeString(m[1]) + `">` + html.EscapeString(m[1]) + "</a>")
+				i += len(m[0])
+			} else if m := inlineHTML.FindString(s[i:]); m != "" {
+				text.WriteString(m)
+				i += len(m)
+			} else {
+				text.WriteString("&lt;")
+				i++
+			}
+
+		case c == '[' || (c == '!' && i+1 < len(s) && s[i+1] == '['):
+			start := i
+			if c == '!' {
+				start++
+			}
+			if link, n := parseLink(s[start:]); n > 0 {
+				text.WriteString(link)
+				i = start + n
+			} else {
+				text.WriteByte(c)
+				i++
+			}
+
+		case c == '*' || c == '_' || c == '~':
+			run := len(s[i:]) - len(strings.TrimLeft(s[i:], string(c)))
+			before, _ := utf8.DecodeLastRuneInString(s[:i])
+			after, _ := utf8.DecodeRuneInString(s[i+run:])
+			if i == 0 {
+				before = ' '
+			}
+			if i+run == len(s) {
+				after = ' '
+			}
+			left := !unicode.IsSpace(after) && (!isPunct(after) || unicode.IsSpace(before) || isPunct(before))
+			right := !unicode.IsSpace(before) && (!isPunct(before) || unicode.IsSpace(after) || isPunct(after))
+			d := &delimiter{char: c, count: run, origCount: run, canOpen: left, canClose: right}
+			if c == '_' {
+				d.canOpen = left && (!right || isPunct(before))
+				d.canClose = right && (!left || isPunct(after))
+			}
+			if c == '~' && run != 2 {
+				d.canOpen, d.canClose = false, false
+			}
+			flush()
+			d.node = len(nodes)
+			nodes = append(nodes, inlineNode{text: s[i : i+run]})
+			delims = append(delims, d)
+			i += run
+
+		default:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				text.WriteString("�")
+			} else {
+				text.WriteString(html.EscapeString(s[i : i+size]))
+			}
+			i += size
+		}
+	}
+	flush()
+
+	processEmphasis(nodes, delims)
+	var b strings.Builder
+	for _, node := range nodes {
+		b.WriteString(node.open + node.text + node.close)
+	}
+	return b.String()
+}
+
+// processEmphasis matches the delimiter runs of a block, following the
+// CommonMark rules, and wraps the matched content in <em>, <strong> or <del>.
+func processEmphasis(nodes []inlineNode, delims []*delimiter) {
+	for c := 0; c < len(delims); c++ {
+		closer := delims[c]
+		for closer.count > 0 && closer.canClose {
+			o := c - 1
+			for ; o >= 0; o-- {
+				opener := delims[o]
+				if opener.char != closer.char || !opener.canOpen || opener.count == 0 {
+					continue
+				}
+				// Runs that could both open and close only match if their
+				// lengths are not a multiple of three, unless both are
+				if (opener.canClose || closer.canOpen) && (opener.origCount+closer.origCount)%3 == 0 &&
+					(opener.origCount%3 != 0 || closer.origCount%3 != 0) {
+					continue
+				}
+				break
+			}
+			if o < 0 {
+				break
+			}
+			opener := delims[o]
+
+			used, tag := 1, "em"
+			switch {
+			case closer.char == '~':
+				used, tag = 2, "del"
+			case opener.count >= 2 && closer.count >= 2:
+				used, tag = 2, "strong"
+			}
+			opener.count -= used
+			closer.count -= used
+			on, cn := &nodes[opener.node], &nodes[closer.node]
+			on.text = on.text[:opener.count]
+			on.close = "<" + tag + ">" + on.close
+			cn.text = cn.text[used:]
+			cn.open = cn.open + "</" + tag + ">"
+
+			// Delimiters between them can no longer match
+			for _, d := range delims[o+1 : c] {
+				d.count = 0
+				d.canOpen, d.canClose = false, false
+			}
+		}
+	}
+}
+
+// findCodeSpanEnd returns the index in s of the backtick run of exactly
+// length n closing a code span, or -1.
+func findCodeSpanEnd(s string, n int) int {
+	for i := 0; i < len(s); {
+		if s[i] != '`' {
+			i++
+			continue
+		}
+		run := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+		if run == n {
+			return i
+		}
+		i += run
+	}
+	return -1
+}
+
+// parseLink parses a link, [text](destination "title"), at the start of s,
+// returning its HTML and length, or a length of 0 if there is none.
+func parseLink(s string) (string, int) {
+	depth := 0
+	end := -1
+	for i := 0; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '`':
+			// Brackets in code spans do not count
+			run := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			if close := findCodeSpanEnd(s[i+run:], run); close >= 0 {
+				i += run + close + run - 1
+			}
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				end = i
+			}
+		}
+	}
+	if end < 0 {
+		return "", 0
+	}
+	m := linkTail.FindStringSubmatch(s[end+1:])
+	if m == nil {
+		return "", 0
+	}
+
+	dest := strings.TrimSuffix(strings.TrimPrefix(m[1], "<"), ">")
+	var b strings.Builder
+	b.WriteString(`<a href="` + html.EscapeString(unescapeMarkdown(dest)) + `"`)
+	if m[2] != "" {
+		b.WriteString(` title="` + html.EscapeString(unescapeMarkdown(m[2][1:len(m[2])-1])) + `"`)
+	}
+	b.WriteString(">" + renderInline(s[1:end]) + "</a>")
+	return b.String(), end + 1 + len(m[0])
+}
+
+// unescapeMarkdown resolves backslash escapes and entities in link
+// destinations and titles.
+func unescapeMarkdown(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return html.UnescapeString(b.String())
+}
+
+// isASCIIPunct reports whether c is ASCII punctuation, which backslashes
+// escape.
+func isASCIIPunct(c byte) bool {
+	return strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", c) >= 0
+}
+
+// isPunct reports whether r counts as punctuation for emphasis.
+func isPunct(r rune) bool {
+	return unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
@@ -0,0 +1,71 @@
+package richtext
+
+import "testing"
+
+func TestMarkdownToHTML(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"Hello", "<p>Hello</p>"},
+		{"# Title *here*", "<h1>Title <em>here</em></h1>"},
+		{"### Third ###", "<h3>Third</h3>"},
+		{"#hashtag", "<p>#hashtag</p>"},
+		{"**bold**, *em*, ***both*** and ~~gone~~", "<p><strong>bold</strong>, <em>em</em>, <em><strong>both</strong></em> and <del>gone</del></p>"},
+		{"snake_case_name and _em_", "<p>snake_case_name and <em>em</em></p>"},
+		{"2 * 3 * 4", "<p>2 * 3 * 4</p>"},
+		{"`a *b* <c>`", "<p><code>a *b* &lt;c&gt;</code></p>"},
+		{"``a ` b``", "<p><code>a ` b</code></p>"},
+		{`\*not em\*`, "<p>*not em*</p>"},
+		{"one\ntwo  \nthree\\\nfour", "<p>one\ntwo<br>\nthree<br>\nfour</p>"},
+		{"first\n\nsecond", "<p>first</p>\n<p>second</p>"},
+		{"&copy; & <", "<p>© &amp; &lt;</p>"},
+		{"[site](https://example.com \"Title\")", `<p><a href="https://example.com" title="Title">site</a></p>`},
+		{"<https://example.com>", `<p><a href="https://example.com">https://example.com</a></p>`},
+		{"- a\n- b\n  - c\n- d", "<ul>\n<li>a</li>\n<li>b\n<ul>\n<li>c</li>\n</ul></li>\n<li>d</li>\n</ul>"},
+		{"1. a\n\n2. b", "<ol>\n<li><p>a</p></li>\n<li><p>b</p></li>\n</ol>"},
+		{"3) c\n4) d", "<ol start=\"3\">\n<li>c</li>\n<li>d</li>\n</ol>"},
+		{"- a\n\nafter", "<ul>\n<li>a</li>\n</ul>\n<p>after</p>"},
+		{"> quoted\nlazy\n\n> again", "<blockquote>\n<p>quoted\nlazy</p>\n</blockquote>\n<blockquote>\n<p>again</p>\n</blockquote>"},
+		{"```go\nx := \"<y>\"\n```", "<pre><code class=\"language-go\">x := &#34;&lt;y&gt;&#34;\n</code></pre>"},
+		{"~~~\nunclosed", "<pre><code>unclosed\n</code></pre>"},
+		{"***", "<hr>"},
+		{"text\n---", "<p>text</p>\n<hr>"},
+		{"<b>inline</b> html", "<p><b>inline</b> html</p>"},
+	}
+
+	for _, tc := range testCases {
+		result := markdownToHTML(tc.input)
+		if result != tc.expected {
+			t.Errorf("markdownToHTML(%q) = %q; expected %q", tc.input, result, tc.expected)
+		}
+	}
+}
+
+func TestHTML(t *testing.T) {
+	if html := HTML(Plain, "<b>hi</b>\nthere"); html != "&lt;b&gt;hi&lt;/b&gt;<br>\nthere" {
+		t.Errorf("Expected plain text to be escaped, got %q", html)
+	}
+	html := HTML(Markdown, "[x](javascript:alert(1)) <script>alert(1)</script>[y](<javascript:alert(1)>)")
+	if html != `<p>[x](javascript:alert(1)) <a rel="nofollow noopener noreferrer">y</a></p>` {
+		t.Errorf("Expected unsafe markup to be removed, got %q", html)
+	}
+}
+
+func TestText(t *testing.T) {
+	testCases := []struct {
+		format, input, expected string
+	}{
+		{Plain, "**Racecar**", "**Racecar**"},
+		{Markdown, "**Racecar**", "Racecar"},
+		{Markdown, "# A man\n\n- a plan\n- a [canal](https://example.com)\n\n> Panama", "A man\na plan\na canal\nPanama"},
+		{Markdown, "x &lt; y <!-- hidden --><style>p{}</style>", "x < y"},
+	}
+
+	for _, tc := range testCases {
+		result := Text(tc.format, tc.input)
+		if result != tc.expected {
+			t.Errorf("Text(%q, %q) = %q; expected %q", tc.format, tc.input, result, tc.expected)
+		}
+	}
+}
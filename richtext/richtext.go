@@ -0,0 +1,40 @@
+// Package richtext renders message content in its format to sanitized HTML,
+// and to the plain text that analysis works on.
+package richtext
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// Content formats.
+const (
+	Plain    = "plain"
+	Markdown = "markdown"
+)
+
+// ValidateFormat returns an error unless format is a known content format.
+func ValidateFormat(format string) error {
+	if format != Plain && format != Markdown {
+		return fmt.Errorf("invalid format %q: must be plain or markdown", format)
+	}
+	return nil
+}
+
+// HTML renders content in format as HTML that is safe to embed in a page.
+// Plain text is escaped, with its line breaks kept.
+func HTML(format, content string) string {
+	if format == Markdown {
+		return Sanitize(markdownToHTML(content))
+	}
+	return strings.ReplaceAll(html.EscapeString(content), "\n", "<br>\n")
+}
+
+// Text returns the text content in format displays as, without markup.
+func Text(format, content string) string {
+	if format == Markdown {
+		return extractText(HTML(format, content))
+	}
+	return content
+}
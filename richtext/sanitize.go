@@ -0,0 +1,323 @@
+package richtext
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// allowedElements lists the elements Sanitize keeps and, for each, the
+// attributes they may carry. Anything else is dropped.
+var allowedElements = map[string][]string{
+	"a":          {"href", "title"},
+	"b":          nil,
+	"blockquote": nil,
+	"br":         nil,
+	"code":       {"class"},
+	"del":        nil,
+	"em":         nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"hr":         nil,
+	"i":          nil,
+	"li":         nil,
+	"ol":         {"start"},
+	"p":          nil,
+	"pre":        nil,
+	"s":          nil,
+	"strong":     nil,
+	"ul":         nil,
+}
+
+// voidElements never have content or an end tag.
+var voidElements = map[string]bool{"br": true, "hr": true}
+
+// rawTextElements are dropped along with everything up to their end tag, so
+// that scripts and styles do not turn into visible text.
+var rawTextElements = map[string]bool{
+	"iframe": true, "noembed": true, "noframes": true, "noscript": true, "plaintext": true,
+	"script": true, "style": true, "template": true, "textarea": true, "title": true, "xmp": true,
+}
+
+// blockElements separate words in the text extracted from HTML.
+var blockElements = map[string]bool{
+	"blockquote": true, "br": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "hr": true, "li": true, "ol": true, "p": true, "pre": true, "ul": true,
+}
+
+// allowedSchemes are the URL schemes links may use. Relative URLs are allowed
+// too.
+var allowedSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+var (
+	codeClass = regexp.MustCompile(`^language-[A-Za-z0-9_+-]{1,32}$`)
+	listStart = regexp.MustCompile(`^[0-9]{1,9}$`)
+)
+
+// Sanitize rewrites untrusted HTML so that only allowed elements and
+// attributes remain: no scripts, styles, event handlers or unsafe URLs. Text
+// is re-escaped, unclosed elements are closed and stray end tags dropped, so
+// the result is well-formed.
+func Sanitize(s string) string {
+	var b strings.Builder
+	var open []string
+	tokenize(s, func(tok token) {
+		switch tok.kind {
+		case textToken:
+			b.WriteString(html.EscapeString(tok.data))
+
+		case startTagToken:
+			attrs, ok := allowedElements[tok.data]
+			if !ok {
+				return
+			}
+			b.WriteString("<" + tok.data)
+			for _, attr := range tok.attrs {
+				if value, ok := allowedAttr(attrs, attr); ok {
+					b.WriteString(" " + attr.name + `="` + html.EscapeString(value) + `"`)
+				}
+			}
+			if tok.data == "a" {
+				b.WriteString(` rel="nofollow noopener noreferrer"`)
+			}
+			b.WriteString(">")
+			if !voidElements[tok.data] {
+				open = append(open, tok.data)
+			}
+
+		case endTagToken:
+			// Close everything opened since the matching start tag, if any
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == tok.data {
+					for j := len(open) - 1; j >= i; j-- {
+						b.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					return
+				}
+			}
+		}
+	})
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+	return b.String()
+}
+
+// allowedAttr reports whether attr may be kept on an element whose allowed
+// attributes are attrs, and returns its value.
+func allowedAttr(attrs []string, attr attribute) (string, bool) {
+	found := false
+	for _, name := range attrs {
+		if name == attr.name {
+			found = true
+		}
+	}
+	if !found {
+		return "", false
+	}
+	switch attr.name {
+	case "href":
+		return attr.value, safeURL(attr.value)
+	case "class":
+		return attr.value, codeClass.MatchString(attr.value)
+	case "start":
+		return attr.value, listStart.MatchString(attr.value)
+	}
+	return attr.value, true
+}
+
+// safeURL reports whether u is relative or uses one of the allowedSchemes.
+// Browsers ignore control characters and spaces in schemes, so they are
+// removed before checking.
+func safeURL(u string) bool {
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u)
+	i := strings.IndexAny(cleaned, ":/?#")
+	if i < 0 || cleaned[i] != ':' {
+		return true
+	}
+	return allowedSchemes[strings.ToLower(cleaned[:i])]
+}
+
+// extractText returns the text of HTML produced by Sanitize, with block
+// elements on lines of their own and without blank lines.
+func extractText(s string) string {
+	var b strings.Builder
+	tokenize(s, func(tok token) {
+		switch tok.kind {
+		case textToken:
+			b.WriteString(tok.data)
+		case startTagToken, endTagToken:
+			if blockElements[tok.data] {
+				b.WriteString("\n")
+			}
+		}
+	})
+
+	var lines []string
+	for _, line := range strings.Split(b.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// tokenKind is the kind of a token.
+type tokenKind int
+
+const (
+	textToken tokenKind = iota
+	startTagToken
+	endTagToken
+)
+
+// attribute is an attribute of a start tag, with its value unescaped.
+type attribute struct {
+	name, value string
+}
+
+// token is a piece of HTML: unescaped text, or a tag with its lowercase name
+// in data.
+type token struct {
+	kind  tokenKind
+	data  string
+	attrs []attribute
+}
+
+var (
+	tagName   = regexp.MustCompile(`^</?([A-Za-z][A-Za-z0-9-]*)`)
+	attrName  = regexp.MustCompile(`^[^\s"'<>/=]+`)
+	attrValue = regexp.MustCompile(`^(?:"([^"]*)"|'([^']*)'|([^\s"'>][^\s>]*))`)
+)
+
+// tokenize splits s into tokens, calling emit for each. Comments, doctypes
+// and processing instructions are skipped, and the content of raw text
+// elements is skipped along with them. Anything that is not a well-formed
+// tag is text.
+func tokenize(s string, emit func(token)) {
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			emit(token{kind: textToken, data: html.UnescapeString(text.String())})
+			text.Reset()
+		}
+	}
+
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			text.WriteString(s)
+			break
+		}
+		text.WriteString(s[:i])
+		s = s[i:]
+
+		switch {
+		case strings.HasPrefix(s, "<!--"):
+			end := strings.Index(s[4:], "-->")
+			if end < 0 {
+				s = ""
+			} else {
+				s = s[4+end+3:]
+			}
+			continue
+		case strings.HasPrefix(s, "<!") || strings.HasPrefix(s, "<?"):
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				s = ""
+			} else {
+				s = s[end+1:]
+			}
+			continue
+		}
+
+		tok, n := parseTag(s)
+		if n == 0 {
+			text.WriteByte('<')
+			s = s[1:]
+			continue
+		}
+		flush()
+		emit(tok)
+		s = s[n:]
+
+		if tok.kind == startTagToken && rawTextElements[tok.data] {
+			end := indexEndTag(s, tok.data)
+			if end < 0 {
+				return
+			}
+			s = s[end:]
+		}
+	}
+	flush()
+}
+
+// indexEndTag returns the index of the first end tag of the element name in
+// s, ignoring case, or -1.
+func indexEndTag(s, name string) int {
+	for i := 0; ; {
+		j := strings.Index(s[i:], "</")
+		if j < 0 {
+			return -1
+		}
+		i += j
+		if len(s)-i-2 >= len(name) && strings.EqualFold(s[i+2:i+2+len(name)], name) {
+			return i
+		}
+		i += 2
+	}
+}
+
+// parseTag parses the tag at the start of s, returning it and its length, or
+// a length of 0 if s does not start with a tag.
+func parseTag(s string) (token, int) {
+	m := tagName.FindStringSubmatch(s)
+	if m == nil {
+		return token{}, 0
+	}
+	tok := token{kind: startTagToken, data: strings.ToLower(m[1])}
+	if s[1] == '/' {
+		tok.kind = endTagToken
+	}
+
+	n := len(m[0])
+	for {
+		rest := strings.TrimLeft(s[n:], " \t\n\r\f/")
+		n = len(s) - len(rest)
+		if rest == "" {
+			return token{}, 0
+		}
+		if rest[0] == '>' {
+			return tok, n + 1
+		}
+
+		name := attrName.FindString(rest)
+		if name == "" {
+			return token{}, 0
+		}
+		n += len(name)
+		attr := attribute{name: strings.ToLower(name)}
+
+		rest = strings.TrimLeft(s[n:], " \t\n\r\f")
+		if strings.HasPrefix(rest, "=") {
+			rest = strings.TrimLeft(rest[1:], " \t\n\r\f")
+			v := attrValue.FindStringSubmatch(rest)
+			if v == nil {
+				return token{}, 0
+			}
+			attr.value = html.UnescapeString(v[1] + v[2] + v[3])
+			n = len(s) - len(rest) + len(v[0])
+		}
+		tok.attrs = append(tok.attrs, attr)
+	}
+}
@@ -0,0 +1,42 @@
+package richtext
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"plain & simple", "plain &amp; simple"},
+		{"<p>Hi <strong>there</strong></p>", "<p>Hi <strong>there</strong></p>"},
+		{"<script>alert(1)</script>ok", "ok"},
+		{"<SCRIPT type=x>alert(1)</ScRiPt>ok", "ok"},
+		{"<style>body{}</style>ok", "ok"},
+		{"<script>never closed", ""},
+		{"<b onclick=\"alert(1)\" style=\"color:red\">x</b>", "<b>x</b>"},
+		{"<img src=x onerror=alert(1)>", ""},
+		{"<iframe src=\"https://evil\"></iframe>", ""},
+		{"<div><span>kept text</span></div>", "kept text"},
+		{"<a href=\"https://example.com\" target=_blank>x</a>", `<a href="https://example.com" rel="nofollow noopener noreferrer">x</a>`},
+		{"<a href=\"/relative?q=1&amp;r=2\">x</a>", `<a href="/relative?q=1&amp;r=2" rel="nofollow noopener noreferrer">x</a>`},
+		{"<a href=\"javascript:alert(1)\">x</a>", `<a rel="nofollow noopener noreferrer">x</a>`},
+		{"<a href=\"JaVa&#x09;Script:alert(1)\">x</a>", `<a rel="nofollow noopener noreferrer">x</a>`},
+		{"<a href=\" data:text/html,x\">x</a>", `<a rel="nofollow noopener noreferrer">x</a>`},
+		{"<a href='mailto:a@b.c' title='T \"q\"'>x</a>", `<a href="mailto:a@b.c" title="T &#34;q&#34;" rel="nofollow noopener noreferrer">x</a>`},
+		{"<code class=\"language-go\">x</code><code class=\"x y\">z</code>", `<code class="language-go">x</code><code>z</code>`},
+		{"<ol start=\"3\" reversed><li>x</ol>", `<ol start="3"><li>x</li></ol>`},
+		{"<em><strong>x</em></strong>", "<em><strong>x</strong></em>"},
+		{"</p>stray", "stray"},
+		{"<br/><hr>", "<br><hr>"},
+		{"a < b > c", "a &lt; b &gt; c"},
+		{"<!-- comment -->x<!DOCTYPE html>", "x"},
+		{"<b title=\"unterminated>x", "&lt;b title=&#34;unterminated&gt;x"},
+	}
+
+	for _, tc := range testCases {
+		result := Sanitize(tc.input)
+		if result != tc.expected {
+			t.Errorf("Sanitize(%q) = %q; expected %q", tc.input, result, tc.expected)
+		}
+	}
+}
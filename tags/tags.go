@@ -0,0 +1,114 @@
+// Package tags stores the tags labelling messages. Users add and remove tags
+// themselves; automatic tags are derived from the message by analysis.
+package tags
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+)
+
+// Palindrome is the automatic tag of palindromes.
+const Palindrome = "palindrome"
+
+// validName matches tag names: lowercase letters, digits, '-' and '_'.
+var validName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// Normalize returns name in its stored form, lowercase and without
+// surrounding spaces, or an error if it is not a valid tag name.
+func Normalize(name string) (string, error) {
+	normalized := strings.ToLower(strings.TrimSpace(name))
+	if !validName.MatchString(normalized) {
+		return "", fmt.Errorf("invalid tag %q: use up to 32 letters, digits, '-' and '_'", name)
+	}
+	return normalized, nil
+}
+
+// Automatic returns the tags analysis gives msg.
+func Automatic(msg database.Message) []string {
+	automatic := []string{}
+	if msg.IsPalindrome && msg.DeletedAt == nil {
+		automatic = append(automatic, Palindrome)
+	}
+	return automatic
+}
+
+// Add tags a message of tenant with names, which must be normalized. Adding a
+// tag by hand to a message that has it automatically makes it a manual tag,
+// which analysis no longer removes.
+func Add(tx *sql.Tx, tenant string, messageID int64, names []string, automatic bool) error {
+	if len(names) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+        INSERT INTO tags (tenant_id, name) SELECT $1, unnest($2::text[])
+        ON CONFLICT (tenant_id, name) DO NOTHING
+    `, tenant, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+        INSERT INTO message_tags (message_id, tag_id, tenant_id, automatic)
+        SELECT $3, id, $1, $4 FROM tags WHERE tenant_id = $1 AND name = ANY($2)
+        ON CONFLICT (message_id, tag_id) DO UPDATE SET automatic = message_tags.automatic AND EXCLUDED.automatic
+    `, tenant, pq.Array(names), messageID, automatic)
+	return err
+}
+
+// Remove removes a tag from a message, reporting whether it had it.
+func Remove(tx *sql.Tx, tenant string, messageID int64, name string) (bool, error) {
+	result, err := tx.Exec(`
+        DELETE FROM message_tags
+        WHERE message_id = $1 AND tenant_id = $2
+          AND tag_id = (SELECT id FROM tags WHERE tenant_id = $2 AND name = $3)
+    `, messageID, tenant, name)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// SetAutomatic replaces the automatic tags of a message with names, leaving
+// its manual tags alone.
+func SetAutomatic(tx *sql.Tx, tenant string, messageID int64, names []string) error {
+	_, err := tx.Exec(`
+        DELETE FROM message_tags
+        WHERE message_id = $1 AND tenant_id = $2 AND automatic
+          AND tag_id NOT IN (SELECT id FROM tags WHERE tenant_id = $2 AND name = ANY($3))
+    `, messageID, tenant, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	return Add(tx, tenant, messageID, names, true)
+}
+
+// ForMessages returns the tags of each of the given messages, sorted by name.
+// Messages without tags are left out.
+func ForMessages(tx *sql.Tx, tenant string, messageIDs []int64) (map[int64][]string, error) {
+	rows, err := tx.Query(`
+        SELECT mt.message_id, t.name
+        FROM message_tags mt JOIN tags t ON t.id = mt.tag_id
+        WHERE mt.tenant_id = $1 AND mt.message_id = ANY($2)
+        ORDER BY t.name ASC
+    `, tenant, pq.Array(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tagged := map[int64][]string{}
+	for rows.Next() {
+		var id int64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		tagged[id] = append(tagged[id], name)
+	}
+	return tagged, rows.Err()
+}
@@ -0,0 +1,88 @@
+package tags
+
+import (
+	"context"
+	"log"
+	"os"
+	"slices"
+	"testing"
+
+	_ "github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+)
+
+func TestMain(m *testing.M) {
+	// Initialize the test database
+	database.InitDB("user=postgres password=postgres dbname=messages_test sslmode=disable")
+	defer database.DB.Close()
+
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run tests
+	code := m.Run()
+
+	// Clean up the test database
+	database.DB.Exec("TRUNCATE TABLE messages, tags RESTART IDENTITY CASCADE;")
+
+	os.Exit(code)
+}
+
+func TestNormalize(t *testing.T) {
+	if name, err := Normalize("  Needs-Review "); err != nil || name != "needs-review" {
+		t.Errorf("Expected 'needs-review', got %q (err %v)", name, err)
+	}
+	for _, name := range []string{"", "two words", "-leading", "ünïcode"} {
+		if _, err := Normalize(name); err == nil {
+			t.Errorf("Expected %q to be invalid", name)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	database.DB.Exec("TRUNCATE TABLE messages, tags RESTART IDENTITY CASCADE;")
+	ctx := context.Background()
+
+	tx, err := database.BeginTenant(ctx, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRow("INSERT INTO messages (content, is_palindrome, tenant_id) VALUES ('Racecar', TRUE, 'acme') RETURNING id").
+		Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetAutomatic(tx, "acme", id, []string{Palindrome}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Add(tx, "acme", id, []string{"cars"}, false); err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := ForMessages(tx, "acme", []int64{id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tagged[id], []string{"cars", Palindrome}) {
+		t.Errorf("Expected [cars palindrome], got %v", tagged[id])
+	}
+
+	// Analysis only removes automatic tags
+	if err := SetAutomatic(tx, "acme", id, []string{}); err != nil {
+		t.Fatal(err)
+	}
+	if tagged, _ = ForMessages(tx, "acme", []int64{id}); !slices.Equal(tagged[id], []string{"cars"}) {
+		t.Errorf("Expected [cars], got %v", tagged[id])
+	}
+
+	if removed, err := Remove(tx, "acme", id, "cars"); err != nil || !removed {
+		t.Errorf("Expected the tag to be removed, got %v (err %v)", removed, err)
+	}
+	if removed, _ := Remove(tx, "acme", id, "cars"); removed {
+		t.Error("Expected removing a missing tag to report false")
+	}
+}
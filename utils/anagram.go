@@ -0,0 +1,12 @@
+package utils
+
+import "slices"
+
+// AnagramSignature returns a key shared by all strings that are anagrams of
+// each other: the normalized letters and numbers of s, sorted. Strings with no
+// letters or numbers have an empty signature.
+func AnagramSignature(s string) string {
+	runes := []rune(normalize(s))
+	slices.Sort(runes)
+	return string(runes)
+}
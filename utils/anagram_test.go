@@ -0,0 +1,33 @@
+package utils
+
+import "testing"
+
+func TestAnagramSignature(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"listen", "silent", true},
+		{"Dormitory", "Dirty room!", true},
+		{"The eyes", "They see", true},
+		{"Astronomer", "Moon starer", true},
+		{"Hello", "World", false},
+		{"abc", "abcc", false},
+		{"123", "3 2 1", true},
+		{"Ämter", "Träme", true},
+	}
+
+	for _, tc := range testCases {
+		result := AnagramSignature(tc.a) == AnagramSignature(tc.b)
+		if result != tc.expected {
+			t.Errorf("AnagramSignature(%q) == AnagramSignature(%q) = %v; expected %v", tc.a, tc.b, result, tc.expected)
+		}
+	}
+
+	if sig := AnagramSignature("!@#$"); sig != "" {
+		t.Errorf("AnagramSignature(%q) = %q; expected empty signature", "!@#$", sig)
+	}
+	if sig := AnagramSignature("Bca"); sig != "abc" {
+		t.Errorf("AnagramSignature(%q) = %q; expected %q", "Bca", sig, "abc")
+	}
+}
@@ -5,20 +5,15 @@ import (
 	"unicode"
 )
 
+// PalindromeVersion identifies the rules implemented by IsPalindrome. It is
+// stored alongside each message's result; bump it whenever IsPalindrome changes
+// so existing rows can be recomputed with the reanalyze command.
+const PalindromeVersion = 1
+
 // IsPalindrome checks if a given string is a palindrome.
 func IsPalindrome(s string) bool {
-	// Mapping function to clean the string
-	f := func(r rune) rune {
-		if !unicode.IsLetter(r) && !unicode.IsNumber(r) {
-			return -1 // Exclude the character
-		}
-		return unicode.ToLower(r)
-	}
-	// Clean the string
-	cleaned := strings.Map(f, s)
-
 	// Convert to a slice of runes to handle Unicode characters
-	runes := []rune(cleaned)
+	runes := []rune(normalize(s))
 	i, j := 0, len(runes)-1
 
 	// Compare characters from both ends
@@ -31,3 +26,16 @@ func IsPalindrome(s string) bool {
 	}
 	return true
 }
+
+// normalize lowercases s and strips everything but letters and numbers. It is
+// shared by all text analysis so results stay consistent with each other.
+func normalize(s string) string {
+	// Mapping function to clean the string
+	f := func(r rune) rune {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) {
+			return -1 // Exclude the character
+		}
+		return unicode.ToLower(r)
+	}
+	return strings.Map(f, s)
+}
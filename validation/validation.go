@@ -0,0 +1,185 @@
+// Package validation checks the JSON bodies and text content clients send,
+// reporting every violation at once as field errors rather than stopping at
+// the first.
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// MaxLength is the longest content the messages table accepts, in
+// characters.
+const MaxLength = 1000
+
+// Error codes of field errors.
+const (
+	CodeInvalidUTF8  = "invalid_utf8"
+	CodeUnknownField = "unknown_field"
+	CodeInvalidType  = "invalid_type"
+	CodeInvalid      = "invalid"
+	CodeTooShort     = "too_short"
+	CodeTooLong      = "too_long"
+	CodeBlank        = "blank"
+	CodeControlChar  = "control_character"
+)
+
+// FieldError is a violation of the rules by a field of a request body. The
+// field is empty for violations of the body as a whole.
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Errors are all the violations found in a request body.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// HasField reports whether any of the errors is about field.
+func (e Errors) HasField(field string) bool {
+	for _, err := range e {
+		if err.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Rules are the constraints text content must meet. Lengths are counted in
+// characters, like the database does, after normalization.
+type Rules struct {
+	MinLength    int  // fewest characters; 0 allows empty content
+	MaxLength    int  // most characters, at most MaxLength
+	RequireText  bool // content must have a character other than whitespace
+	AllowControl bool // allows control characters other than NUL; tab, line feed and carriage return always are
+	Normalize    bool // converts content to Unicode Normalization Form C
+}
+
+// DefaultRules require between 1 and MaxLength characters of normalized
+// text, without control characters.
+var DefaultRules = Rules{MinLength: 1, MaxLength: MaxLength, RequireText: true, Normalize: true}
+
+// Content checks the content of field against the rules, returning it
+// normalized along with every rule it breaks.
+func (r Rules) Content(field, content string) (string, Errors) {
+	var errs Errors
+	if !utf8.ValidString(content) {
+		errs = append(errs, FieldError{field, CodeInvalidUTF8, "Content is not valid UTF-8"})
+		content = strings.ToValidUTF8(content, "\uFFFD")
+	}
+	if r.Normalize {
+		content = norm.NFC.String(content)
+	}
+
+	maxLength := r.MaxLength
+	if maxLength <= 0 || maxLength > MaxLength {
+		maxLength = MaxLength
+	}
+	length := utf8.RuneCountInString(content)
+	if length < r.MinLength {
+		errs = append(errs, FieldError{field, CodeTooShort, fmt.Sprintf("Content must be at least %d characters", r.MinLength)})
+	}
+	if length > maxLength {
+		errs = append(errs, FieldError{field, CodeTooLong, fmt.Sprintf("Content exceeds %d characters", maxLength)})
+	}
+	if r.RequireText && length > 0 && strings.TrimFunc(content, unicode.IsSpace) == "" {
+		errs = append(errs, FieldError{field, CodeBlank, "Content must not be only whitespace"})
+	}
+	// The database cannot store NUL, whatever the rules allow
+	for i, c := range []rune(content) {
+		if c == 0 || (!r.AllowControl && unicode.IsControl(c) && c != '\t' && c != '\n' && c != '\r') {
+			errs = append(errs, FieldError{field, CodeControlChar,
+				fmt.Sprintf("Content contains control character %U at position %d", c, i+1)})
+			break
+		}
+	}
+	return content, errs
+}
+
+// DecodeJSON decodes the JSON object in data into v, a pointer to a struct,
+// returning an error if data is not a JSON object. Field errors do not stop
+// the decoding: each field is decoded on its own, and unless allowUnknown is
+// set, fields v has no place for are errors, matched case-insensitively as
+// encoding/json does, and so are values of the wrong type and invalid UTF-8,
+// which encoding/json replaces without telling.
+func DecodeJSON(data []byte, v any, allowUnknown bool) (Errors, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return nil, errors.New("request body must be a JSON object")
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	known := jsonFields(reflect.TypeOf(v).Elem())
+	var errs Errors
+	for _, name := range names {
+		if !utf8.Valid(fields[name]) {
+			errs = append(errs, FieldError{name, CodeInvalidUTF8, fmt.Sprintf("Field %q is not valid UTF-8", name)})
+		}
+		if !known[strings.ToLower(name)] {
+			if !allowUnknown {
+				errs = append(errs, FieldError{name, CodeUnknownField, fmt.Sprintf("Unknown field %q", name)})
+			}
+			continue
+		}
+		// Decoded alone, the field keeps encoding/json's rules for embedded
+		// structs and names
+		field, _ := json.Marshal(map[string]json.RawMessage{name: fields[name]})
+		if err := json.Unmarshal(field, v); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				errs = append(errs, FieldError{name, CodeInvalidType,
+					fmt.Sprintf("Field %q must be a %s, not a %s", name, typeErr.Type, typeErr.Value)})
+			} else {
+				errs = append(errs, FieldError{name, CodeInvalid, fmt.Sprintf("Field %q is invalid: %v", name, err)})
+			}
+		}
+	}
+	return errs, nil
+}
+
+// jsonFields returns the lowercased names of the JSON fields of struct type
+// t, including those of embedded structs.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for embedded := range jsonFields(f.Type) {
+				fields[embedded] = true
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = true
+	}
+	return fields
+}
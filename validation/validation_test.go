@@ -0,0 +1,121 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRulesContent_Normalize(t *testing.T) {
+	rules := Rules{Normalize: true}
+	for s, want := range map[string]string{
+		"plain ascii":        "plain ascii",
+		"Cafe\u0301":         "Caf\u00e9",
+		"\u212b":             "\u00c5",        // the Angstrom sign is a singleton
+		"a\u0302\u0323":      "\u1ead",        // marks are reordered before composing
+		"q\u0307\u0323":      "q\u0323\u0307", // no precomposed form
+		"\u1100\u1161\u11a8": "\uac01",        // Hangul jamo
+		"\u0958":             "\u0915\u093c",  // excluded from composition
+		"\u00e9\u0301":       "\u00e9\u0301",
+		"\u0065\u0301\u0301": "\u00e9\u0301",
+	} {
+		if got, _ := rules.Content("content", s); got != want {
+			t.Errorf("Content(%+q) = %+q, want %+q", s, got, want)
+		}
+	}
+}
+
+func TestRulesContent(t *testing.T) {
+	codes := func(errs Errors) string {
+		var codes []string
+		for _, err := range errs {
+			codes = append(codes, err.Code)
+		}
+		return strings.Join(codes, ",")
+	}
+
+	tests := []struct {
+		rules   Rules
+		content string
+		want    string
+		codes   string
+	}{
+		{DefaultRules, "Hello", "Hello", ""},
+		{DefaultRules, "", "", "too_short"},
+		{DefaultRules, " \t\n", " \t\n", "blank"},
+		{DefaultRules, "Cafe\u0301", "Caf\u00e9", ""},
+		// Multibyte and decomposed characters count once
+		{DefaultRules, strings.Repeat("\u00e9", 1000), strings.Repeat("\u00e9", 1000), ""},
+		{DefaultRules, strings.Repeat("e\u0301", 1000), strings.Repeat("\u00e9", 1000), ""},
+		{DefaultRules, strings.Repeat("\u00e9", 1001), strings.Repeat("\u00e9", 1001), "too_long"},
+		{DefaultRules, "bell\a", "bell\a", "control_character"},
+		{DefaultRules, "\x00\x00", "\x00\x00", "control_character"},
+		{DefaultRules, "bad \xff", "bad \ufffd", "invalid_utf8"},
+		{Rules{MinLength: 5, MaxLength: 10, RequireText: true}, "   ", "   ", "too_short,blank"},
+		{Rules{MaxLength: 2000}, strings.Repeat("a", 1001), strings.Repeat("a", 1001), "too_long"},
+		{Rules{MaxLength: 10, AllowControl: true}, "bell\a", "bell\a", ""},
+		{Rules{MaxLength: 10, AllowControl: true}, "nul\x00", "nul\x00", "control_character"},
+		{Rules{MaxLength: 10}, "e\u0301", "e\u0301", ""},
+	}
+	for _, tt := range tests {
+		got, errs := tt.rules.Content("content", tt.content)
+		if got != tt.want || codes(errs) != tt.codes {
+			t.Errorf("%+v.Content(%.20q) = %.20q, %q, want %.20q, %q", tt.rules, tt.content, got, codes(errs), tt.want, tt.codes)
+		}
+		for _, err := range errs {
+			if err.Field != "content" || err.Message == "" {
+				t.Errorf("Unexpected field error %+v", err)
+			}
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	type base struct {
+		Content string `json:"content"`
+		Ignored string `json:"-"`
+	}
+	type request struct {
+		base
+		TTLSeconds *int64 `json:"ttlSeconds"`
+		Format     string
+	}
+
+	tests := []struct {
+		body         string
+		allowUnknown bool
+		errors       string
+	}{
+		{`{"content": "hi", "ttlSeconds": 60, "format": "plain"}`, false, ""},
+		{`{"Content": "hi", "TTLSECONDS": 60}`, false, ""},
+		{`{"content": "hi", "colour": "red", "Ignored": "x"}`, false, "Ignored:unknown_field,colour:unknown_field"},
+		{`{"content": "hi", "colour": "red"}`, true, ""},
+		{"{\"content\": \"hi\", \"format\": \"bad \xff\"}", false, "format:invalid_utf8"},
+		{`{"content": "hi", "ttlSeconds": "soon", "colour": "red"}`, false, "colour:unknown_field,ttlSeconds:invalid_type"},
+		// Every wrongly typed field is reported, not just the first
+		{`{"content": "hi", "format": 1, "ttlSeconds": "soon"}`, false, "format:invalid_type,ttlSeconds:invalid_type"},
+		{`["content"]`, false, "error"},
+		{`null`, false, "error"},
+		{`{"content": "hi"`, false, "error"},
+	}
+	for _, tt := range tests {
+		var req request
+		errs, err := DecodeJSON([]byte(tt.body), &req, tt.allowUnknown)
+		if err != nil {
+			if tt.errors != "error" {
+				t.Errorf("DecodeJSON(%q) failed: %v", tt.body, err)
+			}
+			continue
+		}
+		var got []string
+		for _, err := range errs {
+			got = append(got, err.Field+":"+err.Code)
+		}
+		if strings.Join(got, ",") != tt.errors {
+			t.Errorf("DecodeJSON(%q) = %v, want %s", tt.body, got, tt.errors)
+		}
+		// Field errors do not stop the decoding
+		if req.Content != "hi" || req.Ignored != "" {
+			t.Errorf("DecodeJSON(%q) decoded %+v", tt.body, req)
+		}
+	}
+}
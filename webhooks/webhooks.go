@@ -0,0 +1,300 @@
+// Package webhooks stores webhook subscriptions and delivers message events
+// to them through an outbox of signed, retried deliveries.
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/shawn1912/messages-service/events"
+)
+
+// secretPrefix marks webhook signing secrets.
+const secretPrefix = "whsec_"
+
+// Delivery statuses.
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusDead      = "dead"
+)
+
+// Webhook is a subscription of a URL to a tenant's message events.
+type Webhook struct {
+	ID              int64     `json:"id"`
+	URL             string    `json:"url"`
+	EventTypes      []string  `json:"eventTypes"` // empty for every type
+	PalindromesOnly bool      `json:"palindromesOnly"`
+	Active          bool      `json:"active"`
+	Secret          string    `json:"secret,omitempty"` // only shown when created
+	CreatedAt       time.Time `json:"createdAt"`
+	UpdatedAt       time.Time `json:"updatedAt"`
+}
+
+// AllowPrivateAddresses lets webhooks reach loopback, link-local and private
+// addresses, which are refused by default so that tenants cannot use
+// webhooks to reach internal services.
+var AllowPrivateAddresses = false
+
+// blockedPrefixes are the ranges of the IANA special-purpose address
+// registries webhooks may not be sent to: everything but global unicast
+// addresses, including carrier-grade NAT, which some cloud metadata services
+// use.
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/96"), // unspecified, loopback and IPv4-compatible
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001::/23"), // includes Teredo, which hides the IPv4 address it embeds
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// NAT64 and 6to4 addresses embed an IPv4 address, which is what they reach.
+var (
+	nat64Prefix     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFourPrefix = netip.MustParsePrefix("2002::/16")
+)
+
+// allowedAddress reports whether webhooks may be sent to addr.
+func allowedAddress(addr netip.Addr) bool {
+	if AllowPrivateAddresses {
+		return true
+	}
+	addr = addr.WithZone("").Unmap()
+	if addr.Is6() {
+		b := addr.As16()
+		switch {
+		case nat64Prefix.Contains(addr):
+			addr = netip.AddrFrom4([4]byte(b[12:16]))
+		case sixToFourPrefix.Contains(addr):
+			addr = netip.AddrFrom4([4]byte(b[2:6]))
+		}
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return addr.IsGlobalUnicast()
+}
+
+// Validate checks the webhook's URL and event types. Hosts that resolve to
+// addresses webhooks may not be sent to are refused; those that do not
+// resolve yet are accepted, since every delivery checks the address again.
+func (h *Webhook) Validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid URL %q: it must be an absolute http or https URL", h.URL)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, _ := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	for _, addr := range addrs {
+		if !allowedAddress(addr) {
+			return fmt.Errorf("invalid URL %q: %s is not a public address", h.URL, addr.Unmap())
+		}
+	}
+	for _, eventType := range h.EventTypes {
+		if !slices.Contains(events.Types, eventType) {
+			return fmt.Errorf("unknown event type %q", eventType)
+		}
+	}
+	return nil
+}
+
+// Delivery is one attempt, or series of attempts, to send an event to a webhook.
+type Delivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhookId"`
+	EventID        int64           `json:"eventId"`
+	EventType      string          `json:"eventType"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"nextAttemptAt,omitempty"`
+	LastStatusCode *int            `json:"lastStatusCode,omitempty"`
+	LastError      *string         `json:"lastError,omitempty"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+}
+
+const webhookColumns = `id, url, event_types, palindromes_only, active, created_at, updated_at`
+
+func scanWebhook(row interface{ Scan(...any) error }, h *Webhook) error {
+	return row.Scan(&h.ID, &h.URL, pq.Array(&h.EventTypes), &h.PalindromesOnly, &h.Active, &h.CreatedAt, &h.UpdatedAt)
+}
+
+// Create stores a new webhook for tenant, generating its signing secret.
+func Create(tx *sql.Tx, tenant string, h *Webhook) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	h.Secret = secretPrefix + hex.EncodeToString(secret)
+	if h.EventTypes == nil {
+		h.EventTypes = []string{}
+	}
+
+	return tx.QueryRow(`
+        INSERT INTO webhooks (tenant_id, url, secret, event_types, palindromes_only, active)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        RETURNING id, created_at, updated_at
+    `, tenant, h.URL, h.Secret, pq.Array(h.EventTypes), h.PalindromesOnly, h.Active).
+		Scan(&h.ID, &h.CreatedAt, &h.UpdatedAt)
+}
+
+// Get returns the tenant's webhook with the given ID, or sql.ErrNoRows.
+func Get(tx *sql.Tx, tenant string, id int64) (Webhook, error) {
+	var h Webhook
+	err := scanWebhook(tx.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = $1 AND tenant_id = $2`, id, tenant), &h)
+	return h, err
+}
+
+// List returns every webhook of the tenant.
+func List(tx *sql.Tx, tenant string) ([]Webhook, error) {
+	rows, err := tx.Query(`SELECT `+webhookColumns+` FROM webhooks WHERE tenant_id = $1 ORDER BY id ASC`, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []Webhook{}
+	for rows.Next() {
+		var h Webhook
+		if err := scanWebhook(rows, &h); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// Update saves the URL, filters and active flag of an existing webhook.
+func Update(tx *sql.Tx, tenant string, h *Webhook) error {
+	if err := h.Validate(); err != nil {
+		return err
+	}
+	return tx.QueryRow(`
+        UPDATE webhooks
+        SET url = $1, event_types = $2, palindromes_only = $3, active = $4, updated_at = NOW()
+        WHERE id = $5 AND tenant_id = $6
+        RETURNING updated_at
+    `, h.URL, pq.Array(h.EventTypes), h.PalindromesOnly, h.Active, h.ID, tenant).Scan(&h.UpdatedAt)
+}
+
+// Delete removes the tenant's webhook with the given ID along with its
+// deliveries, reporting whether it existed.
+func Delete(tx *sql.Tx, tenant string, id int64) (bool, error) {
+	result, err := tx.Exec("DELETE FROM webhooks WHERE id = $1 AND tenant_id = $2", id, tenant)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// Enqueue adds a pending delivery of event for every active webhook of its
+// tenant whose filters it passes. Calling it in the transaction that makes
+// the change guarantees a delivery exactly when the change commits.
+func Enqueue(tx *sql.Tx, event events.Event) error {
+	payload, err := json.Marshal(struct {
+		events.Event
+		Tenant string `json:"tenant"`
+	}{event, event.Tenant})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO webhook_deliveries (webhook_id, tenant_id, event_id, event_type, payload)
+        SELECT id, tenant_id, $2::bigint, $3::text, $4::jsonb
+        FROM webhooks
+        WHERE tenant_id = $1 AND active
+          AND (cardinality(event_types) = 0 OR $3::text = ANY(event_types))
+          AND (NOT palindromes_only OR $5::boolean)
+    `, event.Tenant, event.ID, event.Type, payload, event.Message.IsPalindrome)
+	return err
+}
+
+// ListDeliveries returns one page of a webhook's deliveries, newest first,
+// optionally restricted to a status, along with the total number matching.
+func ListDeliveries(tx *sql.Tx, tenant string, webhookID int64, status string, limit, offset int) ([]Delivery, int, error) {
+	const where = ` WHERE tenant_id = $1 AND webhook_id = $2 AND ($3 = '' OR status = $3)`
+
+	var total int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries`+where, tenant, webhookID, status).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := tx.Query(`
+        SELECT id, webhook_id, event_id, event_type, payload, status, attempts,
+               CASE WHEN status = 'pending' THEN next_attempt_at END,
+               last_status_code, last_error, created_at, delivered_at
+        FROM webhook_deliveries`+where+`
+        ORDER BY id DESC
+        LIMIT $4 OFFSET $5
+    `, tenant, webhookID, status, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			return nil, 0, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, total, rows.Err()
+}
+
+// Redeliver moves a dead delivery back to pending with a fresh set of
+// attempts, reporting whether there was such a delivery.
+func Redeliver(tx *sql.Tx, tenant string, webhookID, deliveryID int64) (bool, error) {
+	result, err := tx.Exec(`
+        UPDATE webhook_deliveries
+        SET status = 'pending', attempts = 0, next_attempt_at = NOW()
+        WHERE id = $1 AND webhook_id = $2 AND tenant_id = $3 AND status = 'dead'
+    `, deliveryID, webhookID, tenant)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
@@ -0,0 +1,304 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/shawn1912/messages-service/database"
+	"github.com/shawn1912/messages-service/events"
+)
+
+func TestMain(m *testing.M) {
+	// Initialize the test database
+	database.InitDB("user=postgres password=postgres dbname=messages_test sslmode=disable")
+	defer database.DB.Close()
+
+	if err := database.Migrate(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Run tests
+	code := m.Run()
+
+	// Clean up the test database
+	database.DB.Exec("TRUNCATE TABLE webhooks RESTART IDENTITY CASCADE;")
+
+	os.Exit(code)
+}
+
+// inTenant runs fn in a committed transaction scoped to tenant "acme".
+func inTenant(t *testing.T, fn func(tx *sql.Tx) error) {
+	t.Helper()
+	tx, err := database.BeginTenant(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{"id":1}`)
+	header := Sign("whsec_test", now, body)
+
+	if !VerifySignature("whsec_test", header, body, time.Minute, now.Add(30*time.Second)) {
+		t.Error("Expected signature to verify")
+	}
+	if VerifySignature("whsec_other", header, body, time.Minute, now) {
+		t.Error("Expected signature with another secret to fail")
+	}
+	if VerifySignature("whsec_test", header, []byte(`{"id":2}`), time.Minute, now) {
+		t.Error("Expected signature of another body to fail")
+	}
+	if VerifySignature("whsec_test", header, body, time.Minute, now.Add(2*time.Minute)) {
+		t.Error("Expected an old signature to fail")
+	}
+}
+
+func TestValidate_PrivateAddresses(t *testing.T) {
+	for _, url := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://10.0.0.5/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hook",
+		"http://[::ffff:192.168.1.1]/hook",
+		"http://0.0.0.0/hook",
+	} {
+		hook := Webhook{URL: url}
+		if err := hook.Validate(); err == nil {
+			t.Errorf("Expected %s to be refused", url)
+		}
+	}
+	hook := Webhook{URL: "https://93.184.215.14/hook"}
+	if err := hook.Validate(); err != nil {
+		t.Errorf("Expected a public address to be accepted, got %v", err)
+	}
+
+	AllowPrivateAddresses = true
+	defer func() { AllowPrivateAddresses = false }()
+	hook = Webhook{URL: "http://127.0.0.1:8080/hook"}
+	if err := hook.Validate(); err != nil {
+		t.Errorf("Expected private addresses to be allowed, got %v", err)
+	}
+}
+
+func TestAllowedAddress(t *testing.T) {
+	for addr, allowed := range map[string]bool{
+		"93.184.215.14":         true,
+		"2606:2800:21f:cb07::1": true,
+		"100.64.0.1":            false, // carrier-grade NAT
+		"100.100.100.200":       false,
+		"198.18.0.1":            false,
+		"255.255.255.255":       false,
+		"64:ff9b::a9fe:a9fe":    false, // NAT64 of 169.254.169.254
+		"64:ff9b::5db8:d70e":    true,  // NAT64 of a public address
+		"2002:c0a8:101::1":      false, // 6to4 of 192.168.1.1
+		"2002:5db8:d70e::1":     true,
+		"2001:0:4136:e378::1":   false, // Teredo
+		"::127.0.0.1":           false, // IPv4-compatible
+		"fd00:ec2::254":         false,
+		"fe80::1%eth0":          false,
+		"2001:db8::1":           false,
+	} {
+		if got := allowedAddress(netip.MustParseAddr(addr)); got != allowed {
+			t.Errorf("allowedAddress(%s) = %v; expected %v", addr, got, allowed)
+		}
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/hook", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+	client := NewClient(5 * time.Second)
+
+	// Private addresses are refused when connecting, whatever the URL was
+	// when the webhook was registered
+	if resp, err := client.Get(server.URL + "/hook"); err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected the connection to a loopback address to be refused")
+	}
+
+	AllowPrivateAddresses = true
+	defer func() { AllowPrivateAddresses = false }()
+	resp, err := client.Get(server.URL + "/redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("Expected the redirect not to be followed, got %s", resp.Status)
+	}
+}
+
+func TestEnqueueFilters(t *testing.T) {
+	database.DB.Exec("TRUNCATE TABLE webhooks RESTART IDENTITY CASCADE;")
+
+	var all, palindromes, deletes, inactive Webhook
+	inTenant(t, func(tx *sql.Tx) error {
+		all = Webhook{URL: "http://example.com/all", Active: true}
+		palindromes = Webhook{URL: "http://example.com/palindromes", PalindromesOnly: true, Active: true}
+		deletes = Webhook{URL: "http://example.com/deletes", EventTypes: []string{events.MessageDeleted}, Active: true}
+		inactive = Webhook{URL: "http://example.com/inactive"}
+		for _, h := range []*Webhook{&all, &palindromes, &deletes, &inactive} {
+			if err := Create(tx, "acme", h); err != nil {
+				return err
+			}
+		}
+		if err := Enqueue(tx, events.Event{ID: 1, Type: events.MessageCreated, Tenant: "acme",
+			Message: database.Message{ID: 1, Content: "Racecar", IsPalindrome: true}}); err != nil {
+			return err
+		}
+		return Enqueue(tx, events.Event{ID: 2, Type: events.MessageCreated, Tenant: "acme",
+			Message: database.Message{ID: 2, Content: "Hello"}})
+	})
+
+	counts := map[int64]int{}
+	rows, err := database.DB.Query("SELECT webhook_id, COUNT(*) FROM webhook_deliveries GROUP BY webhook_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var n int
+		rows.Scan(&id, &n)
+		counts[id] = n
+	}
+
+	if counts[all.ID] != 2 || counts[palindromes.ID] != 1 || counts[deletes.ID] != 0 || counts[inactive.ID] != 0 {
+		t.Errorf("Unexpected deliveries per webhook: %v", counts)
+	}
+}
+
+func TestWorker(t *testing.T) {
+	database.DB.Exec("TRUNCATE TABLE webhooks RESTART IDENTITY CASCADE;")
+
+	var failures atomic.Int32
+	var received atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failures.Add(-1) >= 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received.Store(struct {
+			body      []byte
+			signature string
+		}{body, r.Header.Get(SignatureHeader)})
+	}))
+	defer server.Close()
+
+	AllowPrivateAddresses = true
+	defer func() { AllowPrivateAddresses = false }()
+	hook := Webhook{URL: server.URL, Active: true}
+	inTenant(t, func(tx *sql.Tx) error {
+		if err := Create(tx, "acme", &hook); err != nil {
+			return err
+		}
+		return Enqueue(tx, events.Event{ID: 7, Type: events.MessageCreated, Tenant: "acme",
+			Message: database.Message{ID: 1, Content: "Racecar", IsPalindrome: true}})
+	})
+
+	worker := &Worker{Client: server.Client(), MaxAttempts: 3, BatchSize: 10}
+
+	// Two failures are retried, the third attempt succeeds
+	failures.Store(2)
+	for i := 0; i < 3; i++ {
+		if n, err := worker.RunOnce(context.Background()); err != nil || n != 1 {
+			t.Fatalf("Attempt %d: expected 1 delivery claimed, got %d (%v)", i+1, n, err)
+		}
+	}
+
+	var status string
+	var attempts int
+	database.DB.QueryRow("SELECT status, attempts FROM webhook_deliveries").Scan(&status, &attempts)
+	if status != StatusDelivered || attempts != 3 {
+		t.Errorf("Expected delivered after 3 attempts, got %s after %d", status, attempts)
+	}
+
+	delivery := received.Load().(struct {
+		body      []byte
+		signature string
+	})
+	if !VerifySignature(hook.Secret, delivery.signature, delivery.body, time.Minute, time.Now()) {
+		t.Error("Expected the delivery to be signed with the webhook's secret")
+	}
+	var payload struct {
+		ID      int64            `json:"id"`
+		Type    string           `json:"type"`
+		Tenant  string           `json:"tenant"`
+		Message database.Message `json:"message"`
+	}
+	json.Unmarshal(delivery.body, &payload)
+	if payload.ID != 7 || payload.Type != events.MessageCreated || payload.Tenant != "acme" || payload.Message.Content != "Racecar" {
+		t.Errorf("Unexpected payload %s", delivery.body)
+	}
+
+	// Running out of attempts makes a delivery dead, until it is redelivered
+	inTenant(t, func(tx *sql.Tx) error {
+		return Enqueue(tx, events.Event{ID: 8, Type: events.MessageDeleted, Tenant: "acme"})
+	})
+	failures.Store(3)
+	for i := 0; i < 3; i++ {
+		worker.RunOnce(context.Background())
+	}
+	if n, _ := worker.RunOnce(context.Background()); n != 0 {
+		t.Errorf("Expected dead deliveries not to be claimed, got %d", n)
+	}
+
+	var dead []Delivery
+	inTenant(t, func(tx *sql.Tx) error {
+		var err error
+		dead, _, err = ListDeliveries(tx, "acme", hook.ID, StatusDead, 10, 0)
+		return err
+	})
+	if len(dead) != 1 || dead[0].EventID != 8 || dead[0].LastStatusCode == nil || *dead[0].LastStatusCode != 500 {
+		t.Fatalf("Expected one dead delivery of event 8 with status 500, got %+v", dead)
+	}
+
+	inTenant(t, func(tx *sql.Tx) error {
+		requeued, err := Redeliver(tx, "acme", hook.ID, dead[0].ID)
+		if err == nil && !requeued {
+			t.Error("Expected the dead delivery to be requeued")
+		}
+		return err
+	})
+	if n, err := worker.RunOnce(context.Background()); err != nil || n != 1 {
+		t.Errorf("Expected the redelivery to be claimed, got %d (%v)", n, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	worker := &Worker{BaseDelay: time.Second, MaxDelay: time.Minute}
+	for _, tc := range []struct {
+		attempts int
+		min      time.Duration
+	}{{1, time.Second}, {2, 2 * time.Second}, {4, 8 * time.Second}, {10, time.Minute}, {100, time.Minute}} {
+		delay := worker.backoff(tc.attempts)
+		if delay < tc.min || delay > tc.min+tc.min/10 {
+			t.Errorf("Attempt %d: expected a delay between %s and %s, got %s", tc.attempts, tc.min, tc.min+tc.min/10, delay)
+		}
+	}
+}
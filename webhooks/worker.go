@@ -0,0 +1,281 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/shawn1912/messages-service/database"
+)
+
+// Headers sent with every delivery.
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// Sign returns the signature header value for body sent at timestamp:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">". Covering the
+// timestamp lets receivers reject replayed deliveries.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	return "t=" + t + ",v1=" + signature(secret, t, body)
+}
+
+// VerifySignature checks a signature header produced by Sign, rejecting
+// timestamps more than tolerance away from now.
+func VerifySignature(secret, header string, body []byte, tolerance time.Duration, now time.Time) bool {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(part, "=")
+		switch name {
+		case "t":
+			t = value
+		case "v1":
+			v1 = value
+		}
+	}
+	seconds, err := strconv.ParseInt(t, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(v1), []byte(signature(secret, t, body)))
+}
+
+func signature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewClient returns an HTTP client for deliveries, with a time limit for
+// each. It only connects to addresses webhooks may be sent to, checked
+// after resolving each host so that DNS cannot be used to point a webhook
+// elsewhere after it is registered, and it does not follow redirects.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !allowedAddress(addrPort.Addr()) {
+				return fmt.Errorf("%s is not a public address", addrPort.Addr().Unmap())
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would be dialed instead of the webhook's host
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Worker sends pending deliveries. Any number of workers, in any number of
+// instances, can run at once: each claims deliveries by leasing them, so a
+// delivery whose worker dies is retried once its lease expires. Deliveries
+// are therefore sent at least once.
+type Worker struct {
+	Client       *http.Client
+	MaxAttempts  int           // attempts before a delivery is dead
+	BaseDelay    time.Duration // delay before the first retry, doubled for each later one
+	MaxDelay     time.Duration // longest delay between attempts
+	BatchSize    int
+	PollInterval time.Duration
+}
+
+// Run sends deliveries until ctx is done.
+func (w *Worker) Run(ctx context.Context) {
+	poll := time.NewTicker(w.PollInterval)
+	defer poll.Stop()
+
+	for {
+		for {
+			n, err := w.RunOnce(ctx)
+			if err != nil {
+				log.Printf("Webhook worker: %v", err)
+			}
+			// Keep going while there is a backlog
+			if err != nil || n < w.BatchSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		}
+	}
+}
+
+// claimed is a delivery leased by a worker.
+type claimed struct {
+	id, eventID int64
+	eventType   string
+	payload     []byte
+	attempts    int
+	url, secret string
+}
+
+// RunOnce claims a batch of due deliveries and attempts each of them,
+// returning the number claimed.
+func (w *Worker) RunOnce(ctx context.Context) (int, error) {
+	batch, err := w.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range batch {
+		statusCode, sendErr := w.send(ctx, d)
+		if err := w.recordAttempt(ctx, d, statusCode, sendErr); err != nil {
+			return len(batch), err
+		}
+	}
+	return len(batch), nil
+}
+
+// claim leases a batch of due deliveries of active webhooks long enough to
+// attempt them all.
+func (w *Worker) claim(ctx context.Context) ([]claimed, error) {
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	lease := time.Duration(w.BatchSize)*w.Client.Timeout + time.Minute
+	rows, err := tx.QueryContext(ctx, `
+        UPDATE webhook_deliveries d
+        SET next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+        FROM webhooks h
+        WHERE h.id = d.webhook_id AND d.id IN (
+            SELECT d.id
+            FROM webhook_deliveries d JOIN webhooks h ON h.id = d.webhook_id
+            WHERE d.status = 'pending' AND d.next_attempt_at <= NOW() AND h.active
+            ORDER BY d.next_attempt_at, d.id
+            LIMIT $1
+            FOR UPDATE OF d SKIP LOCKED
+        )
+        RETURNING d.id, d.event_id, d.event_type, d.payload, d.attempts, h.url, h.secret
+    `, w.BatchSize, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batch []claimed
+	for rows.Next() {
+		var d claimed
+		if err := rows.Scan(&d.id, &d.eventID, &d.eventType, &d.payload, &d.attempts, &d.url, &d.secret); err != nil {
+			return nil, err
+		}
+		batch = append(batch, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return batch, tx.Commit()
+}
+
+// send posts a delivery's payload, returning the response status code.
+// Statuses other than 2xx are reported as errors.
+func (w *Worker) send(ctx context.Context, d claimed) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", d.url, bytes.NewReader(d.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "messages-service-webhooks")
+	req.Header.Set(EventHeader, d.eventType)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(d.id, 10))
+	req.Header.Set(SignatureHeader, Sign(d.secret, time.Now(), d.payload))
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// recordAttempt stores the outcome of an attempt, scheduling a retry or
+// marking the delivery dead once it has used all of its attempts.
+func (w *Worker) recordAttempt(ctx context.Context, d claimed, statusCode int, sendErr error) error {
+	tx, err := database.BeginAllTenants(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	attempts := d.attempts + 1
+	var lastStatusCode any
+	if statusCode != 0 {
+		lastStatusCode = statusCode
+	}
+
+	if sendErr == nil {
+		_, err = tx.ExecContext(ctx, `
+            UPDATE webhook_deliveries
+            SET status = 'delivered', attempts = $2, last_status_code = $3, last_error = NULL, delivered_at = NOW()
+            WHERE id = $1
+        `, d.id, attempts, lastStatusCode)
+	} else {
+		status := StatusPending
+		if attempts >= w.MaxAttempts {
+			status = StatusDead
+		}
+		_, err = tx.ExecContext(ctx, `
+            UPDATE webhook_deliveries
+            SET status = $2, attempts = $3, last_status_code = $4, last_error = $5,
+                next_attempt_at = NOW() + $6 * INTERVAL '1 second'
+            WHERE id = $1
+        `, d.id, status, attempts, lastStatusCode, sendErr.Error(), w.backoff(attempts).Seconds())
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// backoff returns the delay after the given number of failed attempts: the
+// base delay doubled for each attempt after the first, capped at the maximum,
+// with up to 10% jitter so that retries of a burst spread out.
+func (w *Worker) backoff(attempts int) time.Duration {
+	delay := w.BaseDelay
+	for i := 1; i < attempts && delay < w.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, w.MaxDelay)
+	return delay + time.Duration(rand.Int64N(int64(delay)/10+1))
+}
@@ -0,0 +1,180 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newEchoServer returns a server that echoes every message it receives.
+func newEchoServer(t *testing.T, maxMessageSize int64) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.MaxMessageSize = maxMessageSize
+
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := conn.WriteMessage(messageType, data); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return "ws://" + strings.TrimPrefix(server.URL, "http://")
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455, section 1.3
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept key %q", got)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	conn, err := Dial(newEchoServer(t, 1<<20), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Payloads around each length encoding boundary
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		payload := bytes.Repeat([]byte("a"), size)
+		if err := conn.WriteMessage(BinaryMessage, payload); err != nil {
+			t.Fatal(err)
+		}
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if messageType != BinaryMessage || !bytes.Equal(data, payload) {
+			t.Errorf("Size %d: echo did not match", size)
+		}
+	}
+
+	// Pings are answered while reading
+	pongs := 0
+	conn.PongHandler = func() { pongs++ }
+	conn.WriteControl(PingMessage, []byte("ping"))
+	conn.WriteMessage(TextMessage, []byte("hello"))
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("Expected 'hello', got %q (%v)", data, err)
+	}
+	if pongs != 1 {
+		t.Errorf("Expected 1 pong, got %d", pongs)
+	}
+
+	// Closing is echoed
+	conn.WriteClose(CloseNormal, "bye")
+	_, _, err = conn.ReadMessage()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseNormal {
+		t.Errorf("Expected a normal close, got %v", err)
+	}
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	conn, err := Dial(newEchoServer(t, 1024), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A text message split over two frames with a ping in between
+	conn.writeMu.Lock()
+	conn.conn.Write(maskedFrame(TextMessage, false, "hel"))
+	conn.conn.Write(maskedFrame(PingMessage, true, ""))
+	conn.conn.Write(maskedFrame(continuationFrame, true, "lo"))
+	conn.writeMu.Unlock()
+
+	if _, data, err := conn.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Errorf("Expected 'hello', got %q (%v)", data, err)
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		frame []byte
+		code  int
+	}{
+		{"unmasked frame", []byte{0x81, 0x02, 'h', 'i'}, CloseProtocolError},
+		{"unexpected continuation", maskedFrame(continuationFrame, true, "hi"), CloseProtocolError},
+		{"fragmented control frame", maskedFrame(PingMessage, false, ""), CloseProtocolError},
+		{"invalid UTF-8", maskedFrame(TextMessage, true, "\xff"), CloseInvalidPayload},
+		{"too big", maskedFrame(BinaryMessage, true, strings.Repeat("a", 2048)), CloseMessageTooBig},
+	}
+
+	url := newEchoServer(t, 1024)
+	for _, tc := range testCases {
+		conn, err := Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.conn.Write(tc.frame)
+
+		_, _, err = conn.ReadMessage()
+		var closeErr *CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != tc.code {
+			t.Errorf("%s: expected close code %d, got %v", tc.name, tc.code, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestUpgrade_RejectsInvalidHandshakes(t *testing.T) {
+	url := strings.Replace(newEchoServer(t, 1024), "ws://", "http://", 1)
+
+	testCases := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"plain request", nil, http.StatusBadRequest},
+		{"wrong version", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket",
+			"Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ=="}, http.StatusUpgradeRequired},
+		{"bad key", map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket",
+			"Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "short"}, http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		req, _ := http.NewRequest("GET", url, nil)
+		for name, value := range tc.headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+	}
+}
+
+// maskedFrame builds a short client frame with a zero mask.
+func maskedFrame(opcode int, fin bool, payload string) []byte {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first, 0x80 | byte(len(payload))}
+	if len(payload) > 125 {
+		frame[1] = 0x80 | 126
+		frame = append(frame, byte(len(payload)>>8), byte(len(payload)))
+	}
+	frame = append(frame, 0, 0, 0, 0)
+	return append(frame, payload...)
+}